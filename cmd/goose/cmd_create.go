@@ -5,6 +5,7 @@ import (
 	"log"
 	"os"
 	"path/filepath"
+	"text/template"
 	"time"
 
 	"github.com/f-kozlov/goose/lib/goose"
@@ -24,7 +25,7 @@ func createRun(cmd *Command, args ...string) {
 		log.Fatal("goose create: migration name required")
 	}
 
-	migrationType := "go" // default to Go migrations
+	migrationType := "go" // default to Go migrations, as scripts `up` can run
 	if len(args) >= 2 {
 		migrationType = args[1]
 	}
@@ -38,7 +39,18 @@ func createRun(cmd *Command, args ...string) {
 		log.Fatal(err)
 	}
 
-	n, err := goose.CreateMigration(args[0], migrationType, conf.MigrationsDir, time.Now())
+	// a registered Go migration needs the program embedding goose to
+	// run it, so the command writes a script it can run itself
+	var tmpl *template.Template
+	if *flagTemplate != "" {
+		if tmpl, err = template.ParseFiles(*flagTemplate); err != nil {
+			log.Fatal(err)
+		}
+	} else if migrationType == "go" {
+		tmpl = goose.GoScriptMigrationTemplate
+	}
+
+	n, err := goose.CreateMigrationFromTemplate(args[0], migrationType, conf.MigrationsDir, time.Now(), *flagSequential, tmpl)
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sort"
+
+	"github.com/f-kozlov/goose/lib/goose"
+)
+
+var fixCmd = &Command{
+	Name:    "fix",
+	Usage:   "",
+	Summary: "Renumber timestamped migrations sequentially",
+	Help:    `fix extended help here...`,
+	Run:     fixRun,
+}
+
+func fixRun(cmd *Command, args ...string) {
+
+	conf, err := dbConfFromFlags()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	renamed, err := goose.Fix(conf.MigrationsDir)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	names := make([]string, 0, len(renamed))
+	for old := range renamed {
+		names = append(names, old)
+	}
+	sort.Strings(names)
+
+	for _, old := range names {
+		fmt.Printf("goose: renamed %s to %s\n", old, renamed[old])
+	}
+}
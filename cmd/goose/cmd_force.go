@@ -0,0 +1,41 @@
+package main
+
+import (
+	"log"
+	"strconv"
+
+	"github.com/f-kozlov/goose/lib/goose"
+)
+
+var forceCmd = &Command{
+	Name:    "force",
+	Usage:   "version",
+	Summary: "Clear the dirty mark a failed migration left, given the version the database is at",
+	Help:    `force extended help here...`,
+	Run:     forceRun,
+}
+
+func forceRun(cmd *Command, args ...string) {
+	if len(args) != 1 {
+		log.Fatal("goose force: a version is required")
+	}
+	version, err := strconv.ParseInt(args[0], 10, 64)
+	if err != nil {
+		log.Fatalf("goose force: invalid version %q", args[0])
+	}
+
+	conf, err := dbConfFromFlags()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	db, err := goose.OpenDBFromDBConf(conf)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer db.Close()
+
+	if err := goose.Force(conf, db, version); err != nil {
+		log.Fatal(err)
+	}
+}
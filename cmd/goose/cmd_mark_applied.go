@@ -0,0 +1,41 @@
+package main
+
+import (
+	"log"
+	"strconv"
+
+	"github.com/f-kozlov/goose/lib/goose"
+)
+
+var markAppliedCmd = &Command{
+	Name:    "mark-applied",
+	Usage:   "version",
+	Summary: "Record the migrations up to version as applied, without running them",
+	Help:    `mark-applied extended help here...`,
+	Run:     markAppliedRun,
+}
+
+func markAppliedRun(cmd *Command, args ...string) {
+	if len(args) != 1 {
+		log.Fatal("goose mark-applied: a version is required")
+	}
+	version, err := strconv.ParseInt(args[0], 10, 64)
+	if err != nil {
+		log.Fatalf("goose mark-applied: invalid version %q", args[0])
+	}
+
+	conf, err := dbConfFromFlags()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	db, err := goose.OpenDBFromDBConf(conf)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer db.Close()
+
+	if err := goose.MarkApplied(conf, db, conf.MigrationsDir, version); err != nil {
+		log.Fatal(err)
+	}
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/f-kozlov/goose/lib/goose"
+)
+
+var reconcileCmd = &Command{
+	Name:    "reconcile",
+	Usage:   "",
+	Summary: "Check the version table for anomalies, such as after editing it by hand",
+	Help:    `reconcile extended help here...`,
+	Run:     reconcileRun,
+}
+
+func reconcileRun(cmd *Command, args ...string) {
+
+	conf, err := dbConfFromFlags()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	db, err := goose.OpenDBFromDBConf(conf)
+	if err != nil {
+		log.Fatal("couldn't open DB:", err)
+	}
+	defer db.Close()
+
+	anomalies, err := goose.Reconcile(conf, db, conf.MigrationsDir)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	for _, a := range anomalies {
+		fmt.Printf("goose: %s\n", a)
+	}
+	if len(anomalies) > 0 {
+		os.Exit(1)
+	}
+	fmt.Printf("goose: the version table of environment '%v' is consistent\n", conf.Env)
+}
@@ -2,39 +2,40 @@ package main
 
 import (
 	"log"
+	"strconv"
 
 	"github.com/f-kozlov/goose/lib/goose"
 )
 
 var redoCmd = &Command{
 	Name:    "redo",
-	Usage:   "",
-	Summary: "Re-run the latest migration",
+	Usage:   "[n]",
+	Summary: "Re-run the latest n migrations (default = 1)",
 	Help:    `redo extended help here...`,
 	Run:     redoRun,
 }
 
 func redoRun(cmd *Command, args ...string) {
-	conf, err := dbConfFromFlags()
-	if err != nil {
-		log.Fatal(err)
+	n := 1
+	if len(args) > 0 {
+		var err error
+		if n, err = strconv.Atoi(args[0]); err != nil {
+			log.Fatalf("goose redo: invalid count %q", args[0])
+		}
 	}
 
-	current, err := goose.GetDBVersion(conf)
+	conf, err := dbConfFromFlags()
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	previous, err := goose.GetPreviousDBVersion(conf.MigrationsDir, current)
+	db, err := goose.OpenDBFromDBConf(conf)
 	if err != nil {
 		log.Fatal(err)
 	}
+	defer db.Close()
 
-	if err := goose.RunMigrations(conf, conf.MigrationsDir, previous); err != nil {
-		log.Fatal(err)
-	}
-
-	if err := goose.RunMigrations(conf, conf.MigrationsDir, current); err != nil {
+	if err := goose.Redo(conf, db, conf.MigrationsDir, n); err != nil {
 		log.Fatal(err)
 	}
 }
@@ -1,7 +1,6 @@
 package main
 
 import (
-	"database/sql"
 	"fmt"
 	"log"
 	"path/filepath"
@@ -30,14 +29,6 @@ func statusRun(cmd *Command, args ...string) {
 		log.Fatal(err)
 	}
 
-	// collect all migrations
-	min := int64(0)
-	max := int64((1 << 63) - 1)
-	migrations, e := goose.CollectMigrations(conf.MigrationsDir, min, max)
-	if e != nil {
-		log.Fatal(e)
-	}
-
 	db, e := goose.OpenDBFromDBConf(conf)
 	if e != nil {
 		log.Fatal("couldn't open DB:", e)
@@ -49,30 +40,32 @@ func statusRun(cmd *Command, args ...string) {
 		log.Fatal(e)
 	}
 
+	statuses, e := goose.Status(db, conf.Driver.Dialect, conf.MigrationsDir)
+	if e != nil {
+		log.Fatal(e)
+	}
+
 	fmt.Printf("goose: status for environment '%v'\n", conf.Env)
 	fmt.Println("    Applied At                  Migration")
 	fmt.Println("    =======================================")
-	for _, m := range migrations {
-		printMigrationStatus(db, m.Version, filepath.Base(m.Source))
+	for _, s := range statuses {
+		printMigrationStatus(s)
 	}
 }
 
-func printMigrationStatus(db *sql.DB, version int64, script string) {
-	var row goose.MigrationRecord
-	q := fmt.Sprintf("SELECT tstamp, is_applied FROM goose_db_version WHERE version_id=%d ORDER BY tstamp DESC LIMIT 1", version)
-	e := db.QueryRow(q).Scan(&row.TStamp, &row.IsApplied)
-
-	if e != nil && e != sql.ErrNoRows {
-		log.Fatal(e)
-	}
-
+func printMigrationStatus(s goose.MigrationStatus) {
 	var appliedAt string
 
-	if row.IsApplied {
-		appliedAt = row.TStamp.Format(time.ANSIC)
+	if s.Applied {
+		appliedAt = s.AppliedAt.Format(time.ANSIC)
 	} else {
 		appliedAt = "Pending"
 	}
 
+	script := filepath.Base(s.Source)
+	if s.Source == "" {
+		script = fmt.Sprintf("%d (missing)", s.Version)
+	}
+
 	fmt.Printf("    %-24s -- %v\n", appliedAt, script)
 }
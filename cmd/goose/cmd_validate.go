@@ -0,0 +1,29 @@
+package main
+
+import (
+	"fmt"
+	"log"
+
+	"github.com/f-kozlov/goose/lib/goose"
+)
+
+var validateCmd = &Command{
+	Name:    "validate",
+	Usage:   "",
+	Summary: "Check that every migration is well-formed, without a database",
+	Help:    `validate extended help here...`,
+	Run:     validateRun,
+}
+
+func validateRun(cmd *Command, args ...string) {
+
+	conf, err := dbConfFromFlags()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if err := goose.Validate(conf.MigrationsDir); err != nil {
+		log.Fatal(err)
+	}
+	fmt.Println("goose: all migrations are valid")
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+
+	"github.com/f-kozlov/goose/lib/goose"
+)
+
+var verifyCmd = &Command{
+	Name:    "verify",
+	Usage:   "",
+	Summary: "Check that the tables applied migrations created still exist",
+	Help:    `verify extended help here...`,
+	Run:     verifyRun,
+}
+
+func verifyRun(cmd *Command, args ...string) {
+
+	conf, err := dbConfFromFlags()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	db, err := goose.OpenDBFromDBConf(conf)
+	if err != nil {
+		log.Fatal("couldn't open DB:", err)
+	}
+	defer db.Close()
+
+	drift, err := goose.VerifyConf(conf, db, conf.MigrationsDir)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	for _, d := range drift {
+		fmt.Printf("goose: %s is applied, but table %s doesn't exist\n", filepath.Base(d.Source), d.Table)
+	}
+	if len(drift) > 0 {
+		os.Exit(1)
+	}
+	fmt.Printf("goose: no drift found for environment '%v'\n", conf.Env)
+}
@@ -9,4 +9,10 @@ var commands = []*Command{
 	statusCmd,
 	createCmd,
 	dbVersionCmd,
+	fixCmd,
+	validateCmd,
+	verifyCmd,
+	reconcileCmd,
+	forceCmd,
+	markAppliedCmd,
 }
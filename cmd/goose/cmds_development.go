@@ -9,6 +9,12 @@ var commands = []*Command{
 	statusCmd,
 	createCmd,
 	dbVersionCmd,
+	fixCmd,
+	validateCmd,
+	verifyCmd,
+	reconcileCmd,
+	forceCmd,
+	markAppliedCmd,
 	createDatabaseCmd,
 	dropDatabaseCmd,
 }
@@ -15,10 +15,53 @@ var flagPath = flag.String("path", "db", "folder containing db info")
 var flagEnv = flag.String("env", "development", "which DB environment to use")
 var flagPgSchema = flag.String("pgschema", "", "which postgres-schema to migrate (default = none)")
 var flagMigrationsFolder = flag.String("migrationsfolder", "migrations", "folder with migrations")
+var flagLock = flag.Bool("lock", false, "hold a database lock while migrating, so concurrent runs wait their turn")
+var flagLockTimeout = flag.Duration("locktimeout", 0, "how long to wait for the lock taken by -lock (default = forever)")
+var flagProbe = flag.Bool("probe", false, "check the database is the kind the configured dialect is for before running anything")
+var flagDryRun = flag.Bool("dryrun", false, "print the SQL a command would execute, without executing it")
+var flagAllowMissing = flag.Bool("allowmissing", false, "also apply unapplied migrations older than the current version")
+var flagBestEffort = flag.Bool("besteffort", false, "carry on past failed migrations, reporting them all at the end (may leave the db inconsistent)")
+var flagMaxApply = flag.Int("maxapply", 0, "apply at most this many migrations, leaving the rest for a later run (default = all)")
+var flagSingleTransaction = flag.Bool("singletransaction", false, "run all the migrations in one transaction, rolling them all back if any fails")
+var flagStatementTimeout = flag.Duration("statementtimeout", 0, "cancel any statement of a SQL migration still running after this long (default = no limit)")
+var flagMultiStatement = flag.Bool("multistatement", false, "send each section of a SQL migration in a single Exec, where the driver is configured to allow it")
+var flagTags = flag.String("tags", "", "only run migrations with one of these comma-separated tags (default = all)")
+var flagExcludeTags = flag.String("excludetags", "", "don't run migrations with any of these comma-separated tags")
+var flagNoAutoCreate = flag.Bool("noautocreate", false, "fail, rather than create the version table, if it's missing")
+var flagSequential = flag.Bool("sequential", false, "number migrations made by create sequentially rather than by timestamp")
+var flagTemplate = flag.String("template", "", "text/template file create writes the new migration from (default = goose's own)")
 
 // helper to create a DBConf from the given flags
 func dbConfFromFlags() (dbconf *goose.DBConf, err error) {
-	return goose.NewDBConf(*flagPath, *flagEnv, *flagPgSchema, *flagMigrationsFolder)
+	dbconf, err = goose.NewDBConf(*flagPath, *flagEnv, *flagPgSchema, *flagMigrationsFolder)
+	if err != nil {
+		return nil, err
+	}
+	dbconf.Options.Lock = *flagLock
+	dbconf.Options.LockTimeout = *flagLockTimeout
+	dbconf.Options.ProbeDialect = *flagProbe
+	dbconf.Options.DryRun = *flagDryRun
+	dbconf.Options.AllowMissing = *flagAllowMissing
+	dbconf.Options.BestEffort = *flagBestEffort
+	dbconf.Options.MaxApply = *flagMaxApply
+	dbconf.Options.SingleTransaction = *flagSingleTransaction
+	dbconf.Options.StatementTimeout = *flagStatementTimeout
+	dbconf.Options.MultiStatement = *flagMultiStatement
+	dbconf.Options.DisableAutoCreate = *flagNoAutoCreate
+	dbconf.Options.IncludeTags = splitTags(*flagTags)
+	dbconf.Options.ExcludeTags = splitTags(*flagExcludeTags)
+	return dbconf, nil
+}
+
+// splitTags splits a comma-separated list of tags, such as -tags takes
+func splitTags(list string) []string {
+	var tags []string
+	for _, tag := range strings.Split(list, ",") {
+		if tag = strings.TrimSpace(tag); tag != "" {
+			tags = append(tags, tag)
+		}
+	}
+	return tags
 }
 
 func main() {
@@ -0,0 +1,84 @@
+package goose
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// Direction is the way ApplyOne runs a migration.
+type Direction bool
+
+const (
+	Up   Direction = true  // apply the migration
+	Down Direction = false // roll it back
+)
+
+func (d Direction) String() string {
+	if d {
+		return "Up"
+	}
+	return "Down"
+}
+
+// ApplyOne runs the Up or Down section of the single SQL migration at
+// path, for iterating on a migration while writing it. It's not a way
+// to migrate a database: other migrations, pending or not, are ignored.
+//
+// Unless recordVersion is set the version table is left alone, so the
+// migration can be run again and again. If it is set, ApplyOne refuses
+// to apply a migration the version table already has applied, or to
+// roll back one it doesn't.
+//
+// Go migrations are compiled into the binary that runs them, and
+// can't be run on their own.
+func ApplyOne(conf *DBConf, db *sql.DB, path string, direction Direction, recordVersion bool) error {
+	return ApplyOneContext(context.Background(), conf, db, path, direction, recordVersion)
+}
+
+// ApplyOneContext is like ApplyOne, but runs the migration with the
+// given context.
+func ApplyOneContext(ctx context.Context, conf *DBConf, db *sql.DB, path string, direction Direction, recordVersion bool) error {
+
+	if filepath.Ext(path) != ".sql" {
+		return errors.New(fmt.Sprintf("%s: ApplyOne only runs SQL migrations", path))
+	}
+	if info, err := os.Stat(path); err != nil {
+		return err
+	} else if info.IsDir() {
+		return errors.New(fmt.Sprintf("%s is a directory, not a migration", path))
+	}
+	v, err := migrationVersion(conf, path)
+	if err != nil {
+		return err
+	}
+	m := newMigration(v, path)
+
+	if recordVersion {
+		var versions versionSet
+		if store := conf.Options.VersionStore; store != nil {
+			_, versions, err = storeVersions(ctx, store)
+		} else {
+			_, versions, err = ensureDBVersion(ctx, conf, db)
+			if err == nil {
+				err = checkNotDirty(ctx, conf, db)
+			}
+		}
+		if err != nil {
+			return err
+		}
+		if applied := versions[v]; applied == bool(direction) {
+			state := "isn't applied"
+			if applied {
+				state = "is already applied"
+			}
+			return errors.New(fmt.Sprintf("%s: can't run %v, version %d %s", filepath.Base(path), direction, v, state))
+		}
+	}
+
+	logger.Printf("goose: running %v of %s on its own\n", direction, filepath.Base(path))
+	return runSQLScript(ctx, conf, db, m, bool(direction), recordVersion)
+}
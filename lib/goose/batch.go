@@ -0,0 +1,84 @@
+package goose
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"path/filepath"
+)
+
+// With Options.SingleTransaction set, a run's migrations all run in one
+// transaction, along with the version table updates recording them, so
+// that one failing rolls back those that ran before it too.
+
+// checkSingleTransaction returns an error for a run with
+// Options.SingleTransaction set whose migrations can't all be run in
+// one transaction.
+func checkSingleTransaction(conf *DBConf, ms []*Migration) error {
+	switch {
+	case conf.Options.VersionStore != nil:
+		return errors.New("can't run migrations in a single transaction with a VersionStore, which is only told of a migration once its transaction has committed")
+	case conf.Options.BestEffort:
+		return errors.New("can't run migrations in a single transaction with BestEffort set, as one failing rolls back every other")
+	}
+	if _, ok := conf.Driver.Dialect.(sqlNoTxDDL); ok {
+		return errors.New(fmt.Sprintf("can't run migrations in a single transaction: dialect %T can't run DDL within one", conf.Driver.Dialect))
+	}
+
+	for _, m := range ms {
+		if m.upDB != nil {
+			return errors.New(fmt.Sprintf("can't run migrations in a single transaction: migration %d is registered with RegisterMigrationNoTx, so runs outside of one", m.Version))
+		}
+		if m.isRegistered() {
+			continue
+		}
+		name := filepath.Base(m.Source)
+		switch {
+		case filepath.Ext(m.Source) == ".go":
+			return errors.New(fmt.Sprintf("can't run migrations in a single transaction: %s is a Go script, which runs in a transaction of its own", name))
+		case m.script.noTx:
+			return errors.New(fmt.Sprintf("can't run migrations in a single transaction: %s is annotated 'NO TRANSACTION'", name))
+		case m.script.isolation != nil:
+			return errors.New(fmt.Sprintf("can't run migrations in a single transaction: %s asks for an isolation level of its own; set Options.TxOptions instead", name))
+		}
+	}
+	return nil
+}
+
+// runInBatch runs the migration in the run's single transaction, and
+// records it there, leaving the transaction open for the next.
+func runInBatch(ctx context.Context, conf *DBConf, txn *sql.Tx, m *Migration, direction bool) error {
+
+	if m.isRegistered() {
+		fn := m.down
+		if direction {
+			fn = m.up
+		}
+		if fn != nil {
+			if err := fn(ctx, txn); err != nil {
+				return fmt.Errorf("migration %d: %w", m.Version, err)
+			}
+		}
+		return recordMigration(ctx, conf, txn, direction, m.Version, "")
+	}
+
+	name := filepath.Base(m.Source)
+	stmts, checksum, err := m.statements(conf, direction)
+	if err != nil {
+		return err
+	}
+
+	for i, query := range multiStatements(conf, stmts) {
+		if err := execStatement(ctx, conf, txn, i, query); err != nil {
+			return errors.New(fmt.Sprintf("%s: %v", name, err))
+		}
+	}
+	if err := verifyStatements(ctx, conf, txn, m.script.verify); err != nil {
+		return errors.New(fmt.Sprintf("%s: %v", name, err))
+	}
+	if err := recordMigration(ctx, conf, txn, direction, m.Version, checksum); err != nil {
+		return errors.New(fmt.Sprintf("error recording migration %s: %v", name, err))
+	}
+	return nil
+}
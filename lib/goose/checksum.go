@@ -0,0 +1,134 @@
+package goose
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/fs"
+	"io/ioutil"
+	"path/filepath"
+)
+
+// returned by a dialect's checksumQuery when the version table
+// was created before goose recorded checksums
+var errNoChecksumColumn = errors.New("version table has no checksum column")
+
+// checksumOf returns the hex encoded SHA-256 of a migration script.
+func checksumOf(body []byte) string {
+	sum := sha256.Sum256(body)
+	return hex.EncodeToString(sum[:])
+}
+
+// checksum returns the checksum of the migration's script.
+func (m *Migration) checksum() (string, error) {
+	f, err := m.open()
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	body, err := ioutil.ReadAll(f)
+	if err != nil {
+		return "", err
+	}
+	return checksumOf(body), nil
+}
+
+// appliedChecksums reads the checksum recorded for each applied version.
+// Versions applied before checksums were recorded, and Go migrations,
+// have none, and are left out.
+//
+// A version table predating the checksum column has it added,
+// so that the migrations about to run can record theirs.
+func appliedChecksums(ctx context.Context, conf *DBConf, db dbConn) (map[int64]string, error) {
+	d := conf.Driver.Dialect
+
+	rows, err := queryVersionTable(ctx, d, db, d.checksumQuery)
+	if err == errNoChecksumColumn && ctx.Err() == nil {
+		if conf.Options.DryRun {
+			logger.Println("goose: dry run: version table has no checksum column, would add it")
+			printPlannedStatement(d.addChecksumColumnSql())
+			return nil, nil
+		}
+		if _, err := db.ExecContext(ctx, d.addChecksumColumnSql()); err != nil {
+			return nil, errors.New(fmt.Sprintf("failed to add checksum column to the version table: %v", err))
+		}
+		return nil, nil
+	}
+	if err != nil {
+		// nothing is applied to a version table a dry run hasn't created
+		if errors.Is(err, ErrTableDoesNotExist) && conf.Options.DryRun && ctx.Err() == nil {
+			return nil, nil
+		}
+		return nil, err
+	}
+	defer rows.Close()
+
+	// only the most recent record for each version counts
+	seen := make(map[int64]bool)
+	checksums := make(map[int64]string)
+
+	for rows.Next() {
+		var v int64
+		var isApplied bool
+		var checksum sql.NullString // Oracle stores empty strings as NULL
+		if err := rows.Scan(&v, &isApplied, &checksum); err != nil {
+			return nil, errors.New(fmt.Sprintf("error scanning rows: %v", err))
+		}
+		if seen[v] {
+			continue
+		}
+		seen[v] = true
+
+		if isApplied && checksum.String != "" {
+			checksums[v] = checksum.String
+		}
+	}
+	return checksums, rows.Err()
+}
+
+// verifyChecksums checks that the scripts of the applied migrations
+// in migrationsDirs haven't changed since they were applied.
+func verifyChecksums(ctx context.Context, conf *DBConf, fsys fs.FS, migrationsDirs []string, versions versionSet, db dbConn) error {
+
+	checksums, err := appliedChecksums(ctx, conf, db)
+	if err != nil || len(checksums) == 0 {
+		return err
+	}
+
+	migrations, err := collectMigrations(conf, fsys, migrationsDirs, 0, versions.latest())
+	if err != nil {
+		return err
+	}
+
+	for _, m := range migrations {
+		recorded, ok := checksums[m.Version]
+		if !ok {
+			continue
+		}
+
+		// databases migrated before the squash recorded the
+		// checksum of the migration whose version it took
+		squashed, err := m.isSquashed()
+		if err != nil {
+			return err
+		}
+		if squashed {
+			continue
+		}
+
+		checksum, err := m.checksum()
+		if err != nil {
+			return err
+		}
+		if checksum != recorded {
+			return errors.New(fmt.Sprintf("migration %d (%s) has changed since it was applied: checksum %s, recorded %s",
+				m.Version, filepath.Base(m.Source), checksum, recorded))
+		}
+	}
+
+	return nil
+}
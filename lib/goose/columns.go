@@ -0,0 +1,166 @@
+package goose
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// VersionColumn is a column of the version table beyond those goose
+// itself needs, such as one recording who applied each migration.
+type VersionColumn struct {
+	Name  string      // the column's name, a plain identifier
+	Type  string      // its type, as written in the dialect's CREATE TABLE, e.g. "text"
+	Value interface{} // the value recorded with each applied version
+}
+
+// columns of the version table goose writes for itself
+var coreColumns = map[string]bool{"id": true, "version_id": true, "is_applied": true, "tstamp": true, "checksum": true, "dirty": true, "date": true}
+
+func checkExtraColumns(cols []VersionColumn) error {
+	seen := make(map[string]bool)
+	for _, c := range cols {
+		name := strings.ToLower(c.Name)
+		switch {
+		case !validTableName.MatchString(c.Name):
+			return errors.New(fmt.Sprintf("invalid version table column name %q", c.Name))
+		case coreColumns[name], name == strings.ToLower(timestampColumn.Name):
+			return errors.New(fmt.Sprintf("version table column %q is goose's own", c.Name))
+		case seen[name]:
+			return errors.New(fmt.Sprintf("version table column %q given twice", c.Name))
+		case strings.TrimSpace(c.Type) == "":
+			return errors.New(fmt.Sprintf("version table column %q has no type", c.Name))
+		}
+		seen[name] = true
+	}
+	return nil
+}
+
+// createVersionTableSqlFor returns the dialect's createVersionTableSql,
+// with Options.ExtraColumns added to the end of its column list.
+func createVersionTableSqlFor(conf *DBConf) (string, error) {
+	d := conf.Driver.Dialect
+	if checker, ok := d.(sqlVersionTableChecker); ok {
+		if err := checker.checkVersionTable(); err != nil {
+			return "", err
+		}
+	}
+	create := d.createVersionTableSql()
+	cols := conf.Options.ExtraColumns
+	if len(cols) == 0 {
+		return create, nil
+	}
+	if err := checkExtraColumns(cols); err != nil {
+		return "", err
+	}
+
+	start := strings.Index(strings.ToUpper(create), "CREATE TABLE")
+	end := -1
+	if start >= 0 {
+		if i := strings.Index(create[start:], "("); i >= 0 {
+			end = closingParen(create, start+i)
+		}
+	}
+	if end < 0 {
+		return "", errors.New(fmt.Sprintf("can't add columns to the version table created by %T", d))
+	}
+
+	var defs strings.Builder
+	list := strings.TrimRight(create[:end], " \t\r\n")
+	if !strings.HasSuffix(list, ",") {
+		defs.WriteString(",")
+	}
+	for i, c := range cols {
+		if i > 0 {
+			defs.WriteString(",")
+		}
+		defs.WriteString(fmt.Sprintf("\n                %s %s", d.quoteIdentifier(c.Name), c.Type))
+	}
+	return list + defs.String() + "\n            " + create[end:], nil
+}
+
+// recognises the placeholders of each of the dialects' sql strings
+var placeholderRE = regexp.MustCompile(`\$\d+|:\d+|@p\d+|\?`)
+
+// insertVersionSqlFor returns the dialect's versionInsertSql, with
+// Options.ExtraColumns added to its columns, and placeholders for
+// their values, numbered on from the dialect's own, to its VALUES.
+func insertVersionSqlFor(conf *DBConf) (string, error) {
+	d := conf.Driver.Dialect
+	insert := versionInsertSql(conf)
+	cols := conf.Options.ExtraColumns
+	if len(cols) == 0 {
+		return insert, nil
+	}
+	if err := checkExtraColumns(cols); err != nil {
+		return "", err
+	}
+
+	unsupported := errors.New(fmt.Sprintf("can't add columns to the version table inserts of %T", d))
+	values := strings.LastIndex(strings.ToUpper(insert), "VALUES")
+	if values < 0 {
+		return "", unsupported
+	}
+	listEnd := strings.LastIndex(insert[:values], ")")
+	open := strings.Index(insert[values:], "(")
+	if listEnd < 0 || open < 0 {
+		return "", unsupported
+	}
+	open += values
+	end := closingParen(insert, open)
+	if end < 0 {
+		return "", unsupported
+	}
+	placeholders := placeholderRE.FindAllString(insert[open:end], -1)
+	if len(placeholders) == 0 {
+		return "", unsupported
+	}
+
+	var names, params strings.Builder
+	style := placeholders[0]
+	for i, c := range cols {
+		names.WriteString(", " + d.quoteIdentifier(c.Name))
+		if style == "?" {
+			params.WriteString(", ?")
+		} else {
+			n := len(placeholders) + i + 1
+			params.WriteString(fmt.Sprintf(", %s%d", strings.TrimRight(style, "0123456789"), n))
+		}
+	}
+	return insert[:listEnd] + names.String() + insert[listEnd:end] + params.String() + insert[end:], nil
+}
+
+// versionArgs returns the arguments of an insertVersionSqlFor
+// statement recording version v.
+func versionArgs(conf *DBConf, v int64, applied bool, checksum string, dirty bool) []interface{} {
+	args := []interface{}{v, applied, checksum, dirty}
+	for _, c := range conf.Options.ExtraColumns {
+		args = append(args, c.Value)
+	}
+	return args
+}
+
+// closingParen returns the index of the parenthesis closing the one at
+// open, skipping over quoted strings, or -1 if it's unclosed.
+func closingParen(s string, open int) int {
+	if open < 0 || open >= len(s) || s[open] != '(' {
+		return -1
+	}
+	depth, quoted := 0, false
+	for i := open; i < len(s); i++ {
+		switch {
+		case s[i] == '\'':
+			quoted = !quoted
+		case quoted:
+		case s[i] == '(':
+			depth++
+		case s[i] == ')':
+			depth--
+			if depth == 0 {
+				return i
+			}
+		}
+	}
+	return -1
+}
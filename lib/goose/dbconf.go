@@ -33,6 +33,11 @@ type DBConf struct {
 	PgSchema      string
 	DBName        string
 	NoDB          bool
+	Options       Options
+
+	// whether ensureDBVersion found the version table's version_id
+	// unique, so that versions can be recorded with an upsert
+	uniqueVersions bool
 }
 
 // extract configuration details from the given file
@@ -110,6 +115,22 @@ func NewDBConf(p, env, pgschema, migrationsFolder string) (*DBConf, error) {
 		d.Dialect = dialectByName(dialect)
 	}
 
+	// clickhouse clusters need the version table created on every node,
+	// and its engine may differ between environments
+	if ch, ok := d.Dialect.(*ClickHouseDialect); ok {
+		c := *ch
+		if cluster, err := f.Get(fmt.Sprintf("%s.cluster", env)); err == nil {
+			c.Cluster = cluster
+		}
+		if engine, err := f.Get(fmt.Sprintf("%s.engine", env)); err == nil {
+			c.Engine = engine
+		}
+		if err := c.checkVersionTable(); err != nil {
+			return nil, err
+		}
+		d.Dialect = &c
+	}
+
 	if !d.IsValid() {
 		return nil, errors.New(fmt.Sprintf("Invalid DBConf: %v", d))
 	}
@@ -137,23 +158,27 @@ func newDBDriver(name, open, openNoDB string) DBDriver {
 	switch name {
 	case "postgres":
 		d.Import = "github.com/lib/pq"
-		d.Dialect = &PostgresDialect{}
+		d.Dialect = dialectByName("postgres")
 
 	case "pgx":
 		d.Import = "github.com/jackc/pgx/stdlib"
-		d.Dialect = &PostgresDialect{}
+		d.Dialect = dialectByName("postgres")
 
 	case "mymysql":
 		d.Import = "github.com/ziutek/mymysql/godrv"
-		d.Dialect = &MySqlDialect{}
+		d.Dialect = dialectByName("mysql")
 
 	case "mysql":
 		d.Import = "github.com/go-sql-driver/mysql"
-		d.Dialect = &MySqlDialect{}
+		d.Dialect = dialectByName("mysql")
 
 	case "clickhouse":
 		d.Import = "github.com/kshvakov/clickhouse"
-		d.Dialect = &ClickHouseDialect{}
+		d.Dialect = dialectByName("clickhouse")
+
+	case "sqlite3":
+		d.Import = "github.com/mattn/go-sqlite3"
+		d.Dialect = dialectByName("sqlite3")
 	}
 
 	return d
@@ -179,7 +204,7 @@ func OpenDBFromDBConf(conf *DBConf) (*sql.DB, error) {
 	}
 
 	// if a postgres schema has been specified, apply it
-	if conf.Driver.Name == "postgres" && conf.PgSchema != "" {
+	if (conf.Driver.Name == "postgres" || conf.Driver.Name == "pgx") && conf.PgSchema != "" {
 		if _, err := db.Exec("SET search_path TO " + conf.PgSchema); err != nil {
 			return nil, err
 		}
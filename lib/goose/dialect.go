@@ -1,28 +1,364 @@
 package goose
 
 import (
+	"context"
+	"crypto/sha1"
 	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/kshvakov/clickhouse"
+	"github.com/lib/pq"
 )
 
 // SqlDialect abstracts the details of specific SQL dialects
 // for goose's few SQL specific statements
 type SqlDialect interface {
-	createVersionTableSql() string // sql string to create the goose_db_version table
+	createVersionTableSql() string // sql string to create the version table
 	insertVersionSql() string      // sql string to insert the initial version table row
-	dbVersionQuery(db *sql.DB) (*sql.Rows, error)
+	deleteVersionSql() string      // sql string to remove a version's rows when it is rolled back
+	// sql strings collapsing the version table into one row per applied version
+	compactVersionsSql() []string
+	// quotes a table or schema name for use in the dialect's sql strings
+	quoteIdentifier(name string) string
+	dbVersionQuery(ctx context.Context, db dbConn) (*sql.Rows, error)
+	// statusQuery reads (version_id, is_applied, timestamp column) rows, most recent first
+	statusQuery(ctx context.Context, db dbConn) (*sql.Rows, error)
+
+	addChecksumColumnSql() string // sql string to add the checksum column to a version table predating it
+	// checksumQuery reads (version_id, is_applied, checksum) rows, most recent first
+	checksumQuery(ctx context.Context, db dbConn) (*sql.Rows, error)
+
+	addDirtyColumnSql() string // sql string to add the dirty column to a version table predating it
+	setDirtySql() string       // sql string setting the dirty flag (first arg) of a version's rows (second arg)
+	// dirtyQuery reads (version_id, dirty) rows, most recent first
+	dirtyQuery(ctx context.Context, db dbConn) (*sql.Rows, error)
+}
+
+// sqlNoTxDDL is implemented by dialects whose databases can't run DDL
+// within a transaction. The version table is created outside of one,
+// and every SQL migration is run as though annotated 'NO TRANSACTION'.
+type sqlNoTxDDL interface {
+	noTxDDL()
+}
+
+// sqlLowerCaser is implemented by dialects whose databases fold unquoted
+// identifiers to lower case, as Postgres does. The version table's name
+// and schema are folded before they're quoted, so that one set with
+// capitals still names the table it did before names were quoted.
+type sqlLowerCaser interface {
+	foldsToLower()
+}
+
+// sqlVersionTableChecker is implemented by dialects configured with how
+// to create the version table, which can be misconfigured. goose checks
+// before creating it.
+type sqlVersionTableChecker interface {
+	checkVersionTable() error
+}
+
+// sqlTableChecker is implemented by dialects that can ask the database
+// whether the version table exists. goose checks before reading the
+// table, rather than learning that it's missing from a failing query,
+// which the database may well log as an error.
+type sqlTableChecker interface {
+	// tableExistsQuery counts the tables named as the version table is,
+	// in its schema if one was set
+	tableExistsQuery() string
+}
+
+// sqlObjectChecker is implemented by dialects that can ask the database
+// whether any table exists, for Verify to look for the tables named by
+// migrations' CheckExists annotations.
+type sqlObjectChecker interface {
+	// namedTableExistsQuery counts the tables called name in schema,
+	// or wherever unqualified names are looked for if schema is ""
+	namedTableExistsQuery(schema, name string) string
+}
+
+// sqlMultiStatementer is implemented by dialects whose drivers can run
+// several statements, separated by semicolons, in a single Exec, which
+// Options.MultiStatement has each SQL migration's sections sent as.
+type sqlMultiStatementer interface {
+	supportsMultiStatement() bool
+}
+
+// sqlMySQLSyntax is implemented by dialects whose scripts follow MySQL's
+// syntax, in which backslashes escape characters in quoted strings and
+// # begins a comment, which splitting SQL migrations into statements
+// has to allow for.
+type sqlMySQLSyntax interface {
+	mysqlSyntax()
+}
+
+// sqlVersionUpserter is implemented by dialects that can record a
+// version without failing if it's recorded already, as it is when a
+// migration's transaction committed but the acknowledgement was lost,
+// and retrying it records the version again. goose records versions
+// with upsertVersionSql in place of insertVersionSql once
+// uniqueVersionQuery has found the version table's version_id unique,
+// which it isn't in tables created by earlier releases.
+type sqlVersionUpserter interface {
+	// upsertVersionSql is insertVersionSql, doing nothing if the
+	// version has a row already
+	upsertVersionSql() string
+	// uniqueVersionQuery counts the unique constraints, or indexes,
+	// on the version table's version_id alone
+	uniqueVersionQuery() string
+}
+
+// versionInsertSql returns the statement goose records versions with:
+// the dialect's upsertVersionSql if ensureDBVersion found the version
+// table's version_id unique, so that recording one again is a no-op,
+// and otherwise its insertVersionSql.
+func versionInsertSql(conf *DBConf) string {
+	d := conf.Driver.Dialect
+	if u, ok := d.(sqlVersionUpserter); ok && conf.uniqueVersions {
+		return u.upsertVersionSql()
+	}
+	return d.insertVersionSql()
+}
+
+// sqlCurrentVersioner is implemented by dialects that can have the
+// database find the current version, rather than goose reading every
+// row of the version table to, which for a long history is wasteful.
+// Where all that's wanted is the current version, goose asks with
+// currentVersionQuery, falling back to dbVersionQuery if it fails.
+type sqlCurrentVersioner interface {
+	// currentVersionQuery selects the newest version whose most recent
+	// record has it applied, or NULL if there's none
+	currentVersionQuery() string
+}
+
+// sqlProber is implemented by dialects that can ask the database what
+// it is, for ProbeDialect to confirm it's the dialect's engine.
+type sqlProber interface {
+	// dialectProbeSql selects a string identifying the database,
+	// typically its version
+	dialectProbeSql() string
+	// probeMatches reports whether what dialectProbeSql selected
+	// identifies the dialect's engine
+	probeMatches(version string) bool
+}
+
+// matches a version starting with a dotted number, e.g. 3.45.1
+var versionNumber = regexp.MustCompile(`^\d+\.\d+`)
+
+// latestAppliedVersionQuery is a currentVersionQuery for version tables
+// whose ids follow the order rows were inserted in; isApplied tests
+// whether a row, v, records its version as applied.
+func latestAppliedVersionQuery(d SqlDialect, isApplied string) string {
+	t := quotedTableName(d)
+	return fmt.Sprintf("SELECT max(v.version_id) FROM %s v WHERE %s AND NOT EXISTS (SELECT 1 FROM %s r WHERE r.version_id = v.version_id AND r.id > v.id)",
+		t, isApplied, t)
+}
+
+// name of the table used to record applied versions,
+// and optionally the schema it lives in
+var tableName = "goose_db_version"
+var tableSchema = ""
+
+// table names are interpolated into the dialect's SQL,
+// so only plain identifiers are accepted.
+var validTableName = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]{0,62}$`)
+
+// TableName returns the name of the table goose records versions in.
+func TableName() string {
+	return tableName
+}
+
+// SetTableName changes the name of the table goose records versions in,
+// which defaults to goose_db_version. The name is quoted in the SQL
+// goose issues, so it's case sensitive, except on Postgres and the
+// dialects derived from it, where it's folded to lower case, as it
+// would be unquoted.
+func SetTableName(name string) error {
+	if !validTableName.MatchString(name) {
+		return errors.New(fmt.Sprintf("invalid version table name %q", name))
+	}
+	tableName = name
+	return nil
+}
+
+// TableSchema returns the schema the version table lives in,
+// or "" if the table name is left unqualified.
+func TableSchema() string {
+	return tableSchema
+}
+
+// SetTableSchema qualifies the version table with the given schema
+// (a database, in MySQL terms). Passing "" restores the default
+// of leaving the table unqualified.
+func SetTableSchema(schema string) error {
+	if schema != "" && !validTableName.MatchString(schema) {
+		return errors.New(fmt.Sprintf("invalid version table schema %q", schema))
+	}
+	tableSchema = schema
+	return nil
+}
+
+// the version table name, qualified with its schema if one was set
+func qualifiedTableName() string {
+	if tableSchema == "" {
+		return tableName
+	}
+	return tableSchema + "." + tableName
+}
+
+// the qualified version table name, quoted as the dialect quotes
+// identifiers, so that names may be reserved words. On dialects that
+// fold unquoted names to lower case, the names are folded first.
+func quotedTableName(d SqlDialect) string {
+	schema, name := versionTableNames(d)
+	if schema == "" {
+		return d.quoteIdentifier(name)
+	}
+	return d.quoteIdentifier(schema) + "." + d.quoteIdentifier(name)
+}
+
+// versionTableNames returns the version table's schema and name, as
+// the dialect's database reads them unquoted.
+func versionTableNames(d SqlDialect) (schema, name string) {
+	if _, ok := d.(sqlLowerCaser); ok {
+		return strings.ToLower(tableSchema), strings.ToLower(tableName)
+	}
+	return tableSchema, tableName
+}
+
+// TimestampColumn names the version table's column recording when each
+// version was applied or rolled back, and gives its type. Left empty,
+// either takes the dialect's default: a column named tstamp, of the
+// type the dialect defines it with.
+type TimestampColumn struct {
+	Name string // the column's name, a plain identifier
+	Type string // its definition after the name, as written in the dialect's CREATE TABLE, e.g. "timestamptz NOT NULL default now()"
+}
+
+// the version table's timestamp column, as set by SetTimestampColumn
+var timestampColumn TimestampColumn
+
+// SetTimestampColumn changes the name or type of the version table's
+// timestamp column, e.g. to match a table created by another tool.
+// The type is only used when goose creates the table, and should keep
+// what the dialect's own relies on: most leave the column to default to
+// the current time, and Spanner needs allow_commit_timestamp. Passing
+// TimestampColumn{} restores the defaults.
+func SetTimestampColumn(c TimestampColumn) error {
+	if c.Name != "" {
+		if !validTableName.MatchString(c.Name) {
+			return errors.New(fmt.Sprintf("invalid version table timestamp column name %q", c.Name))
+		}
+		if name := strings.ToLower(c.Name); coreColumns[name] && name != "tstamp" {
+			return errors.New(fmt.Sprintf("version table column %q is goose's own", c.Name))
+		}
+	}
+	timestampColumn = c
+	return nil
+}
+
+// the name of the version table's timestamp column, quoted as the
+// dialect quotes identifiers if one was set
+func tstampColumn(d SqlDialect) string {
+	if timestampColumn.Name == "" {
+		return "tstamp"
+	}
+	return d.quoteIdentifier(timestampColumn.Name)
+}
+
+// the definition of the version table's timestamp column, for its
+// CREATE TABLE, where def is the dialect's own type for it
+func tstampColumnDef(d SqlDialect, def string) string {
+	if timestampColumn.Type != "" {
+		def = timestampColumn.Type
+	}
+	return tstampColumn(d) + " " + def
+}
+
+// informationSchemaTableExists is a namedTableExistsQuery for databases
+// with an information_schema, looking in defaultSchema when schema is "".
+// The names are validated as plain identifiers, so they're safe to
+// interpolate as string literals.
+func informationSchemaTableExists(defaultSchema, schema, name string) string {
+	in := defaultSchema
+	if schema != "" {
+		in = "'" + schema + "'"
+	}
+	return fmt.Sprintf("SELECT count(*) FROM information_schema.tables WHERE table_name = '%s' AND table_schema = %s", name, in)
+}
+
+// quoteIdentifierSQL quotes an identifier as the SQL standard does,
+// with double quotes
+func quoteIdentifierSQL(name string) string {
+	return `"` + strings.Replace(name, `"`, `""`, -1) + `"`
+}
+
+// dialects registered at runtime, consulted before the built-in ones
+var registeredDialects = struct {
+	sync.RWMutex
+	m map[string]SqlDialect
+}{m: map[string]SqlDialect{}}
+
+// RegisterDialect makes a dialect available under the given name,
+// e.g. for use with the dialect setting in dbconf.yml.
+// Registering a built-in name replaces the built-in dialect,
+// including for the drivers goose knows about.
+//
+// SqlDialect's methods are unexported, so dialects defined outside
+// of goose are built by embedding one of the dialects provided here.
+func RegisterDialect(name string, d SqlDialect) {
+	if d == nil {
+		panic("goose: RegisterDialect dialect is nil")
+	}
+	registeredDialects.Lock()
+	defer registeredDialects.Unlock()
+	registeredDialects.m[name] = d
+}
+
+// builtinDialects makes, for each name dialectByName knows, the
+// dialect it asks for, unless another was registered under the name.
+var builtinDialects = map[string]func() SqlDialect{
+	"postgres":   func() SqlDialect { return &PostgresDialect{} },
+	"pgx":        func() SqlDialect { return &PostgresDialect{} },
+	"mysql":      func() SqlDialect { return &MySqlDialect{} },
+	"mariadb":    func() SqlDialect { return &MariaDBDialect{} },
+	"tidb":       func() SqlDialect { return &TiDBDialect{} },
+	"clickhouse": func() SqlDialect { return &ClickHouseDialect{} },
+	"sqlite3":    func() SqlDialect { return &Sqlite3Dialect{} },
+	"sqlite":     func() SqlDialect { return &Sqlite3Dialect{} },
+	"cockroach":  func() SqlDialect { return &CockroachDialect{} },
+	"crdb":       func() SqlDialect { return &CockroachDialect{} },
+	"yugabyte":   func() SqlDialect { return &YugabyteDialect{} },
+	"ysql":       func() SqlDialect { return &YugabyteDialect{} },
+	"redshift":   func() SqlDialect { return &RedshiftDialect{} },
+	"spanner":    func() SqlDialect { return &SpannerDialect{} },
+	"vertica":    func() SqlDialect { return &VerticaDialect{} },
+	"oracle":     func() SqlDialect { return &OracleDialect{} },
+	"godror":     func() SqlDialect { return &OracleDialect{} },
+	"duckdb":     func() SqlDialect { return &DuckDBDialect{} },
+	"bigquery":   func() SqlDialect { return &BigQueryDialect{} },
+	"trino":      func() SqlDialect { return &TrinoDialect{} },
+	"presto":     func() SqlDialect { return &TrinoDialect{} },
 }
 
 // drivers that we don't know about can ask for a dialect by name
 func dialectByName(d string) SqlDialect {
-	switch d {
-	case "postgres":
-		return &PostgresDialect{}
-	case "mysql":
-		return &MySqlDialect{}
-	case "clickhouse":
-		return &ClickHouseDialect{}
+	registeredDialects.RLock()
+	rd, ok := registeredDialects.m[d]
+	registeredDialects.RUnlock()
+	if ok {
+		return rd
 	}
 
+	if newDialect, ok := builtinDialects[d]; ok {
+		return newDialect()
+	}
 	return nil
 }
 
@@ -32,31 +368,178 @@ func dialectByName(d string) SqlDialect {
 
 type PostgresDialect struct{}
 
+func (pg PostgresDialect) quoteIdentifier(name string) string {
+	return quoteIdentifierSQL(name)
+}
+
+func (pg PostgresDialect) foldsToLower() {}
+
 func (pg PostgresDialect) createVersionTableSql() string {
-	return `CREATE TABLE goose_db_version (
+	return fmt.Sprintf(`CREATE TABLE %s (
             	id serial NOT NULL,
-                version_id bigint NOT NULL,
+                version_id bigint NOT NULL UNIQUE,
                 is_applied boolean NOT NULL,
-                tstamp timestamp NULL default now(),
+                %s,
+                checksum varchar(64) NOT NULL default '',
+                dirty boolean NOT NULL default false,
                 PRIMARY KEY(id)
-            );`
+            );`, quotedTableName(pg), tstampColumnDef(pg, "timestamp NULL default now()"))
 }
 
 func (pg PostgresDialect) insertVersionSql() string {
-	return "INSERT INTO goose_db_version (version_id, is_applied) VALUES ($1, $2);"
+	return fmt.Sprintf("INSERT INTO %s (version_id, is_applied, checksum, dirty) VALUES ($1, $2, $3, $4);", quotedTableName(pg))
 }
 
-func (pg PostgresDialect) dbVersionQuery(db *sql.DB) (*sql.Rows, error) {
-	rows, err := db.Query("SELECT version_id, is_applied from goose_db_version ORDER BY id DESC")
+// conflicting only on version_id, so that other constraints a table
+// may have been given still fail the insert
+func (pg PostgresDialect) upsertVersionSql() string {
+	return fmt.Sprintf("INSERT INTO %s (version_id, is_applied, checksum, dirty) VALUES ($1, $2, $3, $4) ON CONFLICT (version_id) DO NOTHING;", quotedTableName(pg))
+}
+
+// a partial index can't be conflicted on without its predicate
+func (pg PostgresDialect) uniqueVersionQuery() string {
+	return fmt.Sprintf(`SELECT count(*) FROM pg_index i JOIN pg_attribute a ON a.attrelid = i.indrelid AND a.attnum = i.indkey[0]
+            WHERE i.indrelid = '%s'::regclass AND i.indisunique AND i.indnatts = 1 AND i.indpred IS NULL AND a.attname = 'version_id'`, quotedTableName(pg))
+}
+
+func (pg PostgresDialect) deleteVersionSql() string {
+	return fmt.Sprintf("DELETE FROM %s WHERE version_id = $1;", quotedTableName(pg))
+}
+
+// rows from before rollbacks deleted them leave versions with several
+// rows; only the most recent one counts, and only if it's applied.
+func (pg PostgresDialect) compactVersionsSql() []string {
+	return []string{
+		fmt.Sprintf("DELETE FROM %s WHERE id NOT IN (SELECT max(id) FROM %s GROUP BY version_id);", quotedTableName(pg), quotedTableName(pg)),
+		fmt.Sprintf("DELETE FROM %s WHERE NOT is_applied;", quotedTableName(pg)),
+	}
+}
 
-	// XXX: check for postgres specific error indicating the table doesn't exist.
-	// for now, assume any error is because the table doesn't exist,
-	// in which case we'll try to create it.
+func (pg PostgresDialect) dbVersionQuery(ctx context.Context, db dbConn) (*sql.Rows, error) {
+	rows, err := db.QueryContext(ctx, fmt.Sprintf("SELECT version_id, is_applied from %s ORDER BY id DESC", quotedTableName(pg)))
 	if err != nil {
-		return nil, ErrTableDoesNotExist
+		if isPgUndefinedTable(err) {
+			return nil, tableDoesNotExist(err)
+		}
+		return nil, err
 	}
 
-	return rows, err
+	return rows, nil
+}
+
+func (pg PostgresDialect) currentVersionQuery() string {
+	return latestAppliedVersionQuery(pg, "v.is_applied")
+}
+
+func (pg PostgresDialect) dialectProbeSql() string { return "SELECT version()" }
+
+func (pg PostgresDialect) probeMatches(version string) bool {
+	return strings.HasPrefix(version, "PostgreSQL ")
+}
+
+func (pg PostgresDialect) tableExistsQuery() string {
+	return pg.namedTableExistsQuery(versionTableNames(pg))
+}
+
+// an unqualified table is looked for wherever the search path leads
+func (pg PostgresDialect) namedTableExistsQuery(schema, name string) string {
+	return informationSchemaTableExists("ANY (current_schemas(false))", schema, name)
+}
+
+func (pg PostgresDialect) statusQuery(ctx context.Context, db dbConn) (*sql.Rows, error) {
+	rows, err := db.QueryContext(ctx, fmt.Sprintf("SELECT version_id, is_applied, %s from %s ORDER BY id DESC", tstampColumn(pg), quotedTableName(pg)))
+	if err != nil {
+		if isPgUndefinedTable(err) {
+			return nil, tableDoesNotExist(err)
+		}
+		return nil, err
+	}
+
+	return rows, nil
+}
+
+func (pg PostgresDialect) addChecksumColumnSql() string {
+	return fmt.Sprintf("ALTER TABLE %s ADD COLUMN checksum varchar(64) NOT NULL default '';", quotedTableName(pg))
+}
+
+func (pg PostgresDialect) checksumQuery(ctx context.Context, db dbConn) (*sql.Rows, error) {
+	rows, err := db.QueryContext(ctx, fmt.Sprintf("SELECT version_id, is_applied, checksum from %s ORDER BY id DESC", quotedTableName(pg)))
+	if err != nil {
+		if isPgUndefinedTable(err) {
+			return nil, tableDoesNotExist(err)
+		}
+		if isPgUndefinedColumn(err) {
+			return nil, errNoChecksumColumn
+		}
+		return nil, err
+	}
+
+	return rows, nil
+}
+
+func (pg PostgresDialect) addDirtyColumnSql() string {
+	return fmt.Sprintf("ALTER TABLE %s ADD COLUMN dirty boolean NOT NULL default false;", quotedTableName(pg))
+}
+
+func (pg PostgresDialect) setDirtySql() string {
+	return fmt.Sprintf("UPDATE %s SET dirty = $1 WHERE version_id = $2;", quotedTableName(pg))
+}
+
+func (pg PostgresDialect) dirtyQuery(ctx context.Context, db dbConn) (*sql.Rows, error) {
+	rows, err := db.QueryContext(ctx, fmt.Sprintf("SELECT version_id, dirty from %s ORDER BY id DESC", quotedTableName(pg)))
+	if err != nil {
+		if isPgUndefinedTable(err) {
+			return nil, tableDoesNotExist(err)
+		}
+		if isPgUndefinedColumn(err) {
+			return nil, errNoDirtyColumn
+		}
+		return nil, err
+	}
+
+	return rows, nil
+}
+
+// pg_advisory_lock can't time out, it waits until the lock is free, so
+// a LockTimeout polls pg_try_advisory_lock instead.
+func (pg PostgresDialect) lockSql(name string, timeout time.Duration) string {
+	return fmt.Sprintf("SELECT 1 FROM (SELECT pg_advisory_lock(%d)) AS l", lockKey(name))
+}
+
+func (pg PostgresDialect) tryLockSql(name string) string {
+	return fmt.Sprintf("SELECT pg_try_advisory_lock(%d)", lockKey(name))
+}
+
+func (pg PostgresDialect) unlockSql(name string) string {
+	return fmt.Sprintf("SELECT pg_advisory_unlock(%d)", lockKey(name))
+}
+
+// pgErrorCode returns the SQLSTATE carried by a Postgres error from
+// either lib/pq or pgx, or "" for any other error. pgx's *pgconn.PgError
+// is recognised by its SQLState method, which spares goose a dependency
+// on a particular pgx version.
+func pgErrorCode(err error) string {
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) {
+		return string(pqErr.Code)
+	}
+	var stateErr interface{ SQLState() string }
+	if errors.As(err, &stateErr) {
+		return stateErr.SQLState()
+	}
+	return ""
+}
+
+// isPgUndefinedTable reports whether err carries the
+// undefined_table SQLSTATE (42P01).
+func isPgUndefinedTable(err error) bool {
+	return pgErrorCode(err) == "42P01"
+}
+
+// isPgUndefinedColumn reports whether err carries the
+// undefined_column SQLSTATE (42703).
+func isPgUndefinedColumn(err error) bool {
+	return pgErrorCode(err) == "42703"
 }
 
 ////////////////////////////
@@ -65,62 +548,1694 @@ func (pg PostgresDialect) dbVersionQuery(db *sql.DB) (*sql.Rows, error) {
 
 type MySqlDialect struct{}
 
+// MySQL quotes identifiers with backticks
+func (m MySqlDialect) quoteIdentifier(name string) string {
+	return "`" + strings.Replace(name, "`", "``", -1) + "`"
+}
+
 func (m MySqlDialect) createVersionTableSql() string {
-	return `CREATE TABLE goose_db_version (
+	return fmt.Sprintf(`CREATE TABLE %s (
                 id serial NOT NULL,
-                version_id bigint NOT NULL,
+                version_id bigint NOT NULL UNIQUE,
                 is_applied boolean NOT NULL,
-                tstamp timestamp NULL default now(),
+                %s,
+                checksum varchar(64) NOT NULL default '',
+                dirty boolean NOT NULL default false,
                 PRIMARY KEY(id)
-            );`
+            );`, quotedTableName(m), tstampColumnDef(m, "timestamp NULL default now()"))
 }
 
 func (m MySqlDialect) insertVersionSql() string {
-	return "INSERT INTO goose_db_version (version_id, is_applied) VALUES (?, ?);"
+	return fmt.Sprintf("INSERT INTO %s (version_id, is_applied, checksum, dirty) VALUES (?, ?, ?, ?);", quotedTableName(m))
+}
+
+// rather than INSERT IGNORE, which would ignore more than the duplicate
+func (m MySqlDialect) upsertVersionSql() string {
+	return fmt.Sprintf("INSERT INTO %s (version_id, is_applied, checksum, dirty) VALUES (?, ?, ?, ?) ON DUPLICATE KEY UPDATE version_id = version_id;", quotedTableName(m))
+}
+
+func (m MySqlDialect) uniqueVersionQuery() string {
+	in := "DATABASE()"
+	if tableSchema != "" {
+		in = "'" + tableSchema + "'"
+	}
+	return fmt.Sprintf(`SELECT count(*) FROM (SELECT index_name FROM information_schema.statistics
+            WHERE table_schema = %s AND table_name = '%s' AND non_unique = 0
+            GROUP BY index_name HAVING count(*) = 1 AND max(column_name) = 'version_id') AS u`, in, tableName)
+}
+
+func (m MySqlDialect) deleteVersionSql() string {
+	return fmt.Sprintf("DELETE FROM %s WHERE version_id = ?;", quotedTableName(m))
+}
+
+// MySQL won't delete from a table a subquery reads from,
+// unless the subquery is materialized as a derived table.
+func (m MySqlDialect) compactVersionsSql() []string {
+	return []string{
+		fmt.Sprintf("DELETE FROM %s WHERE id NOT IN (SELECT id FROM (SELECT max(id) AS id FROM %s GROUP BY version_id) AS latest);",
+			quotedTableName(m), quotedTableName(m)),
+		fmt.Sprintf("DELETE FROM %s WHERE NOT is_applied;", quotedTableName(m)),
+	}
+}
+
+// the driver also needs multiStatements=true in its DSN
+func (m MySqlDialect) supportsMultiStatement() bool { return true }
+
+func (m MySqlDialect) mysqlSyntax() {}
+
+func (m MySqlDialect) tableExistsQuery() string {
+	return m.namedTableExistsQuery(tableSchema, tableName)
+}
+
+func (m MySqlDialect) namedTableExistsQuery(schema, name string) string {
+	return informationSchemaTableExists("DATABASE()", schema, name)
+}
+
+func (m MySqlDialect) dbVersionQuery(ctx context.Context, db dbConn) (*sql.Rows, error) {
+	rows, err := db.QueryContext(ctx, fmt.Sprintf("SELECT version_id, is_applied from %s ORDER BY id DESC", quotedTableName(m)))
+	if err != nil {
+		if isMySqlNoSuchTable(err) {
+			return nil, tableDoesNotExist(err)
+		}
+		return nil, err
+	}
+
+	return rows, nil
+}
+
+func (m MySqlDialect) currentVersionQuery() string {
+	return latestAppliedVersionQuery(m, "v.is_applied")
+}
+
+// @@version, a MySQL-ism, is just the version number, as in 8.0.36
+// or 10.11.6-MariaDB
+func (m MySqlDialect) dialectProbeSql() string { return "SELECT @@version" }
+
+func (m MySqlDialect) probeMatches(version string) bool {
+	return mysqlVersion.MatchString(version)
+}
+
+// exactly three parts, so as not to take ClickHouse's four, which its
+// MySQL compatible version() gives, for MySQL's
+var mysqlVersion = regexp.MustCompile(`^\d+\.\d+\.\d+(-.*)?$`)
+
+func (m MySqlDialect) statusQuery(ctx context.Context, db dbConn) (*sql.Rows, error) {
+	rows, err := db.QueryContext(ctx, fmt.Sprintf("SELECT version_id, is_applied, %s from %s ORDER BY id DESC", tstampColumn(m), quotedTableName(m)))
+	if err != nil {
+		if isMySqlNoSuchTable(err) {
+			return nil, tableDoesNotExist(err)
+		}
+		return nil, err
+	}
+
+	return rows, nil
+}
+
+func (m MySqlDialect) addChecksumColumnSql() string {
+	return fmt.Sprintf("ALTER TABLE %s ADD COLUMN checksum varchar(64) NOT NULL default '';", quotedTableName(m))
+}
+
+func (m MySqlDialect) checksumQuery(ctx context.Context, db dbConn) (*sql.Rows, error) {
+	rows, err := db.QueryContext(ctx, fmt.Sprintf("SELECT version_id, is_applied, checksum from %s ORDER BY id DESC", quotedTableName(m)))
+	if err != nil {
+		if isMySqlNoSuchTable(err) {
+			return nil, tableDoesNotExist(err)
+		}
+		if isMySqlBadField(err) {
+			return nil, errNoChecksumColumn
+		}
+		return nil, err
+	}
+
+	return rows, nil
+}
+
+func (m MySqlDialect) addDirtyColumnSql() string {
+	return fmt.Sprintf("ALTER TABLE %s ADD COLUMN dirty boolean NOT NULL default false;", quotedTableName(m))
 }
 
-func (m MySqlDialect) dbVersionQuery(db *sql.DB) (*sql.Rows, error) {
-	rows, err := db.Query("SELECT version_id, is_applied from goose_db_version ORDER BY id DESC")
+func (m MySqlDialect) setDirtySql() string {
+	return fmt.Sprintf("UPDATE %s SET dirty = ? WHERE version_id = ?;", quotedTableName(m))
+}
 
-	// XXX: check for mysql specific error indicating the table doesn't exist.
-	// for now, assume any error is because the table doesn't exist,
-	// in which case we'll try to create it.
+func (m MySqlDialect) dirtyQuery(ctx context.Context, db dbConn) (*sql.Rows, error) {
+	rows, err := db.QueryContext(ctx, fmt.Sprintf("SELECT version_id, dirty from %s ORDER BY id DESC", quotedTableName(m)))
 	if err != nil {
-		return nil, ErrTableDoesNotExist
+		if isMySqlNoSuchTable(err) {
+			return nil, tableDoesNotExist(err)
+		}
+		if isMySqlBadField(err) {
+			return nil, errNoDirtyColumn
+		}
+		return nil, err
+	}
+
+	return rows, nil
+}
+
+func (m MySqlDialect) lockSql(name string, timeout time.Duration) string {
+	// a negative timeout makes GET_LOCK wait forever
+	seconds := -1
+	if timeout > 0 {
+		seconds = int((timeout + time.Second - 1) / time.Second)
+	}
+	return fmt.Sprintf("SELECT GET_LOCK('%s', %d)", mysqlLockName(name), seconds)
+}
+
+func (m MySqlDialect) unlockSql(name string) string {
+	return fmt.Sprintf("SELECT RELEASE_LOCK('%s')", mysqlLockName(name))
+}
+
+// MySQL refuses lock names longer than this
+const mysqlMaxLockName = 64
+
+// mysqlLockName fits a lock name, which a qualified version table name
+// can make twice too long, within mysqlMaxLockName: as much of it as
+// fits, followed by part of a hash of the whole, keeping the names of
+// different tables distinct.
+func mysqlLockName(name string) string {
+	if len(name) <= mysqlMaxLockName {
+		return name
+	}
+	sum := sha1.Sum([]byte(name))
+	hash := hex.EncodeToString(sum[:])[:16]
+	return name[:mysqlMaxLockName-len(hash)-1] + "_" + hash
+}
+
+// isMySqlNoSuchTable reports whether err is MySQL's
+// ER_NO_SUCH_TABLE (1146).
+func isMySqlNoSuchTable(err error) bool {
+	var myErr *mysql.MySQLError
+	if errors.As(err, &myErr) {
+		return myErr.Number == 1146
+	}
+	// mymysql doesn't share go-sql-driver's error type,
+	// but does report the server's error number.
+	return strings.Contains(err.Error(), "#1146 error")
+}
+
+// isMySqlBadField reports whether err is MySQL's
+// ER_BAD_FIELD_ERROR (1054), raised for an unknown column.
+func isMySqlBadField(err error) bool {
+	var myErr *mysql.MySQLError
+	if errors.As(err, &myErr) {
+		return myErr.Number == 1054
 	}
+	return strings.Contains(err.Error(), "#1054 error")
+}
+
+////////////////////////////
+// MariaDB
+////////////////////////////
+
+// MariaDBDialect is MySqlDialect, but creates the version table without
+// relying on serial, or on now() as a timestamp default, which MariaDB
+// doesn't always handle as MySQL does.
+type MariaDBDialect struct {
+	MySqlDialect
+}
+
+func (m MariaDBDialect) createVersionTableSql() string {
+	return fmt.Sprintf(`CREATE TABLE %s (
+                id BIGINT UNSIGNED NOT NULL AUTO_INCREMENT PRIMARY KEY,
+                version_id bigint NOT NULL UNIQUE,
+                is_applied boolean NOT NULL,
+                %s,
+                checksum varchar(64) NOT NULL default '',
+                dirty boolean NOT NULL default false
+            );`, quotedTableName(m), tstampColumnDef(m, "TIMESTAMP NULL DEFAULT CURRENT_TIMESTAMP"))
+}
+
+////////////////////////////
+// TiDB
+////////////////////////////
+
+// TiDBDialect is MySqlDialect, specialized for TiDB's errors and
+// auto-increment behaviour.
+type TiDBDialect struct {
+	MySqlDialect
+}
+
+// each TiDB server normally hands out auto-increment ids from its own
+// cached range, so ids needn't follow insertion order across servers;
+// AUTO_ID_CACHE 1 makes them, as the version queries order by id.
+func (t TiDBDialect) createVersionTableSql() string {
+	return fmt.Sprintf(`CREATE TABLE %s (
+                id bigint NOT NULL AUTO_INCREMENT,
+                version_id bigint NOT NULL UNIQUE,
+                is_applied boolean NOT NULL,
+                %s,
+                checksum varchar(64) NOT NULL default '',
+                dirty boolean NOT NULL default false,
+                PRIMARY KEY(id)
+            ) AUTO_ID_CACHE 1;`, quotedTableName(t), tstampColumnDef(t, "timestamp NULL default now()"))
+}
+
+func (t TiDBDialect) dbVersionQuery(ctx context.Context, db dbConn) (*sql.Rows, error) {
+	return tidbRows(t.MySqlDialect.dbVersionQuery(ctx, db))
+}
+
+func (t TiDBDialect) statusQuery(ctx context.Context, db dbConn) (*sql.Rows, error) {
+	return tidbRows(t.MySqlDialect.statusQuery(ctx, db))
+}
+
+func (t TiDBDialect) checksumQuery(ctx context.Context, db dbConn) (*sql.Rows, error) {
+	return tidbRows(t.MySqlDialect.checksumQuery(ctx, db))
+}
+
+func (t TiDBDialect) dirtyQuery(ctx context.Context, db dbConn) (*sql.Rows, error) {
+	return tidbRows(t.MySqlDialect.dirtyQuery(ctx, db))
+}
 
+// tidbRows passes on the result of a MySQL version query, recognising
+// the missing table errors MySqlDialect doesn't.
+func tidbRows(rows *sql.Rows, err error) (*sql.Rows, error) {
+	if err != nil && isTiDBNoSuchTable(err) {
+		return nil, tableDoesNotExist(err)
+	}
 	return rows, err
 }
 
+// isTiDBNoSuchTable reports whether err is TiDB's ErrNoSuchTable or
+// ErrUnknownTable, whose messages carry their codes as "[schema:1146]".
+func isTiDBNoSuchTable(err error) bool {
+	var myErr *mysql.MySQLError
+	if errors.As(err, &myErr) {
+		return myErr.Number == 1146 || myErr.Number == 1051
+	}
+	return strings.Contains(err.Error(), "[schema:1146]") || strings.Contains(err.Error(), "[schema:1051]")
+}
+
+// TiDB reports a MySQL version it's compatible with, and its own, as in
+// 8.0.11-TiDB-v7.5.0
+func (t TiDBDialect) probeMatches(version string) bool {
+	return strings.Contains(version, "-TiDB-")
+}
+
 ////////////////////////////
 // ClickHouse
 ////////////////////////////
 
-type ClickHouseDialect struct{}
+type ClickHouseDialect struct {
+	// Cluster, if set, names the cluster the version table is created
+	// on. The table is then replicated, so each node sees the same
+	// versions whichever one goose happens to connect to.
+	Cluster string
+
+	// Engine, if set, is the table engine the version table is created
+	// with, one of those in clickHouseEngines, e.g. TinyLog for speed in
+	// tests. It defaults to ReplacingMergeTree, or to its replicated
+	// form if Cluster is set, which then needs a replicated engine.
+	Engine string
+}
+
+// clickHouseEngine describes a table engine the version table can be
+// created with.
+type clickHouseEngine struct {
+	mergeTree  bool // it's partitioned by date, and has mutations and merges
+	replacing  bool // merging collapses a version's rows into its latest
+	replicated bool // the table is replicated across the servers of a cluster
+}
+
+var clickHouseEngines = map[string]clickHouseEngine{
+	"MergeTree":                    {mergeTree: true},
+	"ReplacingMergeTree":           {mergeTree: true, replacing: true},
+	"ReplicatedMergeTree":          {mergeTree: true, replicated: true},
+	"ReplicatedReplacingMergeTree": {mergeTree: true, replacing: true, replicated: true},
+	"TinyLog":                      {},
+	"Log":                          {},
+	"StripeLog":                    {},
+}
+
+// engine returns the name of the engine the version table is created
+// with, and what it supports.
+func (c ClickHouseDialect) engine() (string, clickHouseEngine) {
+	name := c.Engine
+	if name == "" {
+		name = "ReplacingMergeTree"
+		if c.Cluster != "" {
+			name = "ReplicatedReplacingMergeTree"
+		}
+	}
+	return name, clickHouseEngines[name]
+}
+
+func (c ClickHouseDialect) checkVersionTable() error {
+	name, engine := c.engine()
+	if _, ok := clickHouseEngines[name]; !ok {
+		var names []string
+		for n := range clickHouseEngines {
+			names = append(names, n)
+		}
+		sort.Strings(names)
+		return errors.New(fmt.Sprintf("unsupported ClickHouse engine %q for the version table: use one of %s", name, strings.Join(names, ", ")))
+	}
+	if c.Cluster != "" && !engine.replicated {
+		return errors.New(fmt.Sprintf("ClickHouse engine %s doesn't replicate the version table across cluster '%s': use a Replicated engine", name, c.Cluster))
+	}
+	return nil
+}
 
+// MergeTree tables never dedupe, so every up/down cycle would leave
+// another row behind. Instead the version table is a ReplacingMergeTree
+// keyed on version_id, which collapses a version's rows into the one
+// with the latest timestamp as parts are merged. Merges happen in the
+// background, so dbVersionQuery also collapses rows as it reads them.
+//
+// A Log engine takes no partition key, so the table has no date
+// column, and its timestamps are precise enough to order the rows
+// recording a version applied and rolled back within one second.
 func (c ClickHouseDialect) createVersionTableSql() string {
-	return `
-		CREATE TABLE goose_db_version (
+	onCluster := c.onCluster()
+	name, engine := c.engine()
+
+	date := ""
+	tstamp := "DateTime64(6) default now64(6)"
+	var params string
+	if engine.mergeTree {
+		date = "date       Date     default today(),\n\t\t\t"
+		tstamp = "DateTime default now()"
+		params = "(date, (version_id), 8192)"
+		if engine.replacing {
+			params = fmt.Sprintf("(date, (version_id), 8192, %s)", tstampColumn(c))
+		}
+		if engine.replicated {
+			// {shard} and {replica} are macros expanded by each server
+			params = fmt.Sprintf("('/clickhouse/tables/{shard}/%s', '{replica}', %s", qualifiedTableName(), params[1:])
+		}
+	}
+
+	return fmt.Sprintf(`
+		CREATE TABLE %s%s (
 			version_id Int64,
 			is_applied UInt8,
-			date       Date     default today(),
-			tstamp     DateTime default now()
-		) Engine = MergeTree(date, (date), 8192)
-	`
+			%s%s,
+			checksum   String   default '',
+			dirty      UInt8    default 0
+		) Engine = %s%s
+	`, quotedTableName(c), onCluster, date, tstampColumnDef(c, tstamp), name, params)
+}
+
+// ClickHouse accepts double quotes too, but backticks are its own
+func (c ClickHouseDialect) quoteIdentifier(name string) string {
+	return "`" + strings.Replace(name, "`", "\\`", -1) + "`"
+}
+
+// the ON CLUSTER clause for DDL, if the dialect names a cluster
+func (c ClickHouseDialect) onCluster() string {
+	if c.Cluster == "" {
+		return ""
+	}
+	return fmt.Sprintf(" ON CLUSTER '%s'", strings.Replace(c.Cluster, "'", "\\'", -1))
 }
 
 func (c ClickHouseDialect) insertVersionSql() string {
-	return "INSERT INTO goose_db_version (version_id, is_applied) VALUES (?, ?)"
+	return fmt.Sprintf("INSERT INTO %s (version_id, is_applied, checksum, dirty) VALUES (?, ?, ?, ?)", quotedTableName(c))
 }
 
-func (c ClickHouseDialect) dbVersionQuery(db *sql.DB) (*sql.Rows, error) {
-	rows, err := db.Query("SELECT version_id, is_applied FROM goose_db_version ORDER BY version_id DESC, tstamp DESC")
+func (c ClickHouseDialect) deleteVersionSql() string {
+	// a Log engine has no mutations, so a rollback is recorded by a
+	// row of its own, which readers take as the version's latest state
+	if _, engine := c.engine(); !engine.mergeTree {
+		return fmt.Sprintf("INSERT INTO %s (version_id, is_applied) VALUES (?, 0)", quotedTableName(c))
+	}
+	// ClickHouse has no DELETE statement, only the mutation form,
+	// which is otherwise applied in the background once the statement
+	// returns; mutations_sync = 2 waits for it on every replica, so the
+	// next run doesn't see the version still applied.
+	return fmt.Sprintf("ALTER TABLE %s DELETE WHERE version_id = ? SETTINGS mutations_sync = 2", quotedTableName(c))
+}
 
-	// XXX: check for mysql specific error indicating the table doesn't exist.
-	// for now, assume any error is because the table doesn't exist,
-	// in which case we'll try to create it.
-	if err != nil {
-		return nil, ErrTableDoesNotExist
+// merging every part collapses each version's rows into its latest,
+// as the ReplacingMergeTree would eventually do in the background.
+// Rows recording rollbacks are kept: in a version table created as a
+// plain MergeTree by an earlier release, they're all that hides the
+// older rows recording the version as applied.
+func (c ClickHouseDialect) compactVersionsSql() []string {
+	if _, engine := c.engine(); !engine.mergeTree {
+		return nil
 	}
-	return rows, err
-}
\ No newline at end of file
+	return []string{
+		fmt.Sprintf("OPTIMIZE TABLE %s%s FINAL", quotedTableName(c), c.onCluster()),
+	}
+}
+
+func (c ClickHouseDialect) tableExistsQuery() string {
+	return c.namedTableExistsQuery(tableSchema, tableName)
+}
+
+func (c ClickHouseDialect) namedTableExistsQuery(schema, name string) string {
+	database := "currentDatabase()"
+	if schema != "" {
+		database = "'" + schema + "'"
+	}
+	return fmt.Sprintf("SELECT count() FROM system.tables WHERE name = '%s' AND database = %s", name, database)
+}
+
+func (c ClickHouseDialect) dbVersionQuery(ctx context.Context, db dbConn) (*sql.Rows, error) {
+	// one row per version, holding its most recently recorded state.
+	// aggregating rather than reading with FINAL also copes with
+	// version tables created as plain MergeTrees by earlier releases.
+	rows, err := db.QueryContext(ctx, fmt.Sprintf(
+		"SELECT version_id, argMax(is_applied, %s) FROM %s GROUP BY version_id ORDER BY version_id DESC",
+		tstampColumn(c), quotedTableName(c)))
+	if err != nil {
+		if isClickHouseUnknownTable(err) {
+			return nil, tableDoesNotExist(err)
+		}
+		return nil, err
+	}
+	return rows, nil
+}
+
+// each version's most recently recorded state, as dbVersionQuery reads it
+func (c ClickHouseDialect) currentVersionQuery() string {
+	return fmt.Sprintf(
+		"SELECT max(version_id) FROM (SELECT version_id, argMax(is_applied, %s) AS applied FROM %s GROUP BY version_id) WHERE applied = 1",
+		tstampColumn(c), quotedTableName(c))
+}
+
+func (c ClickHouseDialect) dialectProbeSql() string { return "SELECT version()" }
+
+// ClickHouse versions have four parts, e.g. 23.8.2.7, where MySQL's,
+// which version() also gives, have three
+func (c ClickHouseDialect) probeMatches(version string) bool {
+	return clickHouseVersion.MatchString(version)
+}
+
+var clickHouseVersion = regexp.MustCompile(`^\d+\.\d+\.\d+\.\d+$`)
+
+func (c ClickHouseDialect) statusQuery(ctx context.Context, db dbConn) (*sql.Rows, error) {
+	rows, err := db.QueryContext(ctx, fmt.Sprintf(
+		"SELECT version_id, argMax(is_applied, %s), max(%s) FROM %s GROUP BY version_id ORDER BY version_id DESC",
+		tstampColumn(c), tstampColumn(c), quotedTableName(c)))
+	if err != nil {
+		if isClickHouseUnknownTable(err) {
+			return nil, tableDoesNotExist(err)
+		}
+		return nil, err
+	}
+	return rows, nil
+}
+
+func (c ClickHouseDialect) addChecksumColumnSql() string {
+	return fmt.Sprintf("ALTER TABLE %s%s ADD COLUMN checksum String default ''", quotedTableName(c), c.onCluster())
+}
+
+func (c ClickHouseDialect) checksumQuery(ctx context.Context, db dbConn) (*sql.Rows, error) {
+	rows, err := db.QueryContext(ctx, fmt.Sprintf(
+		"SELECT version_id, argMax(is_applied, %s), argMax(checksum, %s) FROM %s GROUP BY version_id ORDER BY version_id DESC",
+		tstampColumn(c), tstampColumn(c), quotedTableName(c)))
+	if err != nil {
+		if isClickHouseUnknownTable(err) {
+			return nil, tableDoesNotExist(err)
+		}
+		if isClickHouseUnknownColumn(err) {
+			return nil, errNoChecksumColumn
+		}
+		return nil, err
+	}
+	return rows, nil
+}
+
+func (c ClickHouseDialect) addDirtyColumnSql() string {
+	return fmt.Sprintf("ALTER TABLE %s%s ADD COLUMN dirty UInt8 default 0", quotedTableName(c), c.onCluster())
+}
+
+// like deleteVersionSql, a mutation applied in the background, or for
+// a Log engine, a row copying the version's latest checksum. A version
+// whose mark is set or cleared is applied.
+func (c ClickHouseDialect) setDirtySql() string {
+	if _, engine := c.engine(); !engine.mergeTree {
+		return fmt.Sprintf("INSERT INTO %s (dirty, version_id, is_applied, checksum) SELECT ?, version_id, 1, argMax(checksum, %s) FROM %s WHERE version_id = ? GROUP BY version_id",
+			quotedTableName(c), tstampColumn(c), quotedTableName(c))
+	}
+	// waiting for the mutation on every replica, as deleteVersionSql does
+	return fmt.Sprintf("ALTER TABLE %s UPDATE dirty = ? WHERE version_id = ? SETTINGS mutations_sync = 2", quotedTableName(c))
+}
+
+func (c ClickHouseDialect) dirtyQuery(ctx context.Context, db dbConn) (*sql.Rows, error) {
+	rows, err := db.QueryContext(ctx, fmt.Sprintf(
+		"SELECT version_id, argMax(dirty, %s) FROM %s GROUP BY version_id ORDER BY version_id DESC",
+		tstampColumn(c), quotedTableName(c)))
+	if err != nil {
+		if isClickHouseUnknownTable(err) {
+			return nil, tableDoesNotExist(err)
+		}
+		if isClickHouseUnknownColumn(err) {
+			return nil, errNoDirtyColumn
+		}
+		return nil, err
+	}
+	return rows, nil
+}
+
+// isClickHouseUnknownTable reports whether err is ClickHouse's
+// UNKNOWN_TABLE exception (code 60).
+func isClickHouseUnknownTable(err error) bool {
+	var chErr *clickhouse.Exception
+	if errors.As(err, &chErr) {
+		return chErr.Code == 60
+	}
+	return false
+}
+
+// isClickHouseUnknownColumn reports whether err is ClickHouse's
+// UNKNOWN_IDENTIFIER (code 47) or NO_SUCH_COLUMN_IN_TABLE (code 16)
+// exception, depending on the server version.
+func isClickHouseUnknownColumn(err error) bool {
+	var chErr *clickhouse.Exception
+	if errors.As(err, &chErr) {
+		return chErr.Code == 47 || chErr.Code == 16
+	}
+	return false
+}
+
+////////////////////////////
+// sqlite3
+////////////////////////////
+
+type Sqlite3Dialect struct{}
+
+func (m Sqlite3Dialect) quoteIdentifier(name string) string {
+	return quoteIdentifierSQL(name)
+}
+
+func (m Sqlite3Dialect) createVersionTableSql() string {
+	return fmt.Sprintf(`CREATE TABLE %s (
+                id INTEGER PRIMARY KEY AUTOINCREMENT,
+                version_id INTEGER NOT NULL UNIQUE,
+                is_applied INTEGER NOT NULL,
+                %s,
+                checksum TEXT NOT NULL DEFAULT '',
+                dirty INTEGER NOT NULL DEFAULT 0
+            );`, quotedTableName(m), tstampColumnDef(m, "TIMESTAMP DEFAULT CURRENT_TIMESTAMP"))
+}
+
+func (m Sqlite3Dialect) insertVersionSql() string {
+	return fmt.Sprintf("INSERT INTO %s (version_id, is_applied, checksum, dirty) VALUES (?, ?, ?, ?);", quotedTableName(m))
+}
+
+func (m Sqlite3Dialect) upsertVersionSql() string {
+	return fmt.Sprintf("INSERT INTO %s (version_id, is_applied, checksum, dirty) VALUES (?, ?, ?, ?) ON CONFLICT (version_id) DO NOTHING;", quotedTableName(m))
+}
+
+// a schema is an attached database, which the pragmas take after the name
+func (m Sqlite3Dialect) uniqueVersionQuery() string {
+	args := "'" + tableName + "'"
+	if tableSchema != "" {
+		args += ", '" + tableSchema + "'"
+	}
+	info := "pragma_index_info(l.name"
+	if tableSchema != "" {
+		info += ", '" + tableSchema + "'"
+	}
+	info += ")"
+	return fmt.Sprintf(`SELECT count(*) FROM pragma_index_list(%s) AS l
+            WHERE l."unique" = 1 AND l.partial = 0
+            AND (SELECT count(*) FROM %s) = 1 AND (SELECT name FROM %s) = 'version_id'`, args, info, info)
+}
+
+func (m Sqlite3Dialect) deleteVersionSql() string {
+	return fmt.Sprintf("DELETE FROM %s WHERE version_id = ?;", quotedTableName(m))
+}
+
+func (m Sqlite3Dialect) compactVersionsSql() []string {
+	return []string{
+		fmt.Sprintf("DELETE FROM %s WHERE id NOT IN (SELECT max(id) FROM %s GROUP BY version_id);", quotedTableName(m), quotedTableName(m)),
+		fmt.Sprintf("DELETE FROM %s WHERE NOT is_applied;", quotedTableName(m)),
+	}
+}
+
+func (m Sqlite3Dialect) tableExistsQuery() string {
+	return m.namedTableExistsQuery(tableSchema, tableName)
+}
+
+// a schema is an attached database, with a sqlite_master of its own
+func (m Sqlite3Dialect) namedTableExistsQuery(schema, name string) string {
+	master := "sqlite_master"
+	if schema != "" {
+		master = m.quoteIdentifier(schema) + ".sqlite_master"
+	}
+	return fmt.Sprintf("SELECT count(*) FROM %s WHERE type = 'table' AND name = '%s'", master, name)
+}
+
+func (m Sqlite3Dialect) dbVersionQuery(ctx context.Context, db dbConn) (*sql.Rows, error) {
+	rows, err := db.QueryContext(ctx, fmt.Sprintf("SELECT version_id, is_applied from %s ORDER BY id DESC", quotedTableName(m)))
+	if err != nil {
+		// the sqlite driver isn't compiled into goose, so its error
+		// type isn't available; match on sqlite's own message instead.
+		if strings.Contains(err.Error(), "no such table") {
+			return nil, tableDoesNotExist(err)
+		}
+		return nil, err
+	}
+
+	return rows, nil
+}
+
+func (m Sqlite3Dialect) currentVersionQuery() string {
+	return latestAppliedVersionQuery(m, "v.is_applied")
+}
+
+func (m Sqlite3Dialect) dialectProbeSql() string { return "SELECT sqlite_version()" }
+
+func (m Sqlite3Dialect) probeMatches(version string) bool {
+	return versionNumber.MatchString(version)
+}
+
+func (m Sqlite3Dialect) statusQuery(ctx context.Context, db dbConn) (*sql.Rows, error) {
+	rows, err := db.QueryContext(ctx, fmt.Sprintf("SELECT version_id, is_applied, %s from %s ORDER BY id DESC", tstampColumn(m), quotedTableName(m)))
+	if err != nil {
+		if strings.Contains(err.Error(), "no such table") {
+			return nil, tableDoesNotExist(err)
+		}
+		return nil, err
+	}
+
+	return rows, nil
+}
+
+func (m Sqlite3Dialect) addChecksumColumnSql() string {
+	return fmt.Sprintf("ALTER TABLE %s ADD COLUMN checksum TEXT NOT NULL DEFAULT '';", quotedTableName(m))
+}
+
+func (m Sqlite3Dialect) checksumQuery(ctx context.Context, db dbConn) (*sql.Rows, error) {
+	rows, err := db.QueryContext(ctx, fmt.Sprintf("SELECT version_id, is_applied, checksum from %s ORDER BY id DESC", quotedTableName(m)))
+	if err != nil {
+		if strings.Contains(err.Error(), "no such table") {
+			return nil, tableDoesNotExist(err)
+		}
+		if strings.Contains(err.Error(), "no such column") {
+			return nil, errNoChecksumColumn
+		}
+		return nil, err
+	}
+
+	return rows, nil
+}
+
+func (m Sqlite3Dialect) addDirtyColumnSql() string {
+	return fmt.Sprintf("ALTER TABLE %s ADD COLUMN dirty INTEGER NOT NULL DEFAULT 0;", quotedTableName(m))
+}
+
+func (m Sqlite3Dialect) setDirtySql() string {
+	return fmt.Sprintf("UPDATE %s SET dirty = ? WHERE version_id = ?;", quotedTableName(m))
+}
+
+func (m Sqlite3Dialect) dirtyQuery(ctx context.Context, db dbConn) (*sql.Rows, error) {
+	rows, err := db.QueryContext(ctx, fmt.Sprintf("SELECT version_id, dirty from %s ORDER BY id DESC", quotedTableName(m)))
+	if err != nil {
+		if strings.Contains(err.Error(), "no such table") {
+			return nil, tableDoesNotExist(err)
+		}
+		if strings.Contains(err.Error(), "no such column") {
+			return nil, errNoDirtyColumn
+		}
+		return nil, err
+	}
+
+	return rows, nil
+}
+
+////////////////////////////
+// CockroachDB
+////////////////////////////
+
+// number of times a version query is attempted when
+// CockroachDB reports a serialization failure
+const cockroachMaxAttempts = 3
+
+type CockroachDialect struct{}
+
+func (c CockroachDialect) quoteIdentifier(name string) string {
+	return quoteIdentifierSQL(name)
+}
+
+func (c CockroachDialect) foldsToLower() {}
+
+func (c CockroachDialect) createVersionTableSql() string {
+	return fmt.Sprintf(`CREATE TABLE %s (
+                id SERIAL NOT NULL,
+                version_id BIGINT NOT NULL UNIQUE,
+                is_applied BOOLEAN NOT NULL,
+                %s,
+                checksum VARCHAR(64) NOT NULL DEFAULT '',
+                dirty BOOLEAN NOT NULL DEFAULT false,
+                PRIMARY KEY(id)
+            );`, quotedTableName(c), tstampColumnDef(c, "TIMESTAMPTZ NULL DEFAULT now()"))
+}
+
+func (c CockroachDialect) insertVersionSql() string {
+	return fmt.Sprintf("INSERT INTO %s (version_id, is_applied, checksum, dirty) VALUES ($1, $2, $3, $4);", quotedTableName(c))
+}
+
+func (c CockroachDialect) upsertVersionSql() string {
+	return fmt.Sprintf("INSERT INTO %s (version_id, is_applied, checksum, dirty) VALUES ($1, $2, $3, $4) ON CONFLICT (version_id) DO NOTHING;", quotedTableName(c))
+}
+
+func (c CockroachDialect) uniqueVersionQuery() string {
+	return PostgresDialect{}.uniqueVersionQuery()
+}
+
+func (c CockroachDialect) deleteVersionSql() string {
+	return fmt.Sprintf("DELETE FROM %s WHERE version_id = $1;", quotedTableName(c))
+}
+
+func (c CockroachDialect) compactVersionsSql() []string {
+	return []string{
+		fmt.Sprintf("DELETE FROM %s WHERE id NOT IN (SELECT max(id) FROM %s GROUP BY version_id);", quotedTableName(c), quotedTableName(c)),
+		fmt.Sprintf("DELETE FROM %s WHERE NOT is_applied;", quotedTableName(c)),
+	}
+}
+
+func (c CockroachDialect) dbVersionQuery(ctx context.Context, db dbConn) (*sql.Rows, error) {
+	// serializable transactions may be aborted with a retryable error
+	// under contention, in which case the query is simply issued again.
+	rows, err := queryWithRetries(ctx, db, fmt.Sprintf("SELECT version_id, is_applied from %s ORDER BY id DESC", quotedTableName(c)),
+		cockroachMaxAttempts, isSerializationFailure)
+	if err != nil {
+		if isPgUndefinedTable(err) {
+			return nil, tableDoesNotExist(err)
+		}
+		return nil, err
+	}
+
+	return rows, nil
+}
+
+func (c CockroachDialect) currentVersionQuery() string {
+	return latestAppliedVersionQuery(c, "v.is_applied")
+}
+
+func (c CockroachDialect) dialectProbeSql() string { return "SELECT version()" }
+
+func (c CockroachDialect) probeMatches(version string) bool {
+	return strings.HasPrefix(version, "CockroachDB ")
+}
+
+func (c CockroachDialect) tableExistsQuery() string {
+	return PostgresDialect{}.tableExistsQuery()
+}
+
+func (c CockroachDialect) namedTableExistsQuery(schema, name string) string {
+	return PostgresDialect{}.namedTableExistsQuery(schema, name)
+}
+
+func (c CockroachDialect) statusQuery(ctx context.Context, db dbConn) (*sql.Rows, error) {
+	rows, err := db.QueryContext(ctx, fmt.Sprintf("SELECT version_id, is_applied, %s from %s ORDER BY id DESC", tstampColumn(c), quotedTableName(c)))
+	if err != nil {
+		if isPgUndefinedTable(err) {
+			return nil, tableDoesNotExist(err)
+		}
+		return nil, err
+	}
+
+	return rows, nil
+}
+
+func (c CockroachDialect) addChecksumColumnSql() string {
+	return fmt.Sprintf("ALTER TABLE %s ADD COLUMN checksum VARCHAR(64) NOT NULL DEFAULT '';", quotedTableName(c))
+}
+
+func (c CockroachDialect) checksumQuery(ctx context.Context, db dbConn) (*sql.Rows, error) {
+	rows, err := db.QueryContext(ctx, fmt.Sprintf("SELECT version_id, is_applied, checksum from %s ORDER BY id DESC", quotedTableName(c)))
+	if err != nil {
+		if isPgUndefinedTable(err) {
+			return nil, tableDoesNotExist(err)
+		}
+		if isPgUndefinedColumn(err) {
+			return nil, errNoChecksumColumn
+		}
+		return nil, err
+	}
+
+	return rows, nil
+}
+
+func (c CockroachDialect) addDirtyColumnSql() string {
+	return fmt.Sprintf("ALTER TABLE %s ADD COLUMN dirty BOOLEAN NOT NULL DEFAULT false;", quotedTableName(c))
+}
+
+func (c CockroachDialect) setDirtySql() string {
+	return PostgresDialect{}.setDirtySql()
+}
+
+func (c CockroachDialect) dirtyQuery(ctx context.Context, db dbConn) (*sql.Rows, error) {
+	return PostgresDialect{}.dirtyQuery(ctx, db)
+}
+
+// isSerializationFailure reports whether err carries the
+// serialization_failure SQLSTATE (40001), which signals that
+// the statement may succeed if retried.
+func isSerializationFailure(err error) bool {
+	return pgErrorCode(err) == "40001"
+}
+
+////////////////////////////
+// YugabyteDB
+////////////////////////////
+
+// YugabyteDialect speaks Postgres' SQL, over YSQL, Yugabyte's Postgres
+// compatible API. Its distributed transactions may be aborted with a
+// serialization failure under contention, so the version query is
+// retried, as is each migration's transaction along with the version
+// table update it ends with. Other errors, such as constraint
+// violations, aren't retried. Options.Lock isn't supported, as not
+// every Yugabyte release has advisory locks.
+type YugabyteDialect struct{}
+
+func (y YugabyteDialect) retryable(err error) bool {
+	return isSerializationFailure(err)
+}
+
+func (y YugabyteDialect) quoteIdentifier(name string) string {
+	return quoteIdentifierSQL(name)
+}
+
+func (y YugabyteDialect) foldsToLower() {}
+
+func (y YugabyteDialect) createVersionTableSql() string {
+	return PostgresDialect{}.createVersionTableSql()
+}
+
+func (y YugabyteDialect) insertVersionSql() string {
+	return PostgresDialect{}.insertVersionSql()
+}
+
+func (y YugabyteDialect) upsertVersionSql() string {
+	return PostgresDialect{}.upsertVersionSql()
+}
+
+func (y YugabyteDialect) uniqueVersionQuery() string {
+	return PostgresDialect{}.uniqueVersionQuery()
+}
+
+func (y YugabyteDialect) deleteVersionSql() string {
+	return PostgresDialect{}.deleteVersionSql()
+}
+
+func (y YugabyteDialect) compactVersionsSql() []string {
+	return PostgresDialect{}.compactVersionsSql()
+}
+
+func (y YugabyteDialect) dbVersionQuery(ctx context.Context, db dbConn) (*sql.Rows, error) {
+	rows, err := queryWithRetries(ctx, db, fmt.Sprintf("SELECT version_id, is_applied from %s ORDER BY id DESC", quotedTableName(y)),
+		retryAttempts, isSerializationFailure)
+	if isPgUndefinedTable(err) {
+		return nil, tableDoesNotExist(err)
+	}
+	return rows, err
+}
+
+func (y YugabyteDialect) currentVersionQuery() string {
+	return PostgresDialect{}.currentVersionQuery()
+}
+
+func (y YugabyteDialect) dialectProbeSql() string { return "SELECT version()" }
+
+// as in PostgreSQL 11.2-YB-2.20.1.0-b0 on x86_64-pc-linux-gnu, ...
+func (y YugabyteDialect) probeMatches(version string) bool {
+	return strings.HasPrefix(version, "PostgreSQL ") && strings.Contains(version, "-YB-")
+}
+
+func (y YugabyteDialect) tableExistsQuery() string {
+	return PostgresDialect{}.tableExistsQuery()
+}
+
+func (y YugabyteDialect) namedTableExistsQuery(schema, name string) string {
+	return PostgresDialect{}.namedTableExistsQuery(schema, name)
+}
+
+func (y YugabyteDialect) statusQuery(ctx context.Context, db dbConn) (*sql.Rows, error) {
+	return PostgresDialect{}.statusQuery(ctx, db)
+}
+
+func (y YugabyteDialect) addChecksumColumnSql() string {
+	return PostgresDialect{}.addChecksumColumnSql()
+}
+
+func (y YugabyteDialect) checksumQuery(ctx context.Context, db dbConn) (*sql.Rows, error) {
+	return PostgresDialect{}.checksumQuery(ctx, db)
+}
+
+func (y YugabyteDialect) addDirtyColumnSql() string {
+	return PostgresDialect{}.addDirtyColumnSql()
+}
+
+func (y YugabyteDialect) setDirtySql() string {
+	return PostgresDialect{}.setDirtySql()
+}
+
+func (y YugabyteDialect) dirtyQuery(ctx context.Context, db dbConn) (*sql.Rows, error) {
+	return PostgresDialect{}.dirtyQuery(ctx, db)
+}
+
+////////////////////////////
+// Redshift
+////////////////////////////
+
+// RedshiftDialect speaks Postgres' SQL, but creates the version table
+// with types Redshift supports. Redshift has no advisory locks, so
+// unlike PostgresDialect it doesn't support Options.Lock.
+type RedshiftDialect struct{}
+
+func (r RedshiftDialect) quoteIdentifier(name string) string {
+	return quoteIdentifierSQL(name)
+}
+
+func (r RedshiftDialect) foldsToLower() {}
+
+func (r RedshiftDialect) createVersionTableSql() string {
+	return fmt.Sprintf(`CREATE TABLE %s (
+                id BIGINT IDENTITY(1,1) NOT NULL,
+                version_id BIGINT NOT NULL,
+                is_applied BOOLEAN NOT NULL,
+                %s,
+                checksum VARCHAR(64) NOT NULL DEFAULT '',
+                dirty BOOLEAN NOT NULL DEFAULT false,
+                PRIMARY KEY(id)
+            );`, quotedTableName(r), tstampColumnDef(r, "TIMESTAMP NULL DEFAULT SYSDATE"))
+}
+
+func (r RedshiftDialect) insertVersionSql() string {
+	return PostgresDialect{}.insertVersionSql()
+}
+
+func (r RedshiftDialect) deleteVersionSql() string {
+	return PostgresDialect{}.deleteVersionSql()
+}
+
+func (r RedshiftDialect) compactVersionsSql() []string {
+	return PostgresDialect{}.compactVersionsSql()
+}
+
+func (r RedshiftDialect) dbVersionQuery(ctx context.Context, db dbConn) (*sql.Rows, error) {
+	return PostgresDialect{}.dbVersionQuery(ctx, db)
+}
+
+func (r RedshiftDialect) currentVersionQuery() string {
+	return PostgresDialect{}.currentVersionQuery()
+}
+
+func (r RedshiftDialect) dialectProbeSql() string { return "SELECT version()" }
+
+// as in PostgreSQL 8.0.2 on i686-pc-linux-gnu, ..., Redshift 1.0.63282
+func (r RedshiftDialect) probeMatches(version string) bool {
+	return strings.Contains(version, "Redshift")
+}
+
+func (r RedshiftDialect) statusQuery(ctx context.Context, db dbConn) (*sql.Rows, error) {
+	return PostgresDialect{}.statusQuery(ctx, db)
+}
+
+func (r RedshiftDialect) addChecksumColumnSql() string {
+	return PostgresDialect{}.addChecksumColumnSql()
+}
+
+func (r RedshiftDialect) checksumQuery(ctx context.Context, db dbConn) (*sql.Rows, error) {
+	return PostgresDialect{}.checksumQuery(ctx, db)
+}
+
+func (r RedshiftDialect) addDirtyColumnSql() string {
+	return PostgresDialect{}.addDirtyColumnSql()
+}
+
+func (r RedshiftDialect) setDirtySql() string {
+	return PostgresDialect{}.setDirtySql()
+}
+
+func (r RedshiftDialect) dirtyQuery(ctx context.Context, db dbConn) (*sql.Rows, error) {
+	return PostgresDialect{}.dirtyQuery(ctx, db)
+}
+
+////////////////////////////
+// Spanner
+////////////////////////////
+
+// SpannerDialect speaks Cloud Spanner's GoogleSQL, as used through the
+// github.com/googleapis/go-sql-spanner driver. Spanner has no
+// auto-incrementing ids, so the version table is keyed by version_id,
+// which holds as rolling back deletes a version's row. Spanner can't
+// run DDL within a read-write transaction, so SQL migrations run
+// against it as though annotated 'NO TRANSACTION'.
+type SpannerDialect struct{}
+
+func (s SpannerDialect) noTxDDL() {}
+
+func (s SpannerDialect) quoteIdentifier(name string) string {
+	return "`" + strings.Replace(name, "`", "", -1) + "`"
+}
+
+func (s SpannerDialect) createVersionTableSql() string {
+	return fmt.Sprintf(`CREATE TABLE %s (
+                version_id INT64 NOT NULL,
+                is_applied BOOL NOT NULL,
+                %s,
+                checksum STRING(64) NOT NULL DEFAULT (''),
+                dirty BOOL NOT NULL DEFAULT (false),
+            ) PRIMARY KEY (version_id)`, quotedTableName(s), tstampColumnDef(s, "TIMESTAMP OPTIONS (allow_commit_timestamp=true)"))
+}
+
+func (s SpannerDialect) insertVersionSql() string {
+	return fmt.Sprintf("INSERT INTO %s (version_id, is_applied, checksum, dirty, %s) VALUES (@p1, @p2, @p3, @p4, PENDING_COMMIT_TIMESTAMP())", quotedTableName(s), tstampColumn(s))
+}
+
+func (s SpannerDialect) deleteVersionSql() string {
+	return fmt.Sprintf("DELETE FROM %s WHERE version_id = @p1", quotedTableName(s))
+}
+
+// the version table already has one row per version
+func (s SpannerDialect) compactVersionsSql() []string {
+	return []string{fmt.Sprintf("DELETE FROM %s WHERE NOT is_applied", quotedTableName(s))}
+}
+
+func (s SpannerDialect) dbVersionQuery(ctx context.Context, db dbConn) (*sql.Rows, error) {
+	rows, err := db.QueryContext(ctx, fmt.Sprintf("SELECT version_id, is_applied FROM %s ORDER BY version_id DESC", quotedTableName(s)))
+	if isSpannerTableNotFound(err) {
+		return nil, tableDoesNotExist(err)
+	}
+	return rows, err
+}
+
+// the version table already has one row per version
+func (s SpannerDialect) currentVersionQuery() string {
+	return fmt.Sprintf("SELECT max(version_id) FROM %s WHERE is_applied", quotedTableName(s))
+}
+
+func (s SpannerDialect) statusQuery(ctx context.Context, db dbConn) (*sql.Rows, error) {
+	rows, err := db.QueryContext(ctx, fmt.Sprintf("SELECT version_id, is_applied, %s FROM %s ORDER BY version_id DESC", tstampColumn(s), quotedTableName(s)))
+	if isSpannerTableNotFound(err) {
+		return nil, tableDoesNotExist(err)
+	}
+	return rows, err
+}
+
+func (s SpannerDialect) addChecksumColumnSql() string {
+	return fmt.Sprintf("ALTER TABLE %s ADD COLUMN checksum STRING(64) NOT NULL DEFAULT ('')", quotedTableName(s))
+}
+
+func (s SpannerDialect) checksumQuery(ctx context.Context, db dbConn) (*sql.Rows, error) {
+	rows, err := db.QueryContext(ctx, fmt.Sprintf("SELECT version_id, is_applied, checksum FROM %s ORDER BY version_id DESC", quotedTableName(s)))
+	switch {
+	case isSpannerTableNotFound(err):
+		return nil, tableDoesNotExist(err)
+	case err != nil && strings.Contains(err.Error(), "Unrecognized name: checksum"):
+		return nil, errNoChecksumColumn
+	}
+	return rows, err
+}
+
+func (s SpannerDialect) addDirtyColumnSql() string {
+	return fmt.Sprintf("ALTER TABLE %s ADD COLUMN dirty BOOL NOT NULL DEFAULT (false)", quotedTableName(s))
+}
+
+func (s SpannerDialect) setDirtySql() string {
+	return fmt.Sprintf("UPDATE %s SET dirty = @p1 WHERE version_id = @p2", quotedTableName(s))
+}
+
+func (s SpannerDialect) dirtyQuery(ctx context.Context, db dbConn) (*sql.Rows, error) {
+	rows, err := db.QueryContext(ctx, fmt.Sprintf("SELECT version_id, dirty FROM %s ORDER BY version_id DESC", quotedTableName(s)))
+	switch {
+	case isSpannerTableNotFound(err):
+		return nil, tableDoesNotExist(err)
+	case err != nil && strings.Contains(err.Error(), "Unrecognized name: dirty"):
+		return nil, errNoDirtyColumn
+	}
+	return rows, err
+}
+
+// the spanner driver isn't compiled into goose, so its gRPC status
+// errors aren't available; match on Spanner's own message instead.
+func isSpannerTableNotFound(err error) bool {
+	return err != nil && strings.Contains(err.Error(), "Table not found")
+}
+
+////////////////////////////
+// Vertica
+////////////////////////////
+
+// VerticaDialect speaks Vertica's SQL, with the ? placeholders the
+// github.com/vertica/vertica-sql-go driver takes. Vertica has no
+// advisory locks, so it doesn't support Options.Lock.
+type VerticaDialect struct{}
+
+func (v VerticaDialect) quoteIdentifier(name string) string {
+	return quoteIdentifierSQL(name)
+}
+
+// ids are otherwise cached per node, so wouldn't order the rows
+func (v VerticaDialect) createVersionTableSql() string {
+	return fmt.Sprintf(`CREATE TABLE %s (
+                id AUTO_INCREMENT(1, 1, 1) PRIMARY KEY,
+                version_id INT NOT NULL,
+                is_applied BOOLEAN NOT NULL,
+                %s,
+                checksum VARCHAR(64) NOT NULL DEFAULT '',
+                dirty BOOLEAN NOT NULL DEFAULT false
+            );`, quotedTableName(v), tstampColumnDef(v, "TIMESTAMP DEFAULT now()"))
+}
+
+func (v VerticaDialect) insertVersionSql() string {
+	return fmt.Sprintf("INSERT INTO %s (version_id, is_applied, checksum, dirty) VALUES (?, ?, ?, ?);", quotedTableName(v))
+}
+
+func (v VerticaDialect) deleteVersionSql() string {
+	return fmt.Sprintf("DELETE FROM %s WHERE version_id = ?;", quotedTableName(v))
+}
+
+func (v VerticaDialect) compactVersionsSql() []string {
+	return PostgresDialect{}.compactVersionsSql()
+}
+
+func (v VerticaDialect) dbVersionQuery(ctx context.Context, db dbConn) (*sql.Rows, error) {
+	rows, err := db.QueryContext(ctx, fmt.Sprintf("SELECT version_id, is_applied from %s ORDER BY id DESC", quotedTableName(v)))
+	if isVerticaError(err, "42V01") {
+		return nil, tableDoesNotExist(err)
+	}
+	return rows, err
+}
+
+func (v VerticaDialect) currentVersionQuery() string {
+	return latestAppliedVersionQuery(v, "v.is_applied")
+}
+
+func (v VerticaDialect) dialectProbeSql() string { return "SELECT version()" }
+
+func (v VerticaDialect) probeMatches(version string) bool {
+	return strings.HasPrefix(version, "Vertica ")
+}
+
+func (v VerticaDialect) statusQuery(ctx context.Context, db dbConn) (*sql.Rows, error) {
+	rows, err := db.QueryContext(ctx, fmt.Sprintf("SELECT version_id, is_applied, %s from %s ORDER BY id DESC", tstampColumn(v), quotedTableName(v)))
+	if isVerticaError(err, "42V01") {
+		return nil, tableDoesNotExist(err)
+	}
+	return rows, err
+}
+
+func (v VerticaDialect) addChecksumColumnSql() string {
+	return fmt.Sprintf("ALTER TABLE %s ADD COLUMN checksum VARCHAR(64) NOT NULL DEFAULT '';", quotedTableName(v))
+}
+
+func (v VerticaDialect) checksumQuery(ctx context.Context, db dbConn) (*sql.Rows, error) {
+	rows, err := db.QueryContext(ctx, fmt.Sprintf("SELECT version_id, is_applied, checksum from %s ORDER BY id DESC", quotedTableName(v)))
+	switch {
+	case isVerticaError(err, "42V01"):
+		return nil, tableDoesNotExist(err)
+	case isVerticaError(err, "42703"):
+		return nil, errNoChecksumColumn
+	}
+	return rows, err
+}
+
+func (v VerticaDialect) addDirtyColumnSql() string {
+	return fmt.Sprintf("ALTER TABLE %s ADD COLUMN dirty BOOLEAN NOT NULL DEFAULT false;", quotedTableName(v))
+}
+
+func (v VerticaDialect) setDirtySql() string {
+	return fmt.Sprintf("UPDATE %s SET dirty = ? WHERE version_id = ?;", quotedTableName(v))
+}
+
+func (v VerticaDialect) dirtyQuery(ctx context.Context, db dbConn) (*sql.Rows, error) {
+	rows, err := db.QueryContext(ctx, fmt.Sprintf("SELECT version_id, dirty from %s ORDER BY id DESC", quotedTableName(v)))
+	switch {
+	case isVerticaError(err, "42V01"):
+		return nil, tableDoesNotExist(err)
+	case isVerticaError(err, "42703"):
+		return nil, errNoDirtyColumn
+	}
+	return rows, err
+}
+
+// the vertica driver isn't compiled into goose, so its error type isn't
+// available; match on the SQLSTATE it writes into its messages instead,
+// e.g. "Error: [42V01] Relation "goose_db_version" does not exist".
+func isVerticaError(err error, sqlState string) bool {
+	return err != nil && strings.Contains(err.Error(), "["+sqlState+"]")
+}
+
+////////////////////////////
+// Oracle
+////////////////////////////
+
+// OracleDialect speaks Oracle's SQL, from 12c on, with the :n
+// placeholders the github.com/godror/godror driver takes. Oracle
+// rejects statements ending in a semicolon, so none of these do.
+//
+// Oracle has no boolean column type, so is_applied is stored as 0 or
+// 1, and read back as text, which database/sql scans into a bool.
+// Oracle also commits implicitly after DDL, and stores empty strings
+// as NULL, so the checksum column is nullable.
+type OracleDialect struct{}
+
+func (o OracleDialect) quoteIdentifier(name string) string {
+	return quoteIdentifierSQL(name)
+}
+
+func (o OracleDialect) createVersionTableSql() string {
+	return fmt.Sprintf(`CREATE TABLE %s (
+                id NUMBER GENERATED BY DEFAULT AS IDENTITY PRIMARY KEY,
+                version_id NUMBER(19) NOT NULL,
+                is_applied NUMBER(1) NOT NULL,
+                %s,
+                checksum VARCHAR2(64),
+                dirty NUMBER(1) DEFAULT 0 NOT NULL
+            )`, quotedTableName(o), tstampColumnDef(o, "TIMESTAMP DEFAULT SYSTIMESTAMP"))
+}
+
+func (o OracleDialect) insertVersionSql() string {
+	return fmt.Sprintf("INSERT INTO %s (version_id, is_applied, checksum, dirty) VALUES (:1, :2, :3, :4)", quotedTableName(o))
+}
+
+func (o OracleDialect) deleteVersionSql() string {
+	return fmt.Sprintf("DELETE FROM %s WHERE version_id = :1", quotedTableName(o))
+}
+
+func (o OracleDialect) compactVersionsSql() []string {
+	return []string{
+		fmt.Sprintf("DELETE FROM %s WHERE id NOT IN (SELECT max(id) FROM %s GROUP BY version_id)", quotedTableName(o), quotedTableName(o)),
+		fmt.Sprintf("DELETE FROM %s WHERE is_applied = 0", quotedTableName(o)),
+	}
+}
+
+func (o OracleDialect) dbVersionQuery(ctx context.Context, db dbConn) (*sql.Rows, error) {
+	rows, err := db.QueryContext(ctx, fmt.Sprintf("SELECT version_id, TO_CHAR(is_applied) FROM %s ORDER BY id DESC", quotedTableName(o)))
+	if isOracleError(err, "ORA-00942") {
+		return nil, tableDoesNotExist(err)
+	}
+	return rows, err
+}
+
+func (o OracleDialect) currentVersionQuery() string {
+	return latestAppliedVersionQuery(o, "v.is_applied = 1")
+}
+
+func (o OracleDialect) dialectProbeSql() string {
+	return "SELECT banner FROM v$version WHERE ROWNUM = 1"
+}
+
+func (o OracleDialect) probeMatches(version string) bool {
+	return strings.HasPrefix(version, "Oracle ")
+}
+
+func (o OracleDialect) statusQuery(ctx context.Context, db dbConn) (*sql.Rows, error) {
+	rows, err := db.QueryContext(ctx, fmt.Sprintf("SELECT version_id, TO_CHAR(is_applied), %s FROM %s ORDER BY id DESC", tstampColumn(o), quotedTableName(o)))
+	if isOracleError(err, "ORA-00942") {
+		return nil, tableDoesNotExist(err)
+	}
+	return rows, err
+}
+
+func (o OracleDialect) addChecksumColumnSql() string {
+	return fmt.Sprintf("ALTER TABLE %s ADD (checksum VARCHAR2(64))", quotedTableName(o))
+}
+
+func (o OracleDialect) checksumQuery(ctx context.Context, db dbConn) (*sql.Rows, error) {
+	rows, err := db.QueryContext(ctx, fmt.Sprintf("SELECT version_id, TO_CHAR(is_applied), checksum FROM %s ORDER BY id DESC", quotedTableName(o)))
+	switch {
+	case isOracleError(err, "ORA-00942"): // table or view does not exist
+		return nil, tableDoesNotExist(err)
+	case isOracleError(err, "ORA-00904"): // invalid identifier
+		return nil, errNoChecksumColumn
+	}
+	return rows, err
+}
+
+func (o OracleDialect) addDirtyColumnSql() string {
+	return fmt.Sprintf("ALTER TABLE %s ADD (dirty NUMBER(1) DEFAULT 0 NOT NULL)", quotedTableName(o))
+}
+
+func (o OracleDialect) setDirtySql() string {
+	return fmt.Sprintf("UPDATE %s SET dirty = :1 WHERE version_id = :2", quotedTableName(o))
+}
+
+func (o OracleDialect) dirtyQuery(ctx context.Context, db dbConn) (*sql.Rows, error) {
+	rows, err := db.QueryContext(ctx, fmt.Sprintf("SELECT version_id, TO_CHAR(dirty) FROM %s ORDER BY id DESC", quotedTableName(o)))
+	switch {
+	case isOracleError(err, "ORA-00942"):
+		return nil, tableDoesNotExist(err)
+	case isOracleError(err, "ORA-00904"):
+		return nil, errNoDirtyColumn
+	}
+	return rows, err
+}
+
+// the godror driver isn't compiled into goose, so its error type isn't
+// available; match on the ORA- code that starts Oracle's messages instead.
+func isOracleError(err error, code string) bool {
+	return err != nil && strings.Contains(err.Error(), code+":")
+}
+
+////////////////////////////
+// DuckDB
+////////////////////////////
+
+// DuckDBDialect speaks DuckDB's SQL, with the ? placeholders the
+// github.com/marcboeker/go-duckdb driver takes. A DuckDB database is
+// only ever opened for writing by one process at a time, so there's
+// nothing for Options.Lock to guard against, and it isn't supported.
+type DuckDBDialect struct{}
+
+func (d DuckDBDialect) quoteIdentifier(name string) string {
+	return quoteIdentifierSQL(name)
+}
+
+// the version table's ids come from a sequence of its own, created
+// alongside it; the driver runs several statements given at once.
+func (d DuckDBDialect) createVersionTableSql() string {
+	seq := qualifiedTableName() + "_id_seq"
+	return fmt.Sprintf(`CREATE SEQUENCE %s;
+            CREATE TABLE %s (
+                id BIGINT PRIMARY KEY DEFAULT nextval('%s'),
+                version_id BIGINT NOT NULL,
+                is_applied BOOLEAN NOT NULL,
+                %s,
+                checksum VARCHAR(64) NOT NULL DEFAULT '',
+                dirty BOOLEAN NOT NULL DEFAULT false
+            );`, seq, quotedTableName(d), seq, tstampColumnDef(d, "TIMESTAMP DEFAULT current_timestamp"))
+}
+
+func (d DuckDBDialect) insertVersionSql() string {
+	return fmt.Sprintf("INSERT INTO %s (version_id, is_applied, checksum, dirty) VALUES (?, ?, ?, ?);", quotedTableName(d))
+}
+
+func (d DuckDBDialect) deleteVersionSql() string {
+	return fmt.Sprintf("DELETE FROM %s WHERE version_id = ?;", quotedTableName(d))
+}
+
+func (d DuckDBDialect) compactVersionsSql() []string {
+	return PostgresDialect{}.compactVersionsSql()
+}
+
+func (d DuckDBDialect) tableExistsQuery() string {
+	return d.namedTableExistsQuery(tableSchema, tableName)
+}
+
+func (d DuckDBDialect) namedTableExistsQuery(schema, name string) string {
+	return informationSchemaTableExists("current_schema()", schema, name)
+}
+
+func (d DuckDBDialect) dbVersionQuery(ctx context.Context, db dbConn) (*sql.Rows, error) {
+	rows, err := db.QueryContext(ctx, fmt.Sprintf("SELECT version_id, is_applied from %s ORDER BY id DESC", quotedTableName(d)))
+	if isDuckDBMissingTable(err) {
+		return nil, tableDoesNotExist(err)
+	}
+	return rows, err
+}
+
+func (d DuckDBDialect) currentVersionQuery() string {
+	return latestAppliedVersionQuery(d, "v.is_applied")
+}
+
+func (d DuckDBDialect) dialectProbeSql() string { return "SELECT version()" }
+
+// as in v0.10.0
+func (d DuckDBDialect) probeMatches(version string) bool {
+	return strings.HasPrefix(version, "v") && versionNumber.MatchString(version[1:])
+}
+
+func (d DuckDBDialect) statusQuery(ctx context.Context, db dbConn) (*sql.Rows, error) {
+	rows, err := db.QueryContext(ctx, fmt.Sprintf("SELECT version_id, is_applied, %s from %s ORDER BY id DESC", tstampColumn(d), quotedTableName(d)))
+	if isDuckDBMissingTable(err) {
+		return nil, tableDoesNotExist(err)
+	}
+	return rows, err
+}
+
+func (d DuckDBDialect) addChecksumColumnSql() string {
+	return fmt.Sprintf("ALTER TABLE %s ADD COLUMN checksum VARCHAR(64) NOT NULL DEFAULT '';", quotedTableName(d))
+}
+
+func (d DuckDBDialect) checksumQuery(ctx context.Context, db dbConn) (*sql.Rows, error) {
+	rows, err := db.QueryContext(ctx, fmt.Sprintf("SELECT version_id, is_applied, checksum from %s ORDER BY id DESC", quotedTableName(d)))
+	switch {
+	case isDuckDBMissingTable(err):
+		return nil, tableDoesNotExist(err)
+	case err != nil && strings.Contains(err.Error(), `column "checksum" not found`):
+		return nil, errNoChecksumColumn
+	}
+	return rows, err
+}
+
+func (d DuckDBDialect) addDirtyColumnSql() string {
+	return fmt.Sprintf("ALTER TABLE %s ADD COLUMN dirty BOOLEAN NOT NULL DEFAULT false;", quotedTableName(d))
+}
+
+func (d DuckDBDialect) setDirtySql() string {
+	return fmt.Sprintf("UPDATE %s SET dirty = ? WHERE version_id = ?;", quotedTableName(d))
+}
+
+func (d DuckDBDialect) dirtyQuery(ctx context.Context, db dbConn) (*sql.Rows, error) {
+	rows, err := db.QueryContext(ctx, fmt.Sprintf("SELECT version_id, dirty from %s ORDER BY id DESC", quotedTableName(d)))
+	switch {
+	case isDuckDBMissingTable(err):
+		return nil, tableDoesNotExist(err)
+	case err != nil && strings.Contains(err.Error(), `column "dirty" not found`):
+		return nil, errNoDirtyColumn
+	}
+	return rows, err
+}
+
+// the duckdb driver isn't compiled into goose, so its error type isn't
+// available; match on DuckDB's own message instead, e.g.
+// "Catalog Error: Table with name goose_db_version does not exist!".
+func isDuckDBMissingTable(err error) bool {
+	return err != nil && strings.Contains(err.Error(), "Catalog Error: Table with name") &&
+		strings.Contains(err.Error(), "does not exist")
+}
+
+////////////////////////////
+// BigQuery
+////////////////////////////
+
+// BigQueryDialect speaks BigQuery's GoogleSQL, with the @pN parameters
+// of the bigquery database/sql drivers. BigQuery tables belong to a
+// dataset, which the version table is qualified with by SetTableSchema,
+// unless the connection names a default one. There are no
+// auto-incrementing ids, so the version table is keyed by version_id,
+// one row per version, and as DDL can't be run within a transaction,
+// SQL migrations run as though annotated 'NO TRANSACTION'.
+type BigQueryDialect struct{}
+
+func (b BigQueryDialect) noTxDDL() {}
+
+func (b BigQueryDialect) quoteIdentifier(name string) string {
+	return "`" + strings.Replace(name, "`", "", -1) + "`"
+}
+
+// BigQuery doesn't enforce primary keys, but notes them for the planner
+func (b BigQueryDialect) createVersionTableSql() string {
+	return fmt.Sprintf(`CREATE TABLE %s (
+                version_id INT64 NOT NULL,
+                is_applied BOOL NOT NULL,
+                %s,
+                checksum STRING DEFAULT '',
+                dirty BOOL DEFAULT false,
+                PRIMARY KEY (version_id) NOT ENFORCED
+            )`, quotedTableName(b), tstampColumnDef(b, "TIMESTAMP DEFAULT CURRENT_TIMESTAMP()"))
+}
+
+func (b BigQueryDialect) insertVersionSql() string {
+	return fmt.Sprintf("INSERT INTO %s (version_id, is_applied, checksum, dirty) VALUES (@p1, @p2, @p3, @p4)", quotedTableName(b))
+}
+
+func (b BigQueryDialect) deleteVersionSql() string {
+	return fmt.Sprintf("DELETE FROM %s WHERE version_id = @p1", quotedTableName(b))
+}
+
+// the version table already has one row per version
+func (b BigQueryDialect) compactVersionsSql() []string {
+	return []string{fmt.Sprintf("DELETE FROM %s WHERE NOT is_applied", quotedTableName(b))}
+}
+
+func (b BigQueryDialect) dbVersionQuery(ctx context.Context, db dbConn) (*sql.Rows, error) {
+	rows, err := db.QueryContext(ctx, fmt.Sprintf("SELECT version_id, is_applied FROM %s ORDER BY version_id DESC", quotedTableName(b)))
+	if isBigQueryTableNotFound(err) {
+		return nil, tableDoesNotExist(err)
+	}
+	return rows, err
+}
+
+// the version table already has one row per version
+func (b BigQueryDialect) currentVersionQuery() string {
+	return fmt.Sprintf("SELECT max(version_id) FROM %s WHERE is_applied", quotedTableName(b))
+}
+
+func (b BigQueryDialect) statusQuery(ctx context.Context, db dbConn) (*sql.Rows, error) {
+	rows, err := db.QueryContext(ctx, fmt.Sprintf("SELECT version_id, is_applied, %s FROM %s ORDER BY version_id DESC", tstampColumn(b), quotedTableName(b)))
+	if isBigQueryTableNotFound(err) {
+		return nil, tableDoesNotExist(err)
+	}
+	return rows, err
+}
+
+// BigQuery can't add a column that's NOT NULL, so versions applied
+// before it was added have a NULL checksum
+func (b BigQueryDialect) addChecksumColumnSql() string {
+	return fmt.Sprintf("ALTER TABLE %s ADD COLUMN checksum STRING", quotedTableName(b))
+}
+
+func (b BigQueryDialect) checksumQuery(ctx context.Context, db dbConn) (*sql.Rows, error) {
+	rows, err := db.QueryContext(ctx, fmt.Sprintf("SELECT version_id, is_applied, checksum FROM %s ORDER BY version_id DESC", quotedTableName(b)))
+	switch {
+	case isBigQueryTableNotFound(err):
+		return nil, tableDoesNotExist(err)
+	case err != nil && strings.Contains(err.Error(), "Unrecognized name: checksum"):
+		return nil, errNoChecksumColumn
+	}
+	return rows, err
+}
+
+// as with the checksum column, versions applied before the dirty
+// column was added have a NULL dirty flag
+func (b BigQueryDialect) addDirtyColumnSql() string {
+	return fmt.Sprintf("ALTER TABLE %s ADD COLUMN dirty BOOL", quotedTableName(b))
+}
+
+func (b BigQueryDialect) setDirtySql() string {
+	return fmt.Sprintf("UPDATE %s SET dirty = @p1 WHERE version_id = @p2", quotedTableName(b))
+}
+
+func (b BigQueryDialect) dirtyQuery(ctx context.Context, db dbConn) (*sql.Rows, error) {
+	rows, err := db.QueryContext(ctx, fmt.Sprintf("SELECT version_id, dirty FROM %s ORDER BY version_id DESC", quotedTableName(b)))
+	switch {
+	case isBigQueryTableNotFound(err):
+		return nil, tableDoesNotExist(err)
+	case err != nil && strings.Contains(err.Error(), "Unrecognized name: dirty"):
+		return nil, errNoDirtyColumn
+	}
+	return rows, err
+}
+
+// no bigquery driver is compiled into goose, so its API errors aren't
+// available; match on BigQuery's own message instead, e.g.
+// "Not found: Table my-project:app.goose_db_version was not found".
+func isBigQueryTableNotFound(err error) bool {
+	return err != nil && strings.Contains(err.Error(), "Not found: Table")
+}
+
+////////////////////////////
+// Trino
+////////////////////////////
+
+// TrinoDialect speaks the SQL of Trino, and of Presto, with the ?
+// placeholders the github.com/trinodb/trino-go-client driver takes.
+// The version table is created in the catalog and schema the connection
+// names, unless SetTableSchema names another schema. Trino rejects
+// statements ending in a semicolon, so none of these do.
+//
+// Connectors vary in the DDL they support, and few have transactions,
+// so SQL migrations run as though annotated 'NO TRANSACTION', and the
+// version table is made of plain columns, without defaults or NOT NULL
+// constraints. There are no auto-incrementing ids either, so it's
+// keyed by version_id, one row per version, which needs a connector
+// that can DELETE and UPDATE rows, such as Iceberg's.
+type TrinoDialect struct{}
+
+func (t TrinoDialect) noTxDDL() {}
+
+func (t TrinoDialect) quoteIdentifier(name string) string {
+	return quoteIdentifierSQL(name)
+}
+
+func (t TrinoDialect) createVersionTableSql() string {
+	return fmt.Sprintf(`CREATE TABLE %s (
+                version_id BIGINT,
+                is_applied BOOLEAN,
+                %s,
+                checksum VARCHAR,
+                dirty BOOLEAN
+            )`, quotedTableName(t), tstampColumnDef(t, "TIMESTAMP"))
+}
+
+// without column defaults, the time is given with every insert
+func (t TrinoDialect) insertVersionSql() string {
+	return fmt.Sprintf("INSERT INTO %s (version_id, is_applied, checksum, dirty, %s) VALUES (?, ?, ?, ?, localtimestamp)", quotedTableName(t), tstampColumn(t))
+}
+
+func (t TrinoDialect) deleteVersionSql() string {
+	return fmt.Sprintf("DELETE FROM %s WHERE version_id = ?", quotedTableName(t))
+}
+
+// the version table already has one row per version
+func (t TrinoDialect) compactVersionsSql() []string {
+	return []string{fmt.Sprintf("DELETE FROM %s WHERE NOT is_applied", quotedTableName(t))}
+}
+
+func (t TrinoDialect) dbVersionQuery(ctx context.Context, db dbConn) (*sql.Rows, error) {
+	rows, err := db.QueryContext(ctx, fmt.Sprintf("SELECT version_id, is_applied FROM %s ORDER BY version_id DESC", quotedTableName(t)))
+	if isTrinoTableNotFound(err) {
+		return nil, tableDoesNotExist(err)
+	}
+	return rows, err
+}
+
+// the version table already has one row per version
+func (t TrinoDialect) currentVersionQuery() string {
+	return fmt.Sprintf("SELECT max(version_id) FROM %s WHERE is_applied", quotedTableName(t))
+}
+
+func (t TrinoDialect) tableExistsQuery() string {
+	return t.namedTableExistsQuery(tableSchema, tableName)
+}
+
+func (t TrinoDialect) namedTableExistsQuery(schema, name string) string {
+	return informationSchemaTableExists("current_schema", schema, name)
+}
+
+func (t TrinoDialect) statusQuery(ctx context.Context, db dbConn) (*sql.Rows, error) {
+	rows, err := db.QueryContext(ctx, fmt.Sprintf("SELECT version_id, is_applied, %s FROM %s ORDER BY version_id DESC", tstampColumn(t), quotedTableName(t)))
+	if isTrinoTableNotFound(err) {
+		return nil, tableDoesNotExist(err)
+	}
+	return rows, err
+}
+
+// as with BigQuery, versions applied before the checksum column was
+// added have a NULL checksum
+func (t TrinoDialect) addChecksumColumnSql() string {
+	return fmt.Sprintf("ALTER TABLE %s ADD COLUMN checksum VARCHAR", quotedTableName(t))
+}
+
+func (t TrinoDialect) checksumQuery(ctx context.Context, db dbConn) (*sql.Rows, error) {
+	rows, err := db.QueryContext(ctx, fmt.Sprintf("SELECT version_id, is_applied, checksum FROM %s ORDER BY version_id DESC", quotedTableName(t)))
+	switch {
+	case isTrinoTableNotFound(err):
+		return nil, tableDoesNotExist(err)
+	case isTrinoColumnNotFound(err, "checksum"):
+		return nil, errNoChecksumColumn
+	}
+	return rows, err
+}
+
+func (t TrinoDialect) addDirtyColumnSql() string {
+	return fmt.Sprintf("ALTER TABLE %s ADD COLUMN dirty BOOLEAN", quotedTableName(t))
+}
+
+func (t TrinoDialect) setDirtySql() string {
+	return fmt.Sprintf("UPDATE %s SET dirty = ? WHERE version_id = ?", quotedTableName(t))
+}
+
+func (t TrinoDialect) dirtyQuery(ctx context.Context, db dbConn) (*sql.Rows, error) {
+	rows, err := db.QueryContext(ctx, fmt.Sprintf("SELECT version_id, dirty FROM %s ORDER BY version_id DESC", quotedTableName(t)))
+	switch {
+	case isTrinoTableNotFound(err):
+		return nil, tableDoesNotExist(err)
+	case isTrinoColumnNotFound(err, "dirty"):
+		return nil, errNoDirtyColumn
+	}
+	return rows, err
+}
+
+// the trino driver isn't compiled into goose, so its error type isn't
+// available; match on Trino's own message instead, e.g.
+// "line 1:37: Table 'iceberg.app.goose_db_version' does not exist".
+func isTrinoTableNotFound(err error) bool {
+	return err != nil && strings.Contains(err.Error(), "Table '") && strings.Contains(err.Error(), "' does not exist")
+}
+
+// e.g. "line 1:31: Column 'checksum' cannot be resolved"
+func isTrinoColumnNotFound(err error, column string) bool {
+	return err != nil && strings.Contains(err.Error(), "Column '"+column+"' cannot be resolved")
+}
@@ -0,0 +1,1178 @@
+package goose
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/kshvakov/clickhouse"
+	"github.com/lib/pq"
+)
+
+// pgconnError stands in for pgx's *pgconn.PgError, which goose
+// recognises by its SQLState method.
+type pgconnError struct {
+	Code string
+}
+
+func (e *pgconnError) Error() string    { return "ERROR (SQLSTATE " + e.Code + ")" }
+func (e *pgconnError) SQLState() string { return e.Code }
+
+func TestMissingTableDetection(t *testing.T) {
+
+	type testData struct {
+		name    string
+		check   func(error) bool
+		err     error
+		missing bool
+	}
+
+	tests := []testData{
+		{
+			name:    "postgres undefined_table",
+			check:   isPgUndefinedTable,
+			err:     &pq.Error{Code: "42P01"},
+			missing: true,
+		},
+		{
+			name:    "postgres invalid_password",
+			check:   isPgUndefinedTable,
+			err:     &pq.Error{Code: "28P01"},
+			missing: false,
+		},
+		{
+			name:    "postgres connection refused",
+			check:   isPgUndefinedTable,
+			err:     errors.New("dial tcp 127.0.0.1:5432: connect: connection refused"),
+			missing: false,
+		},
+		{
+			name:    "pgx undefined_table",
+			check:   isPgUndefinedTable,
+			err:     &pgconnError{Code: "42P01"},
+			missing: true,
+		},
+		{
+			name:    "pgx undefined_table, wrapped",
+			check:   isPgUndefinedTable,
+			err:     fmt.Errorf("query failed: %w", &pgconnError{Code: "42P01"}),
+			missing: true,
+		},
+		{
+			name:    "pgx invalid_password",
+			check:   isPgUndefinedTable,
+			err:     &pgconnError{Code: "28P01"},
+			missing: false,
+		},
+		{
+			name:    "mysql no such table",
+			check:   isMySqlNoSuchTable,
+			err:     &mysql.MySQLError{Number: 1146},
+			missing: true,
+		},
+		{
+			name:    "mysql no such table, wrapped",
+			check:   isMySqlNoSuchTable,
+			err:     fmt.Errorf("query failed: %w", &mysql.MySQLError{Number: 1146}),
+			missing: true,
+		},
+		{
+			name:    "mysql access denied",
+			check:   isMySqlNoSuchTable,
+			err:     &mysql.MySQLError{Number: 1045},
+			missing: false,
+		},
+		{
+			name:    "tidb no such table",
+			check:   isTiDBNoSuchTable,
+			err:     &mysql.MySQLError{Number: 1146},
+			missing: true,
+		},
+		{
+			name:    "tidb no such table, wrapped",
+			check:   isTiDBNoSuchTable,
+			err:     fmt.Errorf("query failed: %w", &mysql.MySQLError{Number: 1051}),
+			missing: true,
+		},
+		{
+			name:    "tidb unknown table, from another driver",
+			check:   isTiDBNoSuchTable,
+			err:     errors.New("[schema:1051]Unknown table 'goose_db_version'"),
+			missing: true,
+		},
+		{
+			name:    "tidb access denied",
+			check:   isTiDBNoSuchTable,
+			err:     &mysql.MySQLError{Number: 1045},
+			missing: false,
+		},
+		{
+			name:    "clickhouse unknown table",
+			check:   isClickHouseUnknownTable,
+			err:     &clickhouse.Exception{Code: 60},
+			missing: true,
+		},
+		{
+			name:    "clickhouse unknown table, wrapped",
+			check:   isClickHouseUnknownTable,
+			err:     fmt.Errorf("query failed: %w", &clickhouse.Exception{Code: 60}),
+			missing: true,
+		},
+		{
+			name:    "clickhouse authentication failed",
+			check:   isClickHouseUnknownTable,
+			err:     &clickhouse.Exception{Code: 516},
+			missing: false,
+		},
+	}
+
+	for _, test := range tests {
+		if r := test.check(test.err); r != test.missing {
+			t.Errorf("%s: incorrect missing table detection. got %v, want %v", test.name, r, test.missing)
+		}
+	}
+}
+
+func TestMissingColumnDetection(t *testing.T) {
+
+	type testData struct {
+		name    string
+		check   func(error) bool
+		err     error
+		missing bool
+	}
+
+	tests := []testData{
+		{
+			name:    "postgres undefined_column",
+			check:   isPgUndefinedColumn,
+			err:     &pq.Error{Code: "42703"},
+			missing: true,
+		},
+		{
+			name:    "postgres undefined_table",
+			check:   isPgUndefinedColumn,
+			err:     &pq.Error{Code: "42P01"},
+			missing: false,
+		},
+		{
+			name:    "pgx undefined_column",
+			check:   isPgUndefinedColumn,
+			err:     &pgconnError{Code: "42703"},
+			missing: true,
+		},
+		{
+			name:    "mysql bad field",
+			check:   isMySqlBadField,
+			err:     &mysql.MySQLError{Number: 1054},
+			missing: true,
+		},
+		{
+			name:    "mysql bad field, wrapped",
+			check:   isMySqlBadField,
+			err:     fmt.Errorf("query failed: %w", &mysql.MySQLError{Number: 1054}),
+			missing: true,
+		},
+		{
+			name:    "mysql no such table",
+			check:   isMySqlBadField,
+			err:     &mysql.MySQLError{Number: 1146},
+			missing: false,
+		},
+		{
+			name:    "clickhouse unknown identifier",
+			check:   isClickHouseUnknownColumn,
+			err:     &clickhouse.Exception{Code: 47},
+			missing: true,
+		},
+		{
+			name:    "clickhouse unknown identifier, wrapped",
+			check:   isClickHouseUnknownColumn,
+			err:     fmt.Errorf("query failed: %w", &clickhouse.Exception{Code: 47}),
+			missing: true,
+		},
+		{
+			name:    "clickhouse unknown table",
+			check:   isClickHouseUnknownColumn,
+			err:     &clickhouse.Exception{Code: 60},
+			missing: false,
+		},
+	}
+
+	for _, test := range tests {
+		if r := test.check(test.err); r != test.missing {
+			t.Errorf("%s: incorrect missing column detection. got %v, want %v", test.name, r, test.missing)
+		}
+	}
+}
+
+func TestRegisterDialect(t *testing.T) {
+
+	RegisterDialect("goosetest", fakeDialect{})
+	defer func() {
+		registeredDialects.Lock()
+		delete(registeredDialects.m, "goosetest")
+		registeredDialects.Unlock()
+	}()
+
+	d := dialectByName("goosetest")
+	if _, ok := d.(fakeDialect); !ok {
+		t.Fatalf("dialectByName returned %T, want the registered fakeDialect", d)
+	}
+
+	db, fdb := newFakeDB(t)
+	dir := writeMigrations(t, map[string]string{
+		"001_create.sql": "-- +goose Up\nCREATE TABLE post (id int);\n\n-- +goose Down\nDROP TABLE post;\n",
+		"002_alter.sql":  "-- +goose Up\nALTER TABLE post ADD title text;\n\n-- +goose Down\nALTER TABLE post DROP title;\n",
+	})
+
+	if err := RunMigrationsOnDb(newFakeConf(d), dir, 2, db); err != nil {
+		t.Fatal(err)
+	}
+
+	if got, want := fdb.appliedVersions(), []int64{1, 2}; !reflect.DeepEqual(got, want) {
+		t.Errorf("incorrect applied versions. got %v, want %v", got, want)
+	}
+
+	want := []string{"CREATE TABLE post (id int);", "ALTER TABLE post ADD title text;"}
+	if got := fdb.statements(); !reflect.DeepEqual(got, want) {
+		t.Errorf("incorrect statements. got %q, want %q", got, want)
+	}
+}
+
+func TestRegisterDialectOverridesBuiltin(t *testing.T) {
+
+	RegisterDialect("postgres", fakeDialect{})
+	defer func() {
+		registeredDialects.Lock()
+		delete(registeredDialects.m, "postgres")
+		registeredDialects.Unlock()
+	}()
+
+	if d := newDBDriver("postgres", "", "").Dialect; d != (fakeDialect{}) {
+		t.Errorf("postgres driver got dialect %T, want the registered fakeDialect", d)
+	}
+}
+
+func TestRegisterNilDialect(t *testing.T) {
+
+	defer func() {
+		if recover() == nil {
+			t.Error("registering a nil dialect did not panic")
+		}
+	}()
+
+	RegisterDialect("nil", nil)
+}
+
+func TestClickHouseCluster(t *testing.T) {
+
+	single := ClickHouseDialect{}.createVersionTableSql()
+	if strings.Contains(single, "ON CLUSTER") || !strings.Contains(single, "Engine = ReplacingMergeTree(") {
+		t.Errorf("single node version table should use a ReplacingMergeTree:\n%s", single)
+	}
+
+	clustered := ClickHouseDialect{Cluster: "prod"}.createVersionTableSql()
+	for _, want := range []string{"`goose_db_version` ON CLUSTER 'prod'", "Engine = ReplicatedReplacingMergeTree("} {
+		if !strings.Contains(clustered, want) {
+			t.Errorf("clustered version table missing %q:\n%s", want, clustered)
+		}
+	}
+}
+
+func TestClickHouseEngine(t *testing.T) {
+
+	tests := []struct {
+		dialect ClickHouseDialect
+		engine  string
+		date    bool // whether the table is partitioned by a date column
+	}{
+		{ClickHouseDialect{}, "Engine = ReplacingMergeTree(date, (version_id), 8192, tstamp)", true},
+		{ClickHouseDialect{Engine: "MergeTree"}, "Engine = MergeTree(date, (version_id), 8192)\n", true},
+		{ClickHouseDialect{Engine: "ReplicatedMergeTree", Cluster: "prod"}, "Engine = ReplicatedMergeTree('/clickhouse/tables/{shard}/goose_db_version', '{replica}', date, (version_id), 8192)\n", true},
+		{ClickHouseDialect{Engine: "TinyLog"}, "Engine = TinyLog\n", false},
+	}
+	for _, test := range tests {
+		create, err := createVersionTableSqlFor(newFakeConf(test.dialect))
+		if err != nil {
+			t.Errorf("%+v: %v", test.dialect, err)
+			continue
+		}
+		if !strings.Contains(create, test.engine) {
+			t.Errorf("%+v: version table doesn't use %q:\n%s", test.dialect, test.engine, create)
+		}
+		if got := strings.Contains(create, "date "); got != test.date {
+			t.Errorf("%+v: expected a date column %v, got:\n%s", test.dialect, test.date, create)
+		}
+	}
+
+	// a MergeTree's rows are removed and marked by mutations, waited for
+	for _, stmt := range []string{ClickHouseDialect{}.deleteVersionSql(), ClickHouseDialect{}.setDirtySql()} {
+		if !strings.HasSuffix(stmt, "SETTINGS mutations_sync = 2") {
+			t.Errorf("expected the mutation to be waited for, got %s", stmt)
+		}
+	}
+
+	// a Log engine has no mutations or merges, so rows record rollbacks
+	// and dirty marks, and ordering them needs precise timestamps
+	tiny := ClickHouseDialect{Engine: "TinyLog"}
+	if create := tiny.createVersionTableSql(); !strings.Contains(create, "tstamp DateTime64(6) default now64(6)") {
+		t.Errorf("expected precise timestamps for a TinyLog version table:\n%s", create)
+	}
+	for _, stmt := range []string{tiny.deleteVersionSql(), tiny.setDirtySql()} {
+		if !strings.HasPrefix(stmt, "INSERT INTO") {
+			t.Errorf("expected a TinyLog version table to be updated by inserts, got %s", stmt)
+		}
+	}
+	if stmts := tiny.compactVersionsSql(); len(stmts) != 0 {
+		t.Errorf("expected no compaction for a TinyLog version table, got %q", stmts)
+	}
+
+	for _, d := range []ClickHouseDialect{{Engine: "Memory; DROP TABLE post"}, {Engine: "TinyLog", Cluster: "prod"}} {
+		if _, err := createVersionTableSqlFor(newFakeConf(d)); err == nil {
+			t.Errorf("expected %+v to be refused", d)
+		}
+	}
+}
+
+func TestClickHouseReappliedMigration(t *testing.T) {
+
+	db, fdb := newFakeDB(t)
+	fdb.noTableErr = &clickhouse.Exception{Code: 60}
+	conf := newFakeConf(&ClickHouseDialect{})
+	dir := writeMigrations(t, map[string]string{
+		"001_create.sql": "-- +goose Up\nCREATE TABLE post (id Int64) Engine = Memory;\n\n-- +goose Down\nDROP TABLE post;\n",
+	})
+
+	// apply and roll back the same migration twice, then apply it again
+	for _, target := range []int64{1, 0, 1, 0, 1} {
+		if err := RunMigrationsOnDb(conf, dir, target, db); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	rows, err := conf.Driver.Dialect.dbVersionQuery(context.Background(), db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+
+	seen := map[int64]int{}
+	for rows.Next() {
+		var row MigrationRecord
+		if err := rows.Scan(&row.VersionId, &row.IsApplied); err != nil {
+			t.Fatal(err)
+		}
+		seen[row.VersionId]++
+	}
+
+	if want := map[int64]int{0: 1, 1: 1}; !reflect.DeepEqual(seen, want) {
+		t.Errorf("incorrect rows per version. got %v, want %v", seen, want)
+	}
+}
+
+// a Go migration script is handed its conf gob encoded, which needs
+// its dialect registered with gob
+func TestDialectsGobEncode(t *testing.T) {
+
+	for name, newDialect := range builtinDialects {
+		conf := DBConf{Driver: DBDriver{Name: name, Dialect: newDialect()}}
+		var bb bytes.Buffer
+		if err := gob.NewEncoder(&bb).Encode(&conf); err != nil {
+			t.Errorf("%s: %v", name, err)
+			continue
+		}
+		var got DBConf
+		if err := gob.NewDecoder(&bb).Decode(&got); err != nil {
+			t.Errorf("%s: %v", name, err)
+			continue
+		}
+		if want := reflect.ValueOf(conf.Driver.Dialect).Elem().Interface(); !reflect.DeepEqual(got.Driver.Dialect, want) {
+			t.Errorf("%s: incorrect dialect after a round trip. got %#v, want %#v", name, got.Driver.Dialect, want)
+		}
+	}
+}
+
+func TestDialectAliases(t *testing.T) {
+
+	for _, name := range []string{"postgres", "pgx"} {
+		if _, ok := dialectByName(name).(*PostgresDialect); !ok {
+			t.Errorf("dialectByName(%q) returned %T, want *PostgresDialect", name, dialectByName(name))
+		}
+	}
+}
+
+func TestQuotedTableName(t *testing.T) {
+
+	if err := SetTableName("MyMigrations"); err != nil {
+		t.Fatal(err)
+	}
+	defer SetTableName("goose_db_version")
+
+	type testData struct {
+		dialect SqlDialect
+		quoted  string
+	}
+
+	// Postgres and its derivatives fold the name, as they would unquoted
+	tests := []testData{
+		{dialect: PostgresDialect{}, quoted: `"mymigrations"`},
+		{dialect: MySqlDialect{}, quoted: "`MyMigrations`"},
+		{dialect: ClickHouseDialect{}, quoted: "`MyMigrations`"},
+		{dialect: Sqlite3Dialect{}, quoted: `"MyMigrations"`},
+		{dialect: CockroachDialect{}, quoted: `"mymigrations"`},
+		{dialect: YugabyteDialect{}, quoted: `"mymigrations"`},
+		{dialect: RedshiftDialect{}, quoted: `"mymigrations"`},
+	}
+
+	for _, test := range tests {
+		for _, query := range []string{test.dialect.createVersionTableSql(), test.dialect.insertVersionSql(), test.dialect.deleteVersionSql()} {
+			if !strings.Contains(query, test.quoted) {
+				t.Errorf("%T: table name not quoted as %s in %q", test.dialect, test.quoted, query)
+			}
+		}
+	}
+
+	if err := SetTableSchema("Ops"); err != nil {
+		t.Fatal(err)
+	}
+	defer SetTableSchema("")
+
+	if got, want := quotedTableName(PostgresDialect{}), `"ops"."mymigrations"`; got != want {
+		t.Errorf("incorrect qualified name. got %v, want %v", got, want)
+	}
+	if q := (PostgresDialect{}).tableExistsQuery(); !strings.Contains(q, "table_name = 'mymigrations' AND table_schema = 'ops'") {
+		t.Errorf("expected the folded name to be looked for, got %q", q)
+	}
+	if got, want := quotedTableName(MySqlDialect{}), "`Ops`.`MyMigrations`"; got != want {
+		t.Errorf("incorrect qualified name. got %v, want %v", got, want)
+	}
+}
+
+func TestMySqlLockName(t *testing.T) {
+
+	if got := mysqlLockName("goose_db_version"); got != "goose_db_version" {
+		t.Errorf("expected a short name to be kept, got %q", got)
+	}
+
+	// a schema and table of 63 characters each
+	long := strings.Repeat("s", 63) + "." + strings.Repeat("t", 63)
+	other := strings.Repeat("s", 63) + "." + strings.Repeat("t", 62) + "u"
+	a, b := mysqlLockName(long), mysqlLockName(other)
+	if len(a) > 64 || len(b) > 64 {
+		t.Errorf("expected names of at most 64 characters, got %q and %q", a, b)
+	}
+	if a == b {
+		t.Errorf("expected different tables to keep different locks, both got %q", a)
+	}
+	if !strings.HasPrefix(a, strings.Repeat("s", 40)) {
+		t.Errorf("expected the name to keep its beginning, got %q", a)
+	}
+
+	d := MySqlDialect{}
+	if lock, unlock := d.lockSql(long, 0), d.unlockSql(long); !strings.Contains(lock, "'"+a+"'") || !strings.Contains(unlock, "'"+a+"'") {
+		t.Errorf("expected the lock to be taken and released by %q, got %s and %s", a, lock, unlock)
+	}
+}
+
+// scriptedConn records the queries a dialect issues through it, and
+// fails them with errs in turn, before passing the rest on to the
+// dbConn it wraps.
+type scriptedConn struct {
+	dbConn
+	errs    []error
+	queries []string
+}
+
+func (c *scriptedConn) QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error) {
+	c.queries = append(c.queries, query)
+	if len(c.errs) > 0 {
+		err := c.errs[0]
+		c.errs = c.errs[1:]
+		return nil, err
+	}
+	return c.dbConn.QueryContext(ctx, query, args...)
+}
+
+func TestSqlite3Dialect(t *testing.T) {
+
+	for _, name := range []string{"sqlite3", "sqlite"} {
+		if _, ok := dialectByName(name).(*Sqlite3Dialect); !ok {
+			t.Errorf("dialectByName(%q) returned %T, want *Sqlite3Dialect", name, dialectByName(name))
+		}
+	}
+
+	d := Sqlite3Dialect{}
+	create := d.createVersionTableSql()
+	for _, want := range []string{"id INTEGER PRIMARY KEY AUTOINCREMENT", "version_id INTEGER NOT NULL", "DEFAULT CURRENT_TIMESTAMP"} {
+		if !strings.Contains(create, want) {
+			t.Errorf("version table missing %q:\n%s", want, create)
+		}
+	}
+	if strings.Contains(create, "now()") || strings.Contains(create, "serial") {
+		t.Errorf("SQLite has neither now() nor serial:\n%s", create)
+	}
+	if !strings.Contains(d.insertVersionSql(), "VALUES (?, ?, ?, ?)") {
+		t.Errorf("insert should use ? placeholders: %q", d.insertVersionSql())
+	}
+
+	db, fdb := newFakeDB(t)
+	fdb.versions = []fakeVersionRow{}
+	conn := &scriptedConn{dbConn: db}
+	rows, err := d.dbVersionQuery(context.Background(), conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rows.Close()
+	if len(conn.queries) != 1 || !strings.HasPrefix(conn.queries[0], "SELECT version_id, is_applied from") || !strings.HasSuffix(conn.queries[0], "ORDER BY id DESC") {
+		t.Errorf("incorrect version query %q", conn.queries)
+	}
+
+	// the driver isn't compiled in, so a missing table is told by its message
+	conn = &scriptedConn{dbConn: db, errs: []error{errors.New("no such table: goose_db_version")}}
+	if _, err := d.dbVersionQuery(context.Background(), conn); !errors.Is(err, ErrTableDoesNotExist) {
+		t.Errorf("expected ErrTableDoesNotExist, got %v", err)
+	}
+}
+
+func TestCockroachDialect(t *testing.T) {
+
+	for _, name := range []string{"cockroach", "crdb"} {
+		if _, ok := dialectByName(name).(*CockroachDialect); !ok {
+			t.Errorf("dialectByName(%q) returned %T, want *CockroachDialect", name, dialectByName(name))
+		}
+	}
+
+	d := CockroachDialect{}
+	create := d.createVersionTableSql()
+	for _, want := range []string{"id SERIAL NOT NULL", "TIMESTAMPTZ NULL DEFAULT now()"} {
+		if !strings.Contains(create, want) {
+			t.Errorf("version table missing %q:\n%s", want, create)
+		}
+	}
+	if !strings.Contains(d.insertVersionSql(), "VALUES ($1, $2, $3, $4)") {
+		t.Errorf("insert should use $n placeholders: %q", d.insertVersionSql())
+	}
+
+	// the version query is issued again after a serialization failure, a
+	// few times at most, and not after any other error
+	db, fdb := newFakeDB(t)
+	fdb.versions = []fakeVersionRow{}
+	retry := &pq.Error{Code: "40001"}
+	tests := []struct {
+		name    string
+		errs    []error
+		queries int
+		code    string // the SQLSTATE of the error the query fails with
+	}{
+		{"succeeds first time", nil, 1, ""},
+		{"succeeds once retried", []error{retry, retry}, 3, ""},
+		{"gives up", []error{retry, retry, retry, retry}, cockroachMaxAttempts, "40001"},
+		{"isn't retryable", []error{&pq.Error{Code: "23505"}}, 1, "23505"},
+		{"pgx's error, wrapped", []error{fmt.Errorf("query: %w", &pgconnError{Code: "40001"})}, 2, ""},
+	}
+	for _, tt := range tests {
+		conn := &scriptedConn{dbConn: db, errs: tt.errs}
+		rows, err := d.dbVersionQuery(context.Background(), conn)
+		if err == nil {
+			rows.Close()
+		}
+		if got := pgErrorCode(err); got != tt.code || tt.code == "" && err != nil {
+			t.Errorf("%s: incorrect error. got %v (SQLSTATE %q), want SQLSTATE %q", tt.name, err, got, tt.code)
+		}
+		if len(conn.queries) != tt.queries {
+			t.Errorf("%s: the version query was issued %d times, want %d", tt.name, len(conn.queries), tt.queries)
+		}
+	}
+
+	conn := &scriptedConn{dbConn: db, errs: []error{&pq.Error{Code: "42P01"}}}
+	if _, err := d.dbVersionQuery(context.Background(), conn); !errors.Is(err, ErrTableDoesNotExist) {
+		t.Errorf("expected ErrTableDoesNotExist, got %v", err)
+	}
+}
+
+// pgLockingDialect is a fakeDialect taking Postgres' advisory lock.
+type pgLockingDialect struct{ fakeDialect }
+
+func (pgLockingDialect) lockSql(name string, timeout time.Duration) string {
+	return PostgresDialect{}.lockSql(name, timeout)
+}
+
+func (pgLockingDialect) unlockSql(name string) string {
+	return PostgresDialect{}.unlockSql(name)
+}
+
+func TestPostgresAdvisoryLock(t *testing.T) {
+
+	// the lock is keyed by the version table's name, so migrators of
+	// different tables don't contend
+	d := PostgresDialect{}
+	keys := map[int64]string{}
+	for _, name := range []string{"goose_db_version", "app.goose_db_version", "other_versions"} {
+		key := lockKey(name)
+		if other, ok := keys[key]; ok {
+			t.Errorf("%q and %q share the lock key %d", name, other, key)
+		}
+		keys[key] = name
+		if got, want := d.lockSql(name, 0), fmt.Sprintf("pg_advisory_lock(%d)", key); !strings.Contains(got, want) {
+			t.Errorf("lock for %q is %q, want it to contain %q", name, got, want)
+		}
+		if got, want := d.unlockSql(name), fmt.Sprintf("SELECT pg_advisory_unlock(%d)", key); got != want {
+			t.Errorf("unlock for %q is %q, want %q", name, got, want)
+		}
+	}
+
+	// and is taken once, held while each migration runs, and released
+	db, fdb := newFakeDB(t)
+	conf := newFakeConf(pgLockingDialect{})
+	conf.Options.Lock = true
+	var held []bool
+	conf.Options.BeforeEach = func(m *Migration) { held = append(held, fdb.lockHeld()) }
+	dir := writeMigrations(t, map[string]string{
+		"001_a.sql": "-- +goose Up\nCREATE TABLE a (id int);\n",
+		"002_b.sql": "-- +goose Up\nCREATE TABLE b (id int);\n",
+	})
+	if err := RunMigrationsOnDb(conf, dir, 2, db); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(held, []bool{true, true}) {
+		t.Errorf("lock held while each migration ran: %v, want it held throughout", held)
+	}
+	name := qualifiedTableName()
+	if want := []string{d.lockSql(name, 0), d.unlockSql(name)}; !reflect.DeepEqual(fdb.lockStmts, want) {
+		t.Errorf("incorrect lock statements.\ngot  %q\nwant %q", fdb.lockStmts, want)
+	}
+	if fdb.lockHeld() {
+		t.Error("lock still held after the run")
+	}
+}
+
+func TestDeleteVersionSql(t *testing.T) {
+
+	// a rollback deletes the version's rows, with the dialect's placeholder
+	tests := []struct {
+		d           SqlDialect
+		placeholder string
+	}{
+		{PostgresDialect{}, "$1"},
+		{MySqlDialect{}, "?"},
+		{Sqlite3Dialect{}, "?"},
+		{CockroachDialect{}, "$1"},
+	}
+	for _, tt := range tests {
+		want := fmt.Sprintf("DELETE FROM %s WHERE version_id = %s;", quotedTableName(tt.d), tt.placeholder)
+		if got := tt.d.deleteVersionSql(); got != want {
+			t.Errorf("%T: incorrect delete. got %q, want %q", tt.d, got, want)
+		}
+	}
+
+	// so the version table holds exactly the applied versions
+	db, fdb := newFakeDB(t)
+	conf := newFakeConf(fakeDialect{})
+	dir := writeMigrations(t, map[string]string{
+		"001_a.sql": "-- +goose Up\nCREATE TABLE a (id int);\n-- +goose Down\nDROP TABLE a;\n",
+		"002_b.sql": "-- +goose Up\nCREATE TABLE b (id int);\n-- +goose Down\nDROP TABLE b;\n",
+	})
+	if err := RunMigrationsOnDb(conf, dir, 2, db); err != nil {
+		t.Fatal(err)
+	}
+	if err := RunMigrationsOnDb(conf, dir, 1, db); err != nil {
+		t.Fatal(err)
+	}
+	for _, r := range fdb.versions {
+		if r.args[0] == int64(2) {
+			t.Errorf("version 2 still has a row after its rollback: %v", r.args)
+		}
+	}
+	if got, want := fdb.appliedVersions(), []int64{1}; !reflect.DeepEqual(got, want) {
+		t.Errorf("incorrect applied versions. got %v, want %v", got, want)
+	}
+}
+
+func TestMariaDBDialect(t *testing.T) {
+
+	d, ok := dialectByName("mariadb").(*MariaDBDialect)
+	if !ok {
+		t.Fatalf("dialectByName(\"mariadb\") returned %T, want *MariaDBDialect", dialectByName("mariadb"))
+	}
+
+	create := d.createVersionTableSql()
+	for _, want := range []string{"AUTO_INCREMENT PRIMARY KEY", "DEFAULT CURRENT_TIMESTAMP"} {
+		if !strings.Contains(create, want) {
+			t.Errorf("version table missing %q:\n%s", want, create)
+		}
+	}
+	if strings.Contains(create, "serial") || strings.Contains(create, "now()") {
+		t.Errorf("version table should use neither serial nor now():\n%s", create)
+	}
+
+	// everything else is MySQL's
+	if got, want := d.insertVersionSql(), (MySqlDialect{}).insertVersionSql(); got != want {
+		t.Errorf("incorrect insert. got %q, want %q", got, want)
+	}
+	if !strings.Contains(d.insertVersionSql(), "VALUES (?, ?, ?, ?)") {
+		t.Errorf("insert should use ? placeholders: %q", d.insertVersionSql())
+	}
+}
+
+func TestRedshiftDialect(t *testing.T) {
+
+	d, ok := dialectByName("redshift").(*RedshiftDialect)
+	if !ok {
+		t.Fatalf("dialectByName(\"redshift\") returned %T, want *RedshiftDialect", dialectByName("redshift"))
+	}
+
+	create := d.createVersionTableSql()
+	for _, want := range []string{"BIGINT IDENTITY(1,1)", "DEFAULT SYSDATE"} {
+		if !strings.Contains(create, want) {
+			t.Errorf("version table missing %q:\n%s", want, create)
+		}
+	}
+	if !strings.Contains(d.insertVersionSql(), "VALUES ($1, $2, $3, $4)") {
+		t.Errorf("insert should use $n placeholders: %q", d.insertVersionSql())
+	}
+
+	// Redshift has no advisory locks
+	if _, ok := SqlDialect(d).(sqlLocker); ok {
+		t.Error("RedshiftDialect shouldn't claim to support locking")
+	}
+}
+
+func TestTiDBDialect(t *testing.T) {
+
+	d, ok := dialectByName("tidb").(*TiDBDialect)
+	if !ok {
+		t.Fatalf("dialectByName(\"tidb\") returned %T, want *TiDBDialect", dialectByName("tidb"))
+	}
+	if create := d.createVersionTableSql(); !strings.Contains(create, "AUTO_ID_CACHE 1") {
+		t.Errorf("version table should disable the auto-increment cache:\n%s", create)
+	}
+	if got, want := d.insertVersionSql(), (MySqlDialect{}).insertVersionSql(); got != want {
+		t.Errorf("incorrect insert. got %q, want %q", got, want)
+	}
+}
+
+func TestSpannerDialect(t *testing.T) {
+
+	d, ok := dialectByName("spanner").(*SpannerDialect)
+	if !ok {
+		t.Fatalf("dialectByName(\"spanner\") returned %T, want *SpannerDialect", dialectByName("spanner"))
+	}
+
+	create := d.createVersionTableSql()
+	for _, want := range []string{"INT64", "BOOL", "TIMESTAMP", "PRIMARY KEY (version_id)"} {
+		if !strings.Contains(create, want) {
+			t.Errorf("version table missing %q:\n%s", want, create)
+		}
+	}
+	if strings.Contains(create, "AUTO_INCREMENT") {
+		t.Errorf("Spanner has no AUTO_INCREMENT:\n%s", create)
+	}
+	if !strings.Contains(d.insertVersionSql(), "VALUES (@p1, @p2, @p3,") {
+		t.Errorf("insert should use @pn parameters: %q", d.insertVersionSql())
+	}
+
+	if _, ok := SqlDialect(d).(sqlNoTxDDL); !ok {
+		t.Error("SpannerDialect should run DDL outside of transactions")
+	}
+	if _, ok := SqlDialect(d).(sqlLocker); ok {
+		t.Error("SpannerDialect shouldn't claim to support locking")
+	}
+}
+
+func TestVerticaDialect(t *testing.T) {
+
+	d, ok := dialectByName("vertica").(*VerticaDialect)
+	if !ok {
+		t.Fatalf("dialectByName(\"vertica\") returned %T, want *VerticaDialect", dialectByName("vertica"))
+	}
+
+	create := d.createVersionTableSql()
+	for _, want := range []string{"AUTO_INCREMENT", "is_applied BOOLEAN NOT NULL"} {
+		if !strings.Contains(create, want) {
+			t.Errorf("version table missing %q:\n%s", want, create)
+		}
+	}
+	if !strings.Contains(d.insertVersionSql(), "VALUES (?, ?, ?, ?)") {
+		t.Errorf("insert should use ? placeholders: %q", d.insertVersionSql())
+	}
+
+	missing := errors.New(`Error: [42V01] Relation "goose_db_version" does not exist`)
+	if !isVerticaError(missing, "42V01") || isVerticaError(missing, "42703") || isVerticaError(nil, "42V01") {
+		t.Errorf("incorrect SQLSTATE matching of %q", missing)
+	}
+}
+
+func TestOracleDialect(t *testing.T) {
+
+	for _, name := range []string{"oracle", "godror"} {
+		if _, ok := dialectByName(name).(*OracleDialect); !ok {
+			t.Errorf("dialectByName(%q) returned %T, want *OracleDialect", name, dialectByName(name))
+		}
+	}
+
+	d := OracleDialect{}
+	create := d.createVersionTableSql()
+	for _, want := range []string{"GENERATED BY DEFAULT AS IDENTITY", "is_applied NUMBER(1)", "DEFAULT SYSTIMESTAMP"} {
+		if !strings.Contains(create, want) {
+			t.Errorf("version table missing %q:\n%s", want, create)
+		}
+	}
+	if !strings.Contains(d.insertVersionSql(), "VALUES (:1, :2, :3, :4)") {
+		t.Errorf("insert should use :n placeholders: %q", d.insertVersionSql())
+	}
+
+	// Oracle rejects a trailing semicolon
+	stmts := append([]string{create, d.insertVersionSql(), d.deleteVersionSql(), d.addChecksumColumnSql()}, d.compactVersionsSql()...)
+	for _, stmt := range stmts {
+		if strings.HasSuffix(strings.TrimSpace(stmt), ";") {
+			t.Errorf("statement ends with a semicolon: %q", stmt)
+		}
+	}
+
+	missing := errors.New("ORA-00942: table or view does not exist")
+	if !isOracleError(missing, "ORA-00942") || isOracleError(missing, "ORA-00904") {
+		t.Errorf("incorrect error matching of %q", missing)
+	}
+}
+
+func TestYugabyteDialect(t *testing.T) {
+
+	for _, name := range []string{"yugabyte", "ysql"} {
+		if _, ok := dialectByName(name).(*YugabyteDialect); !ok {
+			t.Errorf("dialectByName(%q) returned %T, want *YugabyteDialect", name, dialectByName(name))
+		}
+	}
+
+	d := YugabyteDialect{}
+	if !strings.Contains(d.insertVersionSql(), "VALUES ($1, $2, $3, $4)") {
+		t.Errorf("insert should use $n placeholders: %q", d.insertVersionSql())
+	}
+	if _, ok := SqlDialect(d).(sqlLocker); ok {
+		t.Error("YugabyteDB doesn't support advisory locks")
+	}
+
+	tests := []struct {
+		err  error
+		want bool
+	}{
+		{&pq.Error{Code: "40001"}, true},
+		{fmt.Errorf("migration 1: %w", &pq.Error{Code: "40001"}), true},
+		{&pq.Error{Code: "23505"}, false},
+		{errors.New("connection refused"), false},
+	}
+	for _, tt := range tests {
+		if got := d.retryable(tt.err); got != tt.want {
+			t.Errorf("retryable(%v) = %v, want %v", tt.err, got, tt.want)
+		}
+	}
+}
+
+func TestBigQueryDialect(t *testing.T) {
+
+	d, ok := dialectByName("bigquery").(*BigQueryDialect)
+	if !ok {
+		t.Fatalf("dialectByName(\"bigquery\") returned %T, want *BigQueryDialect", dialectByName("bigquery"))
+	}
+	if _, ok := SqlDialect(d).(sqlNoTxDDL); !ok {
+		t.Error("BigQuery migrations should run outside of a transaction")
+	}
+
+	defer SetTableSchema("")
+	if err := SetTableSchema("app"); err != nil {
+		t.Fatal(err)
+	}
+
+	create := d.createVersionTableSql()
+	for _, want := range []string{"CREATE TABLE `app`.`goose_db_version`", "version_id INT64 NOT NULL", "is_applied BOOL NOT NULL", "tstamp TIMESTAMP", "PRIMARY KEY (version_id) NOT ENFORCED"} {
+		if !strings.Contains(create, want) {
+			t.Errorf("version table missing %q:\n%s", want, create)
+		}
+	}
+	if strings.Contains(create, " id ") {
+		t.Errorf("version table shouldn't have an id column:\n%s", create)
+	}
+	if !strings.Contains(d.insertVersionSql(), "VALUES (@p1, @p2, @p3, @p4)") {
+		t.Errorf("insert should use @pN parameters: %q", d.insertVersionSql())
+	}
+
+	missing := errors.New("googleapi: Error 404: Not found: Table my-project:app.goose_db_version was not found in location US, notFound")
+	if !isBigQueryTableNotFound(missing) || isBigQueryTableNotFound(errors.New("Not found: Dataset my-project:app")) || isBigQueryTableNotFound(nil) {
+		t.Errorf("incorrect error matching of %q", missing)
+	}
+}
+
+func TestTrinoDialect(t *testing.T) {
+
+	for _, name := range []string{"trino", "presto"} {
+		if _, ok := dialectByName(name).(*TrinoDialect); !ok {
+			t.Errorf("dialectByName(%q) returned %T, want *TrinoDialect", name, dialectByName(name))
+		}
+	}
+
+	d := TrinoDialect{}
+	if _, ok := SqlDialect(d).(sqlNoTxDDL); !ok {
+		t.Error("Trino migrations should run outside of a transaction")
+	}
+	if _, ok := SqlDialect(d).(sqlLocker); ok {
+		t.Error("Trino has no locks")
+	}
+
+	create := d.createVersionTableSql()
+	for _, want := range []string{"version_id BIGINT", "is_applied BOOLEAN", "tstamp TIMESTAMP"} {
+		if !strings.Contains(create, want) {
+			t.Errorf("version table missing %q:\n%s", want, create)
+		}
+	}
+	for _, unsupported := range []string{" id ", "DEFAULT", "NOT NULL"} {
+		if strings.Contains(create, unsupported) {
+			t.Errorf("version table shouldn't use %q:\n%s", unsupported, create)
+		}
+	}
+	if !strings.Contains(d.insertVersionSql(), "VALUES (?, ?, ?, ?, localtimestamp)") {
+		t.Errorf("insert should use ? placeholders: %q", d.insertVersionSql())
+	}
+
+	// Trino rejects a trailing semicolon
+	stmts := append([]string{create, d.insertVersionSql(), d.deleteVersionSql(), d.addChecksumColumnSql(), d.addDirtyColumnSql(), d.setDirtySql()}, d.compactVersionsSql()...)
+	for _, stmt := range stmts {
+		if strings.HasSuffix(strings.TrimSpace(stmt), ";") {
+			t.Errorf("statement ends with a semicolon: %q", stmt)
+		}
+	}
+
+	missing := errors.New(`trino: query failed (200 OK): "io.trino.spi.TrinoException: line 1:37: Table 'iceberg.app.goose_db_version' does not exist"`)
+	if !isTrinoTableNotFound(missing) || isTrinoTableNotFound(errors.New("line 1:15: Schema 'app' does not exist")) || isTrinoTableNotFound(nil) {
+		t.Errorf("incorrect error matching of %q", missing)
+	}
+	if noColumn := errors.New("line 1:31: Column 'checksum' cannot be resolved"); !isTrinoColumnNotFound(noColumn, "checksum") || isTrinoColumnNotFound(noColumn, "dirty") {
+		t.Errorf("incorrect error matching of %q", noColumn)
+	}
+}
+
+func TestDuckDBDialect(t *testing.T) {
+
+	d, ok := dialectByName("duckdb").(*DuckDBDialect)
+	if !ok {
+		t.Fatalf("dialectByName(\"duckdb\") returned %T, want *DuckDBDialect", dialectByName("duckdb"))
+	}
+
+	create := d.createVersionTableSql()
+	for _, want := range []string{"CREATE SEQUENCE goose_db_version_id_seq;", "DEFAULT nextval('goose_db_version_id_seq')", "version_id BIGINT NOT NULL", "is_applied BOOLEAN NOT NULL"} {
+		if !strings.Contains(create, want) {
+			t.Errorf("version table missing %q:\n%s", want, create)
+		}
+	}
+	if !strings.Contains(d.insertVersionSql(), "VALUES (?, ?, ?, ?)") {
+		t.Errorf("insert should use ? placeholders: %q", d.insertVersionSql())
+	}
+
+	missing := errors.New("Catalog Error: Table with name goose_db_version does not exist!\nDid you mean \"pg_version\"?")
+	if !isDuckDBMissingTable(missing) || isDuckDBMissingTable(errors.New("Catalog Error: Sequence with name x does not exist!")) || isDuckDBMissingTable(nil) {
+		t.Errorf("incorrect error matching of %q", missing)
+	}
+}
+
+func TestDialectTableExistsQuery(t *testing.T) {
+	defer SetTableSchema("")
+
+	tests := []struct {
+		dialect SqlDialect
+		schema  string
+		want    string
+	}{
+		{PostgresDialect{}, "", "SELECT count(*) FROM information_schema.tables WHERE table_name = 'goose_db_version' AND table_schema = ANY (current_schemas(false))"},
+		{PostgresDialect{}, "app", "SELECT count(*) FROM information_schema.tables WHERE table_name = 'goose_db_version' AND table_schema = 'app'"},
+		{MySqlDialect{}, "", "SELECT count(*) FROM information_schema.tables WHERE table_name = 'goose_db_version' AND table_schema = DATABASE()"},
+		{TiDBDialect{}, "app", "SELECT count(*) FROM information_schema.tables WHERE table_name = 'goose_db_version' AND table_schema = 'app'"},
+		{ClickHouseDialect{}, "", "SELECT count() FROM system.tables WHERE name = 'goose_db_version' AND database = currentDatabase()"},
+		{Sqlite3Dialect{}, "", "SELECT count(*) FROM sqlite_master WHERE type = 'table' AND name = 'goose_db_version'"},
+		{Sqlite3Dialect{}, "aux", `SELECT count(*) FROM "aux".sqlite_master WHERE type = 'table' AND name = 'goose_db_version'`},
+		{CockroachDialect{}, "", "SELECT count(*) FROM information_schema.tables WHERE table_name = 'goose_db_version' AND table_schema = ANY (current_schemas(false))"},
+	}
+	for _, tt := range tests {
+		if err := SetTableSchema(tt.schema); err != nil {
+			t.Fatal(err)
+		}
+		if got := tt.dialect.(sqlTableChecker).tableExistsQuery(); got != tt.want {
+			t.Errorf("%T with schema %q:\ngot  %s\nwant %s", tt.dialect, tt.schema, got, tt.want)
+		}
+	}
+}
+
+func TestExtraColumnsSql(t *testing.T) {
+
+	conf := newFakeConf(nil)
+	conf.Options.ExtraColumns = []VersionColumn{{Name: "applied_by", Type: "text"}, {Name: "host", Type: "text"}}
+	conf.uniqueVersions = true
+
+	inserts := map[string]string{
+		"postgres":   `INSERT INTO "goose_db_version" (version_id, is_applied, checksum, dirty, "applied_by", "host") VALUES ($1, $2, $3, $4, $5, $6) ON CONFLICT (version_id) DO NOTHING;`,
+		"mysql":      "INSERT INTO `goose_db_version` (version_id, is_applied, checksum, dirty, `applied_by`, `host`) VALUES (?, ?, ?, ?, ?, ?) ON DUPLICATE KEY UPDATE version_id = version_id;",
+		"spanner":    "INSERT INTO `goose_db_version` (version_id, is_applied, checksum, dirty, tstamp, `applied_by`, `host`) VALUES (@p1, @p2, @p3, @p4, PENDING_COMMIT_TIMESTAMP(), @p5, @p6)",
+		"oracle":     `INSERT INTO "goose_db_version" (version_id, is_applied, checksum, dirty, "applied_by", "host") VALUES (:1, :2, :3, :4, :5, :6)`,
+		"clickhouse": "INSERT INTO `goose_db_version` (version_id, is_applied, checksum, dirty, `applied_by`, `host`) VALUES (?, ?, ?, ?, ?, ?)",
+		"trino":      `INSERT INTO "goose_db_version" (version_id, is_applied, checksum, dirty, tstamp, "applied_by", "host") VALUES (?, ?, ?, ?, localtimestamp, ?, ?)`,
+	}
+	for _, name := range []string{"postgres", "mysql", "mariadb", "tidb", "clickhouse", "sqlite3", "cockroach", "yugabyte",
+		"redshift", "spanner", "vertica", "oracle", "duckdb", "bigquery", "trino"} {
+		conf.Driver.Dialect = dialectByName(name)
+
+		create, err := createVersionTableSqlFor(conf)
+		if err != nil {
+			t.Errorf("%s: %v", name, err)
+			continue
+		}
+		if !strings.Contains(create, "applied_by") || strings.Contains(create, ",,") {
+			t.Errorf("%s: extra columns not added to the version table:\n%s", name, create)
+		}
+
+		insert, err := insertVersionSqlFor(conf)
+		if err != nil {
+			t.Errorf("%s: %v", name, err)
+			continue
+		}
+		if want, ok := inserts[name]; ok && insert != want {
+			t.Errorf("%s: incorrect insert.\ngot  %s\nwant %s", name, insert, want)
+		}
+	}
+}
+
+func TestTimestampColumn(t *testing.T) {
+
+	defaults := make(map[string]string)
+	names := []string{"postgres", "mysql", "mariadb", "tidb", "clickhouse", "sqlite3", "cockroach", "yugabyte",
+		"redshift", "spanner", "vertica", "oracle", "duckdb", "bigquery", "trino"}
+	for _, name := range names {
+		defaults[name] = dialectByName(name).createVersionTableSql()
+	}
+
+	if err := SetTimestampColumn(TimestampColumn{Name: "created_at", Type: "timestamptz NOT NULL default now()"}); err != nil {
+		t.Fatal(err)
+	}
+	defer SetTimestampColumn(TimestampColumn{})
+
+	for _, name := range names {
+		d := dialectByName(name)
+		create := d.createVersionTableSql()
+		if want := d.quoteIdentifier("created_at") + " timestamptz NOT NULL default now()"; !strings.Contains(create, want) {
+			t.Errorf("%s: timestamp column not created as %s:\n%s", name, want, create)
+		}
+		if strings.Contains(create, "tstamp") {
+			t.Errorf("%s: tstamp still created:\n%s", name, create)
+		}
+	}
+
+	if got, want := (SpannerDialect{}).insertVersionSql(), "INSERT INTO `goose_db_version` (version_id, is_applied, checksum, dirty, `created_at`) VALUES (@p1, @p2, @p3, @p4, PENDING_COMMIT_TIMESTAMP())"; got != want {
+		t.Errorf("incorrect spanner insert.\ngot  %s\nwant %s", got, want)
+	}
+	if got, want := (ClickHouseDialect{}).currentVersionQuery(), "SELECT max(version_id) FROM (SELECT version_id, argMax(is_applied, `created_at`) AS applied FROM `goose_db_version` GROUP BY version_id) WHERE applied = 1"; got != want {
+		t.Errorf("incorrect clickhouse query.\ngot  %s\nwant %s", got, want)
+	}
+	if create := (ClickHouseDialect{}).createVersionTableSql(); !strings.Contains(create, "ReplacingMergeTree(date, (version_id), 8192, `created_at`)") {
+		t.Errorf("clickhouse table not versioned by the timestamp column:\n%s", create)
+	}
+
+	if err := checkExtraColumns([]VersionColumn{{Name: "created_at", Type: "text"}}); err == nil {
+		t.Error("expected an extra column named after the timestamp column to be rejected")
+	}
+	for _, c := range []TimestampColumn{{Name: "version_id"}, {Name: "created at"}} {
+		if err := SetTimestampColumn(c); err == nil {
+			t.Errorf("expected timestamp column %q to be rejected", c.Name)
+		}
+	}
+
+	SetTimestampColumn(TimestampColumn{})
+	for _, name := range names {
+		if got := dialectByName(name).createVersionTableSql(); got != defaults[name] {
+			t.Errorf("%s: version table not restored to its default:\n%s", name, got)
+		}
+	}
+}
+
+func TestDialectCurrentVersionQuery(t *testing.T) {
+
+	tests := []struct {
+		dialect SqlDialect
+		want    string
+	}{
+		{PostgresDialect{}, `SELECT max(v.version_id) FROM "goose_db_version" v WHERE v.is_applied AND NOT EXISTS (SELECT 1 FROM "goose_db_version" r WHERE r.version_id = v.version_id AND r.id > v.id)`},
+		{TiDBDialect{}, "SELECT max(v.version_id) FROM `goose_db_version` v WHERE v.is_applied AND NOT EXISTS (SELECT 1 FROM `goose_db_version` r WHERE r.version_id = v.version_id AND r.id > v.id)"},
+		{OracleDialect{}, `SELECT max(v.version_id) FROM "goose_db_version" v WHERE v.is_applied = 1 AND NOT EXISTS (SELECT 1 FROM "goose_db_version" r WHERE r.version_id = v.version_id AND r.id > v.id)`},
+		{ClickHouseDialect{}, "SELECT max(version_id) FROM (SELECT version_id, argMax(is_applied, tstamp) AS applied FROM `goose_db_version` GROUP BY version_id) WHERE applied = 1"},
+		{SpannerDialect{}, "SELECT max(version_id) FROM `goose_db_version` WHERE is_applied"},
+	}
+	for _, tt := range tests {
+		if got := tt.dialect.(sqlCurrentVersioner).currentVersionQuery(); got != tt.want {
+			t.Errorf("%T:\ngot  %s\nwant %s", tt.dialect, got, tt.want)
+		}
+	}
+
+	for _, name := range []string{"postgres", "mysql", "mariadb", "tidb", "clickhouse", "sqlite3", "cockroach", "yugabyte",
+		"redshift", "spanner", "vertica", "oracle", "duckdb", "bigquery", "trino"} {
+		if _, ok := dialectByName(name).(sqlCurrentVersioner); !ok {
+			t.Errorf("%s has no currentVersionQuery", name)
+		}
+	}
+}
+
+func TestDialectProbe(t *testing.T) {
+
+	postgres := "PostgreSQL 16.2 on x86_64-pc-linux-gnu, compiled by gcc (GCC) 12.2.0, 64-bit"
+	versions := map[string]string{
+		"postgres":   postgres,
+		"mysql":      "8.0.36",
+		"mariadb":    "10.11.6-MariaDB-1:10.11.6+maria~ubu2204",
+		"tidb":       "8.0.11-TiDB-v7.5.0",
+		"clickhouse": "23.8.2.7",
+		"sqlite3":    "3.45.1",
+		"cockroach":  "CockroachDB CCL v23.2.1 (x86_64-pc-linux-gnu, built 2024/01/23 19:16:57, go1.21.5 X:nocoverageredesign)",
+		"yugabyte":   "PostgreSQL 11.2-YB-2.20.1.0-b0 on x86_64-pc-linux-gnu, compiled by clang version 16.0.6, 64-bit",
+		"redshift":   "PostgreSQL 8.0.2 on i686-pc-linux-gnu, compiled by GCC gcc (GCC) 3.4.2 20041017 (Red Hat 3.4.2-6.fc3), Redshift 1.0.63282",
+		"vertica":    "Vertica Analytic Database v12.0.4-0",
+		"oracle":     "Oracle Database 19c Enterprise Edition Release 19.0.0.0.0 - Production",
+		"duckdb":     "v0.10.0",
+	}
+
+	for name, version := range versions {
+		p, ok := dialectByName(name).(sqlProber)
+		if !ok {
+			t.Errorf("%s has no dialectProbeSql", name)
+			continue
+		}
+		if !p.probeMatches(version) {
+			t.Errorf("%s doesn't recognise %q", name, version)
+		}
+	}
+
+	// each is told apart from the engines most likely to be mistaken for it
+	mistaken := map[string][]string{
+		"postgres":   {versions["cockroach"]},
+		"mysql":      {postgres, versions["clickhouse"]},
+		"clickhouse": {versions["mysql"]},
+		"sqlite3":    {postgres},
+		"yugabyte":   {postgres},
+		"redshift":   {postgres},
+		"tidb":       {versions["mysql"]},
+		"duckdb":     {versions["sqlite3"]},
+	}
+	for name, vs := range mistaken {
+		for _, version := range vs {
+			if dialectByName(name).(sqlProber).probeMatches(version) {
+				t.Errorf("%s mistakes %q for its own", name, version)
+			}
+		}
+	}
+
+	if got := (ClickHouseDialect{}).dialectProbeSql(); got != "SELECT version()" {
+		t.Errorf("incorrect ClickHouse probe. got %s, want SELECT version()", got)
+	}
+}
@@ -0,0 +1,233 @@
+package goose
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"sort"
+)
+
+// returned by a dialect's dirtyQuery when the version table
+// was created before goose recorded dirty migrations
+var errNoDirtyColumn = errors.New("version table has no dirty column")
+
+// A migration run outside of a transaction can fail partway, leaving
+// the database between two versions, so its version is marked dirty
+// before any of its statements run, and the mark cleared once they've
+// all succeeded. A migration run within a transaction is rolled back
+// as a whole if it fails, so is never marked.
+
+// dirtyVersions lists the versions whose most recent record has them
+// marked dirty, in ascending order.
+//
+// A version table predating the dirty column has it added, so that
+// the migrations about to run can mark themselves.
+func dirtyVersions(ctx context.Context, conf *DBConf, db dbConn) ([]int64, error) {
+	d := conf.Driver.Dialect
+
+	rows, err := queryVersionTable(ctx, d, db, d.dirtyQuery)
+	if err == errNoDirtyColumn && ctx.Err() == nil {
+		if conf.Options.DryRun {
+			logger.Println("goose: dry run: version table has no dirty column, would add it")
+			printPlannedStatement(d.addDirtyColumnSql())
+			return nil, nil
+		}
+		if _, err := db.ExecContext(ctx, d.addDirtyColumnSql()); err != nil {
+			return nil, errors.New(fmt.Sprintf("failed to add dirty column to the version table: %v", err))
+		}
+		return nil, nil
+	}
+	if err != nil {
+		// nothing is dirty in a version table a dry run hasn't created
+		if errors.Is(err, ErrTableDoesNotExist) && conf.Options.DryRun && ctx.Err() == nil {
+			return nil, nil
+		}
+		return nil, err
+	}
+	defer rows.Close()
+	return scanDirtyVersions(rows)
+}
+
+// scanDirtyVersions reads the versions marked dirty from the rows of a
+// dialect's dirtyQuery, in ascending order.
+func scanDirtyVersions(rows *sql.Rows) ([]int64, error) {
+
+	// only the most recent record for each version counts
+	seen := make(map[int64]bool)
+	var dirty []int64
+
+	for rows.Next() {
+		var v int64
+		var isDirty sql.NullBool // BigQuery's is NULL for rows predating the column
+		if err := rows.Scan(&v, &isDirty); err != nil {
+			return nil, errors.New(fmt.Sprintf("error scanning rows: %v", err))
+		}
+		if seen[v] {
+			continue
+		}
+		seen[v] = true
+
+		if isDirty.Bool {
+			dirty = append(dirty, v)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	sort.Slice(dirty, func(i, j int) bool { return dirty[i] < dirty[j] })
+	return dirty, nil
+}
+
+// checkNotDirty refuses to go on with a database a migration was left
+// dirty in, returning an error wrapping ErrDirtyDatabase.
+func checkNotDirty(ctx context.Context, conf *DBConf, db dbConn) error {
+	dirty, err := dirtyVersions(ctx, conf, db)
+	if err != nil || len(dirty) == 0 {
+		return err
+	}
+	return fmt.Errorf("%w: migration %d failed partway, so its changes need putting right by hand before Force records the version the database is at",
+		ErrDirtyDatabase, dirty[len(dirty)-1])
+}
+
+// markDirty records that migration v is about to run in the given
+// direction: applying it records it, marked dirty, and rolling it
+// back marks its record dirty.
+func markDirty(ctx context.Context, conf *DBConf, ex execer, direction bool, v int64, checksum string) error {
+	if direction {
+		insert, err := insertVersionSqlFor(conf)
+		if err != nil {
+			return err
+		}
+		_, err = ex.ExecContext(ctx, insert, versionArgs(conf, v, true, checksum, true)...)
+		return err
+	}
+	return setDirty(ctx, conf, ex, v, true)
+}
+
+// unmarkDirty undoes markDirty, for a migration that failed before any
+// of its statements ran.
+func unmarkDirty(ctx context.Context, conf *DBConf, ex execer, direction bool, v int64) error {
+	if direction {
+		_, err := ex.ExecContext(ctx, conf.Driver.Dialect.deleteVersionSql(), v)
+		return err
+	}
+	return setDirty(ctx, conf, ex, v, false)
+}
+
+// recordDirtyMigration updates the version table for a migration
+// markDirty marked once it has run: an applied migration's record has
+// its mark cleared, and a rolled back one's rows are removed.
+func recordDirtyMigration(ctx context.Context, conf *DBConf, ex execer, direction bool, v int64) error {
+	if direction {
+		return setDirty(ctx, conf, ex, v, false)
+	}
+	return recordMigration(ctx, conf, ex, false, v, "")
+}
+
+func setDirty(ctx context.Context, conf *DBConf, ex execer, v int64, dirty bool) error {
+	_, err := ex.ExecContext(ctx, conf.Driver.Dialect.setDirtySql(), dirty, v)
+	return err
+}
+
+// Force clears the dirty mark a failed migration left on the database,
+// once whatever it changed has been put right by hand. Each migration
+// left dirty is recorded as applied if its version is at most version,
+// and as rolled back otherwise: to keep a migration that failed while
+// being applied, its changes have to have been completed, and to
+// discard it, undone. Other versions are left as they are.
+func Force(conf *DBConf, db *sql.DB, version int64) error {
+	if version < 0 {
+		return errors.New(fmt.Sprintf("can't force version %d: versions aren't negative", version))
+	}
+
+	ctx := context.Background()
+	dirty, err := dirtyVersions(ctx, conf, db)
+	if err != nil {
+		return err
+	}
+
+	for _, v := range dirty {
+		if v <= version {
+			logger.Printf("goose: forcing migration %d, left dirty, to be recorded as applied\n", v)
+			err = setDirty(ctx, conf, db, v, false)
+		} else {
+			logger.Printf("goose: forcing migration %d, left dirty, to be recorded as rolled back\n", v)
+			err = recordMigration(ctx, conf, db, false, v, "")
+		}
+		if err != nil {
+			return errors.New(fmt.Sprintf("failed to clear the dirty mark of migration %d: %v", v, err))
+		}
+	}
+	return nil
+}
+
+// ForceVersion records the database as being at version, without
+// running any migrations, e.g. once a hotfix has brought its schema
+// there by hand. Versions recorded as applied above version have their
+// records removed, version itself is recorded as applied if it isn't
+// already, and every dirty mark is cleared. Versions below it that were
+// never recorded are left that way, as without the migrations there's
+// no knowing what they are; the current version is version all the
+// same. The version table is created if it's missing.
+func ForceVersion(db *sql.DB, dialect SqlDialect, version int64) error {
+	if version < 0 {
+		return errors.New(fmt.Sprintf("can't force version %d: versions aren't negative", version))
+	}
+
+	ctx := context.Background()
+	conf := dialectConf(dialect, "", Options{})
+
+	_, versions, err := ensureDBVersion(ctx, conf, db)
+	if err != nil {
+		return err
+	}
+	dirty, err := dirtyVersions(ctx, conf, db)
+	if err != nil {
+		return err
+	}
+
+	logger.Printf("goose: WARNING: forcing the database to version %d without running any migrations\n", version)
+
+	force := func(ex execer) error {
+		for _, v := range dirty {
+			if v <= version {
+				if err := setDirty(ctx, conf, ex, v, false); err != nil {
+					return err
+				}
+			}
+		}
+		// a dirty version has a record applying it, so is among these
+		for _, v := range versions.applied() {
+			if v > version {
+				if err := recordMigration(ctx, conf, ex, false, v, ""); err != nil {
+					return err
+				}
+			}
+		}
+		if version > 0 && !versions[version] {
+			return recordMigration(ctx, conf, ex, true, version, "")
+		}
+		return nil
+	}
+
+	if _, ok := dialect.(sqlNoTxDDL); ok {
+		err = force(db)
+	} else {
+		err = withRetries(ctx, dialect, func() error {
+			txn, err := db.BeginTx(ctx, nil)
+			if err != nil {
+				return err
+			}
+			if err := force(txn); err != nil {
+				txn.Rollback()
+				return err
+			}
+			return txn.Commit()
+		})
+	}
+	if err != nil {
+		return errors.New(fmt.Sprintf("failed to force version %d: %v", version, err))
+	}
+	return nil
+}
@@ -0,0 +1,111 @@
+package goose
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+// Drift is an applied migration whose 'CheckExists' annotation names a
+// table the database no longer has, e.g. one dropped by hand.
+type Drift struct {
+	Version int64
+	Source  string // the migration script
+	Table   string // the missing table, as the annotation names it
+}
+
+// Verify checks that the tables named by the 'CheckExists <table>'
+// annotations of each migration in migrationsDir the version table
+// records as applied are still there, returning a Drift for each that
+// isn't, in ascending order of version. A table may be qualified with
+// its schema, and is otherwise looked for where the database looks for
+// unqualified names.
+//
+// It only reports: nothing is repaired, and the database isn't
+// modified. A missing version table has nothing applied, so nothing to
+// report. The scripts are read as written; use VerifyConf for those
+// rendered with Options.TemplateData.
+func Verify(db *sql.DB, dialect SqlDialect, migrationsDir string) ([]Drift, error) {
+	return VerifyConf(dialectConf(dialect, "", Options{}), db, migrationsDir)
+}
+
+// VerifyConf is Verify, with conf's dialect, reading each script as a
+// run with conf does: rendered with Options.TemplateData, if it's set,
+// so that a 'CheckExists' annotation may name a table by a template.
+func VerifyConf(conf *DBConf, db *sql.DB, migrationsDir string) ([]Drift, error) {
+
+	ctx := context.Background()
+	dialect := conf.Driver.Dialect
+	records, err := versionRecords(ctx, dialect, db)
+	if err != nil {
+		return nil, err
+	}
+
+	migrations, err := CollectMigrations(migrationsDir, 0, (1<<63)-1)
+	if err != nil {
+		return nil, err
+	}
+	migrationSorter(migrations).Sort(true)
+
+	var drift []Drift
+	for _, m := range migrations {
+		if r, ok := records[m.Version]; !ok || !r.IsApplied || filepath.Ext(m.Source) != ".sql" {
+			continue
+		}
+		if _, _, err := m.parseRenderedSQL(conf, true); err != nil {
+			// a script with only a Down section created nothing to check
+			if errors.Is(err, ErrNoUpMigration) {
+				continue
+			}
+			return nil, err
+		}
+		for _, table := range m.script.checkExists {
+			exists, err := tableExists(ctx, dialect, db, table)
+			if err != nil {
+				return nil, err
+			}
+			if !exists {
+				drift = append(drift, Drift{Version: m.Version, Source: m.Source, Table: table})
+			}
+		}
+	}
+	return drift, nil
+}
+
+// tableExists reports whether a table named by a 'CheckExists'
+// annotation is in the database.
+func tableExists(ctx context.Context, d SqlDialect, db dbConn, table string) (bool, error) {
+	c, ok := d.(sqlObjectChecker)
+	if !ok {
+		return false, errors.New(fmt.Sprintf("dialect %T can't check that tables exist, so can't verify 'CheckExists' annotations", d))
+	}
+
+	schema, name, _ := splitObjectName(table)
+	var n int64
+	if err := db.QueryRowContext(ctx, c.namedTableExistsQuery(schema, name)).Scan(&n); err != nil {
+		return false, errors.New(fmt.Sprintf("failed to check for table %s: %v", table, err))
+	}
+	return n > 0, nil
+}
+
+// splitObjectName splits a table name, optionally qualified with its
+// schema, into the two, reporting whether each is a plain identifier,
+// as the names are interpolated into the dialect's SQL.
+func splitObjectName(object string) (schema, name string, ok bool) {
+	parts := strings.Split(object, ".")
+	for _, p := range parts {
+		if !validTableName.MatchString(p) {
+			return "", "", false
+		}
+	}
+	switch len(parts) {
+	case 1:
+		return "", parts[0], true
+	case 2:
+		return parts[0], parts[1], true
+	}
+	return "", "", false
+}
@@ -0,0 +1,105 @@
+package goose
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"strings"
+)
+
+// dryRunDBVersion reads the current and applied versions like ensureDBVersion,
+// but only describes the version table it would have created.
+func dryRunDBVersion(ctx context.Context, conf *DBConf, db dbConn) (int64, versionSet, error) {
+	d := conf.Driver.Dialect
+
+	rows, err := queryVersionTable(ctx, d, db, d.dbVersionQuery)
+	if err != nil {
+		if errors.Is(err, ErrTableDoesNotExist) && ctx.Err() == nil {
+			if conf.Options.DisableAutoCreate {
+				return 0, nil, autoCreateDisabled(err)
+			}
+			logger.Println("goose: dry run: version table does not exist, would create it")
+			create, err := createVersionTableSqlFor(conf)
+			if err != nil {
+				return 0, nil, err
+			}
+			insert, err := insertVersionSqlFor(conf)
+			if err != nil {
+				return 0, nil, err
+			}
+			printPlannedStatement(create)
+			printPlannedStatement(insert, versionArgs(conf, 0, true, "", false)...)
+			return 0, versionSet{0: true}, nil
+		}
+		return 0, nil, err
+	}
+	defer rows.Close()
+
+	return scanVersions(rows)
+}
+
+// dryRunMigration prints the statements a migration would execute,
+// followed by the version table update recording it.
+func dryRunMigration(conf *DBConf, m *Migration, direction bool) error {
+	action, directionStr := "roll back", "Down"
+	if direction {
+		action, directionStr = "apply", "Up"
+	}
+	logger.Printf("goose: dry run: would %v %v\n", action, filepath.Base(m.Source))
+
+	checksum := ""
+	switch {
+	case m.upDB != nil:
+		logger.Printf("-- registered %v(ctx, db) for version %v, outside of a transaction\n", directionStr, m.Version)
+	case m.isRegistered():
+		logger.Printf("-- registered %v(ctx, tx) for version %v\n", directionStr, m.Version)
+	case filepath.Ext(m.Source) == ".go":
+		logger.Printf("-- %v_%v(txn)\n", directionStr, m.Version)
+	case filepath.Ext(m.Source) == ".sql":
+		stmts, sum, err := m.statements(conf, direction)
+		if err != nil {
+			return err
+		}
+		checksum = sum
+
+		switch {
+		case m.noTx(conf):
+			logger.Println("-- outside of a transaction")
+		case m.script.isolation != nil:
+			logger.Printf("-- in a transaction with isolation level %v\n", m.script.isolation)
+		}
+		for _, query := range stmts {
+			printPlannedStatement(query)
+		}
+		for _, query := range m.script.verify {
+			logger.Println("-- verify that this returns rows:")
+			printPlannedStatement(query)
+		}
+	}
+
+	d := conf.Driver.Dialect
+	switch {
+	case conf.Options.VersionStore != nil && direction:
+		logger.Printf("-- record version %v as applied in the version store\n", m.Version)
+	case conf.Options.VersionStore != nil:
+		logger.Printf("-- delete version %v from the version store\n", m.Version)
+	case direction:
+		insert, err := insertVersionSqlFor(conf)
+		if err != nil {
+			return err
+		}
+		printPlannedStatement(insert, versionArgs(conf, m.Version, direction, checksum, false)...)
+	default:
+		printPlannedStatement(d.deleteVersionSql(), m.Version)
+	}
+	return nil
+}
+
+func printPlannedStatement(query string, args ...interface{}) {
+	query = strings.TrimSpace(query)
+	if len(args) == 0 {
+		logger.Println(query)
+		return
+	}
+	logger.Printf("%v -- args: %v\n", query, args)
+}
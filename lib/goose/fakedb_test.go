@@ -0,0 +1,820 @@
+package goose
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// an in-memory database/sql driver good enough to drive the runner.
+//
+// Statements touching the version table are recognised by the table's
+// name and applied to an emulated version table; any other statement
+// is simply recorded, in the order it was committed.
+
+func init() {
+	sql.Register("goosetest", fakeDriver{})
+}
+
+// keep the runner's progress messages out of test output
+func TestMain(m *testing.M) {
+	SetLogger(NopLogger())
+	os.Exit(m.Run())
+}
+
+var errFakeNoTable = errors.New("no such table")
+var errFakeNoColumn = errors.New("no such column")
+var errFakeUnreachable = errors.New("connection refused")
+
+type fakeVersionRow struct {
+	id   int64
+	args []driver.Value
+	at   time.Time
+}
+
+type fakeDB struct {
+	mu          sync.Mutex
+	versions    []fakeVersionRow // nil until the version table is created
+	nextID      int64
+	stmts       []string           // committed statements, other than version table bookkeeping
+	untxed      []string           // statements run outside of a transaction
+	txOpts      []driver.TxOptions // options each transaction began with
+	failOn      string             // statements containing this fail
+	slowOn      string             // statements containing this run until cancelled
+	latency     time.Duration      // how long each Exec takes, as a round trip to a real database would
+	lostCommits int                // commits to carry out, then fail with errFakeConflict, as though the acknowledgement was lost
+	insertErrs  []error            // returned in turn by version table inserts
+
+	insertSettings []string  // the settings of the connection each version table insert ran on
+	unlockSettings string    // the settings of the connection the lock was last released on
+	lockedBy       *fakeConn // the connection holding the lock, if any
+	lockStmts      []string  // the Postgres advisory lock and unlock statements issued, in order
+
+	versionQueries int // number of dbVersionQuery style selects answered
+	currentQueries int // number of currentVersionQuery style selects answered
+	tableChecks    int // number of tableExistsQuery style selects answered
+	missedTable    int // number of statements failed for want of the version table
+
+	unreachable int // number of connection attempts to refuse
+
+	createdWith string // the statement that created the version table
+
+	noTableErr error // returned for a missing version table, errFakeNoTable if nil
+	noChecksum bool  // the version table predates the checksum column
+	noDirty    bool  // the version table predates the dirty column
+}
+
+var fakeDBs = struct {
+	sync.Mutex
+	m map[string]*fakeDB
+}{m: map[string]*fakeDB{}}
+
+// newFakeDB opens a fresh in-memory database named after the test.
+func newFakeDB(t testing.TB) (*sql.DB, *fakeDB) {
+	return newNamedFakeDB(t, t.Name())
+}
+
+// newNamedFakeDB is newFakeDB for a test needing more than one database,
+// each named differently.
+func newNamedFakeDB(t testing.TB, name string) (*sql.DB, *fakeDB) {
+	fdb := &fakeDB{}
+	fakeDBs.Lock()
+	fakeDBs.m[name] = fdb
+	fakeDBs.Unlock()
+
+	db, err := sql.Open("goosetest", name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db, fdb
+}
+
+// appliedVersions lists the versions recorded as applied, in row order.
+func (f *fakeDB) appliedVersions() []int64 {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	var vs []int64
+	for _, r := range f.versions {
+		if v := r.args[0].(int64); v != 0 && asBool(r.args[1]) {
+			vs = append(vs, v)
+		}
+	}
+	return vs
+}
+
+// compact keeps the latest row of each applied version.
+func (f *fakeDB) compact() {
+	latest := map[driver.Value]fakeVersionRow{}
+	for _, r := range f.versions {
+		if l, ok := latest[r.args[0]]; !ok || r.id > l.id {
+			latest[r.args[0]] = r
+		}
+	}
+	kept := f.versions[:0]
+	for _, r := range f.versions {
+		if latest[r.args[0]].id == r.id && asBool(r.args[1]) {
+			kept = append(kept, r)
+		}
+	}
+	f.versions = kept
+}
+
+func (f *fakeDB) statements() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]string(nil), f.stmts...)
+}
+
+func asBool(v driver.Value) bool {
+	switch b := v.(type) {
+	case bool:
+		return b
+	case int64:
+		return b != 0
+	}
+	return false
+}
+
+// exec applies a statement. Statements in a transaction take effect
+// as they run, and are undone by restoring a snapshot on rollback.
+func (f *fakeDB) exec(query string, args []driver.NamedValue) error {
+	q := stripComments(query)
+	if f.failOn != "" && strings.Contains(q, f.failOn) {
+		return fmt.Errorf("fake failure executing %q", q)
+	}
+
+	vals := make([]driver.Value, len(args))
+	for i, a := range args {
+		vals[i] = a.Value
+	}
+
+	if !strings.Contains(q, TableName()) {
+		f.stmts = append(f.stmts, q)
+		return nil
+	}
+
+	upper := strings.ToUpper(q)
+	switch {
+	case strings.HasPrefix(upper, "CREATE TABLE"):
+		if f.versions != nil {
+			return errors.New("table already exists")
+		}
+		f.versions = []fakeVersionRow{}
+		f.createdWith = q
+	case f.versions == nil:
+		return f.missingTable()
+	case strings.Contains(upper, "ADD COLUMN CHECKSUM"):
+		f.noChecksum = false
+	case strings.Contains(upper, "ADD COLUMN DIRTY"):
+		f.noDirty = false
+	case strings.HasPrefix(upper, "UPDATE") && strings.Contains(upper, "SET DIRTY"):
+		if f.noDirty {
+			return errFakeNoColumn
+		}
+		for _, r := range f.versions {
+			if r.args[0] == vals[1] && len(r.args) > 3 {
+				r.args[3] = vals[0]
+			}
+		}
+	case strings.HasPrefix(upper, "COMPACT"):
+		f.compact()
+	case strings.HasPrefix(upper, "INSERT"):
+		if len(f.insertErrs) > 0 {
+			err := f.insertErrs[0]
+			f.insertErrs = f.insertErrs[1:]
+			return err
+		}
+		// a version table created with version_id UNIQUE has at most
+		// one row per version, which an upsert leaves be; one without
+		// has no constraint for an upsert to conflict on
+		upsert := strings.Contains(upper, "ON CONFLICT (VERSION_ID) DO NOTHING")
+		if upsert && !f.uniqueVersions() {
+			return errors.New("there is no unique or exclusion constraint matching the ON CONFLICT specification")
+		}
+		if f.uniqueVersions() {
+			for _, r := range f.versions {
+				if r.args[0] != vals[0] {
+					continue
+				}
+				if upsert {
+					return nil
+				}
+				return fmt.Errorf("duplicate key value violates unique constraint: version_id %v", vals[0])
+			}
+		}
+		f.nextID++
+		f.versions = append(f.versions, fakeVersionRow{f.nextID, vals, time.Now()})
+	case strings.HasPrefix(upper, "DELETE") || strings.Contains(upper, " DELETE "):
+		kept := f.versions[:0]
+		for _, r := range f.versions {
+			if r.args[0] != vals[0] {
+				kept = append(kept, r)
+			}
+		}
+		f.versions = kept
+	default:
+		f.stmts = append(f.stmts, q)
+	}
+	return nil
+}
+
+// stripComments drops whole-line comments, such as goose's annotations.
+func stripComments(query string) string {
+	var lines []string
+	for _, l := range strings.Split(query, "\n") {
+		if l = strings.TrimSpace(l); l != "" && !strings.HasPrefix(l, "--") {
+			lines = append(lines, l)
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+// query answers version table selects with (version_id, is_applied)
+// rows, most recently inserted first, along with each row's tstamp
+// and checksum if the query asks for them. A query for the dirty
+// column gets (version_id, dirty) rows instead.
+func (f *fakeDB) query(query string) (driver.Rows, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if query == "SELECT version()" {
+		return &fakeRows{cols: []string{"version"}, vals: [][]driver.Value{{"fakedb 1.0"}}}, nil
+	}
+	if !strings.Contains(query, TableName()) {
+		return f.tableQuery(query)
+	}
+	if strings.Contains(query, "unique_indexes") {
+		n := int64(0)
+		if f.uniqueVersions() {
+			n = 1
+		}
+		return &fakeRows{cols: []string{"count"}, vals: [][]driver.Value{{n}}}, nil
+	}
+	if isTableExistsQuery(query) {
+		f.tableChecks++
+		n := int64(0)
+		if f.versions != nil {
+			n = 1
+		}
+		return &fakeRows{cols: []string{"count"}, vals: [][]driver.Value{{n}}}, nil
+	}
+	if f.versions == nil {
+		return nil, f.missingTable()
+	}
+	if cols := selectedColumns(query); len(cols) == 1 && cols[0] == "max(version_id)" {
+		f.currentQueries++
+		return &fakeRows{cols: cols, vals: [][]driver.Value{{f.currentVersion()}}}, nil
+	}
+	withTstamp, withChecksum, withDirty := false, false, false
+	for _, col := range selectedColumns(query) {
+		switch {
+		case strings.Contains(col, "dirty"):
+			withDirty = true
+		case strings.Contains(col, "checksum"):
+			withChecksum = true
+		case col == "tstamp" || col == "max(tstamp)":
+			withTstamp = true
+		}
+	}
+	if withChecksum && f.noChecksum || withDirty && f.noDirty {
+		return nil, errFakeNoColumn
+	}
+	if !withTstamp && !withChecksum && !withDirty {
+		f.versionQueries++
+	}
+
+	rows := append([]fakeVersionRow(nil), f.versions...)
+	sort.Slice(rows, func(i, j int) bool { return rows[i].id > rows[j].id })
+
+	if withDirty {
+		r := &fakeRows{cols: []string{"version_id", "dirty"}}
+		for _, row := range rows {
+			r.vals = append(r.vals, []driver.Value{row.args[0], row.dirty()})
+		}
+		return r, nil
+	}
+
+	// a grouped query only sees the latest row for each version
+	grouped := strings.Contains(query, "GROUP BY version_id")
+	seen := map[driver.Value]bool{}
+
+	r := &fakeRows{cols: []string{"version_id", "is_applied"}}
+	if withTstamp {
+		r.cols = append(r.cols, "tstamp")
+	}
+	if withChecksum {
+		r.cols = append(r.cols, "checksum")
+	}
+	for _, row := range rows {
+		if grouped && seen[row.args[0]] {
+			continue
+		}
+		seen[row.args[0]] = true
+		vals := []driver.Value{row.args[0], asBool(row.args[1])}
+		if withTstamp {
+			vals = append(vals, row.at)
+		}
+		if withChecksum {
+			vals = append(vals, row.checksum())
+		}
+		r.vals = append(r.vals, vals)
+	}
+	return r, nil
+}
+
+// tableQuery answers "SELECT ... FROM <table>" for a table other than
+// the version table with a row for each "INSERT INTO <table>" run since
+// it was created, as a migration's Verify section might query it.
+func (f *fakeDB) tableQuery(query string) (driver.Rows, error) {
+	q := stripComments(query)
+	if f.failOn != "" && strings.Contains(q, f.failOn) {
+		return nil, fmt.Errorf("fake failure querying %q", q)
+	}
+	if isTableExistsQuery(q) {
+		return f.countTables(q), nil
+	}
+	i := strings.Index(q, " FROM ")
+	if !strings.HasPrefix(q, "SELECT ") || i < 0 {
+		return nil, fmt.Errorf("fake can't answer %q", query)
+	}
+	table := strings.TrimSuffix(strings.Fields(q[i+len(" FROM "):])[0], ";")
+
+	var r *fakeRows
+	for _, stmt := range f.stmts {
+		switch {
+		case strings.HasPrefix(stmt, "CREATE TABLE "+table+" "):
+			r = &fakeRows{cols: []string{"row"}}
+		case strings.HasPrefix(stmt, "INSERT INTO "+table+" ") && r != nil:
+			r.vals = append(r.vals, []driver.Value{int64(len(r.vals) + 1)})
+		}
+	}
+	if r == nil {
+		return nil, fmt.Errorf("no such table: %s", table)
+	}
+	return r, nil
+}
+
+// countTables answers a namedTableExistsQuery for the table named in
+// its table_name condition, which exists if the statements run created
+// it more often than they dropped it.
+func (f *fakeDB) countTables(query string) driver.Rows {
+	name := query[strings.Index(query, "table_name = '")+len("table_name = '"):]
+	name = name[:strings.Index(name, "'")]
+
+	n := int64(0)
+	for _, stmt := range f.stmts {
+		switch {
+		case strings.HasPrefix(stmt, "CREATE TABLE "+name+" "):
+			n++
+		case strings.HasPrefix(stmt, "DROP TABLE "+name+";"):
+			n--
+		}
+	}
+	return &fakeRows{cols: []string{"count"}, vals: [][]driver.Value{{n}}}
+}
+
+// currentVersion is the newest version whose latest row has it
+// applied, or nil if there's none, as a currentVersionQuery finds it.
+func (f *fakeDB) currentVersion() driver.Value {
+	latest := map[driver.Value]fakeVersionRow{}
+	for _, r := range f.versions {
+		if l, ok := latest[r.args[0]]; !ok || r.id > l.id {
+			latest[r.args[0]] = r
+		}
+	}
+	var current driver.Value
+	for v, r := range latest {
+		if asBool(r.args[1]) && (current == nil || v.(int64) > current.(int64)) {
+			current = v
+		}
+	}
+	return current
+}
+
+// isTableExistsQuery reports whether query is one of the dialects'
+// tableExistsQuery lookups in the database's catalog.
+// uniqueVersions reports whether the version table was created with
+// version_id unique.
+func (f *fakeDB) uniqueVersions() bool {
+	return strings.Contains(f.createdWith, "UNIQUE")
+}
+
+func isTableExistsQuery(query string) bool {
+	for _, catalog := range []string{"information_schema.tables", "system.tables", "sqlite_master"} {
+		if strings.Contains(query, catalog) {
+			return true
+		}
+	}
+	return false
+}
+
+// checksum is the checksum the row was inserted with, if any.
+func (r fakeVersionRow) checksum() string {
+	if len(r.args) > 2 {
+		if s, ok := r.args[2].(string); ok {
+			return s
+		}
+	}
+	return ""
+}
+
+// dirty is the dirty flag the row was inserted with, or last set to.
+func (r fakeVersionRow) dirty() bool {
+	return len(r.args) > 3 && asBool(r.args[3])
+}
+
+// dirtyVersions lists the versions recorded as dirty, in row order.
+func (f *fakeDB) dirtyVersions() []int64 {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	var vs []int64
+	for _, r := range f.versions {
+		if r.dirty() {
+			vs = append(vs, r.args[0].(int64))
+		}
+	}
+	return vs
+}
+
+// selectedColumns splits the select list of a query on its top-level commas.
+func selectedColumns(query string) []string {
+	upper := strings.ToUpper(query)
+	start, end := strings.Index(upper, "SELECT ")+len("SELECT "), strings.Index(upper, " FROM ")
+	if start < len("SELECT ") || end < start {
+		return nil
+	}
+
+	var cols []string
+	depth, from := 0, start
+	for i := start; i < end; i++ {
+		switch query[i] {
+		case '(':
+			depth++
+		case ')':
+			depth--
+		case ',':
+			if depth == 0 {
+				cols = append(cols, strings.TrimSpace(query[from:i]))
+				from = i + 1
+			}
+		}
+	}
+	return append(cols, strings.TrimSpace(query[from:end]))
+}
+
+func (f *fakeDB) missingTable() error {
+	f.missedTable++
+	if f.noTableErr != nil {
+		return f.noTableErr
+	}
+	return errFakeNoTable
+}
+
+type fakeDriver struct{}
+
+func (fakeDriver) Open(name string) (driver.Conn, error) {
+	fakeDBs.Lock()
+	defer fakeDBs.Unlock()
+
+	fdb, ok := fakeDBs.m[name]
+	if !ok {
+		return nil, fmt.Errorf("no fake database named %q", name)
+	}
+
+	fdb.mu.Lock()
+	defer fdb.mu.Unlock()
+	if fdb.unreachable > 0 {
+		fdb.unreachable--
+		return nil, errFakeUnreachable
+	}
+	return &fakeConn{db: fdb}, nil
+}
+
+type fakeConn struct {
+	db       *fakeDB
+	tx       *fakeTx  // the open transaction, if any
+	settings []string // SET statements run on the connection, and the locks it took
+}
+
+func (c *fakeConn) Prepare(query string) (driver.Stmt, error) {
+	return &fakeStmt{c: c, query: query}, nil
+}
+
+func (c *fakeConn) Close() error { return nil }
+
+func (c *fakeConn) Begin() (driver.Tx, error) {
+	return c.BeginTx(context.Background(), driver.TxOptions{})
+}
+
+func (c *fakeConn) BeginTx(ctx context.Context, opts driver.TxOptions) (driver.Tx, error) {
+	if c.tx != nil {
+		return nil, errors.New("transaction already open")
+	}
+
+	c.db.mu.Lock()
+	defer c.db.mu.Unlock()
+
+	c.db.txOpts = append(c.db.txOpts, opts)
+	c.tx = &fakeTx{
+		c:        c,
+		versions: append([]fakeVersionRow(nil), c.db.versions...),
+		created:  c.db.versions != nil,
+		nstmts:   len(c.db.stmts),
+	}
+	return c.tx, nil
+}
+
+func (c *fakeConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if c.db.slowOn != "" && strings.Contains(query, c.db.slowOn) {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}
+	time.Sleep(c.db.latency)
+	if strings.HasPrefix(query, "SELECT fake_unlock(") || strings.HasPrefix(query, "SELECT pg_advisory_unlock(") {
+		c.db.mu.Lock()
+		if strings.Contains(query, "pg_advisory") {
+			c.db.lockStmts = append(c.db.lockStmts, query)
+		}
+		c.db.unlockSettings = strings.Join(c.settings, "; ")
+		if c.db.lockedBy == c {
+			c.db.lockedBy = nil
+		}
+		c.db.mu.Unlock()
+		return driver.RowsAffected(0), nil
+	}
+
+	c.db.mu.Lock()
+	defer c.db.mu.Unlock()
+
+	if err := c.db.exec(query, args); err != nil {
+		return nil, err
+	}
+	if c.tx == nil {
+		c.db.untxed = append(c.db.untxed, stripComments(query))
+	}
+
+	upper := strings.ToUpper(strings.TrimSpace(query))
+	switch {
+	case strings.HasPrefix(upper, "SET "):
+		c.settings = append(c.settings, query)
+	case strings.HasPrefix(upper, "INSERT") && strings.Contains(query, TableName()):
+		c.db.insertSettings = append(c.db.insertSettings, strings.Join(c.settings, "; "))
+	}
+	return driver.RowsAffected(1), nil
+}
+
+func (c *fakeConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if strings.HasPrefix(query, "SELECT fake_lock(") || strings.Contains(query, "pg_advisory_lock(") {
+		// waits, as pg_advisory_lock does, until the lock is free
+		if strings.Contains(query, "pg_advisory") {
+			c.db.mu.Lock()
+			c.db.lockStmts = append(c.db.lockStmts, query)
+			c.db.mu.Unlock()
+		}
+		for !c.db.takeLock(c) {
+			select {
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			case <-time.After(time.Millisecond):
+			}
+		}
+		c.settings = append(c.settings, query)
+		return &fakeRows{cols: []string{"held"}, vals: [][]driver.Value{{int64(1)}}}, nil
+	}
+	if strings.HasPrefix(query, "SELECT fake_try_lock(") {
+		held := c.db.takeLock(c)
+		if held {
+			c.settings = append(c.settings, query)
+		}
+		return &fakeRows{cols: []string{"held"}, vals: [][]driver.Value{{held}}}, nil
+	}
+	return c.db.query(query)
+}
+
+// takeLock takes the lock for c, unless another connection holds it.
+func (f *fakeDB) takeLock(c *fakeConn) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.lockedBy != nil && f.lockedBy != c {
+		return false
+	}
+	f.lockedBy = c
+	return true
+}
+
+// lockHeld reports whether any connection holds the lock.
+func (f *fakeDB) lockHeld() bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.lockedBy != nil
+}
+
+// fakeTx remembers the state to restore on rollback.
+type fakeTx struct {
+	c        *fakeConn
+	versions []fakeVersionRow
+	created  bool
+	nstmts   int
+}
+
+func (tx *fakeTx) Commit() error {
+	tx.c.tx = nil
+
+	f := tx.c.db
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.lostCommits > 0 {
+		f.lostCommits--
+		return errFakeConflict
+	}
+	return nil
+}
+
+func (tx *fakeTx) Rollback() error {
+	f := tx.c.db
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.versions = nil
+	if tx.created {
+		f.versions = append([]fakeVersionRow{}, tx.versions...)
+	}
+	f.stmts = f.stmts[:tx.nstmts]
+	tx.c.tx = nil
+	return nil
+}
+
+type fakeStmt struct {
+	c     *fakeConn
+	query string
+}
+
+func (s *fakeStmt) Close() error  { return nil }
+func (s *fakeStmt) NumInput() int { return -1 }
+
+func (s *fakeStmt) Exec(args []driver.Value) (driver.Result, error) {
+	return s.c.ExecContext(context.Background(), s.query, named(args))
+}
+
+func (s *fakeStmt) Query(args []driver.Value) (driver.Rows, error) {
+	return s.c.QueryContext(context.Background(), s.query, named(args))
+}
+
+func named(args []driver.Value) []driver.NamedValue {
+	nv := make([]driver.NamedValue, len(args))
+	for i, a := range args {
+		nv[i] = driver.NamedValue{Ordinal: i + 1, Value: a}
+	}
+	return nv
+}
+
+type fakeRows struct {
+	cols []string
+	vals [][]driver.Value
+}
+
+func (r *fakeRows) Columns() []string { return r.cols }
+func (r *fakeRows) Close() error      { return nil }
+
+func (r *fakeRows) Next(dest []driver.Value) error {
+	if len(r.vals) == 0 {
+		return io.EOF
+	}
+	copy(dest, r.vals[0])
+	r.vals = r.vals[1:]
+	return nil
+}
+
+// fakeDialect emits just enough SQL for the fake driver to recognise.
+type fakeDialect struct{}
+
+func (fakeDialect) quoteIdentifier(name string) string {
+	return name
+}
+
+func (fakeDialect) createVersionTableSql() string {
+	return "CREATE TABLE " + qualifiedTableName() + " (version_id int, is_applied bool, checksum text, dirty bool)"
+}
+
+func (fakeDialect) insertVersionSql() string {
+	return "INSERT INTO " + qualifiedTableName() + " (version_id, is_applied, checksum, dirty) VALUES (?, ?, ?, ?)"
+}
+
+func (fakeDialect) deleteVersionSql() string {
+	return "DELETE FROM " + qualifiedTableName()
+}
+
+func (fakeDialect) compactVersionsSql() []string {
+	return []string{"COMPACT " + qualifiedTableName()}
+}
+
+func (fakeDialect) dbVersionQuery(ctx context.Context, db dbConn) (*sql.Rows, error) {
+	rows, err := db.QueryContext(ctx, "SELECT version_id, is_applied FROM "+qualifiedTableName())
+	if err != nil {
+		if err.Error() == errFakeNoTable.Error() {
+			return nil, tableDoesNotExist(err)
+		}
+		return nil, err
+	}
+	return rows, nil
+}
+
+func (fakeDialect) statusQuery(ctx context.Context, db dbConn) (*sql.Rows, error) {
+	rows, err := db.QueryContext(ctx, "SELECT version_id, is_applied, tstamp FROM "+qualifiedTableName())
+	if err != nil {
+		if err.Error() == errFakeNoTable.Error() {
+			return nil, tableDoesNotExist(err)
+		}
+		return nil, err
+	}
+	return rows, nil
+}
+
+func (fakeDialect) addChecksumColumnSql() string {
+	return "ALTER TABLE " + qualifiedTableName() + " ADD COLUMN checksum"
+}
+
+func (fakeDialect) checksumQuery(ctx context.Context, db dbConn) (*sql.Rows, error) {
+	rows, err := db.QueryContext(ctx, "SELECT version_id, is_applied, checksum FROM "+qualifiedTableName())
+	if err != nil {
+		switch err.Error() {
+		case errFakeNoTable.Error():
+			return nil, tableDoesNotExist(err)
+		case errFakeNoColumn.Error():
+			return nil, errNoChecksumColumn
+		}
+		return nil, err
+	}
+	return rows, nil
+}
+
+func (fakeDialect) addDirtyColumnSql() string {
+	return "ALTER TABLE " + qualifiedTableName() + " ADD COLUMN dirty"
+}
+
+func (fakeDialect) setDirtySql() string {
+	return "UPDATE " + qualifiedTableName() + " SET dirty = ? WHERE version_id = ?"
+}
+
+func (fakeDialect) dirtyQuery(ctx context.Context, db dbConn) (*sql.Rows, error) {
+	rows, err := db.QueryContext(ctx, "SELECT version_id, dirty FROM "+qualifiedTableName())
+	if err != nil {
+		switch err.Error() {
+		case errFakeNoTable.Error():
+			return nil, tableDoesNotExist(err)
+		case errFakeNoColumn.Error():
+			return nil, errNoDirtyColumn
+		}
+		return nil, err
+	}
+	return rows, nil
+}
+
+// newFakeConf returns a DBConf running against the fake driver
+// with the given dialect.
+func newFakeConf(d SqlDialect) *DBConf {
+	return &DBConf{
+		Env: "test",
+		Driver: DBDriver{
+			Name:    "goosetest",
+			Import:  "goosetest",
+			Dialect: d,
+		},
+	}
+}
+
+// writeMigrations creates a migrations folder holding the given files.
+func writeMigrations(t testing.TB, files map[string]string) string {
+	dir, err := ioutil.TempDir("", "goose")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	for name, contents := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
@@ -0,0 +1,117 @@
+package goose
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// versions at or above this are taken to be timestamps, as written
+// by `goose create`, rather than sequence numbers
+const timestampVersionThreshold = 19700101000000
+
+// Fix renumbers the timestamped migrations in dir to follow on from
+// its sequentially numbered ones, in chronological order, keeping the
+// rest of each file name. e.g. with 00002_users.sql already in dir,
+// 20130106093224_posts.sql becomes 00003_posts.sql.
+//
+// Go migration scripts have their Up and Down functions renamed to
+// match, as do Go migrations written from GoMigrationTemplate, along
+// with the version they register and their up and down functions.
+// Migrations registered in any other way aren't affected, and neither
+// is the version table, so Fix is best run on migrations that have yet
+// to be applied anywhere the old versions would be kept.
+//
+// Fix only understands numbered file names, so leaves those that
+// only Options.VersionFunc can find versions in as they are.
+//
+// Running Fix again, with no new timestamped migrations, does nothing.
+// It returns the new name of each renamed file, keyed by its old name.
+func Fix(dir string) (map[string]string, error) {
+
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	type timestamped struct {
+		name    string
+		version int64
+	}
+
+	var last int64
+	var pending []timestamped
+	for _, f := range files {
+		if f.IsDir() {
+			continue
+		}
+		v, err := NumericComponent(f.Name())
+		if err != nil {
+			continue
+		}
+		if v >= timestampVersionThreshold {
+			pending = append(pending, timestamped{f.Name(), v})
+		} else if v > last {
+			last = v
+		}
+	}
+
+	sort.Slice(pending, func(i, j int) bool {
+		if pending[i].version != pending[j].version {
+			return pending[i].version < pending[j].version
+		}
+		return pending[i].name < pending[j].name
+	})
+
+	renamed := make(map[string]string, len(pending))
+	for _, p := range pending {
+		last++
+		suffix := p.name[strings.Index(p.name, "_"):]
+		name := fmt.Sprintf("%05d%s", last, suffix)
+
+		oldPath, newPath := filepath.Join(dir, p.name), filepath.Join(dir, name)
+		if _, err := os.Stat(newPath); err == nil {
+			return renamed, errors.New(fmt.Sprintf("can't rename %s to %s: file exists", p.name, name))
+		}
+
+		if filepath.Ext(p.name) == ".go" {
+			if err := renameGoMigrationFuncs(oldPath, p.version, last); err != nil {
+				return renamed, err
+			}
+		}
+		if err := os.Rename(oldPath, newPath); err != nil {
+			return renamed, err
+		}
+		renamed[p.name] = name
+	}
+
+	return renamed, nil
+}
+
+// renameGoMigrationFuncs rewrites a Go migration script's
+// Up_<version> and Down_<version> functions for its new version, and
+// a registered migration's RegisterMigration(<version>, ...) call and
+// up<version> and down<version> functions, as GoMigrationTemplate
+// writes them.
+func renameGoMigrationFuncs(path string, from, to int64) error {
+	src, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	funcs := regexp.MustCompile(fmt.Sprintf(`\b(Up_|Down_|up|down)%d\b`, from))
+	renamed := funcs.ReplaceAllString(string(src), fmt.Sprintf("${1}%d", to))
+	register := regexp.MustCompile(fmt.Sprintf(`\b(RegisterMigration(?:NoTx)?\(\s*)%d\b`, from))
+	renamed = register.ReplaceAllString(renamed, fmt.Sprintf("${1}%d", to))
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, []byte(renamed), info.Mode())
+}
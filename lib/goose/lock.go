@@ -0,0 +1,118 @@
+package goose
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"time"
+)
+
+// sqlLocker is implemented by dialects that can take a session-level
+// lock to keep concurrent migrators from racing on the version table.
+type sqlLocker interface {
+	// sql string to wait up to timeout (forever, if zero) for the named
+	// lock, yielding a single row holding 1 once the lock is held
+	lockSql(name string, timeout time.Duration) string
+	unlockSql(name string) string // sql string to release the named lock
+}
+
+// sqlTryLocker is implemented by lockers whose lockSql can't time out,
+// so that a LockTimeout is honoured by polling for the lock instead.
+type sqlTryLocker interface {
+	// sql string to take the named lock if it's free, without waiting,
+	// yielding a single row holding whether it was taken
+	tryLockSql(name string) string
+}
+
+// lockPollInterval is how long to wait between attempts to take a
+// lock polled for by a sqlTryLocker.
+var lockPollInterval = 250 * time.Millisecond
+
+// lockName derives the lock name from the qualified version table name,
+// so that migrators working on different version tables don't contend.
+// Names are always valid identifiers, so are safe to quote into SQL.
+func lockName() string {
+	return qualifiedTableName()
+}
+
+// lockKey hashes a lock name into the integer key used by
+// databases whose locks aren't named.
+func lockKey(name string) int64 {
+	h := fnv.New64a()
+	h.Write([]byte(name))
+	return int64(h.Sum64())
+}
+
+// acquireLock takes the dialect's migration lock on conn and returns a
+// func that releases it. Session-level locks belong to the connection
+// that took them, so the unlock statement is issued on conn too, which
+// must be kept open until it has been.
+//
+// Waiting for the lock stops once ctx is done, whatever the timeout.
+func acquireLock(ctx context.Context, d SqlDialect, conn *sql.Conn, timeout time.Duration) (func() error, error) {
+	l, ok := d.(sqlLocker)
+	if !ok {
+		return nil, errors.New(fmt.Sprintf("dialect %T does not support locking", d))
+	}
+
+	name := lockName()
+	if tl, ok := d.(sqlTryLocker); ok && timeout > 0 {
+		if err := pollLock(ctx, tl, conn, name, timeout); err != nil {
+			return nil, err
+		}
+	} else {
+		var held sql.NullInt64
+		if err := conn.QueryRowContext(ctx, l.lockSql(name, timeout)).Scan(&held); err != nil {
+			if cerr := ctx.Err(); cerr != nil {
+				return nil, fmt.Errorf("could not acquire migration lock %q: %w", name, cerr)
+			}
+			return nil, errors.New(fmt.Sprintf("failed to acquire migration lock %q: %v", name, err))
+		}
+		if !held.Valid || held.Int64 != 1 {
+			return nil, lockTimedOut(name, timeout)
+		}
+	}
+
+	return func() error {
+		// release even if the run's context is already done
+		_, err := conn.ExecContext(context.Background(), l.unlockSql(name))
+		return err
+	}, nil
+}
+
+// pollLock tries to take the named lock every lockPollInterval until
+// it's taken, timeout has passed, or ctx is done.
+func pollLock(ctx context.Context, l sqlTryLocker, conn *sql.Conn, name string, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		var held sql.NullBool
+		if err := conn.QueryRowContext(ctx, l.tryLockSql(name)).Scan(&held); err != nil {
+			if cerr := ctx.Err(); cerr != nil {
+				return fmt.Errorf("could not acquire migration lock %q: %w", name, cerr)
+			}
+			return errors.New(fmt.Sprintf("failed to acquire migration lock %q: %v", name, err))
+		}
+		if held.Bool {
+			return nil
+		}
+
+		wait := time.Until(deadline)
+		if wait <= 0 {
+			return lockTimedOut(name, timeout)
+		}
+		if wait > lockPollInterval {
+			wait = lockPollInterval
+		}
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("could not acquire migration lock %q: %w", name, ctx.Err())
+		case <-time.After(wait):
+		}
+	}
+}
+
+func lockTimedOut(name string, timeout time.Duration) error {
+	return errors.New(fmt.Sprintf("could not acquire migration lock %q within %v, is another migration running?", name, timeout))
+}
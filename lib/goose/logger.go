@@ -0,0 +1,35 @@
+package goose
+
+import (
+	"log"
+	"os"
+)
+
+// Logger receives the progress messages goose prints while migrating.
+// *log.Logger satisfies it.
+type Logger interface {
+	Printf(format string, v ...interface{})
+	Println(v ...interface{})
+}
+
+// by default, messages go to stdout, unadorned
+var logger Logger = log.New(os.Stdout, "", 0)
+
+// SetLogger routes goose's progress messages to l, in place of stdout.
+// Use NopLogger to discard them altogether.
+func SetLogger(l Logger) {
+	if l == nil {
+		panic("goose: SetLogger logger is nil")
+	}
+	logger = l
+}
+
+// NopLogger returns a Logger that discards every message.
+func NopLogger() Logger {
+	return nopLogger{}
+}
+
+type nopLogger struct{}
+
+func (nopLogger) Printf(format string, v ...interface{}) {}
+func (nopLogger) Println(v ...interface{})               {}
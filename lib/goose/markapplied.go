@@ -0,0 +1,111 @@
+package goose
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"path/filepath"
+)
+
+// MarkApplied records every migration in dir with a version up to upto
+// as applied, without running any of them, e.g. to adopt goose on a
+// database whose schema was already loaded from a dump. Versions
+// already applied are left as they are, so it can be run again. SQL
+// migrations have their checksums recorded, as though they had run.
+//
+// A migration can't be marked applied below a version that's applied
+// already, as it would be were it missing, unless Options.AllowMissing
+// is set. The version table is created if it's missing, and the
+// database is refused if it's dirty.
+func MarkApplied(conf *DBConf, db *sql.DB, dir string, upto int64) error {
+	if upto < 0 {
+		return errors.New(fmt.Sprintf("can't mark migrations applied up to version %d: versions aren't negative", upto))
+	}
+
+	ctx := context.Background()
+	store := conf.Options.VersionStore
+
+	var versions versionSet
+	var err error
+	if store != nil {
+		_, versions, err = storeVersions(ctx, store)
+	} else {
+		if _, versions, err = ensureDBVersion(ctx, conf, db); err == nil {
+			err = checkNotDirty(ctx, conf, db)
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	migrations, err := collectMigrations(conf, nil, []string{dir}, 0, upto)
+	if err != nil {
+		return err
+	}
+	migrationSorter(migrations).Sort(true)
+
+	var unmarked []*Migration
+	for _, m := range migrations {
+		if versions[m.Version] {
+			continue
+		}
+		if latest := versions.latest(); m.Version < latest && !conf.Options.AllowMissing {
+			return errors.New(fmt.Sprintf("can't mark migration %d (%s) applied: version %d, after it, is applied already; set AllowMissing to mark it anyway",
+				m.Version, filepath.Base(m.Source), latest))
+		}
+		unmarked = append(unmarked, m)
+	}
+	if len(unmarked) == 0 {
+		logger.Printf("goose: no migrations to mark applied up to version %d\n", upto)
+		return nil
+	}
+
+	mark := func(ex execer) error {
+		for _, m := range unmarked {
+			if store != nil {
+				if err := store.Insert(ctx, m.Version, true); err != nil {
+					return err
+				}
+				continue
+			}
+			checksum := ""
+			if !m.isRegistered() && filepath.Ext(m.Source) == ".sql" {
+				sum, err := m.checksum()
+				if err != nil {
+					return err
+				}
+				checksum = sum
+			}
+			if err := recordMigration(ctx, conf, ex, true, m.Version, checksum); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	d := conf.Driver.Dialect
+	if _, ok := d.(sqlNoTxDDL); ok || store != nil {
+		err = mark(db)
+	} else {
+		err = withRetries(ctx, d, func() error {
+			txn, err := db.BeginTx(ctx, nil)
+			if err != nil {
+				return err
+			}
+			if err := mark(txn); err != nil {
+				txn.Rollback()
+				return err
+			}
+			return txn.Commit()
+		})
+	}
+	if err != nil {
+		return errors.New(fmt.Sprintf("failed to mark migrations applied: %v", err))
+	}
+
+	for _, m := range unmarked {
+		logger.Printf("goose: marked %s applied, without running it\n", filepath.Base(m.Source))
+	}
+	return nil
+}
@@ -0,0 +1,117 @@
+package goose
+
+import (
+	"bufio"
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+// MigrationMetadata describes what a migration provides, as found by
+// ParseMigrations from its script alone.
+type MigrationMetadata struct {
+	HasUp     bool `json:"has_up"`     // it can be applied
+	HasDown   bool `json:"has_down"`   // it can be rolled back
+	HasVerify bool `json:"has_verify"` // its script has a Verify section
+
+	// it's annotated 'NO TRANSACTION', so runs outside of one
+	NoTransaction bool `json:"no_transaction"`
+
+	// the annotations of its SQL script other than those beginning
+	// sections and statements, e.g. "NO TRANSACTION" or "ENVSUB ON",
+	// each once, in the order they first appear
+	Directives []string `json:"directives,omitempty"`
+}
+
+// ParseMigrations returns every migration in dir, in ascending order,
+// with its Metadata, for tools such as linters that inspect migrations
+// without a database; it never connects to one. Each SQL script is
+// parsed in each direction it has a section for, and the first that
+// can't be run as written fails with a *ParseError.
+//
+// Migrations added with RegisterMigration are included, described by
+// the functions they were registered with.
+func ParseMigrations(dir string) ([]*Migration, error) {
+
+	ms, err := collectMigrations(nil, nil, []string{dir}, 0, (1<<63)-1)
+	if err != nil {
+		return nil, err
+	}
+	migrationSorter(ms).Sort(true)
+
+	for _, m := range ms {
+		if m.Metadata, err = m.parseMetadata(); err != nil {
+			return nil, err
+		}
+	}
+	return ms, nil
+}
+
+// parseMetadata describes the migration, from its script or the
+// functions it was registered with.
+func (m *Migration) parseMetadata() (*MigrationMetadata, error) {
+
+	if m.isRegistered() {
+		return &MigrationMetadata{HasUp: true, HasDown: m.down != nil || m.downDB != nil, NoTransaction: m.upDB != nil}, nil
+	}
+
+	f, err := m.open()
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	meta := &MigrationMetadata{}
+	isGo := filepath.Ext(m.Source) == ".go"
+	seen := make(map[string]bool)
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, bufferSize), bufferSize)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+
+		if isGo {
+			meta.HasUp = meta.HasUp || strings.HasPrefix(line, fmt.Sprintf("func Up_%d(", m.Version))
+			meta.HasDown = meta.HasDown || strings.HasPrefix(line, fmt.Sprintf("func Down_%d(", m.Version))
+			continue
+		}
+		if !strings.HasPrefix(line, sqlCmdPrefix) {
+			continue
+		}
+
+		switch cmd := strings.TrimSpace(line[len(sqlCmdPrefix):]); cmd {
+		case "Up":
+			meta.HasUp = true
+		case "Down":
+			meta.HasDown = true
+		case "Verify":
+			meta.HasVerify = true
+		case "StatementBegin", "StatementEnd":
+		default:
+			meta.NoTransaction = meta.NoTransaction || cmd == "NO TRANSACTION"
+			if !seen[cmd] {
+				seen[cmd] = true
+				meta.Directives = append(meta.Directives, cmd)
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	if isGo {
+		return meta, nil
+	}
+	// a script with neither section fails to parse either way
+	if meta.HasUp || !meta.HasDown {
+		if _, _, err := m.parseSQL(true); err != nil {
+			return nil, err
+		}
+	}
+	if meta.HasDown {
+		if _, _, err := m.parseSQL(false); err != nil {
+			return nil, err
+		}
+	}
+	return meta, nil
+}
@@ -0,0 +1,41 @@
+package goose
+
+import "time"
+
+// RunMetrics describes how a run went, for Options.Metrics to pass on
+// to a tracer or metrics library of the caller's choosing, e.g. as a
+// span for the run with one child per migration.
+type RunMetrics struct {
+	Up       bool          // whether the run applied migrations, rather than rolling them back
+	Start    time.Time     // when the run began
+	Duration time.Duration // how long the whole run took, from connecting to releasing the lock
+	Applied  int           // how many migrations the run left applied, or rolled back
+	Failed   int           // how many migrations failed
+	Err      error         // the error the run failed with, or nil
+
+	// every migration run, in the order it ran
+	Migrations []MigrationMetrics
+}
+
+// MigrationMetrics describes how one migration of a run went.
+type MigrationMetrics struct {
+	Version  int64
+	Source   string
+	Start    time.Time
+	Duration time.Duration
+	Err      error // the error it failed with, or nil
+}
+
+// reportMetrics passes the run's metrics to Options.Metrics, once the
+// run has ended with ran and err.
+func reportMetrics(conf *DBConf, metrics *RunMetrics, ran []*Migration, err error) {
+	metrics.Duration = time.Since(metrics.Start)
+	metrics.Applied = len(ran)
+	metrics.Err = err
+	for _, m := range metrics.Migrations {
+		if m.Err != nil {
+			metrics.Failed++
+		}
+	}
+	conf.Options.Metrics(metrics)
+}
@@ -1,11 +1,17 @@
 package goose
 
 import (
+	"bufio"
+	"bytes"
+	"context"
 	"database/sql"
 	"errors"
 	"fmt"
-	"log"
+	"io"
+	"io/fs"
+	"io/ioutil"
 	"os"
+	"path"
 	"path/filepath"
 	"sort"
 	"strconv"
@@ -21,8 +27,93 @@ import (
 var (
 	ErrTableDoesNotExist = errors.New("table does not exist")
 	ErrNoPreviousVersion = errors.New("no previous version found")
+
+	// ErrNoMigrationFiles is returned when a directory expected to hold
+	// migrations has none in it.
+	ErrNoMigrationFiles = errors.New("no migration files found")
+
+	// ErrDirtyDatabase is wrapped by the error a migration run outside of
+	// a transaction fails with once some of its statements have run,
+	// leaving the database partway between two versions, and by the
+	// error later runs are refused with until Force is called.
+	ErrDirtyDatabase = errors.New("database left partially migrated")
+
+	// ErrNoDownMigration is wrapped by the error for a migration that
+	// has to be rolled back, but has no down section.
+	ErrNoDownMigration = errors.New("no down section")
+
+	// ErrNoUpMigration is wrapped by the error for a migration that has
+	// to be applied, but has only a down section.
+	ErrNoUpMigration = errors.New("no up section")
+
+	// ErrVersionGap is wrapped by the error for a rollback past a version
+	// that's applied, but has no migration to roll it back with.
+	ErrVersionGap = errors.New("applied version has no migration")
 )
 
+// missingTableError is the ErrTableDoesNotExist a dialect reports for a
+// missing version table, keeping the driver's error as its cause.
+type missingTableError struct {
+	cause error
+}
+
+// tableDoesNotExist wraps the driver's error for a missing version table,
+// so that errors.Is(err, ErrTableDoesNotExist) holds, while errors.Unwrap
+// still reaches the cause.
+func tableDoesNotExist(cause error) error {
+	return &missingTableError{cause: cause}
+}
+
+func (e *missingTableError) Error() string {
+	return fmt.Sprintf("%v: %v", ErrTableDoesNotExist, e.cause)
+}
+
+func (e *missingTableError) Is(target error) bool {
+	return target == ErrTableDoesNotExist
+}
+
+func (e *missingTableError) Unwrap() error {
+	return e.cause
+}
+
+// MigrationError is a migration's failure in a run.
+type MigrationError struct {
+	Migration *Migration
+	Err       error
+}
+
+func (e *MigrationError) Error() string {
+	return fmt.Sprintf("FAIL %v", e.Err)
+}
+
+func (e *MigrationError) Unwrap() error {
+	return e.Err
+}
+
+// BestEffortError lists every migration that failed in a run with
+// Options.BestEffort set, in the order they were attempted.
+type BestEffortError struct {
+	Failures []*MigrationError
+}
+
+func (e *BestEffortError) Error() string {
+	msgs := make([]string, len(e.Failures))
+	for i, f := range e.Failures {
+		msgs[i] = f.Error()
+	}
+	return fmt.Sprintf("%d migrations failed:\n%s", len(e.Failures), strings.Join(msgs, "\n"))
+}
+
+// Unwrap returns the failures, so errors.As can find a particular
+// error among them.
+func (e *BestEffortError) Unwrap() []error {
+	errs := make([]error, len(e.Failures))
+	for i, f := range e.Failures {
+		errs[i] = f
+	}
+	return errs
+}
+
 type MigrationRecord struct {
 	VersionId int64
 	TStamp    time.Time
@@ -30,10 +121,30 @@ type MigrationRecord struct {
 }
 
 type Migration struct {
-	Version  int64
-	Next     int64  // next version, or -1 if none
-	Previous int64  // previous version, -1 if none
-	Source   string // path to .go or .sql script
+	Version  int64  `json:"version"`
+	Next     int64  `json:"next"`     // next version, or -1 if none
+	Previous int64  `json:"previous"` // previous version, -1 if none
+	Source   string `json:"source"`   // path to .go or .sql script
+
+	// when the migration was applied, as recorded in the version table,
+	// if it's known to be; see ListMigrations
+	AppliedAt *time.Time `json:"applied_at,omitempty"`
+
+	// the tags its SQL script's 'TAGS' annotation gives it, known once
+	// it's been parsed, for Options.IncludeTags and ExcludeTags to
+	// select migrations by
+	Tags []string `json:"tags,omitempty"`
+
+	// what the migration provides, if it's been described by
+	// ParseMigrations
+	Metadata *MigrationMetadata `json:"metadata,omitempty"`
+
+	fsys fs.FS // filesystem holding Source, nil for the local disk
+
+	script scriptDirectives // annotations on a SQL script, known once it's parsed
+
+	up, down     GoMigrationFunc     // set for migrations added by RegisterMigration
+	upDB, downDB GoMigrationNoTxFunc // set for migrations added by RegisterMigrationNoTx
 }
 
 type migrationSorter []*Migration
@@ -44,10 +155,64 @@ func (ms migrationSorter) Swap(i, j int)      { ms[i], ms[j] = ms[j], ms[i] }
 func (ms migrationSorter) Less(i, j int) bool { return ms[i].Version < ms[j].Version }
 
 func newMigration(v int64, src string) *Migration {
-	return &Migration{v, -1, -1, src}
+	return &Migration{Version: v, Next: -1, Previous: -1, Source: src}
+}
+
+// open returns the contents of the migration script.
+func (m *Migration) open() (io.ReadCloser, error) {
+	if m.fsys == nil {
+		return os.Open(m.Source)
+	}
+	return m.fsys.Open(m.Source)
+}
+
+// missingSection wraps a parse error for a script that has no section
+// for the direction it's run in with the migration's version and file,
+// as a script may have only an Up or a Down section, and fails only
+// once it's run the other way. Other errors are returned as they are.
+func missingSection(m *Migration, err error) error {
+	var perr *ParseError
+	if errors.As(err, &perr) && (errors.Is(perr.Err, ErrNoDownMigration) || errors.Is(perr.Err, ErrNoUpMigration)) {
+		return fmt.Errorf("migration %d (%s): %w", m.Version, filepath.Base(m.Source), perr)
+	}
+	return err
+}
+
+// hasDown reports whether the migration can be rolled back:
+// whether its script has a Down section, or function.
+func (m *Migration) hasDown() (bool, error) {
+	if m.isRegistered() {
+		return m.down != nil || m.downDB != nil, nil
+	}
+
+	f, err := m.open()
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+
+	marker := sqlCmdPrefix + "Down"
+	if filepath.Ext(m.Source) == ".go" {
+		marker = fmt.Sprintf("func Down_%d(", m.Version)
+	}
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, bufferSize), bufferSize)
+	for scanner.Scan() {
+		if strings.HasPrefix(strings.TrimSpace(scanner.Text()), marker) {
+			return true, nil
+		}
+	}
+	return false, scanner.Err()
 }
 
 func RunMigrations(conf *DBConf, migrationsDir string, target int64) (err error) {
+	return RunMigrationsContext(context.Background(), conf, migrationsDir, target)
+}
+
+// RunMigrationsContext is like RunMigrations, but stops as soon as
+// the given context is done.
+func RunMigrationsContext(ctx context.Context, conf *DBConf, migrationsDir string, target int64) (err error) {
 
 	db, err := OpenDBFromDBConf(conf)
 	if err != nil {
@@ -55,81 +220,643 @@ func RunMigrations(conf *DBConf, migrationsDir string, target int64) (err error)
 	}
 	defer db.Close()
 
-	return RunMigrationsOnDb(conf, migrationsDir, target, db)
+	return RunMigrationsOnDbContext(ctx, conf, migrationsDir, target, db)
 }
 
 // Runs migration on a specific database instance.
 func RunMigrationsOnDb(conf *DBConf, migrationsDir string, target int64, db *sql.DB) (err error) {
-	current, err := EnsureDBVersion(conf, db)
+	return RunMigrationsOnDbContext(context.Background(), conf, migrationsDir, target, db)
+}
+
+// RunMigrationsOnDbContext is like RunMigrationsOnDb, but passes the given
+// context down to every query and statement issued against the database.
+// Once it's done, no more migrations are begun, and one that's running
+// fails, its transaction rolled back and its version left unrecorded;
+// the error returned then matches ctx.Err() with errors.Is.
+func RunMigrationsOnDbContext(ctx context.Context, conf *DBConf, migrationsDir string, target int64, db *sql.DB) (err error) {
+	return runMigrations(ctx, conf, nil, []string{migrationsDir}, target, db, nil)
+}
+
+// RunMigrationsFS is like RunMigrationsOnDb, but reads the migrations
+// from migrationsDir within fsys, such as an embed.FS, rather than
+// from the local disk.
+func RunMigrationsFS(conf *DBConf, fsys fs.FS, migrationsDir string, target int64, db *sql.DB) error {
+	return RunMigrationsFSContext(context.Background(), conf, fsys, migrationsDir, target, db)
+}
+
+// RunMigrationsFSContext is like RunMigrationsFS, but passes the given
+// context down to every query and statement issued against the database.
+func RunMigrationsFSContext(ctx context.Context, conf *DBConf, fsys fs.FS, migrationsDir string, target int64, db *sql.DB) error {
+	return runMigrations(ctx, conf, fsys, []string{migrationsDir}, target, db, nil)
+}
+
+// RunMigrationsDirs is like RunMigrationsOnDb, but merges the migrations
+// in each of migrationsDirs into a single set, ordered by version, such
+// as a base schema shared between services and each service's own
+// extensions to it. A version found in more than one directory is an
+// error.
+func RunMigrationsDirs(conf *DBConf, migrationsDirs []string, target int64, db *sql.DB) error {
+	return RunMigrationsDirsContext(context.Background(), conf, migrationsDirs, target, db)
+}
+
+// RunMigrationsDirsContext is like RunMigrationsDirs, but passes the given
+// context down to every query and statement issued against the database.
+func RunMigrationsDirsContext(ctx context.Context, conf *DBConf, migrationsDirs []string, target int64, db *sql.DB) error {
+	return runMigrations(ctx, conf, nil, migrationsDirs, target, db, nil)
+}
+
+// RunMigrationsWithDialect migrates db, a connection pool the caller
+// opened and configured, from migrationsDir to target, using the given
+// dialect rather than one inferred from a driver name. goose never
+// opens a connection of its own, so no DBConf or connection string is
+// needed; Go migrations must therefore be registered with
+// RegisterMigration, as Go scripts can't be run without one.
+func RunMigrationsWithDialect(db *sql.DB, dialect SqlDialect, migrationsDir string, target int64, opts Options) error {
+	return RunMigrationsWithDialectContext(context.Background(), db, dialect, migrationsDir, target, opts)
+}
+
+// RunMigrationsWithDialectContext is like RunMigrationsWithDialect, but passes
+// the given context down to every query and statement issued against the database.
+func RunMigrationsWithDialectContext(ctx context.Context, db *sql.DB, dialect SqlDialect, migrationsDir string, target int64, opts Options) error {
+	return runMigrations(ctx, dialectConf(dialect, migrationsDir, opts), nil, []string{migrationsDir}, target, db, nil)
+}
+
+// dialectConf describes a database the caller connected to with the
+// given dialect, for the runner entry points that take a *sql.DB and
+// a dialect in place of a DBConf.
+func dialectConf(dialect SqlDialect, migrationsDir string, opts Options) *DBConf {
+	return &DBConf{
+		MigrationsDir: migrationsDir,
+		Driver:        DBDriver{Dialect: dialect},
+		Options:       opts,
+	}
+}
+
+// Migrate is like RunMigrationsOnDbContext, but also returns the
+// migrations that ran, in the order they ran. If a migration fails,
+// those that succeeded before it are returned along with the error.
+// In a dry run, the migrations that would have run are returned.
+func Migrate(ctx context.Context, conf *DBConf, db *sql.DB, migrationsDir string, target int64) ([]*Migration, error) {
+	return migrate(ctx, conf, nil, []string{migrationsDir}, target, db, nil, nil)
+}
+
+// MigrateBatch is like Migrate, but also returns how many migrations
+// were left for a later run, for runs bounded by Options.MaxApply to
+// report their progress. If a migration fails, those remaining include
+// it and the migrations after it.
+func MigrateBatch(ctx context.Context, conf *DBConf, db *sql.DB, migrationsDir string, target int64) (ran []*Migration, remaining int, err error) {
+	ran, err = migrate(ctx, conf, nil, []string{migrationsDir}, target, db, nil, &remaining)
+	return ran, remaining, err
+}
+
+// UpTo applies the migrations in migrationsDir up to and including
+// the target version, holding back any newer ones.
+// It fails, rather than rolling back, if the database is already
+// past the target.
+func UpTo(conf *DBConf, db *sql.DB, migrationsDir string, target int64) error {
+	return runMigrations(context.Background(), conf, nil, []string{migrationsDir}, target, db, func(current int64, _ []*Migration) error {
+		if current > target {
+			return errors.New(fmt.Sprintf("current version %d is already past target %d", current, target))
+		}
+		return nil
+	})
+}
+
+// DownTo rolls back the migrations in migrationsDir newer than the
+// target version, newest first, stopping once target is current.
+// A target of 0 rolls back every migration.
+// It fails, rather than migrating up, if the database is behind the target.
+func DownTo(conf *DBConf, db *sql.DB, migrationsDir string, target int64) error {
+	return runMigrations(context.Background(), conf, nil, []string{migrationsDir}, target, db, func(current int64, _ []*Migration) error {
+		if current < target {
+			return errors.New(fmt.Sprintf("current version %d is already behind target %d", current, target))
+		}
+		return nil
+	})
+}
+
+// Reset rolls back every applied migration in migrationsDir, newest
+// first, leaving the database at version 0. It does nothing if the
+// database is already there. Nothing is rolled back if any of the
+// migrations has no down section.
+func Reset(conf *DBConf, db *sql.DB, migrationsDir string) error {
+	return runMigrations(context.Background(), conf, nil, []string{migrationsDir}, 0, db, func(current int64, ms []*Migration) error {
+		for _, m := range ms {
+			ok, err := m.hasDown()
+			if err != nil {
+				return err
+			}
+			if !ok {
+				return fmt.Errorf("can't reset: migration %d (%s) has %w",
+					m.Version, filepath.Base(m.Source), ErrNoDownMigration)
+			}
+		}
+		return nil
+	})
+}
+
+// Redo rolls back the last n applied migrations in migrationsDir,
+// newest first, then applies them again, oldest first. A count
+// exceeding the number of applied migrations redoes all of them.
+func Redo(conf *DBConf, db *sql.DB, migrationsDir string, n int) error {
+	if n < 1 {
+		return errors.New(fmt.Sprintf("can't redo %d migrations", n))
+	}
+
+	ctx := context.Background()
+
+	current, versions, err := loadVersions(ctx, conf, db)
 	if err != nil {
 		return err
 	}
 
-	migrations, err := CollectMigrations(migrationsDir, current, target)
-	if err != nil {
+	// version 0 marks the creation of the version table, not a migration
+	var redone []int64
+	for _, v := range versions.applied() {
+		if v > 0 && v <= current {
+			redone = append(redone, v)
+		}
+	}
+
+	var target int64
+	if n < len(redone) {
+		target = redone[len(redone)-n-1]
+	}
+
+	if err := runMigrations(ctx, conf, nil, []string{migrationsDir}, target, db, nil); err != nil {
 		return err
 	}
+	// a replica may not show the rollbacks yet
+	return runMigrations(ctx, onPrimary(conf), nil, []string{migrationsDir}, current, db, nil)
+}
+
+// runMigrations is migrate, for callers that only need to know
+// whether the run succeeded.
+func runMigrations(ctx context.Context, conf *DBConf, fsys fs.FS, migrationsDirs []string, target int64, db *sql.DB, validate func(current int64, ms []*Migration) error) error {
+	_, err := migrate(ctx, conf, fsys, migrationsDirs, target, db, validate, nil)
+	return err
+}
+
+// migrate migrates the database from its current version to target,
+// reading the migrations in each of migrationsDirs from fsys, or from
+// the local disk if fsys is nil, and returns the migrations it ran, in
+// the order they ran.
+// If given, validate is called with the current version and the
+// migrations to run before any of them do, and may veto the run
+// by returning an error, and remaining is set to the number of
+// migrations to target left unrun once it ends.
+func migrate(ctx context.Context, conf *DBConf, fsys fs.FS, migrationsDirs []string, target int64, db *sql.DB, validate func(current int64, ms []*Migration) error, remaining *int) (ran []*Migration, err error) {
+	dryRun := conf.Options.DryRun
+
+	// reported once every other deferred step of the run is done
+	var metrics *RunMetrics
+	if conf.Options.Metrics != nil && !dryRun {
+		metrics = &RunMetrics{Start: time.Now()}
+		defer func() { reportMetrics(conf, metrics, ran, err) }()
+	}
+
+	if conf.Options.PingAttempts > 0 {
+		if err := waitForDB(ctx, db, conf.Options.PingAttempts, conf.Options.PingBackoff); err != nil {
+			return ran, err
+		}
+	}
+
+	// the whole run, from taking the lock to releasing it, is issued
+	// on one connection, which session-level locks and settings need
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return ran, err
+	}
+	defer conn.Close()
+
+	if conf.Options.ProbeDialect {
+		if err := probeDialect(ctx, conf.Driver.Dialect, conn); err != nil {
+			return ran, err
+		}
+	}
+
+	if conf.Options.Lock && !dryRun {
+		unlock, lerr := acquireLock(ctx, conf.Driver.Dialect, conn, conf.Options.LockTimeout)
+		if lerr != nil {
+			return ran, lerr
+		}
+		// released however the run ends
+		defer func() {
+			if uerr := unlock(); err == nil && uerr != nil {
+				err = errors.New(fmt.Sprintf("failed to release migration lock: %v", uerr))
+			}
+		}()
+	}
+
+	if setup := sessionSetup(conf); len(setup) > 0 {
+		if dryRun {
+			logger.Println("goose: dry run: would set up the session with")
+			for _, stmt := range setup {
+				printPlannedStatement(stmt)
+			}
+		} else if err := setUpSession(ctx, conn, setup); err != nil {
+			return ran, err
+		}
+	}
+
+	current, versions, err := loadVersions(ctx, conf, conn)
+	if err != nil {
+		return ran, err
+	}
+	// a VersionStore keeps neither dirty marks nor checksums
+	store := conf.Options.VersionStore
+	if store == nil {
+		if err := checkNotDirty(ctx, conf, conn); err != nil {
+			return ran, err
+		}
+	}
+
+	direction := current < target
+
+	// an applied migration is only skipped if it's unchanged
+	if store == nil && (direction || conf.Options.AllowMissing) {
+		if err := verifyChecksums(ctx, conf, fsys, migrationsDirs, versions, conn); err != nil {
+			return ran, err
+		}
+	}
+
+	var migrations []*Migration
+	if conf.Options.AllowMissing && current <= target {
+		direction = true
+		migrations, err = collectMissingMigrations(conf, fsys, migrationsDirs, versions, target)
+	} else {
+		migrations, err = collectMigrations(conf, fsys, migrationsDirs, current, target)
+	}
+	if err != nil {
+		return ran, err
+	}
+	if !direction && !conf.Options.AllowMissing {
+		if err := checkVersionGaps(versions, migrations, current, target); err != nil {
+			return ran, err
+		}
+	}
+
+	if validate != nil {
+		if err := validate(current, migrations); err != nil {
+			return ran, err
+		}
+	}
 
 	if len(migrations) == 0 {
-		fmt.Printf("goose: no migrations to run. current version: %d\n", current)
-		return nil
+		logger.Printf("goose: no migrations to run. current version: %d\n", current)
+		return ran, nil
 	}
 
 	ms := migrationSorter(migrations)
-	direction := current < target
 	ms.Sort(direction)
 
-	fmt.Printf("goose: migrating db environment '%v', current version: %d, target: %d\n",
+	// refuse to start a run that would stop partway at a malformed script
+	for _, m := range ms {
+		if err := checkStoreSupports(conf, m); err != nil {
+			return ran, err
+		}
+		if !m.isRegistered() && filepath.Ext(m.Source) == ".sql" {
+			if _, _, err := m.parseRenderedSQL(conf, direction); err != nil {
+				return ran, missingSection(m, err)
+			}
+		}
+	}
+
+	if len(conf.Options.IncludeTags) > 0 || len(conf.Options.ExcludeTags) > 0 {
+		ms = selectTagged(conf.Options, ms)
+		if len(ms) == 0 {
+			logger.Printf("goose: no migrations with the selected tags to run. current version: %d\n", current)
+			return ran, nil
+		}
+		ms.Sort(direction)
+	}
+
+	pending := len(ms)
+	if remaining != nil {
+		defer func() { *remaining = pending - len(ran) }()
+	}
+	if limit := conf.Options.MaxApply; direction && limit > 0 && len(ms) > limit {
+		logger.Printf("goose: applying %d of the %d pending migrations, as MaxApply allows\n", limit, len(ms))
+		ms = ms[:limit]
+	}
+
+	if conf.Options.SingleTransaction {
+		if err := checkSingleTransaction(conf, ms); err != nil {
+			return ran, err
+		}
+	}
+
+	logger.Printf("goose: migrating db environment '%v', current version: %d, target: %d\n",
 		conf.Env, current, target)
 
+	// with Options.SingleTransaction, every migration runs in batch,
+	// and none is left applied unless they all are, so none is reported
+	// to AfterEach and Progress as having succeeded until they all have
+	var batch *sql.Tx
+	if conf.Options.SingleTransaction && !dryRun {
+		if batch, err = conn.BeginTx(ctx, conf.Options.TxOptions); err != nil {
+			return ran, errors.New(fmt.Sprintf("db.Begin: %v", err))
+		}
+		defer func() {
+			if err != nil {
+				batch.Rollback()
+				logger.Printf("goose: rolled back the %d migrations run before the failure\n", len(ran))
+				reportBatched(conf, ran, len(ms), err)
+				ran = nil
+			}
+		}()
+	}
+
+	if metrics != nil {
+		metrics.Up = direction
+	}
+	var failures []*MigrationError
 	for _, m := range ms {
 
-		switch filepath.Ext(m.Source) {
-		case ".go":
-			err = runGoMigration(conf, m.Source, m.Version, direction)
-		case ".sql":
-			err = runSQLMigration(conf, db, m.Source, m.Version, direction)
+		// a migration that has begun is left to fail, and roll back,
+		// with its statements, but none is begun once ctx is done
+		if err := ctx.Err(); err != nil {
+			logger.Printf("goose: stopping before %s: %v\n", filepath.Base(m.Source), err)
+			return ran, err
+		}
+
+		if dryRun {
+			if err = dryRunMigration(conf, m, direction); err != nil {
+				return ran, err
+			}
+			ran = append(ran, m)
+			continue
+		}
+
+		if conf.Options.BeforeEach != nil {
+			conf.Options.BeforeEach(m)
+		}
+		if conf.Options.Progress != nil {
+			done := len(ran)
+			if batch != nil {
+				done = 0
+			}
+			conf.Options.Progress(done, len(ms), m)
+		}
+
+		start := time.Now()
+		switch {
+		case batch != nil:
+			err = runInBatch(ctx, conf, batch, m, direction)
+		case m.upDB != nil:
+			err = runRegisteredNoTxMigration(ctx, conf, db, conn, m, direction)
+		case m.isRegistered():
+			err = runRegisteredMigration(ctx, conf, conn, m, direction)
+		case filepath.Ext(m.Source) == ".go":
+			err = runGoMigration(ctx, conf, m, direction)
+		case filepath.Ext(m.Source) == ".sql":
+			err = runSQLMigration(ctx, conf, conn, m, direction)
+		}
+		if metrics != nil {
+			metrics.Migrations = append(metrics.Migrations, MigrationMetrics{
+				Version: m.Version, Source: m.Source, Start: start, Duration: time.Since(start), Err: err,
+			})
+		}
+
+		if conf.Options.AfterEach != nil && (batch == nil || err != nil) {
+			conf.Options.AfterEach(m, err)
 		}
 
 		if err != nil {
-			return errors.New(fmt.Sprintf("FAIL %v, quitting migration", err))
+			if cerr := ctx.Err(); cerr != nil && !errors.Is(err, cerr) {
+				return ran, fmt.Errorf("FAIL %v, quitting migration: %w", err, cerr)
+			}
+			if !conf.Options.BestEffort || ctx.Err() != nil {
+				return ran, fmt.Errorf("FAIL %w, quitting migration", err)
+			}
+			logger.Printf("FAIL %v, continuing\n", err)
+			failures = append(failures, &MigrationError{Migration: m, Err: err})
+			continue
 		}
 
-		fmt.Println("OK   ", filepath.Base(m.Source))
+		logger.Println("OK   ", filepath.Base(m.Source))
+		ran = append(ran, m)
+
+		if conf.Options.Progress != nil && batch == nil {
+			conf.Options.Progress(len(ran), len(ms), m)
+		}
 	}
 
-	return nil
+	if len(failures) > 0 {
+		return ran, &BestEffortError{Failures: failures}
+	}
+	if batch != nil {
+		if err := batch.Commit(); err != nil {
+			return ran, errors.New(fmt.Sprintf("failed to commit the migrations' transaction: %v", err))
+		}
+		reportBatched(conf, ran, len(ms), nil)
+	}
+	if left := pending - len(ran); left > 0 {
+		logger.Printf("goose: %d migrations remaining\n", left)
+	}
+	return ran, nil
+}
+
+// reportBatched calls AfterEach and Progress for each of the migrations
+// a run with Options.SingleTransaction ran, in turn, once the run's
+// transaction has committed, with a nil err, or been rolled back, with
+// the error the run failed with.
+func reportBatched(conf *DBConf, ran []*Migration, total int, err error) {
+	for i, m := range ran {
+		if conf.Options.AfterEach != nil {
+			conf.Options.AfterEach(m, err)
+		}
+		if conf.Options.Progress != nil && err == nil {
+			conf.Options.Progress(i+1, total, m)
+		}
+	}
+}
+
+// selectTagged returns the migrations opts' tags select.
+func selectTagged(opts Options, ms migrationSorter) migrationSorter {
+	has := func(m *Migration, tags []string) bool {
+		for _, tag := range tags {
+			for _, t := range m.Tags {
+				if t == tag {
+					return true
+				}
+			}
+		}
+		return false
+	}
+
+	var selected migrationSorter
+	for _, m := range ms {
+		if len(opts.IncludeTags) > 0 && !has(m, opts.IncludeTags) {
+			logger.Printf("goose: skipping %s, which has none of the included tags\n", filepath.Base(m.Source))
+			continue
+		}
+		if has(m, opts.ExcludeTags) {
+			logger.Printf("goose: skipping %s, which has an excluded tag\n", filepath.Base(m.Source))
+			continue
+		}
+		selected = append(selected, m)
+	}
+	return selected
 }
 
 // collect all the valid looking migration scripts in the
 // migrations folder, and key them by version
 func CollectMigrations(dirpath string, current, target int64) (m []*Migration, err error) {
+	return collectMigrations(nil, nil, []string{dirpath}, current, target)
+}
 
-	// extract the numeric component of each migration,
-	// filter out any uninteresting files,
-	// and ensure we only have one file per migration version.
-	filepath.Walk(dirpath, func(name string, info os.FileInfo, err error) error {
+// CollectMigrationsFS is like CollectMigrations, but looks for
+// migration scripts in dirpath within fsys.
+func CollectMigrationsFS(fsys fs.FS, dirpath string, current, target int64) (m []*Migration, err error) {
+	return collectMigrations(nil, fsys, []string{dirpath}, current, target)
+}
 
-		if v, e := NumericComponent(name); e == nil {
+// CollectFS returns every migration in dir within fsys, in ascending
+// order, as fs.Sub(fsys, dir) would see them: each Source is relative
+// to dir. With migrations embedded by "//go:embed db/migrations", for
+// example, CollectFS(fsys, "db/migrations") finds 001_init.sql,
+// rather than db/migrations/001_init.sql.
+func CollectFS(fsys fs.FS, dir string) ([]*Migration, error) {
+	sub, err := fs.Sub(fsys, path.Clean(filepath.ToSlash(dir)))
+	if err != nil {
+		return nil, err
+	}
 
-			for _, g := range m {
-				if v == g.Version {
-					log.Fatalf("more than one file specifies the migration for version %d (%s and %s)",
-						v, g.Source, filepath.Join(dirpath, name))
-				}
-			}
+	ms, err := collectMigrations(nil, sub, []string{"."}, 0, (1<<63)-1)
+	if err != nil {
+		return nil, err
+	}
+	migrationSorter(ms).Sort(true)
+	return ms, nil
+}
 
-			if versionFilter(v, current, target) {
-				m = append(m, newMigration(v, name))
-			}
+// collectMigrations walks each of dirpaths within fsys. A nil fsys means
+// the local disk, in which case each Source keeps its dirpath as its prefix.
+// Migrations added with RegisterMigration are collected too. Versions
+// are found as migrationVersion finds them with conf, which may be nil.
+func collectMigrations(conf *DBConf, fsys fs.FS, dirpaths []string, current, target int64) (m []*Migration, err error) {
+
+	// ensure we only have one file per migration version, across
+	// every directory, whether or not it's within range.
+	sources := make(map[int64]string)
+	err = walkMigrations(conf, fsys, dirpaths, func(mig *Migration) error {
+
+		if other, dup := sources[mig.Version]; dup {
+			return duplicateVersionError(mig.Version, other, mig.Source)
 		}
+		sources[mig.Version] = mig.Source
 
+		if versionFilter(mig.Version, current, target) {
+			m = append(m, mig)
+		}
 		return nil
 	})
+	if err != nil {
+		return nil, err
+	}
+
+	// a registered migration takes the place of its .go file
+	for _, r := range registeredMigrationsFor(func(int64) bool { return true }) {
+		if other, dup := sources[r.Version]; dup && filepath.Ext(other) != ".go" {
+			return nil, duplicateVersionError(r.Version, other, r.Source)
+		}
+		if !versionFilter(r.Version, current, target) {
+			continue
+		}
+
+		i := 0
+		for i < len(m) && m[i].Version != r.Version {
+			i++
+		}
+		if i == len(m) {
+			m = append(m, r)
+		} else {
+			m[i] = r
+		}
+	}
 
 	return m, nil
 }
 
+// walkMigrations calls fn with each migration script within each of
+// dirpaths in turn, extracting the version of each with conf, which may
+// be nil, and filtering out any uninteresting files. A nil fsys means
+// the local disk, in which case each Source keeps its dirpath as its
+// prefix.
+func walkMigrations(conf *DBConf, fsys fs.FS, dirpaths []string, fn func(m *Migration) error) error {
+
+	for _, dirpath := range dirpaths {
+		// fs.FS paths are slash separated and unrooted,
+		// with no "./" or trailing slash
+		dirfs, root, prefix := fsys, path.Clean(filepath.ToSlash(dirpath)), ""
+		if fsys == nil {
+			dirfs, root, prefix = os.DirFS(dirpath), ".", dirpath
+		}
+
+		err := fs.WalkDir(dirfs, root, func(name string, d fs.DirEntry, err error) error {
+
+			v, e := migrationVersion(conf, name)
+			if e != nil {
+				return nil
+			}
+
+			mig := newMigration(v, name)
+			if prefix != "" {
+				mig.Source = filepath.Join(prefix, filepath.FromSlash(name))
+			} else {
+				mig.fsys = dirfs
+			}
+			return fn(mig)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkVersionGaps makes sure there's a migration among ms for each
+// applied version a rollback from current to target would pass, which
+// would otherwise be left applied below versions that were rolled back,
+// as Options.AllowMissing lets them be.
+func checkVersionGaps(versions versionSet, ms []*Migration, current, target int64) error {
+	have := make(map[int64]bool, len(ms))
+	for _, m := range ms {
+		have[m.Version] = true
+	}
+	for _, v := range versions.applied() {
+		if versionFilter(v, current, target) && !have[v] {
+			return fmt.Errorf("can't roll back to version %d: %w: version %d; set AllowMissing (-allowmissing) to roll back past it anyway, leaving it applied",
+				target, ErrVersionGap, v)
+		}
+	}
+	return nil
+}
+
+func duplicateVersionError(v int64, a, b string) error {
+	return errors.New(fmt.Sprintf("more than one file specifies the migration for version %d (%s and %s)", v, a, b))
+}
+
+// collectMissingMigrations collects every migration up to target
+// that isn't among the applied versions, whether or not it's older
+// than the current version.
+func collectMissingMigrations(conf *DBConf, fsys fs.FS, dirpaths []string, versions versionSet, target int64) ([]*Migration, error) {
+
+	all, err := collectMigrations(conf, fsys, dirpaths, 0, target)
+	if err != nil {
+		return nil, err
+	}
+
+	var missing []*Migration
+	for _, m := range all {
+		if !versions[m.Version] {
+			missing = append(missing, m)
+		}
+	}
+	return missing, nil
+}
+
 func versionFilter(v, current, target int64) bool {
 
 	if target > current {
@@ -169,6 +896,13 @@ func (ms migrationSorter) Sort(direction bool) {
 // where XXX specifies the version number
 // and ext specifies the type of migration
 func NumericComponent(name string) (int64, error) {
+	return migrationVersion(nil, name)
+}
+
+// migrationVersion is NumericComponent, finding the version with
+// conf's Options.VersionFunc instead, if it has one. A nil conf always
+// uses the number.
+func migrationVersion(conf *DBConf, name string) (int64, error) {
 
 	base := filepath.Base(name)
 
@@ -176,12 +910,17 @@ func NumericComponent(name string) (int64, error) {
 		return 0, errors.New("not a recognized migration file type")
 	}
 
-	idx := strings.Index(base, "_")
-	if idx < 0 {
-		return 0, errors.New("no separator found")
+	var n int64
+	var e error
+	if conf != nil && conf.Options.VersionFunc != nil {
+		n, e = conf.Options.VersionFunc(base)
+	} else {
+		idx := strings.Index(base, "_")
+		if idx < 0 {
+			return 0, errors.New("no separator found")
+		}
+		n, e = strconv.ParseInt(base[:idx], 10, 64)
 	}
-
-	n, e := strconv.ParseInt(base[:idx], 10, 64)
 	if e == nil && n <= 0 {
 		return 0, errors.New("migration IDs must be greater than zero")
 	}
@@ -192,76 +931,233 @@ func NumericComponent(name string) (int64, error) {
 // retrieve the current version for this DB.
 // Create and initialize the DB version table if it doesn't exist.
 func EnsureDBVersion(conf *DBConf, db *sql.DB) (int64, error) {
+	return EnsureDBVersionContext(context.Background(), conf, db)
+}
+
+// EnsureDBVersionContext is like EnsureDBVersion, but issues its
+// queries with the given context.
+func EnsureDBVersionContext(ctx context.Context, conf *DBConf, db *sql.DB) (int64, error) {
+	current, err := currentDBVersion(ctx, conf.Driver.Dialect, db)
+	if err == nil || !errors.Is(err, ErrTableDoesNotExist) || ctx.Err() != nil {
+		return current, err
+	}
+	current, _, err = ensureDBVersion(ctx, conf, db)
+	return current, err
+}
+
+// ensureDBVersion is EnsureDBVersionContext, additionally returning
+// the state of every version, as scanVersions does.
+func ensureDBVersion(ctx context.Context, conf *DBConf, db dbConn) (int64, versionSet, error) {
 
-	rows, err := conf.Driver.Dialect.dbVersionQuery(db)
+	d := conf.Driver.Dialect
+	rows, err := queryVersionTable(ctx, d, db, d.dbVersionQuery)
 	if err != nil {
-		if err == ErrTableDoesNotExist {
-			return 0, createVersionTable(conf, db)
+		// a cancelled query is not evidence of a missing table
+		if ctx.Err() != nil {
+			return 0, nil, ctx.Err()
+		}
+		if errors.Is(err, ErrTableDoesNotExist) {
+			if conf.Options.DisableAutoCreate {
+				return 0, nil, autoCreateDisabled(err)
+			}
+			if err := createVersionTable(ctx, conf, db); err != nil {
+				return 0, nil, err
+			}
+			checkUniqueVersions(ctx, conf, db)
+			return 0, versionSet{0: true}, nil
 		}
-		return 0, err
+		return 0, nil, err
+	}
+	current, versions, err := scanVersions(rows)
+	rows.Close()
+	if err == nil {
+		checkUniqueVersions(ctx, conf, db)
+	}
+	return current, versions, err
+}
+
+// checkUniqueVersions records whether the version table's version_id
+// is unique, as it is in tables goose has created since it recorded
+// versions with an upsert, for versionInsertSql to upsert into only
+// those, as an upsert fails on a table without a constraint to conflict
+// on. Should the check fail, versions are recorded with a plain insert,
+// as they were before.
+func checkUniqueVersions(ctx context.Context, conf *DBConf, db dbConn) {
+	u, ok := conf.Driver.Dialect.(sqlVersionUpserter)
+	if !ok {
+		return
+	}
+	var n int64
+	err := db.QueryRowContext(ctx, u.uniqueVersionQuery()).Scan(&n)
+	conf.uniqueVersions = err == nil && n > 0
+}
+
+// autoCreateDisabled reports the missing version table, which
+// Options.DisableAutoCreate leaves uncreated.
+func autoCreateDisabled(err error) error {
+	return fmt.Errorf("version table %s needs creating, which DisableAutoCreate leaves to its administrators: %w", TableName(), err)
+}
+
+// queryVersionTable runs query, one of the dialect's queries of the
+// version table. If the dialect implements sqlTableChecker, a missing
+// table is reported as ErrTableDoesNotExist without query being run.
+func queryVersionTable(ctx context.Context, d SqlDialect, db dbConn, query func(context.Context, dbConn) (*sql.Rows, error)) (*sql.Rows, error) {
+	if err := checkVersionTable(ctx, d, db); err != nil {
+		return nil, err
+	}
+	return query(ctx, db)
+}
+
+// checkVersionTable reports a missing version table as
+// ErrTableDoesNotExist, if the dialect implements sqlTableChecker.
+func checkVersionTable(ctx context.Context, d SqlDialect, db dbConn) error {
+	c, ok := d.(sqlTableChecker)
+	if !ok {
+		return nil
+	}
+	var n int64
+	if err := db.QueryRowContext(ctx, c.tableExistsQuery()).Scan(&n); err != nil {
+		return errors.New(fmt.Sprintf("failed to check for the version table: %v", err))
+	}
+	if n == 0 {
+		return tableDoesNotExist(errors.New(fmt.Sprintf("no table named %s", qualifiedTableName())))
+	}
+	return nil
+}
+
+// currentDBVersion reads the current version, with the dialect's
+// currentVersionQuery if it has one. Should that fail, the version
+// table is read in full, which also reports a missing table as
+// ErrTableDoesNotExist, whichever dialect it is.
+func currentDBVersion(ctx context.Context, d SqlDialect, db dbConn) (int64, error) {
+	if cv, ok := d.(sqlCurrentVersioner); ok {
+		if err := checkVersionTable(ctx, d, db); err != nil {
+			return -1, err
+		}
+		var v sql.NullInt64
+		if err := db.QueryRowContext(ctx, cv.currentVersionQuery()).Scan(&v); err == nil && v.Valid {
+			return v.Int64, nil
+		}
+	}
+
+	rows, err := queryVersionTable(ctx, d, db, d.dbVersionQuery)
+	if err != nil {
+		return -1, err
 	}
 	defer rows.Close()
 
-	// The most recent record for each migration specifies
-	// whether it has been applied or rolled back.
-	// The first version we find that has been applied is the current version.
+	current, _, err := scanVersions(rows)
+	if err != nil {
+		return -1, err
+	}
+	return current, nil
+}
 
-	toSkip := make([]int64, 0)
+// versionSet maps each version in the version table to whether
+// its most recent record has it applied or rolled back.
+type versionSet map[int64]bool
 
-	for rows.Next() {
-		var row MigrationRecord
-		if err = rows.Scan(&row.VersionId, &row.IsApplied); err != nil {
-			log.Fatal("error scanning rows:", err)
+// applied lists the applied versions, in ascending order.
+func (vs versionSet) applied() []int64 {
+	var applied []int64
+	for v, isApplied := range vs {
+		if isApplied {
+			applied = append(applied, v)
 		}
+	}
+	sort.Slice(applied, func(i, j int) bool { return applied[i] < applied[j] })
+	return applied
+}
 
-		// have we already marked this version to be skipped?
-		skip := false
-		for _, v := range toSkip {
-			if v == row.VersionId {
-				skip = true
-				break
-			}
+// latest returns the newest applied version, or 0 if there's none.
+func (vs versionSet) latest() int64 {
+	var latest int64
+	for v, isApplied := range vs {
+		if isApplied && v > latest {
+			latest = v
 		}
+	}
+	return latest
+}
 
-		if skip {
-			continue
+// scanVersions walks the rows of a dialect's dbVersionQuery, most recent
+// first, materializing the state of every version in a single pass, so
+// that a run needn't query the version table again.
+//
+// The most recent record for each migration specifies
+// whether it has been applied or rolled back.
+// The newest version whose most recent record has it applied is the
+// current version, whichever order the versions were applied in.
+func scanVersions(rows *sql.Rows) (current int64, versions versionSet, err error) {
+
+	latest := make(versionSet)
+	found := false
+
+	for rows.Next() {
+		var row MigrationRecord
+		if err = rows.Scan(&row.VersionId, &row.IsApplied); err != nil {
+			return 0, nil, errors.New(fmt.Sprintf("error scanning rows: %v", err))
 		}
 
-		// if version has been applied we're done
-		if row.IsApplied {
-			return row.VersionId, nil
+		// only the most recent record for each version counts
+		if _, seen := latest[row.VersionId]; seen {
+			continue
 		}
+		latest[row.VersionId] = row.IsApplied
+		found = found || row.IsApplied
+	}
+	if err = rows.Err(); err != nil {
+		return 0, nil, err
+	}
 
-		// latest version of migration has not been applied.
-		toSkip = append(toSkip, row.VersionId)
+	if !found {
+		return 0, nil, errors.New("no applied version found in the version table")
 	}
 
-	panic("failure in EnsureDBVersion()")
+	return latest.latest(), latest, nil
 }
 
 // Create the goose_db_version table
 // and insert the initial 0 value into it
-func createVersionTable(conf *DBConf, db *sql.DB) error {
-	txn, err := db.Begin()
+func createVersionTable(ctx context.Context, conf *DBConf, db dbConn) error {
+	d := conf.Driver.Dialect
+
+	create, err := createVersionTableSqlFor(conf)
 	if err != nil {
 		return err
 	}
-
-	d := conf.Driver.Dialect
-
-	if _, err := txn.Exec(d.createVersionTableSql()); err != nil {
-		txn.Rollback()
+	insert, err := insertVersionSqlFor(conf)
+	if err != nil {
 		return err
 	}
+	args := versionArgs(conf, 0, true, "", false)
 
-	version := 0
-	applied := true
-	if _, err := txn.Exec(d.insertVersionSql(), version, applied); err != nil {
-		txn.Rollback()
+	if _, ok := d.(sqlNoTxDDL); ok {
+		if _, err := db.ExecContext(ctx, create); err != nil {
+			return err
+		}
+		_, err := db.ExecContext(ctx, insert, args...)
 		return err
 	}
 
-	return txn.Commit()
+	return withRetries(ctx, d, func() error {
+		txn, err := db.BeginTx(ctx, nil)
+		if err != nil {
+			return err
+		}
+
+		if _, err := txn.ExecContext(ctx, create); err != nil {
+			txn.Rollback()
+			return err
+		}
+
+		if _, err := txn.ExecContext(ctx, insert, args...); err != nil {
+			txn.Rollback()
+			return err
+		}
+
+		return txn.Commit()
+	})
 }
 
 // wrapper for EnsureDBVersion for callers that don't already have
@@ -282,6 +1178,123 @@ func GetDBVersion(conf *DBConf) (version int64, err error) {
 	return version, nil
 }
 
+// DBVersion reports the current version of the given database. If the
+// version table is missing, it's created, and 0 returned, when
+// createIfMissing is set, as EnsureDBVersion does. Otherwise the
+// database is left untouched, as by GetDBVersionOnDb, and the error
+// returned is one errors.Is reports as ErrTableDoesNotExist, so a
+// read-only replica can be asked without goose trying to write to it.
+func DBVersion(db *sql.DB, dialect SqlDialect, createIfMissing bool) (int64, error) {
+	if !createIfMissing {
+		return GetDBVersionOnDb(db, dialect)
+	}
+	return EnsureDBVersion(dialectConf(dialect, "", Options{}), db)
+}
+
+// GetDBVersionOnDb reports the current version of the given database
+// without modifying it. Unlike EnsureDBVersion it never creates the
+// version table, returning an error that errors.Is reports as
+// ErrTableDoesNotExist if it's missing, wrapping the driver's error.
+func GetDBVersionOnDb(db *sql.DB, dialect SqlDialect) (int64, error) {
+	return currentDBVersion(context.Background(), dialect, db)
+}
+
+// ListAppliedVersions returns the version of every migration applied
+// to the given database, in ascending order. Like GetDBVersionOnDb
+// it's read-only, returning an error matching ErrTableDoesNotExist if
+// the version table is missing.
+func ListAppliedVersions(db *sql.DB, dialect SqlDialect) ([]int64, error) {
+	rows, err := queryVersionTable(context.Background(), dialect, db, dialect.dbVersionQuery)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	_, vs, err := scanVersions(rows)
+	if err != nil {
+		return nil, err
+	}
+
+	// version 0 marks the creation of the version table, not a migration
+	applied := vs.applied()
+	versions := make([]int64, 0, len(applied))
+	for _, v := range applied {
+		if v > 0 {
+			versions = append(versions, v)
+		}
+	}
+	return versions, nil
+}
+
+// GetPendingMigrations returns the migrations in migrationsDir that
+// haven't been applied to the given database, in ascending order,
+// whether or not they're older than the current version. It's
+// read-only: a missing version table leaves every migration pending.
+// It takes the dialect the version table is queried with, as Status
+// and ListMigrations do, since it can't be told from db alone.
+func GetPendingMigrations(db *sql.DB, dialect SqlDialect, migrationsDir string) ([]*Migration, error) {
+	versions := versionSet{}
+	rows, err := queryVersionTable(context.Background(), dialect, db, dialect.dbVersionQuery)
+	switch {
+	case errors.Is(err, ErrTableDoesNotExist):
+	case err != nil:
+		return nil, err
+	default:
+		defer rows.Close()
+		if _, versions, err = scanVersions(rows); err != nil {
+			return nil, err
+		}
+	}
+
+	pending, err := collectMissingMigrations(nil, nil, []string{migrationsDir}, versions, (1<<63)-1)
+	if err != nil {
+		return nil, err
+	}
+	migrationSorter(pending).Sort(true)
+	return pending, nil
+}
+
+// ListMigrations returns every migration in migrationsDir, in ascending
+// order, with AppliedAt set on those applied to the given database.
+// Like Status it's read-only: a missing version table leaves every
+// migration pending.
+func ListMigrations(db *sql.DB, dialect SqlDialect, migrationsDir string) ([]*Migration, error) {
+
+	records, err := versionRecords(context.Background(), dialect, db)
+	if err != nil {
+		return nil, err
+	}
+
+	migrations, err := CollectMigrations(migrationsDir, 0, (1<<63)-1)
+	if err != nil {
+		return nil, err
+	}
+	migrationSorter(migrations).Sort(true)
+
+	for _, m := range migrations {
+		if r, ok := records[m.Version]; ok && r.IsApplied {
+			tstamp := r.TStamp
+			m.AppliedAt = &tstamp
+		}
+	}
+	return migrations, nil
+}
+
+// CompactVersionTable collapses the version table of the given database
+// into one row per applied version, dropping the history left by
+// releases that recorded rollbacks as rows of their own. Rollbacks now
+// delete a version's rows, so the table only needs compacting once.
+// Each statement leaves the table in a consistent state, so a
+// compaction that fails part way can simply be run again.
+func CompactVersionTable(db *sql.DB, dialect SqlDialect) error {
+	for _, query := range dialect.compactVersionsSql() {
+		if _, err := db.ExecContext(context.Background(), query); err != nil {
+			return errors.New(fmt.Sprintf("failed to compact the version table: %v", err))
+		}
+	}
+	return nil
+}
+
 func GetPreviousDBVersion(dirpath string, version int64) (previous int64, err error) {
 
 	previous = -1
@@ -340,68 +1353,216 @@ func GetMostRecentDBVersion(dirpath string) (version int64, err error) {
 	})
 
 	if version == -1 {
-		err = errors.New("no valid version found")
+		err = ErrNoMigrationFiles
 	}
 
 	return
 }
 
-func CreateMigration(name, migrationType, dir string, t time.Time) (path string, err error) {
+// CreateMigration writes the scaffolding for a new migration to dir,
+// returning the path of the file it created. A kind of "sql" writes a
+// script with empty Up and Down sections, from SqlMigrationTemplate;
+// "go" writes a Go migration registered with RegisterMigration, to be
+// compiled into the program running the migrations, from
+// GoMigrationTemplate.
+//
+// The migration is versioned with t formatted as a timestamp, e.g.
+// 20130106093224; CreateMigrationFromTemplate can number it in
+// sequence instead. It fails if a migration with that version already
+// exists.
+func CreateMigration(name, kind, dir string, t time.Time) (path string, err error) {
+	return CreateMigrationFromTemplate(name, kind, dir, t, false, nil)
+}
+
+// MigrationTemplateData is what the template of a new migration is
+// executed with.
+type MigrationTemplateData struct {
+	Version   int64     // the new migration's version
+	Name      string    // its name, as given to CreateMigration
+	Timestamp time.Time // the time given to CreateMigration
+}
 
-	if migrationType != "go" && migrationType != "sql" {
+// CreateMigrationFromTemplate is CreateMigration, writing the new
+// migration from tmpl, executed with a MigrationTemplateData, rather
+// than from the built-in template for its kind, e.g. to begin every
+// script with a header naming its ticket. A nil tmpl uses the built-in
+// one. Nothing is written if tmpl fails.
+//
+// With sequential set, the migration is numbered one past the newest
+// sequentially numbered migration in dir, e.g. 00043, rather than with
+// t; timestamped migrations in dir are left out of the count, as Fix
+// leaves them to be renumbered.
+func CreateMigrationFromTemplate(name, kind, dir string, t time.Time, sequential bool, tmpl *template.Template) (path string, err error) {
+
+	if kind != "go" && kind != "sql" {
 		return "", errors.New("migration type must be 'go' or 'sql'")
 	}
 
-	timestamp := t.Format("20060102150405")
-	filename := fmt.Sprintf("%v_%v.%v", timestamp, name, migrationType)
+	existing, err := os.ReadDir(dir)
+	if err != nil {
+		return "", err
+	}
+
+	versions := make(map[int64]string)
+	var last int64
+	for _, e := range existing {
+		if v, err := NumericComponent(e.Name()); err == nil && !e.IsDir() {
+			versions[v] = e.Name()
+			if v > last && v < timestampVersionThreshold {
+				last = v
+			}
+		}
+	}
 
-	fpath := filepath.Join(dir, filename)
+	version := fmt.Sprintf("%05d", last+1)
+	if !sequential {
+		version = t.Format("20060102150405")
+	}
 
-	var tmpl *template.Template
-	if migrationType == "sql" {
-		tmpl = sqlMigrationTemplate
-	} else {
-		tmpl = goMigrationTemplate
+	v, err := strconv.ParseInt(version, 10, 64)
+	if err != nil {
+		return "", err
+	}
+	if other, ok := versions[v]; ok {
+		return "", errors.New(fmt.Sprintf("a migration with version %d already exists: %s", v, other))
 	}
 
-	path, err = writeTemplateToFile(fpath, tmpl, timestamp)
+	fpath := filepath.Join(dir, fmt.Sprintf("%v_%v.%v", version, name, kind))
 
-	return
+	if tmpl == nil {
+		tmpl = SqlMigrationTemplate
+		if kind == "go" {
+			tmpl = GoMigrationTemplate
+		}
+	}
+
+	var body bytes.Buffer
+	if err := tmpl.Execute(&body, MigrationTemplateData{Version: v, Name: name, Timestamp: t}); err != nil {
+		return "", errors.New(fmt.Sprintf("failed to execute the template for migration %s: %v", filepath.Base(fpath), err))
+	}
+	if err := ioutil.WriteFile(fpath, body.Bytes(), 0644); err != nil {
+		return "", err
+	}
+	return fpath, nil
 }
 
 // Update the version table for the given migration,
 // and finalize the transaction.
 func FinalizeMigration(conf *DBConf, txn *sql.Tx, direction bool, v int64) error {
+	return finalizeMigration(context.Background(), conf, txn, direction, v, "")
+}
 
-	// XXX: drop goose_db_version table on some minimum version number?
-	stmt := conf.Driver.Dialect.insertVersionSql()
-	if _, err := txn.Exec(stmt, v, direction); err != nil {
+// finalizeMigration is FinalizeMigration, also recording the checksum
+// of an applied migration's script, if it has one.
+//
+// With Options.VersionStore set, the migration is recorded there
+// instead, once its transaction has been committed.
+func finalizeMigration(ctx context.Context, conf *DBConf, txn *sql.Tx, direction bool, v int64, checksum string) error {
+	if store := conf.Options.VersionStore; store != nil {
+		if err := txn.Commit(); err != nil {
+			return err
+		}
+		return recordInStore(ctx, store, direction, v)
+	}
+	if err := recordMigration(ctx, conf, txn, direction, v, checksum); err != nil {
 		txn.Rollback()
 		return err
 	}
-
 	return txn.Commit()
 }
 
-var goMigrationTemplate = template.Must(template.New("goose.go-migration").Parse(`
+// execer is satisfied by *sql.DB, *sql.Conn and *sql.Tx.
+type execer interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+}
+
+// queryer is what a Verify section's queries are run through:
+// the migration's transaction, or its dbConn.
+type queryer interface {
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+}
+
+// dbConn is what the runner issues its queries through: the *sql.DB it
+// was given, or a *sql.Conn taken from it, so that statements share the
+// session state of the one connection.
+type dbConn interface {
+	execer
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+	BeginTx(ctx context.Context, opts *sql.TxOptions) (*sql.Tx, error)
+}
+
+// recordMigration updates the version table for the given migration.
+func recordMigration(ctx context.Context, conf *DBConf, ex execer, direction bool, v int64, checksum string) error {
+
+	// XXX: drop goose_db_version table on some minimum version number?
+	// an applied migration gets a row, a rolled back one loses its rows,
+	// so that the table holds exactly the set of applied versions.
+	d := conf.Driver.Dialect
+	if direction {
+		insert, err := insertVersionSqlFor(conf)
+		if err != nil {
+			return err
+		}
+		_, err = ex.ExecContext(ctx, insert, versionArgs(conf, v, direction, checksum, false)...)
+		return err
+	}
+	_, err := ex.ExecContext(ctx, d.deleteVersionSql(), v)
+	return err
+}
+
+// GoMigrationTemplate is the template CreateMigration writes Go
+// migrations from.
+var GoMigrationTemplate = template.Must(template.New("goose.go-migration").Parse(`
+package migrations
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/f-kozlov/goose/lib/goose"
+)
+
+func init() {
+	goose.RegisterMigration({{ .Version }}, up{{ .Version }}, down{{ .Version }})
+}
+
+// up{{ .Version }} is executed when this migration is applied
+func up{{ .Version }}(ctx context.Context, tx *sql.Tx) error {
+	return nil
+}
+
+// down{{ .Version }} is executed when this migration is rolled back
+func down{{ .Version }}(ctx context.Context, tx *sql.Tx) error {
+	return nil
+}
+`))
+
+// GoScriptMigrationTemplate is the template the goose command writes Go
+// migrations from: a script of Up_<version> and Down_<version>
+// functions, which the command runs with `go run`, as it can't run one
+// registering itself in a program of its own.
+var GoScriptMigrationTemplate = template.Must(template.New("goose.go-script-migration").Parse(`
 package main
 
 import (
 	"database/sql"
 )
 
-// Up is executed when this migration is applied
-func Up_{{ . }}(txn *sql.Tx) {
+// Up_{{ .Version }} is executed when this migration is applied
+func Up_{{ .Version }}(txn *sql.Tx) {
 
 }
 
-// Down is executed when this migration is rolled back
-func Down_{{ . }}(txn *sql.Tx) {
+// Down_{{ .Version }} is executed when this migration is rolled back
+func Down_{{ .Version }}(txn *sql.Tx) {
 
 }
 `))
 
-var sqlMigrationTemplate = template.Must(template.New("goose.sql-migration").Parse(`
+// SqlMigrationTemplate is the template CreateMigration writes SQL
+// migrations from.
+var SqlMigrationTemplate = template.Must(template.New("goose.sql-migration").Parse(`
 -- +goose Up
 -- SQL in section 'Up' is executed when this migration is applied
 
@@ -1,7 +1,30 @@
 package goose
 
 import (
+	"bytes"
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"embed"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
 	"testing"
+	"testing/fstest"
+	"text/template"
+	"time"
+	"unicode/utf8"
 )
 
 func TestMigrationMapSortUp(t *testing.T) {
@@ -69,3 +92,3569 @@ func validateMigrationSort(t *testing.T, ms migrationSorter, sorted []int64) {
 
 	t.Log(ms)
 }
+
+func TestTableDoesNotExistCause(t *testing.T) {
+
+	db, _ := newFakeDB(t)
+
+	_, err := GetDBVersionOnDb(db, fakeDialect{})
+	if !errors.Is(err, ErrTableDoesNotExist) {
+		t.Fatalf("incorrect error for a missing version table. got %v, want %v", err, ErrTableDoesNotExist)
+	}
+	if cause := errors.Unwrap(err); cause == nil || cause.Error() != errFakeNoTable.Error() {
+		t.Errorf("incorrect cause. got %v, want %v", cause, errFakeNoTable)
+	}
+	if !strings.Contains(err.Error(), errFakeNoTable.Error()) {
+		t.Errorf("expected the error to include its cause, got %v", err)
+	}
+}
+
+func TestReadOnlyVersionQueries(t *testing.T) {
+
+	db, fdb := newFakeDB(t)
+	conf := newFakeConf(fakeDialect{})
+
+	if _, err := GetDBVersionOnDb(db, conf.Driver.Dialect); !errors.Is(err, ErrTableDoesNotExist) {
+		t.Errorf("incorrect error for a missing version table. got %v, want %v", err, ErrTableDoesNotExist)
+	}
+	if _, err := ListAppliedVersions(db, conf.Driver.Dialect); !errors.Is(err, ErrTableDoesNotExist) {
+		t.Errorf("incorrect error for a missing version table. got %v, want %v", err, ErrTableDoesNotExist)
+	}
+	if fdb.versions != nil {
+		t.Fatal("read-only queries created the version table")
+	}
+
+	dir := writeMigrations(t, map[string]string{
+		"001_a.sql": "-- +goose Up\nSELECT 1;\n-- +goose Down\nSELECT 1;\n",
+		"002_b.sql": "-- +goose Up\nSELECT 2;\n-- +goose Down\nSELECT 2;\n",
+		"003_c.sql": "-- +goose Up\nSELECT 3;\n-- +goose Down\nSELECT 3;\n",
+	})
+	if err := RunMigrationsOnDb(conf, dir, 3, db); err != nil {
+		t.Fatal(err)
+	}
+
+	current, err := GetDBVersionOnDb(db, conf.Driver.Dialect)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if current != 3 {
+		t.Errorf("incorrect current version. got %v, want 3", current)
+	}
+
+	applied, err := ListAppliedVersions(db, conf.Driver.Dialect)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []int64{1, 2, 3}; !reflect.DeepEqual(applied, want) {
+		t.Errorf("incorrect applied versions. got %v, want %v", applied, want)
+	}
+}
+
+func TestDryRun(t *testing.T) {
+
+	db, fdb := newFakeDB(t)
+	conf := newFakeConf(fakeDialect{})
+	conf.Options.DryRun = true
+
+	dir := writeMigrations(t, map[string]string{
+		"001_a.sql": "-- +goose Up\nCREATE TABLE a (id int);\n-- +goose Down\nDROP TABLE a;\n",
+	})
+	if err := RunMigrationsOnDb(conf, dir, 1, db); err != nil {
+		t.Fatal(err)
+	}
+
+	if fdb.versions != nil || len(fdb.statements()) != 0 {
+		t.Errorf("dry run touched the database: versions %v, statements %q", fdb.versions, fdb.statements())
+	}
+}
+
+func TestUpTo(t *testing.T) {
+
+	files := map[string]string{
+		"001_a.sql": "-- +goose Up\nCREATE TABLE a (id int);\n-- +goose Down\nDROP TABLE a;\n",
+		"002_b.sql": "-- +goose Up\nCREATE TABLE b (id int);\n-- +goose Down\nDROP TABLE b;\n",
+		"003_c.sql": "-- +goose Up\nCREATE TABLE c (id int);\n-- +goose Down\nDROP TABLE c;\n",
+		"004_d.sql": "-- +goose Up\nCREATE TABLE d (id int);\n-- +goose Down\nDROP TABLE d;\n",
+	}
+
+	db, fdb := newFakeDB(t)
+	conf := newFakeConf(fakeDialect{})
+	dir := writeMigrations(t, files)
+
+	// target in the middle of the set
+	if err := UpTo(conf, db, dir, 2); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := fdb.appliedVersions(), []int64{1, 2}; !reflect.DeepEqual(got, want) {
+		t.Errorf("incorrect applied versions. got %v, want %v", got, want)
+	}
+	want := []string{"CREATE TABLE a (id int);", "CREATE TABLE b (id int);"}
+	if got := fdb.statements(); !reflect.DeepEqual(got, want) {
+		t.Errorf("incorrect statements. got %q, want %q", got, want)
+	}
+
+	// target equal to current is a no-op
+	if err := UpTo(conf, db, dir, 2); err != nil {
+		t.Fatal(err)
+	}
+	if got := fdb.statements(); !reflect.DeepEqual(got, want) {
+		t.Errorf("migrating to the current version ran statements. got %q, want %q", got, want)
+	}
+
+	// target behind current is refused
+	if err := UpTo(conf, db, dir, 1); err == nil {
+		t.Error("expected an error migrating up to an older version")
+	}
+	if got, want := fdb.appliedVersions(), []int64{1, 2}; !reflect.DeepEqual(got, want) {
+		t.Errorf("incorrect applied versions. got %v, want %v", got, want)
+	}
+}
+
+func TestDownTo(t *testing.T) {
+
+	files := map[string]string{
+		"001_a.sql": "-- +goose Up\nCREATE TABLE a (id int);\n-- +goose Down\nDROP TABLE a;\n",
+		"002_b.sql": "-- +goose Up\nCREATE TABLE b (id int);\n-- +goose Down\nDROP TABLE b;\n",
+		"003_c.sql": "-- +goose Up\nCREATE TABLE c (id int);\n-- +goose Down\nDROP TABLE c;\n",
+		"004_d.sql": "-- +goose Up\nCREATE TABLE d (id int);\n-- +goose Down\nDROP TABLE d;\n",
+	}
+
+	db, fdb := newFakeDB(t)
+	conf := newFakeConf(fakeDialect{})
+	dir := writeMigrations(t, files)
+
+	if err := RunMigrationsOnDb(conf, dir, 4, db); err != nil {
+		t.Fatal(err)
+	}
+
+	// stop exactly at the target
+	if err := DownTo(conf, db, dir, 2); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := fdb.appliedVersions(), []int64{1, 2}; !reflect.DeepEqual(got, want) {
+		t.Errorf("incorrect applied versions. got %v, want %v", got, want)
+	}
+	if got, want := fdb.statements()[4:], []string{"DROP TABLE d;", "DROP TABLE c;"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("incorrect rollback statements. got %q, want %q", got, want)
+	}
+
+	// target ahead of current is refused
+	if err := DownTo(conf, db, dir, 3); err == nil {
+		t.Error("expected an error migrating down to a newer version")
+	}
+
+	// target 0 rolls everything back
+	if err := DownTo(conf, db, dir, 0); err != nil {
+		t.Fatal(err)
+	}
+	if got := fdb.appliedVersions(); len(got) != 0 {
+		t.Errorf("expected no applied versions, got %v", got)
+	}
+	if got, want := fdb.statements()[6:], []string{"DROP TABLE b;", "DROP TABLE a;"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("incorrect rollback statements. got %q, want %q", got, want)
+	}
+}
+
+func TestRunMigrationsFS(t *testing.T) {
+
+	fsys := fstest.MapFS{
+		"db/migrations/001_a.sql": {Data: []byte("-- +goose Up\nCREATE TABLE a (id int);\n-- +goose Down\nDROP TABLE a;\n")},
+		"db/migrations/002_b.sql": {Data: []byte("-- +goose Up\nCREATE TABLE b (id int);\n-- +goose Down\nDROP TABLE b;\n")},
+		"db/migrations/README":    {Data: []byte("not a migration")},
+	}
+
+	ms, err := CollectMigrationsFS(fsys, "db/migrations", 0, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ms) != 2 || ms[0].Source != "db/migrations/001_a.sql" {
+		t.Fatalf("unexpected migrations collected: %v", ms)
+	}
+
+	db, fdb := newFakeDB(t)
+	conf := newFakeConf(fakeDialect{})
+
+	if err := RunMigrationsFS(conf, fsys, "db/migrations", 2, db); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := fdb.appliedVersions(), []int64{1, 2}; !reflect.DeepEqual(got, want) {
+		t.Errorf("incorrect applied versions. got %v, want %v", got, want)
+	}
+
+	if err := RunMigrationsFS(conf, fsys, "db/migrations", 0, db); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"CREATE TABLE a (id int);", "CREATE TABLE b (id int);", "DROP TABLE b;", "DROP TABLE a;"}
+	if got := fdb.statements(); !reflect.DeepEqual(got, want) {
+		t.Errorf("incorrect statements. got %q, want %q", got, want)
+	}
+}
+
+//go:embed testdata/embed
+var embeddedMigrations embed.FS
+
+func TestCollectFS(t *testing.T) {
+
+	for _, dir := range []string{"testdata/embed/db/migrations", "./testdata/embed/db/migrations/"} {
+		ms, err := CollectFS(embeddedMigrations, dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var sources []string
+		for _, m := range ms {
+			sources = append(sources, m.Source)
+		}
+		// migrations in nested directories are found too, but not
+		// those outside of dir
+		want := []string{"001_create_users.sql", "archive/002_add_email.sql"}
+		if !reflect.DeepEqual(sources, want) {
+			t.Errorf("CollectFS(%q) found %q, want %q", dir, sources, want)
+		}
+	}
+
+	ms, err := CollectFS(embeddedMigrations, "testdata/embed/db/migrations")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stmts, _, err := ms[1].parseSQL(true); err != nil || len(stmts) != 1 || !strings.Contains(stmts[0], "ALTER TABLE users ADD email text;") {
+		t.Errorf("couldn't read a collected migration: %q, %v", stmts, err)
+	}
+
+	if _, err := CollectFS(embeddedMigrations, "/testdata"); err == nil {
+		t.Error("expected an invalid path to be rejected")
+	}
+}
+
+func TestAllowMissing(t *testing.T) {
+
+	files := map[string]string{
+		"20231001_a.sql": "-- +goose Up\nCREATE TABLE a (id int);\n-- +goose Down\nDROP TABLE a;\n",
+		"20231101_c.sql": "-- +goose Up\nCREATE TABLE c (id int);\n-- +goose Down\nDROP TABLE c;\n",
+	}
+
+	db, fdb := newFakeDB(t)
+	conf := newFakeConf(fakeDialect{})
+	dir := writeMigrations(t, files)
+
+	if err := RunMigrationsOnDb(conf, dir, 20231101, db); err != nil {
+		t.Fatal(err)
+	}
+
+	// a branch merged in an older migration that never ran
+	if err := ioutil.WriteFile(filepath.Join(dir, "20231015_b.sql"),
+		[]byte("-- +goose Up\nCREATE TABLE b (id int);\n-- +goose Down\nDROP TABLE b;\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// strict ordering skips it
+	if err := RunMigrationsOnDb(conf, dir, 20231101, db); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := fdb.appliedVersions(), []int64{20231001, 20231101}; !reflect.DeepEqual(got, want) {
+		t.Errorf("incorrect applied versions. got %v, want %v", got, want)
+	}
+
+	conf.Options.AllowMissing = true
+	if err := RunMigrationsOnDb(conf, dir, 20231101, db); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := fdb.appliedVersions(), []int64{20231001, 20231101, 20231015}; !reflect.DeepEqual(got, want) {
+		t.Errorf("incorrect applied versions. got %v, want %v", got, want)
+	}
+	want := []string{"CREATE TABLE a (id int);", "CREATE TABLE c (id int);", "CREATE TABLE b (id int);"}
+	if got := fdb.statements(); !reflect.DeepEqual(got, want) {
+		t.Errorf("incorrect statements. got %q, want %q", got, want)
+	}
+}
+
+func TestChecksumMismatch(t *testing.T) {
+
+	files := map[string]string{
+		"001_a.sql": "-- +goose Up\nCREATE TABLE a (id int);\n-- +goose Down\nDROP TABLE a;\n",
+		"002_b.sql": "-- +goose Up\nCREATE TABLE b (id int);\n-- +goose Down\nDROP TABLE b;\n",
+	}
+
+	db, fdb := newFakeDB(t)
+	conf := newFakeConf(fakeDialect{})
+	dir := writeMigrations(t, files)
+
+	if err := RunMigrationsOnDb(conf, dir, 1, db); err != nil {
+		t.Fatal(err)
+	}
+
+	want := checksumOf([]byte(files["001_a.sql"]))
+	if got := fdb.versions[len(fdb.versions)-1].checksum(); got != want {
+		t.Errorf("incorrect recorded checksum. got %q, want %q", got, want)
+	}
+
+	// edit the migration after it was applied
+	if err := ioutil.WriteFile(filepath.Join(dir, "001_a.sql"),
+		[]byte("-- +goose Up\nCREATE TABLE a (id bigint);\n-- +goose Down\nDROP TABLE a;\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	err := RunMigrationsOnDb(conf, dir, 2, db)
+	if err == nil || !strings.Contains(err.Error(), "migration 1 (001_a.sql) has changed") {
+		t.Fatalf("expected a checksum mismatch naming migration 1, got %v", err)
+	}
+	if got, want := fdb.appliedVersions(), []int64{1}; !reflect.DeepEqual(got, want) {
+		t.Errorf("incorrect applied versions. got %v, want %v", got, want)
+	}
+}
+
+func TestChecksumColumnUpgrade(t *testing.T) {
+
+	db, fdb := newFakeDB(t)
+	conf := newFakeConf(fakeDialect{})
+
+	// a version table from before checksums were recorded
+	fdb.versions = []fakeVersionRow{{id: 1, args: []driver.Value{int64(0), true}}}
+	fdb.nextID = 1
+	fdb.noChecksum = true
+
+	dir := writeMigrations(t, map[string]string{
+		"001_a.sql": "-- +goose Up\nCREATE TABLE a (id int);\n-- +goose Down\nDROP TABLE a;\n",
+	})
+	if err := RunMigrationsOnDb(conf, dir, 1, db); err != nil {
+		t.Fatal(err)
+	}
+
+	if fdb.noChecksum {
+		t.Error("checksum column was not added to the version table")
+	}
+	if got, want := fdb.appliedVersions(), []int64{1}; !reflect.DeepEqual(got, want) {
+		t.Errorf("incorrect applied versions. got %v, want %v", got, want)
+	}
+	if got := fdb.versions[1].checksum(); got == "" {
+		t.Error("no checksum recorded for migration 1")
+	}
+}
+
+func TestStatus(t *testing.T) {
+
+	db, _ := newFakeDB(t)
+	conf := newFakeConf(fakeDialect{})
+	dir := writeMigrations(t, map[string]string{
+		"001_a.sql": "-- +goose Up\nCREATE TABLE a (id int);\n-- +goose Down\nDROP TABLE a;\n",
+		"002_b.sql": "-- +goose Up\nCREATE TABLE b (id int);\n-- +goose Down\nDROP TABLE b;\n",
+		"003_c.sql": "-- +goose Up\nCREATE TABLE c (id int);\n-- +goose Down\nDROP TABLE c;\n",
+	})
+
+	// a missing version table leaves everything pending
+	statuses, err := Status(db, conf.Driver.Dialect, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(statuses) != 3 || statuses[0].Applied || statuses[2].Applied {
+		t.Fatalf("expected 3 pending migrations, got %+v", statuses)
+	}
+
+	if err := RunMigrationsOnDb(conf, dir, 2, db); err != nil {
+		t.Fatal(err)
+	}
+
+	// the script for 002 goes missing
+	if err := os.Remove(filepath.Join(dir, "002_b.sql")); err != nil {
+		t.Fatal(err)
+	}
+
+	statuses, err = Status(db, conf.Driver.Dialect, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	type summary struct {
+		Version int64
+		Source  string
+		Applied bool
+	}
+	var got []summary
+	for _, s := range statuses {
+		got = append(got, summary{s.Version, filepath.Base(s.Source), s.Applied})
+		if s.Applied == s.AppliedAt.IsZero() {
+			t.Errorf("version %d: applied %v, but applied at %v", s.Version, s.Applied, s.AppliedAt)
+		}
+	}
+	want := []summary{{1, "001_a.sql", true}, {2, ".", true}, {3, "003_c.sql", false}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("incorrect statuses. got %+v, want %+v", got, want)
+	}
+}
+
+func TestConfGobRoundTrip(t *testing.T) {
+
+	readDB, _ := newFakeDB(t)
+	conf := &DBConf{
+		MigrationsDir: "db/migrations",
+		Env:           "production",
+		Driver:        DBDriver{Name: "postgres", OpenStr: "dbname=app", OpenNoDBStr: "dbname=postgres", Import: "github.com/lib/pq", Dialect: PostgresDialect{}},
+		PgSchema:      "app",
+		DBName:        "app",
+		NoDB:          true,
+		Options: Options{
+			Lock: true, LockTimeout: time.Minute, PingAttempts: 3, PingBackoff: time.Second, ProbeDialect: true,
+			DryRun: true, AllowMissing: true, MaxApply: 2, BestEffort: true, SingleTransaction: true,
+			ReadDB:            readDB,
+			SessionSetup:      []string{"SET lock_timeout = '1s'"},
+			IncludeTags:       []string{"a"},
+			ExcludeTags:       []string{"b"},
+			DisableAutoCreate: true,
+			VersionStore:      NewVersionStore(newFakeConf(fakeDialect{}), readDB),
+			ExtraColumns:      []VersionColumn{{Name: "deployed_by", Type: "text", Value: "ci"}},
+			TxOptions:         &sql.TxOptions{Isolation: sql.LevelSerializable, ReadOnly: true},
+			StatementTimeout:  time.Second,
+			StatementRewriter: func(stmt string) (string, error) { return stmt, nil },
+			MultiStatement:    true,
+			StrictEnvSub:      true,
+			TemplateData:      map[string]interface{}{"Shard": 3},
+			StrictTemplate:    true,
+			BeforeEach:        func(m *Migration) {},
+			AfterEach:         func(m *Migration, err error) {},
+			Progress:          func(done, total int, m *Migration) {},
+			Metrics:           func(m *RunMetrics) {},
+		},
+	}
+
+	var bb bytes.Buffer
+	if err := gob.NewEncoder(&bb).Encode(conf); err != nil {
+		t.Fatal(err)
+	}
+	var got DBConf
+	if err := gob.NewDecoder(&bb).Decode(&got); err != nil {
+		t.Fatal(err)
+	}
+
+	// what gob can't encode is left out, and everything else kept
+	dropped := map[string]bool{
+		"ReadDB": true, "VersionStore": true, "StatementRewriter": true, "VersionFunc": true, "TemplateData": true,
+		"BeforeEach": true, "AfterEach": true, "Progress": true, "Metrics": true,
+	}
+	want := *conf
+	opts := reflect.ValueOf(&want.Options).Elem()
+	for i := 0; i < opts.NumField(); i++ {
+		name := opts.Type().Field(i).Name
+		_, kept := reflect.TypeOf(gobOptions{}).FieldByName(name)
+		if dropped[name] == kept {
+			t.Errorf("Options.%s must be either encoded, in gobOptions, or dropped", name)
+		}
+		if dropped[name] {
+			opts.Field(i).Set(reflect.Zero(opts.Field(i).Type()))
+		}
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("incorrect conf after a round trip.\ngot  %+v\nwant %+v", got, want)
+	}
+}
+
+func TestRegisteredMigrations(t *testing.T) {
+
+	backfill := func(ctx context.Context, tx *sql.Tx) error {
+		_, err := tx.ExecContext(ctx, "UPDATE a SET b_id = 1;")
+		return err
+	}
+	broken := func(ctx context.Context, tx *sql.Tx) error {
+		if _, err := tx.ExecContext(ctx, "UPDATE c SET id = 2;"); err != nil {
+			return err
+		}
+		return errors.New("backfill failed")
+	}
+	RegisterMigration(2, backfill, nil)
+	RegisterMigration(4, broken, nil)
+	defer func() {
+		registeredMigrations.Lock()
+		delete(registeredMigrations.m, 2)
+		delete(registeredMigrations.m, 4)
+		registeredMigrations.Unlock()
+	}()
+
+	db, fdb := newFakeDB(t)
+	conf := newFakeConf(fakeDialect{})
+	dir := writeMigrations(t, map[string]string{
+		"001_a.sql": "-- +goose Up\nCREATE TABLE a (id int);\n-- +goose Down\nDROP TABLE a;\n",
+		"003_c.sql": "-- +goose Up\nCREATE TABLE c (id int);\n-- +goose Down\nDROP TABLE c;\n",
+	})
+
+	if err := RunMigrationsOnDb(conf, dir, 3, db); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"CREATE TABLE a (id int);", "UPDATE a SET b_id = 1;", "CREATE TABLE c (id int);"}
+	if got := fdb.statements(); !reflect.DeepEqual(got, want) {
+		t.Errorf("incorrect statements. got %q, want %q", got, want)
+	}
+
+	// a failing migration rolls back its own statements and version row
+	if err := RunMigrationsOnDb(conf, dir, 4, db); err == nil {
+		t.Fatal("expected the failing migration to fail the run")
+	}
+	if got := fdb.statements(); !reflect.DeepEqual(got, want) {
+		t.Errorf("incorrect statements. got %q, want %q", got, want)
+	}
+	if got, want := fdb.appliedVersions(), []int64{1, 2, 3}; !reflect.DeepEqual(got, want) {
+		t.Errorf("incorrect applied versions. got %v, want %v", got, want)
+	}
+}
+
+func TestRegisteredNoTxMigrations(t *testing.T) {
+
+	index := func(ctx context.Context, db *sql.DB) error {
+		_, err := db.ExecContext(ctx, "CREATE INDEX CONCURRENTLY a_id ON a (id);")
+		return err
+	}
+	dropIndex := func(ctx context.Context, db *sql.DB) error {
+		_, err := db.ExecContext(ctx, "DROP INDEX CONCURRENTLY a_id;")
+		return err
+	}
+	broken := func(ctx context.Context, db *sql.DB) error {
+		return errors.New("service unavailable")
+	}
+	RegisterMigrationNoTx(2, index, dropIndex)
+	RegisterMigrationNoTx(4, broken, nil)
+	defer func() {
+		registeredMigrations.Lock()
+		delete(registeredMigrations.m, 2)
+		delete(registeredMigrations.m, 4)
+		registeredMigrations.Unlock()
+	}()
+
+	db, fdb := newFakeDB(t)
+	conf := newFakeConf(fakeDialect{})
+	dir := writeMigrations(t, map[string]string{
+		"001_a.sql": "-- +goose Up\nCREATE TABLE a (id int);\n-- +goose Down\nDROP TABLE a;\n",
+		"003_c.sql": "-- +goose Up\nCREATE TABLE c (id int);\n-- +goose Down\nDROP TABLE c;\n",
+	})
+
+	if err := RunMigrationsOnDb(conf, dir, 3, db); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := fdb.appliedVersions(), []int64{1, 2, 3}; !reflect.DeepEqual(got, want) {
+		t.Errorf("incorrect applied versions. got %v, want %v", got, want)
+	}
+	if untxed := strings.Join(fdb.untxed, "\n"); !strings.Contains(untxed, "CREATE INDEX CONCURRENTLY a_id ON a (id);") {
+		t.Errorf("migration 2 ran in a transaction: %q", fdb.untxed)
+	}
+
+	if err := RunMigrationsOnDb(conf, dir, 1, db); err != nil {
+		t.Fatal(err)
+	}
+	if got := fdb.statements(); got[len(got)-1] != "DROP INDEX CONCURRENTLY a_id;" {
+		t.Errorf("migration 2 wasn't rolled back: %q", got)
+	}
+
+	// a failure leaves the database dirty, as whatever ran stays
+	if err := RunMigrationsOnDb(conf, dir, 4, db); !errors.Is(err, ErrDirtyDatabase) {
+		t.Fatalf("expected the failing migration to leave the database dirty, got %v", err)
+	}
+	if got, want := fdb.dirtyVersions(), []int64{4}; !reflect.DeepEqual(got, want) {
+		t.Errorf("incorrect dirty versions. got %v, want %v", got, want)
+	}
+
+	db, _ = newNamedFakeDB(t, t.Name()+"/batch")
+	conf.Options.SingleTransaction = true
+	if err := RunMigrationsOnDb(conf, dir, 3, db); err == nil || !strings.Contains(err.Error(), "RegisterMigrationNoTx") {
+		t.Errorf("expected a single transaction run to refuse a migration registered with RegisterMigrationNoTx, got %v", err)
+	}
+
+	func() {
+		defer func() {
+			if r := recover(); r == nil || !strings.Contains(fmt.Sprint(r), "already registered") {
+				t.Errorf("expected registering version 2 in a transaction too to panic, got %v", r)
+			}
+		}()
+		RegisterMigration(2, func(ctx context.Context, tx *sql.Tx) error { return nil }, nil)
+	}()
+}
+
+func TestNoTransaction(t *testing.T) {
+
+	db, fdb := newFakeDB(t)
+	conf := newFakeConf(fakeDialect{})
+	dir := writeMigrations(t, map[string]string{
+		"001_a.sql": "-- +goose Up\nCREATE TABLE a (id int);\n-- +goose Down\nDROP TABLE a;\n",
+		"002_b.sql": "-- +goose NO TRANSACTION\n-- +goose Up\nCREATE INDEX CONCURRENTLY a_id ON a (id);\n-- +goose Down\nDROP INDEX CONCURRENTLY a_id;\n",
+	})
+
+	if err := RunMigrationsOnDb(conf, dir, 2, db); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := fdb.appliedVersions(), []int64{1, 2}; !reflect.DeepEqual(got, want) {
+		t.Errorf("incorrect applied versions. got %v, want %v", got, want)
+	}
+
+	untxed := strings.Join(fdb.untxed, "\n")
+	if !strings.Contains(untxed, "CREATE INDEX CONCURRENTLY a_id ON a (id);") {
+		t.Errorf("NO TRANSACTION migration ran in a transaction: %q", fdb.untxed)
+	}
+	if strings.Contains(untxed, "CREATE TABLE a (id int);") {
+		t.Errorf("migration ran outside of a transaction: %q", fdb.untxed)
+	}
+}
+
+func TestDirtyMigration(t *testing.T) {
+
+	db, fdb := newFakeDB(t)
+	conf := newFakeConf(fakeDialect{})
+
+	// a version table from before dirty migrations were recorded
+	fdb.versions = []fakeVersionRow{{id: 1, args: []driver.Value{int64(0), true, ""}}}
+	fdb.nextID = 1
+	fdb.noDirty = true
+
+	dir := writeMigrations(t, map[string]string{
+		"001_a.sql": "-- +goose Up\nCREATE TABLE a (id int);\n-- +goose Down\nDROP TABLE a;\n",
+		"002_b.sql": "-- +goose NO TRANSACTION\n-- +goose Up\nCREATE INDEX a_id ON a (id);\nCREATE INDEX a_x ON a (x);\n-- +goose Down\nDROP INDEX a_x;\nDROP INDEX a_id;\n",
+	})
+
+	// failing before any of its statements ran leaves nothing dirty
+	fdb.failOn = "a_id"
+	if err := RunMigrationsOnDb(conf, dir, 2, db); err == nil || errors.Is(err, ErrDirtyDatabase) {
+		t.Fatalf("expected a clean failure, got %v", err)
+	}
+	if fdb.noDirty {
+		t.Error("dirty column was not added to the version table")
+	}
+	if got := fdb.dirtyVersions(); len(got) != 0 {
+		t.Errorf("expected no dirty versions, got %v", got)
+	}
+	if got, want := fdb.appliedVersions(), []int64{1}; !reflect.DeepEqual(got, want) {
+		t.Errorf("incorrect applied versions. got %v, want %v", got, want)
+	}
+
+	// failing partway does, and blocks later runs
+	fdb.failOn = "a_x"
+	if err := RunMigrationsOnDb(conf, dir, 2, db); !errors.Is(err, ErrDirtyDatabase) {
+		t.Fatalf("expected ErrDirtyDatabase, got %v", err)
+	}
+	fdb.failOn = ""
+	if got, want := fdb.dirtyVersions(), []int64{2}; !reflect.DeepEqual(got, want) {
+		t.Errorf("incorrect dirty versions. got %v, want %v", got, want)
+	}
+	err := RunMigrationsOnDb(conf, dir, 2, db)
+	if !errors.Is(err, ErrDirtyDatabase) || !strings.Contains(err.Error(), "migration 2") {
+		t.Fatalf("expected a dirty database naming migration 2 to be refused, got %v", err)
+	}
+
+	// the index was created by hand, so 002 is recorded as applied
+	if err := Force(conf, db, -1); err == nil {
+		t.Error("expected a negative version to be refused")
+	}
+	if err := Force(conf, db, 2); err != nil {
+		t.Fatal(err)
+	}
+	if got := fdb.dirtyVersions(); len(got) != 0 {
+		t.Errorf("expected no dirty versions once forced, got %v", got)
+	}
+	if got, want := fdb.appliedVersions(), []int64{1, 2}; !reflect.DeepEqual(got, want) {
+		t.Errorf("incorrect applied versions. got %v, want %v", got, want)
+	}
+
+	// and a successful rollback leaves no mark behind
+	if err := RunMigrationsOnDb(conf, dir, 1, db); err != nil {
+		t.Fatal(err)
+	}
+	if got := fdb.dirtyVersions(); len(got) != 0 {
+		t.Errorf("expected no dirty versions, got %v", got)
+	}
+	if got, want := fdb.appliedVersions(), []int64{1}; !reflect.DeepEqual(got, want) {
+		t.Errorf("incorrect applied versions. got %v, want %v", got, want)
+	}
+}
+
+// noTxDDLDialect is a fakeDialect that can't run DDL within a transaction.
+type noTxDDLDialect struct{ fakeDialect }
+
+func (noTxDDLDialect) noTxDDL() {}
+
+func TestNoTxDDLDialect(t *testing.T) {
+
+	db, fdb := newFakeDB(t)
+	conf := newFakeConf(noTxDDLDialect{})
+	dir := writeMigrations(t, map[string]string{
+		"001_a.sql": "-- +goose Up\nCREATE TABLE a (id int);\n-- +goose Down\nDROP TABLE a;\n",
+	})
+
+	if err := RunMigrationsOnDb(conf, dir, 1, db); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := fdb.appliedVersions(), []int64{1}; !reflect.DeepEqual(got, want) {
+		t.Errorf("incorrect applied versions. got %v, want %v", got, want)
+	}
+
+	untxed := strings.Join(fdb.untxed, "\n")
+	for _, want := range []string{"CREATE TABLE goose_db_version", "CREATE TABLE a (id int);"} {
+		if !strings.Contains(untxed, want) {
+			t.Errorf("expected %q to run outside of a transaction, got %q", want, fdb.untxed)
+		}
+	}
+}
+
+// sessionDialect is a fakeDialect with session setup of its own.
+type sessionDialect struct{ fakeDialect }
+
+func (sessionDialect) sessionSetupSql() []string { return []string{"SET dialect_default = 1"} }
+
+func TestSessionSetup(t *testing.T) {
+
+	db, fdb := newFakeDB(t)
+	// every connection returned to the pool is closed, so
+	// the setup is lost unless the run holds on to its own
+	db.SetMaxIdleConns(0)
+
+	conf := newFakeConf(sessionDialect{})
+	conf.Options.SessionSetup = []string{"SET lock_timeout = '5s'"}
+	dir := writeMigrations(t, map[string]string{
+		"001_a.sql": "-- +goose Up\nCREATE TABLE a (id int);\n",
+		"002_b.sql": "-- +goose Up\nCREATE TABLE b (id int);\n",
+	})
+
+	if err := RunMigrationsOnDb(conf, dir, 2, db); err != nil {
+		t.Fatal(err)
+	}
+
+	// the version table's creation, and each migration, ran in the session
+	setup := "SET dialect_default = 1; SET lock_timeout = '5s'"
+	if want := []string{setup, setup, setup}; !reflect.DeepEqual(fdb.insertSettings, want) {
+		t.Errorf("version table inserts ran with settings %q, want %q", fdb.insertSettings, want)
+	}
+
+	conf.Options.SessionSetup = []string{"SET nonsense"}
+	fdb.failOn = "nonsense"
+	if err := RunMigrationsOnDb(conf, dir, 0, db); err == nil || !strings.Contains(err.Error(), "session setup") {
+		t.Errorf("expected the session setup to fail the run, got %v", err)
+	}
+	if got, want := fdb.appliedVersions(), []int64{1, 2}; !reflect.DeepEqual(got, want) {
+		t.Errorf("incorrect applied versions. got %v, want %v", got, want)
+	}
+}
+
+// lockingDialect is a fakeDialect supporting Options.Lock.
+type lockingDialect struct{ fakeDialect }
+
+func (lockingDialect) lockSql(name string, timeout time.Duration) string {
+	return "SELECT fake_lock('" + name + "')"
+}
+
+func (lockingDialect) unlockSql(name string) string {
+	return "SELECT fake_unlock('" + name + "')"
+}
+
+// tryLockingDialect is a lockingDialect that polls for the lock when
+// there's a LockTimeout.
+type tryLockingDialect struct{ lockingDialect }
+
+func (tryLockingDialect) tryLockSql(name string) string {
+	return "SELECT fake_try_lock('" + name + "')"
+}
+
+func TestLockContention(t *testing.T) {
+	defer func(d time.Duration) { lockPollInterval = d }(lockPollInterval)
+	lockPollInterval = 5 * time.Millisecond
+
+	db, fdb := newFakeDB(t)
+	fdb.slowOn = "slow()"
+	conf := newFakeConf(tryLockingDialect{})
+	conf.Options.Lock = true
+	dir := writeMigrations(t, map[string]string{
+		"001_a.sql":    "-- +goose Up\nCREATE TABLE a (id int);\n",
+		"002_slow.sql": "-- +goose Up\nSELECT slow();\n",
+	})
+
+	// the first migrator holds the lock until its batch is cancelled
+	ctx, cancel := context.WithCancel(context.Background())
+	first := make(chan error)
+	go func() { first <- RunMigrationsOnDbContext(ctx, conf, dir, 2, db) }()
+	for start := time.Now(); !fdb.lockHeld(); time.Sleep(time.Millisecond) {
+		if time.Since(start) > 5*time.Second {
+			t.Fatal("the first migrator never took the lock")
+		}
+	}
+
+	// so the second gives up once its timeout has passed, polling
+	polled := *conf
+	polled.Options.LockTimeout = 50 * time.Millisecond
+	second := make(chan error)
+	go func() { second <- RunMigrationsOnDb(&polled, dir, 2, db) }()
+	if err := <-second; err == nil || !strings.Contains(err.Error(), "could not acquire migration lock") {
+		t.Errorf("expected the second migrator to time out waiting for the lock, got %v", err)
+	}
+
+	// or once its context is done, waiting
+	deadline, cancelDeadline := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancelDeadline()
+	go func() { second <- RunMigrationsOnDbContext(deadline, conf, dir, 2, db) }()
+	if err := <-second; !errors.Is(err, context.DeadlineExceeded) || !strings.Contains(err.Error(), "could not acquire migration lock") {
+		t.Errorf("expected the second migrator to give up waiting for the lock at its deadline, got %v", err)
+	}
+
+	// the lock is released although the first migrator's batch failed
+	cancel()
+	if err := <-first; !errors.Is(err, context.Canceled) {
+		t.Errorf("expected the first migrator to be cancelled, got %v", err)
+	}
+	if fdb.lockHeld() {
+		t.Fatal("lock still held after the first migrator's batch failed")
+	}
+
+	fdb.slowOn = ""
+	if err := RunMigrationsOnDb(&polled, dir, 2, db); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := fdb.appliedVersions(), []int64{1, 2}; !reflect.DeepEqual(got, want) {
+		t.Errorf("incorrect applied versions. got %v, want %v", got, want)
+	}
+}
+
+func TestRunSharesOneConnection(t *testing.T) {
+
+	db, fdb := newFakeDB(t)
+	db.SetMaxIdleConns(0)
+
+	conf := newFakeConf(lockingDialect{})
+	conf.Options.Lock = true
+	conf.Options.SessionSetup = []string{"SET x = 1"}
+	dir := writeMigrations(t, map[string]string{
+		"001_a.sql": "-- +goose Up\nCREATE TABLE a (id int);\n",
+		"002_b.sql": "-- +goose Up\nCREATE TABLE b (id int);\n",
+	})
+
+	if err := RunMigrationsOnDb(conf, dir, 2, db); err != nil {
+		t.Fatal(err)
+	}
+
+	// the lock was taken, and released, on the connection that
+	// created the version table and ran each migration
+	session := "SELECT fake_lock('goose_db_version'); SET x = 1"
+	if want := []string{session, session, session}; !reflect.DeepEqual(fdb.insertSettings, want) {
+		t.Errorf("version table inserts ran with settings %q, want %q", fdb.insertSettings, want)
+	}
+	if fdb.unlockSettings != session {
+		t.Errorf("lock released on a connection with settings %q, want %q", fdb.unlockSettings, session)
+	}
+	if n := db.Stats().OpenConnections; n != 0 {
+		t.Errorf("%v connections left open after the run", n)
+	}
+}
+
+func TestExtraColumns(t *testing.T) {
+
+	db, fdb := newFakeDB(t)
+	conf := newFakeConf(fakeDialect{})
+	conf.Options.ExtraColumns = []VersionColumn{{Name: "applied_by", Type: "text", Value: "alice"}}
+	dir := writeMigrations(t, map[string]string{
+		"001_a.sql": "-- +goose Up\nCREATE TABLE a (id int);\n",
+	})
+
+	if err := RunMigrationsOnDb(conf, dir, 1, db); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(fdb.createdWith, "dirty bool,\napplied_by text\n)") {
+		t.Errorf("version table created without applied_by:\n%s", fdb.createdWith)
+	}
+	for _, r := range fdb.versions {
+		if len(r.args) != 5 || r.args[4] != "alice" {
+			t.Errorf("version %v recorded with args %v, want applied_by alice", r.args[0], r.args)
+		}
+	}
+
+	for _, bad := range [][]VersionColumn{
+		{{Name: "version_id", Type: "int"}},
+		{{Name: "applied by", Type: "text"}},
+		{{Name: "applied_by"}},
+		{{Name: "a", Type: "text"}, {Name: "A", Type: "text"}},
+	} {
+		if err := checkExtraColumns(bad); err == nil {
+			t.Errorf("expected extra columns %v to be rejected", bad)
+		}
+	}
+}
+
+func TestDBVersion(t *testing.T) {
+
+	db, fdb := newFakeDB(t)
+
+	if _, err := DBVersion(db, fakeDialect{}, false); !errors.Is(err, ErrTableDoesNotExist) {
+		t.Errorf("expected ErrTableDoesNotExist, got %v", err)
+	}
+	if fdb.versions != nil {
+		t.Fatal("version table created without createIfMissing")
+	}
+
+	if v, err := DBVersion(db, fakeDialect{}, true); err != nil || v != 0 {
+		t.Fatalf("DBVersion(create) = %v, %v, want 0, nil", v, err)
+	}
+	if fdb.versions == nil {
+		t.Fatal("version table not created")
+	}
+
+	dir := writeMigrations(t, map[string]string{
+		"001_a.sql": "-- +goose Up\nCREATE TABLE a (id int);\n",
+	})
+	if err := RunMigrationsOnDb(newFakeConf(fakeDialect{}), dir, 1, db); err != nil {
+		t.Fatal(err)
+	}
+	for _, create := range []bool{false, true} {
+		if v, err := DBVersion(db, fakeDialect{}, create); err != nil || v != 1 {
+			t.Errorf("DBVersion(%v) = %v, %v, want 1, nil", create, v, err)
+		}
+	}
+}
+
+func TestApplyOne(t *testing.T) {
+
+	db, fdb := newFakeDB(t)
+	conf := newFakeConf(fakeDialect{})
+	dir := writeMigrations(t, map[string]string{
+		"001_a.sql": "-- +goose Up\nCREATE TABLE a (id int);\n-- +goose Down\nDROP TABLE a;\n",
+		"002_b.go":  "package migrations\n",
+	})
+	path := filepath.Join(dir, "001_a.sql")
+
+	// without recording the version, the migration can be run repeatedly
+	for _, d := range []Direction{Up, Up, Down} {
+		if err := ApplyOne(conf, db, path, d, false); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want := []string{"CREATE TABLE a (id int);", "CREATE TABLE a (id int);", "DROP TABLE a;"}
+	if !reflect.DeepEqual(fdb.stmts, want) {
+		t.Errorf("incorrect statements. got %q, want %q", fdb.stmts, want)
+	}
+	if fdb.versions != nil {
+		t.Error("version table created without recordVersion")
+	}
+
+	if err := ApplyOne(conf, db, path, Up, true); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := fdb.appliedVersions(), []int64{1}; !reflect.DeepEqual(got, want) {
+		t.Errorf("incorrect applied versions. got %v, want %v", got, want)
+	}
+	if err := ApplyOne(conf, db, path, Up, true); err == nil || !strings.Contains(err.Error(), "already applied") {
+		t.Errorf("expected applying an applied version to be refused, got %v", err)
+	}
+	if err := ApplyOne(conf, db, path, Down, true); err != nil {
+		t.Fatal(err)
+	}
+	if err := ApplyOne(conf, db, path, Down, true); err == nil || !strings.Contains(err.Error(), "isn't applied") {
+		t.Errorf("expected rolling back an unapplied version to be refused, got %v", err)
+	}
+
+	for _, bad := range []string{filepath.Join(dir, "002_b.go"), dir} {
+		if err := ApplyOne(conf, db, bad, Up, false); err == nil {
+			t.Errorf("expected ApplyOne(%q) to fail", bad)
+		}
+	}
+
+	// a NO TRANSACTION migration failing partway leaves no dirty mark
+	// unless the version is recorded
+	dir = writeMigrations(t, map[string]string{
+		"003_c.sql": "-- +goose NO TRANSACTION\n-- +goose Up\nCREATE TABLE c (id int);\n-- +goose Verify\nSELECT 1 FROM c;\n",
+	})
+	fdb.failOn = "FROM c"
+	err := ApplyOne(conf, db, filepath.Join(dir, "003_c.sql"), Up, false)
+	if err == nil || errors.Is(err, ErrDirtyDatabase) || !strings.Contains(err.Error(), "aren't undone") {
+		t.Errorf("expected the failed verification to be reported without ErrDirtyDatabase, got %v", err)
+	}
+	fdb.failOn = ""
+}
+
+func TestStatementTimeout(t *testing.T) {
+
+	db, fdb := newFakeDB(t)
+	fdb.slowOn = "pg_sleep"
+	conf := newFakeConf(fakeDialect{})
+	conf.Options.StatementTimeout = 20 * time.Millisecond
+	dir := writeMigrations(t, map[string]string{
+		"001_a.sql": "-- +goose Up\nCREATE TABLE a (id int);\n",
+		"002_b.sql": "-- +goose Up\nCREATE TABLE b (id int);\nSELECT pg_sleep(3600);\n",
+	})
+
+	err := RunMigrationsOnDb(conf, dir, 2, db)
+	want := "002_b.sql: statement 2 timed out after 20ms: SELECT pg_sleep(3600);"
+	if err == nil || !strings.Contains(err.Error(), want) {
+		t.Fatalf("expected an error containing %q, got %v", want, err)
+	}
+	if got, want := fdb.appliedVersions(), []int64{1}; !reflect.DeepEqual(got, want) {
+		t.Errorf("incorrect applied versions. got %v, want %v", got, want)
+	}
+	if got, want := fdb.stmts, []string{"CREATE TABLE a (id int);"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("the timed out migration wasn't rolled back. got %q, want %q", got, want)
+	}
+}
+
+func TestStatementRewriter(t *testing.T) {
+
+	db, fdb := newFakeDB(t)
+	conf := newFakeConf(fakeDialect{})
+	engine := regexp.MustCompile(`(?i)\s*ENGINE\s*=\s*InnoDB`)
+	conf.Options.StatementRewriter = func(stmt string) (string, error) {
+		if strings.Contains(stmt, "DROP DATABASE") {
+			return "", errors.New("not on this platform")
+		}
+		if strings.HasPrefix(stmt, "OPTIMIZE") {
+			return "", nil
+		}
+		return engine.ReplaceAllString(stmt, ""), nil
+	}
+	dir := writeMigrations(t, map[string]string{
+		"001_a.sql": "-- +goose Up\nCREATE TABLE a (id int) ENGINE=InnoDB;\nOPTIMIZE TABLE a;\n",
+		"002_b.sql": "-- +goose NO TRANSACTION\n-- +goose Up\nCREATE TABLE b (id int);\nDROP DATABASE app;\n",
+	})
+
+	err := RunMigrationsOnDb(conf, dir, 2, db)
+	if err == nil || !strings.Contains(err.Error(), "002_b.sql: failed to rewrite statement 2: not on this platform") {
+		t.Fatalf("expected the rewriter to fail migration 2, got %v", err)
+	}
+	// the rewritten statements ran, and of migration 2, once it failed, none did
+	if got, want := fdb.statements(), []string{"CREATE TABLE a (id int);"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("incorrect statements run. got %q, want %q", got, want)
+	}
+	if got, want := fdb.appliedVersions(), []int64{1}; !reflect.DeepEqual(got, want) {
+		t.Errorf("incorrect applied versions. got %v, want %v", got, want)
+	}
+	if err := checkNotDirty(context.Background(), conf, db); err != nil {
+		t.Errorf("migration 2 left the database dirty: %v", err)
+	}
+}
+
+func TestStatementSummary(t *testing.T) {
+	long := "ALTER TABLE orders\n    ADD COLUMN shipped_at timestamp,\n    ADD COLUMN delivered_at timestamp;"
+	if got, want := statementSummary(long), "ALTER TABLE orders ADD COLUMN shipped_at timestamp, ADD COLU..."; got != want {
+		t.Errorf("statementSummary() = %q, want %q", got, want)
+	}
+
+	// multi-byte characters are kept whole
+	accented := "INSERT INTO names (name) VALUES ('" + strings.Repeat("é", 40) + "');"
+	if got := statementSummary(accented); !utf8.ValidString(got) || utf8.RuneCountInString(got) != 63 {
+		t.Errorf("statementSummary() = %q, want 60 whole characters and an ellipsis", got)
+	}
+}
+
+// tableCheckingDialect is a fakeDialect that checks for the version
+// table before reading it.
+type tableCheckingDialect struct{ fakeDialect }
+
+func (tableCheckingDialect) tableExistsQuery() string {
+	return "SELECT count(*) FROM information_schema.tables WHERE table_name = '" + TableName() + "'"
+}
+
+func TestTableExistsQuery(t *testing.T) {
+
+	db, fdb := newFakeDB(t)
+	conf := newFakeConf(tableCheckingDialect{})
+	dir := writeMigrations(t, map[string]string{
+		"001_a.sql": "-- +goose Up\nCREATE TABLE a (id int);\n",
+	})
+
+	// read-only queries of a missing table still report it as missing
+	if _, err := GetDBVersionOnDb(db, conf.Driver.Dialect); !errors.Is(err, ErrTableDoesNotExist) {
+		t.Errorf("expected ErrTableDoesNotExist, got %v", err)
+	}
+	if _, err := Status(db, conf.Driver.Dialect, dir); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := RunMigrationsOnDb(conf, dir, 1, db); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := fdb.appliedVersions(), []int64{1}; !reflect.DeepEqual(got, want) {
+		t.Errorf("incorrect applied versions. got %v, want %v", got, want)
+	}
+	if fdb.missedTable != 0 {
+		t.Errorf("the missing version table was queried %v times", fdb.missedTable)
+	}
+	if fdb.tableChecks == 0 {
+		t.Error("expected the dialect's tableExistsQuery to be used")
+	}
+}
+
+func TestDisableAutoCreate(t *testing.T) {
+
+	db, fdb := newFakeDB(t)
+	conf := newFakeConf(fakeDialect{})
+	conf.Options.DisableAutoCreate = true
+	dir := writeMigrations(t, map[string]string{
+		"001_a.sql": "-- +goose Up\nCREATE TABLE a (id int);\n",
+	})
+
+	if err := RunMigrationsOnDb(conf, dir, 1, db); !errors.Is(err, ErrTableDoesNotExist) {
+		t.Fatalf("expected ErrTableDoesNotExist, got %v", err)
+	}
+	if _, err := EnsureDBVersion(conf, db); !errors.Is(err, ErrTableDoesNotExist) {
+		t.Errorf("expected ErrTableDoesNotExist, got %v", err)
+	}
+	conf.Options.DryRun = true
+	if err := RunMigrationsOnDb(conf, dir, 1, db); !errors.Is(err, ErrTableDoesNotExist) {
+		t.Errorf("expected ErrTableDoesNotExist from a dry run, got %v", err)
+	}
+	conf.Options.DryRun = false
+	if fdb.createdWith != "" || len(fdb.statements()) != 0 {
+		t.Errorf("expected nothing to run, got %q and statements %q", fdb.createdWith, fdb.statements())
+	}
+
+	// once created out of band, the table is used as ever
+	conf.Options.DisableAutoCreate = false
+	if _, err := EnsureDBVersion(conf, db); err != nil {
+		t.Fatal(err)
+	}
+	conf.Options.DisableAutoCreate = true
+	if err := RunMigrationsOnDb(conf, dir, 1, db); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := fdb.appliedVersions(), []int64{1}; !reflect.DeepEqual(got, want) {
+		t.Errorf("incorrect applied versions. got %v, want %v", got, want)
+	}
+}
+
+// probingDialect is a fakeDialect expecting the database it probes to
+// report being the given engine.
+type probingDialect struct {
+	fakeDialect
+	engine string
+}
+
+func (probingDialect) dialectProbeSql() string { return "SELECT version()" }
+
+func (p probingDialect) probeMatches(version string) bool {
+	return strings.HasPrefix(version, p.engine+" ")
+}
+
+func TestProbeDialect(t *testing.T) {
+
+	db, fdb := newFakeDB(t)
+	dir := writeMigrations(t, map[string]string{
+		"001_a.sql": "-- +goose Up\nCREATE TABLE a (id int);\n",
+	})
+
+	if err := ProbeDialect(db, probingDialect{engine: "fakedb"}); err != nil {
+		t.Errorf("expected the fake database to match, got %v", err)
+	}
+	err := ProbeDialect(db, probingDialect{engine: "PostgreSQL"})
+	if err == nil || !strings.Contains(err.Error(), `"fakedb 1.0"`) {
+		t.Errorf("expected a mismatch naming what the database reports, got %v", err)
+	}
+
+	// a run only probes if asked to, and then before anything else
+	conf := newFakeConf(probingDialect{engine: "PostgreSQL"})
+	conf.Options.ProbeDialect = true
+	if err := RunMigrationsOnDb(conf, dir, 1, db); err == nil || !strings.Contains(err.Error(), "doesn't look like") {
+		t.Fatalf("expected the run to fail the probe, got %v", err)
+	}
+	if fdb.versions != nil {
+		t.Error("expected the version table to be left uncreated")
+	}
+	conf.Options.ProbeDialect = false
+	if err := RunMigrationsOnDb(conf, dir, 1, db); err != nil {
+		t.Fatal(err)
+	}
+}
+
+var errFakeConflict = errors.New("fake serialization failure")
+
+// retryingDialect is a fakeDialect whose transactions may be retried
+// after errFakeConflict.
+type retryingDialect struct{ fakeDialect }
+
+func (retryingDialect) retryable(err error) bool { return errors.Is(err, errFakeConflict) }
+
+// upsertingDialect is a retryingDialect whose version table has
+// version_id unique, and which records versions with an upsert.
+type upsertingDialect struct{ retryingDialect }
+
+func (upsertingDialect) createVersionTableSql() string {
+	return "CREATE TABLE " + qualifiedTableName() + " (version_id int UNIQUE, is_applied bool, checksum text, dirty bool)"
+}
+
+func (upsertingDialect) upsertVersionSql() string {
+	return "INSERT INTO " + qualifiedTableName() + " (version_id, is_applied, checksum, dirty) VALUES (?, ?, ?, ?) ON CONFLICT (version_id) DO NOTHING"
+}
+
+func (upsertingDialect) uniqueVersionQuery() string {
+	return "SELECT count(*) FROM unique_indexes WHERE table_name = '" + qualifiedTableName() + "' AND column_name = 'version_id'"
+}
+
+func TestUpsertVersion(t *testing.T) {
+
+	dir := writeMigrations(t, map[string]string{
+		"001_a.sql": "-- +goose Up\nCREATE TABLE IF NOT EXISTS a (id int);\n",
+	})
+
+	// the migration commits, but the client hears it failed, so retries
+	// it, recording version 1 again
+	db, fdb := newFakeDB(t)
+	conf := newFakeConf(upsertingDialect{})
+	if _, err := EnsureDBVersion(conf, db); err != nil {
+		t.Fatal(err)
+	}
+	fdb.lostCommits = 1
+	if err := RunMigrationsOnDb(conf, dir, 1, db); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := fdb.appliedVersions(), []int64{1}; !reflect.DeepEqual(got, want) {
+		t.Errorf("incorrect applied versions. got %v, want %v", got, want)
+	}
+
+	// a plain insert trips over the unique version_id instead
+	db, fdb = newNamedFakeDB(t, t.Name()+"/insert")
+	conf = newFakeConf(upsertingDialect{})
+	if _, err := EnsureDBVersion(conf, db); err != nil {
+		t.Fatal(err)
+	}
+	fdb.lostCommits = 1
+	conf.Driver.Dialect = retryingDialect{}
+	if err := RunMigrationsOnDb(conf, dir, 1, db); err == nil || !strings.Contains(err.Error(), "duplicate key") {
+		t.Errorf("expected re-recording the version to fail without an upsert, got %v", err)
+	}
+
+	// a table created before version_id was unique has nothing for an
+	// upsert to conflict on, so gets a plain insert
+	db, fdb = newNamedFakeDB(t, t.Name()+"/legacy")
+	conf = newFakeConf(retryingDialect{})
+	if _, err := EnsureDBVersion(conf, db); err != nil {
+		t.Fatal(err)
+	}
+	conf.Driver.Dialect = upsertingDialect{}
+	if err := RunMigrationsOnDb(conf, dir, 1, db); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := fdb.appliedVersions(), []int64{1}; !reflect.DeepEqual(got, want) {
+		t.Errorf("incorrect applied versions. got %v, want %v", got, want)
+	}
+}
+
+func TestRetryableDialect(t *testing.T) {
+
+	db, fdb := newFakeDB(t)
+	conf := newFakeConf(retryingDialect{})
+	dir := writeMigrations(t, map[string]string{
+		"001_a.sql": "-- +goose Up\nCREATE TABLE a (id int);\n",
+		"002_b.sql": "-- +goose Up\nCREATE TABLE b (id int);\n",
+	})
+	if _, err := EnsureDBVersion(conf, db); err != nil {
+		t.Fatal(err)
+	}
+
+	// the first two attempts at the version update conflict
+	fdb.insertErrs = []error{errFakeConflict, errFakeConflict}
+	if err := RunMigrationsOnDb(conf, dir, 1, db); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := fdb.appliedVersions(), []int64{1}; !reflect.DeepEqual(got, want) {
+		t.Errorf("incorrect applied versions. got %v, want %v", got, want)
+	}
+	if got, want := fdb.stmts, []string{"CREATE TABLE a (id int);"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("rolled back attempts should leave no statements behind. got %q, want %q", got, want)
+	}
+
+	// any other failure is returned straight away
+	fdb.insertErrs = []error{errors.New("unique violation")}
+	if err := RunMigrationsOnDb(conf, dir, 2, db); err == nil {
+		t.Fatal("expected the migration to fail")
+	}
+	if got, want := fdb.appliedVersions(), []int64{1}; !reflect.DeepEqual(got, want) {
+		t.Errorf("a failure that isn't retryable was retried. got %v, want %v", got, want)
+	}
+}
+
+// recordingLogger keeps the messages it's given.
+type recordingLogger struct {
+	lines []string
+}
+
+func (l *recordingLogger) Printf(format string, v ...interface{}) {
+	l.lines = append(l.lines, strings.TrimSuffix(fmt.Sprintf(format, v...), "\n"))
+}
+
+func (l *recordingLogger) Println(v ...interface{}) {
+	l.lines = append(l.lines, strings.TrimSuffix(fmt.Sprintln(v...), "\n"))
+}
+
+func TestSetLogger(t *testing.T) {
+
+	rec := &recordingLogger{}
+	SetLogger(rec)
+	defer SetLogger(NopLogger())
+
+	db, _ := newFakeDB(t)
+	dir := writeMigrations(t, map[string]string{
+		"001_a.sql": "-- +goose Up\nCREATE TABLE a (id int);\n-- +goose Down\nDROP TABLE a;\n",
+	})
+	if err := RunMigrationsOnDb(newFakeConf(fakeDialect{}), dir, 1, db); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{
+		"goose: migrating db environment 'test', current version: 0, target: 1",
+		"OK    001_a.sql",
+	}
+	if !reflect.DeepEqual(rec.lines, want) {
+		t.Errorf("incorrect log output. got %q, want %q", rec.lines, want)
+	}
+}
+
+func TestReset(t *testing.T) {
+
+	db, fdb := newFakeDB(t)
+	conf := newFakeConf(fakeDialect{})
+	dir := writeMigrations(t, map[string]string{
+		"001_a.sql": "-- +goose Up\nCREATE TABLE a (id int);\n-- +goose Down\nDROP TABLE a;\n",
+		"002_b.sql": "-- +goose Up\nCREATE TABLE b (id int);\n-- +goose Down\nDROP TABLE b;\n",
+	})
+
+	// already at version 0
+	if err := Reset(conf, db, dir); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := RunMigrationsOnDb(conf, dir, 2, db); err != nil {
+		t.Fatal(err)
+	}
+	if err := Reset(conf, db, dir); err != nil {
+		t.Fatal(err)
+	}
+	if got := fdb.appliedVersions(); len(got) != 0 {
+		t.Errorf("expected no applied versions, got %v", got)
+	}
+	want := []string{"CREATE TABLE a (id int);", "CREATE TABLE b (id int);", "DROP TABLE b;", "DROP TABLE a;"}
+	if got := fdb.statements(); !reflect.DeepEqual(got, want) {
+		t.Errorf("incorrect statements. got %q, want %q", got, want)
+	}
+}
+
+func TestResetWithoutDown(t *testing.T) {
+
+	db, fdb := newFakeDB(t)
+	conf := newFakeConf(fakeDialect{})
+	dir := writeMigrations(t, map[string]string{
+		"001_a.sql": "-- +goose Up\nCREATE TABLE a (id int);\n",
+		"002_b.sql": "-- +goose Up\nCREATE TABLE b (id int);\n-- +goose Down\nDROP TABLE b;\n",
+	})
+
+	if err := RunMigrationsOnDb(conf, dir, 2, db); err != nil {
+		t.Fatal(err)
+	}
+
+	err := Reset(conf, db, dir)
+	if err == nil || !strings.Contains(err.Error(), "migration 1 (001_a.sql) has no down section") {
+		t.Fatalf("expected an error naming migration 1, got %v", err)
+	}
+	if !errors.Is(err, ErrNoDownMigration) {
+		t.Errorf("expected ErrNoDownMigration, got %v", err)
+	}
+	if got, want := fdb.appliedVersions(), []int64{1, 2}; !reflect.DeepEqual(got, want) {
+		t.Errorf("incorrect applied versions. got %v, want %v", got, want)
+	}
+}
+
+func TestOneSidedMigrations(t *testing.T) {
+
+	db, fdb := newFakeDB(t)
+	conf := newFakeConf(fakeDialect{})
+	dir := writeMigrations(t, map[string]string{
+		"001_a.sql": "-- +goose Up\nCREATE TABLE a (id int);\n",
+		"002_b.sql": "-- +goose Up\nCREATE TABLE b (id int);\n-- +goose Down\nDROP TABLE b;\n",
+		"003_c.sql": "-- +goose Down\nDROP TABLE c;\n",
+	})
+
+	if err := Validate(dir); err != nil {
+		t.Fatalf("expected scripts with one section to be valid, got %v", err)
+	}
+	ms, err := ParseMigrations(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m := ms[0].Metadata; !m.HasUp || m.HasDown {
+		t.Errorf("incorrect metadata for 001_a.sql: %+v", m)
+	}
+	if m := ms[2].Metadata; m.HasUp || !m.HasDown {
+		t.Errorf("incorrect metadata for 003_c.sql: %+v", m)
+	}
+
+	if err := RunMigrationsOnDb(conf, dir, 2, db); err != nil {
+		t.Fatal(err)
+	}
+
+	// applying a script with only a Down section
+	err = RunMigrationsOnDb(conf, dir, 3, db)
+	if !errors.Is(err, ErrNoUpMigration) {
+		t.Fatalf("expected ErrNoUpMigration, got %v", err)
+	}
+	if !strings.Contains(err.Error(), "migration 3 (003_c.sql): ") {
+		t.Errorf("expected an error naming 003_c.sql, got %v", err)
+	}
+
+	// rolling back one with only an Up section is refused before
+	// anything is rolled back
+	err = RunMigrationsOnDb(conf, dir, 0, db)
+	if !errors.Is(err, ErrNoDownMigration) {
+		t.Fatalf("expected ErrNoDownMigration, got %v", err)
+	}
+	if !strings.Contains(err.Error(), "migration 1 (001_a.sql): ") {
+		t.Errorf("expected an error naming 001_a.sql, got %v", err)
+	}
+	var perr *ParseError
+	if !errors.As(err, &perr) || filepath.Base(perr.Path) != "001_a.sql" {
+		t.Errorf("expected a *ParseError for 001_a.sql, got %v", err)
+	}
+	if got, want := fdb.appliedVersions(), []int64{1, 2}; !reflect.DeepEqual(got, want) {
+		t.Errorf("incorrect applied versions. got %v, want %v", got, want)
+	}
+
+	// but those with a Down section still roll back
+	if err := RunMigrationsOnDb(conf, dir, 1, db); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := fdb.appliedVersions(), []int64{1}; !reflect.DeepEqual(got, want) {
+		t.Errorf("incorrect applied versions. got %v, want %v", got, want)
+	}
+}
+
+func TestFix(t *testing.T) {
+
+	dir := writeMigrations(t, map[string]string{
+		"00001_users.sql":            "-- +goose Up\n-- +goose Down\n",
+		"00002_posts.sql":            "-- +goose Up\n-- +goose Down\n",
+		"20231101120000_tags.sql":    "-- +goose Up\n-- +goose Down\n",
+		"20231015090000_backfill.go": "package main\n\nfunc Up_20231015090000(txn *sql.Tx) {}\n\nfunc Down_20231015090000(txn *sql.Tx) {}\n",
+		"README.md":                  "not a migration",
+	})
+
+	renamed, err := Fix(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{
+		"20231015090000_backfill.go": "00003_backfill.go",
+		"20231101120000_tags.sql":    "00004_tags.sql",
+	}
+	if !reflect.DeepEqual(renamed, want) {
+		t.Errorf("incorrect renames. got %v, want %v", renamed, want)
+	}
+
+	src, err := ioutil.ReadFile(filepath.Join(dir, "00003_backfill.go"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(src), "func Up_3(") || !strings.Contains(string(src), "func Down_3(") {
+		t.Errorf("go migration functions weren't renamed:\n%s", src)
+	}
+
+	// a registered migration, as CreateMigration scaffolds it, registers
+	// its new version
+	at := time.Date(2023, 12, 1, 8, 0, 0, 0, time.UTC)
+	path, err := CreateMigration("posts", "go", dir, at)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if renamed, err = Fix(dir); err != nil {
+		t.Fatal(err)
+	}
+	if want := map[string]string{filepath.Base(path): "00005_posts.go"}; !reflect.DeepEqual(renamed, want) {
+		t.Errorf("incorrect renames. got %v, want %v", renamed, want)
+	}
+	if src, err = ioutil.ReadFile(filepath.Join(dir, "00005_posts.go")); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"goose.RegisterMigration(5, up5, down5)", "func up5(", "func down5("} {
+		if !strings.Contains(string(src), want) {
+			t.Errorf("expected the renamed migration to have %q:\n%s", want, src)
+		}
+	}
+	if strings.Contains(string(src), "20231201080000") {
+		t.Errorf("the old version is left in the renamed migration:\n%s", src)
+	}
+
+	// a second run has nothing left to do
+	renamed, err = Fix(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(renamed) != 0 {
+		t.Errorf("expected no renames, got %v", renamed)
+	}
+}
+
+func TestMigrateReturnsRan(t *testing.T) {
+
+	RegisterMigration(3, func(ctx context.Context, tx *sql.Tx) error {
+		return errors.New("backfill failed")
+	}, nil)
+	defer func() {
+		registeredMigrations.Lock()
+		delete(registeredMigrations.m, 3)
+		registeredMigrations.Unlock()
+	}()
+
+	db, _ := newFakeDB(t)
+	conf := newFakeConf(fakeDialect{})
+	dir := writeMigrations(t, map[string]string{
+		"001_a.sql": "-- +goose Up\nCREATE TABLE a (id int);\n-- +goose Down\nDROP TABLE a;\n",
+		"002_b.sql": "-- +goose Up\nCREATE TABLE b (id int);\n-- +goose Down\nDROP TABLE b;\n",
+	})
+
+	versions := func(ms []*Migration) (vs []int64) {
+		for _, m := range ms {
+			vs = append(vs, m.Version)
+		}
+		return vs
+	}
+
+	ran, err := Migrate(context.Background(), conf, db, dir, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := versions(ran), []int64{1, 2}; !reflect.DeepEqual(got, want) {
+		t.Errorf("incorrect migrations ran. got %v, want %v", got, want)
+	}
+	if got, want := ran[1].Source, filepath.Join(dir, "002_b.sql"); got != want {
+		t.Errorf("incorrect source. got %v, want %v", got, want)
+	}
+
+	ran, err = Migrate(context.Background(), conf, db, dir, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := versions(ran), []int64{2, 1}; !reflect.DeepEqual(got, want) {
+		t.Errorf("incorrect migrations rolled back. got %v, want %v", got, want)
+	}
+
+	// the batch fails at migration 3
+	ran, err = Migrate(context.Background(), conf, db, dir, 3)
+	if err == nil {
+		t.Fatal("expected migration 3 to fail the run")
+	}
+	if got, want := versions(ran), []int64{1, 2}; !reflect.DeepEqual(got, want) {
+		t.Errorf("incorrect migrations ran before the failure. got %v, want %v", got, want)
+	}
+}
+
+func TestHooks(t *testing.T) {
+
+	RegisterMigration(3, func(ctx context.Context, tx *sql.Tx) error {
+		return errors.New("backfill failed")
+	}, nil)
+	defer func() {
+		registeredMigrations.Lock()
+		delete(registeredMigrations.m, 3)
+		registeredMigrations.Unlock()
+	}()
+
+	db, _ := newFakeDB(t)
+	conf := newFakeConf(fakeDialect{})
+	dir := writeMigrations(t, map[string]string{
+		"001_a.sql": "-- +goose Up\nCREATE TABLE a (id int);\n-- +goose Down\nDROP TABLE a;\n",
+		"002_b.sql": "-- +goose Up\nCREATE TABLE b (id int);\n-- +goose Down\nDROP TABLE b;\n",
+	})
+
+	var calls []string
+	conf.Options.BeforeEach = func(m *Migration) {
+		calls = append(calls, fmt.Sprintf("before %d", m.Version))
+	}
+	conf.Options.AfterEach = func(m *Migration, err error) {
+		calls = append(calls, fmt.Sprintf("after %d: %v", m.Version, err))
+	}
+
+	if err := RunMigrationsOnDb(conf, dir, 2, db); err != nil {
+		t.Fatal(err)
+	}
+	if err := RunMigrationsOnDb(conf, dir, 1, db); err != nil {
+		t.Fatal(err)
+	}
+	if err := RunMigrationsOnDb(conf, dir, 3, db); err == nil {
+		t.Fatal("expected migration 3 to fail the run")
+	}
+
+	want := []string{
+		"before 1", "after 1: <nil>",
+		"before 2", "after 2: <nil>",
+		"before 2", "after 2: <nil>",
+		"before 2", "after 2: <nil>",
+		"before 3", "after 3: migration 3: backfill failed",
+	}
+	if !reflect.DeepEqual(calls, want) {
+		t.Errorf("incorrect hook calls. got %q, want %q", calls, want)
+	}
+}
+
+func TestProgress(t *testing.T) {
+
+	db, _ := newFakeDB(t)
+	conf := newFakeConf(fakeDialect{})
+	dir := writeMigrations(t, map[string]string{
+		"001_a.sql": "-- +goose Up\nCREATE TABLE a (id int);\n-- +goose Down\nDROP TABLE a;\n",
+		"002_b.sql": "-- +goose Up\nCREATE TABLE b (id int);\n-- +goose Down\nDROP TABLE b;\n",
+		"003_c.sql": "-- +goose Up\nCREATE TABLE c (id int);\n-- +goose Down\nDROP TABLE c;\n",
+	})
+
+	var events []string
+	conf.Options.Progress = func(done, total int, m *Migration) {
+		events = append(events, fmt.Sprintf("%d/%d %d", done, total, m.Version))
+	}
+
+	if err := RunMigrationsOnDb(conf, dir, 3, db); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"0/3 1", "1/3 1", "1/3 2", "2/3 2", "2/3 3", "3/3 3"}
+	if !reflect.DeepEqual(events, want) {
+		t.Errorf("incorrect progress. got %q, want %q", events, want)
+	}
+}
+
+func TestMetrics(t *testing.T) {
+
+	db, fdb := newFakeDB(t)
+	fdb.latency = time.Millisecond
+	conf := newFakeConf(fakeDialect{})
+	dir := writeMigrations(t, map[string]string{
+		"001_a.sql": "-- +goose Up\nCREATE TABLE a (id int);\n-- +goose Down\nDROP TABLE a;\n",
+		"002_b.sql": "-- +goose Up\nCREATE TABLE b (id int);\n-- +goose Down\nDROP TABLE b;\n",
+		"003_c.sql": "-- +goose Up\nCREATE TABLE c (id int);\n-- +goose Down\nDROP TABLE c;\n",
+	})
+
+	var runs []*RunMetrics
+	conf.Options.Metrics = func(m *RunMetrics) {
+		runs = append(runs, m)
+	}
+
+	if err := RunMigrationsOnDb(conf, dir, 2, db); err != nil {
+		t.Fatal(err)
+	}
+	fdb.failOn = "CREATE TABLE c"
+	if err := RunMigrationsOnDb(conf, dir, 3, db); err == nil {
+		t.Fatal("expected migration 3 to fail the run")
+	}
+	fdb.failOn = ""
+	if err := RunMigrationsOnDb(conf, dir, 1, db); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(runs) != 3 {
+		t.Fatalf("expected metrics for 3 runs, got %d", len(runs))
+	}
+	for i, want := range []struct {
+		up              bool
+		applied, failed int
+		versions        []int64
+	}{
+		{true, 2, 0, []int64{1, 2}},
+		{true, 0, 1, []int64{3}},
+		{false, 1, 0, []int64{2}},
+	} {
+		run := runs[i]
+		if run.Up != want.up || run.Applied != want.applied || run.Failed != want.failed {
+			t.Errorf("run %d: incorrect metrics. got up %v, %d applied, %d failed, want up %v, %d applied, %d failed",
+				i, run.Up, run.Applied, run.Failed, want.up, want.applied, want.failed)
+		}
+		if (run.Err != nil) != (want.failed > 0) {
+			t.Errorf("run %d: incorrect error %v", i, run.Err)
+		}
+
+		var versions []int64
+		var total time.Duration
+		for _, m := range run.Migrations {
+			versions = append(versions, m.Version)
+			if m.Duration < time.Millisecond || m.Start.Before(run.Start) {
+				t.Errorf("run %d: migration %d: expected its timing to be recorded, got start %v, duration %v", i, m.Version, m.Start, m.Duration)
+			}
+			total += m.Duration
+		}
+		if !reflect.DeepEqual(versions, want.versions) {
+			t.Errorf("run %d: incorrect versions. got %v, want %v", i, versions, want.versions)
+		}
+		if run.Duration < total {
+			t.Errorf("run %d: expected the run's duration to span its migrations', got %v, want at least %v", i, run.Duration, total)
+		}
+	}
+	if err := runs[1].Migrations[0].Err; err == nil || !strings.Contains(err.Error(), "CREATE TABLE c") {
+		t.Errorf("expected migration 3's error to be recorded, got %v", err)
+	}
+
+	// dry runs run nothing to measure
+	conf.Options.DryRun = true
+	if err := RunMigrationsOnDb(conf, dir, 3, db); err != nil {
+		t.Fatal(err)
+	}
+	if len(runs) != 3 {
+		t.Errorf("expected no metrics for a dry run, got %d runs", len(runs))
+	}
+}
+
+func TestTxOptions(t *testing.T) {
+
+	db, fdb := newFakeDB(t)
+	conf := newFakeConf(fakeDialect{})
+	dir := writeMigrations(t, map[string]string{
+		"001_a.sql": "-- +goose Up\nCREATE TABLE a (id int);\n-- +goose Down\nDROP TABLE a;\n",
+		"002_b.sql": "-- +goose ISOLATION SERIALIZABLE\n-- +goose Up\nUPDATE a SET id = id + 1;\n-- +goose Down\nUPDATE a SET id = id - 1;\n",
+	})
+
+	// by default, transactions get the driver's defaults
+	if err := RunMigrationsOnDb(conf, dir, 2, db); err != nil {
+		t.Fatal(err)
+	}
+	got := fdb.txOpts[len(fdb.txOpts)-2:]
+	want := []driver.TxOptions{{}, {Isolation: driver.IsolationLevel(sql.LevelSerializable)}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("incorrect transaction options. got %+v, want %+v", got, want)
+	}
+
+	conf.Options.TxOptions = &sql.TxOptions{Isolation: sql.LevelRepeatableRead, ReadOnly: true}
+	if err := RunMigrationsOnDb(conf, dir, 0, db); err != nil {
+		t.Fatal(err)
+	}
+	got = fdb.txOpts[len(fdb.txOpts)-2:]
+	want = []driver.TxOptions{
+		{Isolation: driver.IsolationLevel(sql.LevelSerializable), ReadOnly: true},
+		{Isolation: driver.IsolationLevel(sql.LevelRepeatableRead), ReadOnly: true},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("incorrect transaction options. got %+v, want %+v", got, want)
+	}
+}
+
+func TestRunMigrationsWithDialect(t *testing.T) {
+
+	db, fdb := newFakeDB(t)
+	dir := writeMigrations(t, map[string]string{
+		"001_a.sql": "-- +goose Up\nCREATE TABLE a (id int);\n-- +goose Down\nDROP TABLE a;\n",
+		"002_b.sql": "-- +goose Up\nCREATE TABLE b (id int);\n-- +goose Down\nDROP TABLE b;\n",
+		"003_c.go":  "package main\n\nfunc Up_3(txn *sql.Tx) {}\n\nfunc Down_3(txn *sql.Tx) {}\n",
+	})
+
+	if err := RunMigrationsWithDialect(db, fakeDialect{}, dir, 2, Options{}); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"CREATE TABLE a (id int);", "CREATE TABLE b (id int);"}
+	if got := fdb.statements(); !reflect.DeepEqual(got, want) {
+		t.Errorf("incorrect statements. got %q, want %q", got, want)
+	}
+	if v, err := GetDBVersionOnDb(db, fakeDialect{}); err != nil || v != 2 {
+		t.Errorf("incorrect version. got %v (%v), want 2", v, err)
+	}
+
+	// Go scripts need a driver to run with `go run`
+	err := RunMigrationsWithDialect(db, fakeDialect{}, dir, 3, Options{})
+	if err == nil || !strings.Contains(err.Error(), "RegisterMigration") {
+		t.Errorf("expected the Go script to be refused, got %v", err)
+	}
+}
+
+// seedVersionHistory fills the fake's version table the way releases
+// that recorded rollbacks as rows did: each of versions 1 to n applied,
+// rolled back and applied again, and version n+1 applied then rolled back.
+func seedVersionHistory(f *fakeDB, n int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	add := func(v int64, applied bool) {
+		f.nextID++
+		f.versions = append(f.versions, fakeVersionRow{f.nextID, []driver.Value{v, applied, ""}, time.Now()})
+	}
+	f.versions = []fakeVersionRow{}
+	add(0, true)
+	for v := int64(1); v <= int64(n); v++ {
+		add(v, true)
+		add(v, false)
+		add(v, true)
+	}
+	add(int64(n)+1, true)
+	add(int64(n)+1, false)
+}
+
+func TestCompactVersionTable(t *testing.T) {
+
+	db, fdb := newFakeDB(t)
+	seedVersionHistory(fdb, 3)
+
+	before, err := ListAppliedVersions(db, fakeDialect{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := CompactVersionTable(db, fakeDialect{}); err != nil {
+		t.Fatal(err)
+	}
+
+	after, err := ListAppliedVersions(db, fakeDialect{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(after, before) {
+		t.Errorf("compaction changed the applied versions. got %v, want %v", after, before)
+	}
+	if got := len(fdb.versions); got != 4 {
+		t.Errorf("incorrect number of version rows. got %v, want 4", got)
+	}
+	if v, err := GetDBVersionOnDb(db, fakeDialect{}); err != nil || v != 3 {
+		t.Errorf("incorrect version. got %v (%v), want 3", v, err)
+	}
+}
+
+func BenchmarkDBVersion(b *testing.B) {
+
+	for _, compacted := range []bool{false, true} {
+		name := "history"
+		if compacted {
+			name = "compacted"
+		}
+		b.Run(name, func(b *testing.B) {
+			db, fdb := newFakeDB(b)
+			seedVersionHistory(fdb, 2000)
+			if compacted {
+				if err := CompactVersionTable(db, fakeDialect{}); err != nil {
+					b.Fatal(err)
+				}
+			}
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, err := GetDBVersionOnDb(db, fakeDialect{}); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// currentVersionDialect is a fakeDialect that can have the database
+// find the current version.
+type currentVersionDialect struct{ fakeDialect }
+
+func (currentVersionDialect) currentVersionQuery() string {
+	return "SELECT max(version_id) FROM " + qualifiedTableName() + " WHERE is_applied"
+}
+
+// unanswerableCurrentVersionDialect's currentVersionQuery always fails.
+type unanswerableCurrentVersionDialect struct{ fakeDialect }
+
+func (unanswerableCurrentVersionDialect) currentVersionQuery() string {
+	return "SELECT max(version_id) FROM elsewhere"
+}
+
+func TestCurrentVersionQuery(t *testing.T) {
+
+	db, fdb := newFakeDB(t)
+	d := currentVersionDialect{}
+
+	// a missing table is still reported as such
+	if _, err := GetDBVersionOnDb(db, d); !errors.Is(err, ErrTableDoesNotExist) {
+		t.Fatalf("expected ErrTableDoesNotExist, got %v", err)
+	}
+	if v, err := EnsureDBVersion(newFakeConf(d), db); err != nil || v != 0 {
+		t.Fatalf("expected version 0 once created, got %v (%v)", v, err)
+	}
+
+	// 11 is applied, then rolled back, leaving 10 current
+	seedVersionHistory(fdb, 10)
+	fdb.versionQueries = 0
+	for _, get := range []func() (int64, error){
+		func() (int64, error) { return GetDBVersionOnDb(db, d) },
+		func() (int64, error) { return EnsureDBVersion(newFakeConf(d), db) },
+		func() (int64, error) { return DBVersion(db, d, false) },
+	} {
+		if v, err := get(); err != nil || v != 10 {
+			t.Errorf("incorrect version. got %v (%v), want 10", v, err)
+		}
+	}
+	if fdb.currentQueries != 3 || fdb.versionQueries != 0 {
+		t.Errorf("expected the current version query alone, got %v of them and %v full reads", fdb.currentQueries, fdb.versionQueries)
+	}
+
+	// it gives way to the full read if it fails
+	if v, err := GetDBVersionOnDb(db, unanswerableCurrentVersionDialect{}); err != nil || v != 10 {
+		t.Errorf("incorrect version. got %v (%v), want 10", v, err)
+	}
+	if fdb.versionQueries != 1 {
+		t.Errorf("expected a full read once the current version query failed, got %v", fdb.versionQueries)
+	}
+}
+
+func BenchmarkCurrentVersionQuery(b *testing.B) {
+
+	for _, d := range []SqlDialect{fakeDialect{}, currentVersionDialect{}} {
+		name := "dbVersionQuery"
+		if _, ok := d.(sqlCurrentVersioner); ok {
+			name = "currentVersionQuery"
+		}
+		b.Run(name, func(b *testing.B) {
+			db, fdb := newFakeDB(b)
+			seedVersionHistory(fdb, 100000/3)
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, err := GetDBVersionOnDb(db, d); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestVersionsReadOnce(t *testing.T) {
+
+	db, fdb := newFakeDB(t)
+	seedVersionHistory(fdb, 2)
+	conf := newFakeConf(fakeDialect{})
+	conf.Options.AllowMissing = true
+	dir := writeMigrations(t, map[string]string{
+		"001_a.sql": "-- +goose Up\nCREATE TABLE a (id int);\n-- +goose Down\nDROP TABLE a;\n",
+		"002_b.sql": "-- +goose Up\nCREATE TABLE b (id int);\n-- +goose Down\nDROP TABLE b;\n",
+		"003_c.sql": "-- +goose Up\nCREATE TABLE c (id int);\n-- +goose Down\nDROP TABLE c;\n",
+		"004_d.sql": "-- +goose Up\nCREATE TABLE d (id int);\n-- +goose Down\nDROP TABLE d;\n",
+		"005_e.sql": "-- +goose Up\nCREATE TABLE e (id int);\n-- +goose Down\nDROP TABLE e;\n",
+	})
+
+	ran, err := Migrate(context.Background(), conf, db, dir, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ran) != 3 {
+		t.Errorf("incorrect number of migrations run. got %v, want 3", len(ran))
+	}
+	if fdb.versionQueries != 1 {
+		t.Errorf("version table read %v times, want once", fdb.versionQueries)
+	}
+}
+
+func TestScanVersions(t *testing.T) {
+
+	db, fdb := newFakeDB(t)
+	seedVersionHistory(fdb, 2)
+
+	rows, err := fakeDialect{}.dbVersionQuery(context.Background(), db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+
+	current, versions, err := scanVersions(rows)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if current != 2 {
+		t.Errorf("incorrect current version. got %v, want 2", current)
+	}
+	if want := (versionSet{0: true, 1: true, 2: true, 3: false}); !reflect.DeepEqual(versions, want) {
+		t.Errorf("incorrect versions. got %v, want %v", versions, want)
+	}
+	if got, want := versions.applied(), []int64{0, 1, 2}; !reflect.DeepEqual(got, want) {
+		t.Errorf("incorrect applied versions. got %v, want %v", got, want)
+	}
+}
+
+func TestCurrentVersion(t *testing.T) {
+
+	db, fdb := newFakeDB(t)
+	conf := newFakeConf(fakeDialect{})
+	dir := writeMigrations(t, map[string]string{
+		"001_a.sql": "-- +goose Up\nCREATE TABLE a (id int);\n-- +goose Down\nDROP TABLE a;\n",
+		"002_b.sql": "-- +goose Up\nCREATE TABLE b (id int);\n-- +goose Down\nDROP TABLE b;\n",
+		"003_c.sql": "-- +goose Up\nCREATE TABLE c (id int);\n-- +goose Down\nDROP TABLE c;\n",
+	})
+
+	// apply v3, then roll it back
+	if err := RunMigrationsOnDb(conf, dir, 3, db); err != nil {
+		t.Fatal(err)
+	}
+	if err := RunMigrationsOnDb(conf, dir, 2, db); err != nil {
+		t.Fatal(err)
+	}
+	if v, err := GetDBVersionOnDb(db, fakeDialect{}); err != nil || v != 2 {
+		t.Errorf("incorrect version. got %v (%v), want 2", v, err)
+	}
+
+	add := func(v int64, applied bool) {
+		fdb.mu.Lock()
+		defer fdb.mu.Unlock()
+		fdb.nextID++
+		fdb.versions = append(fdb.versions, fakeVersionRow{fdb.nextID, []driver.Value{v, applied, ""}, time.Now()})
+	}
+	reset := func() {
+		fdb.mu.Lock()
+		fdb.versions = []fakeVersionRow{}
+		fdb.mu.Unlock()
+		add(0, true)
+	}
+
+	// a rollback recorded as a row of its own, as by older releases
+	reset()
+	add(1, true)
+	add(2, true)
+	add(3, true)
+	add(3, false)
+	if v, err := GetDBVersionOnDb(db, fakeDialect{}); err != nil || v != 2 {
+		t.Errorf("incorrect version after recorded rollback. got %v (%v), want 2", v, err)
+	}
+
+	// an older migration applied last, as with AllowMissing
+	reset()
+	add(2, true)
+	add(3, true)
+	add(1, true)
+	if v, err := GetDBVersionOnDb(db, fakeDialect{}); err != nil || v != 3 {
+		t.Errorf("incorrect version after applying a missing migration. got %v (%v), want 3", v, err)
+	}
+}
+
+func TestCreateMigration(t *testing.T) {
+
+	dir := writeMigrations(t, map[string]string{})
+	at := time.Date(2013, 1, 6, 9, 32, 24, 0, time.UTC)
+
+	path, err := CreateMigration("add_users", "sql", dir, at)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := filepath.Join(dir, "20130106093224_add_users.sql"); path != want {
+		t.Errorf("incorrect path. got %v, want %v", path, want)
+	}
+	if ok, err := newMigration(20130106093224, path).hasDown(); err != nil || !ok {
+		t.Errorf("expected the SQL skeleton to have a down section, got %v (%v)", ok, err)
+	}
+
+	// a second migration in the same second would share its version
+	if _, err := CreateMigration("add_posts", "go", dir, at); err == nil || !strings.Contains(err.Error(), "20130106093224_add_users.sql") {
+		t.Errorf("expected a duplicate version error naming the existing file, got %v", err)
+	}
+
+	// numbered in sequence, after the sequential migrations but not
+	// the timestamped ones
+	ioutil.WriteFile(filepath.Join(dir, "00041_a.sql"), nil, 0666)
+
+	path, err = CreateMigrationFromTemplate("backfill", "go", dir, at, true, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := filepath.Join(dir, "00042_backfill.go"); path != want {
+		t.Errorf("incorrect path. got %v, want %v", path, want)
+	}
+	body, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(body), "goose.RegisterMigration(42, up42, down42)") {
+		t.Errorf("expected a registered migration stub, got:\n%s", body)
+	}
+}
+
+func TestCreateMigrationFromTemplate(t *testing.T) {
+
+	dir := t.TempDir()
+	at := time.Date(2024, 3, 1, 12, 30, 0, 0, time.UTC)
+	tmpl := template.Must(template.New("house").Parse(
+		"-- {{.Name}}, version {{.Version}}, written {{.Timestamp.Format \"2006-01-02\"}}\n-- +goose NO TRANSACTION\n-- +goose Up\n"))
+
+	path, err := CreateMigrationFromTemplate("add_index", "sql", dir, at, false, tmpl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := filepath.Join(dir, "20240301123000_add_index.sql"); path != want {
+		t.Errorf("incorrect path. got %v, want %v", path, want)
+	}
+	body, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "-- add_index, version 20240301123000, written 2024-03-01\n-- +goose NO TRANSACTION\n-- +goose Up\n"
+	if string(body) != want {
+		t.Errorf("incorrect migration written. got:\n%s\nwant:\n%s", body, want)
+	}
+
+	// the built-in templates are the defaults
+	path, err = CreateMigrationFromTemplate("backfill", "go", dir, at.Add(time.Second), false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if body, err = ioutil.ReadFile(path); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(body), "goose.RegisterMigration(20240301123001, up20240301123001, down20240301123001)") {
+		t.Errorf("expected the built-in Go template, got:\n%s", body)
+	}
+
+	// a template that fails leaves nothing behind
+	bad := template.Must(template.New("bad").Parse("{{.Ticket}}"))
+	if _, err := CreateMigrationFromTemplate("broken", "sql", dir, at.Add(2*time.Second), false, bad); err == nil {
+		t.Error("expected a template referring to a missing field to fail")
+	}
+	if _, err := os.Stat(filepath.Join(dir, "20240301123002_broken.sql")); !os.IsNotExist(err) {
+		t.Errorf("expected no file to be written, got %v", err)
+	}
+}
+
+func TestCreateGoScript(t *testing.T) {
+
+	// as `goose create` does, then `goose up` and `goose down` run
+	dir := t.TempDir()
+	at := time.Date(2024, 3, 1, 12, 30, 0, 0, time.UTC)
+	path, err := CreateMigrationFromTemplate("backfill", "go", dir, at, false, GoScriptMigrationTemplate)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ms, err := CollectMigrations(dir, 0, (1<<63)-1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ms) != 1 || ms[0].Source != path || ms[0].isRegistered() {
+		t.Fatalf("expected the script to be collected as one to run with `go run`, got %v", ms)
+	}
+	m := ms[0]
+	if down, err := m.hasDown(); err != nil || !down {
+		t.Errorf("expected the script to be able to be rolled back, got %v (%v)", down, err)
+	}
+
+	script, err := parser.ParseFile(token.NewFileSet(), path, nil, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, direction := range []string{"Up", "Down"} {
+		// the driver `go run` runs the script with calls its function with a transaction
+		td := &templateData{Version: m.Version, Import: "github.com/lib/pq", Conf: "[]byte{}", Func: fmt.Sprintf("%s_%d", direction, m.Version)}
+		var main bytes.Buffer
+		if err := goMigrationDriverTemplate.Execute(&main, td); err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(main.String(), td.Func+"(txn)") {
+			t.Fatalf("expected the driver to call %s(txn):\n%s", td.Func, main.String())
+		}
+		if _, err := parser.ParseFile(token.NewFileSet(), "goose_main.go", main.Bytes(), 0); err != nil {
+			t.Errorf("the driver doesn't parse: %v", err)
+		}
+
+		var decl *ast.FuncDecl
+		for _, d := range script.Decls {
+			if fn, ok := d.(*ast.FuncDecl); ok && fn.Name.Name == td.Func {
+				decl = fn
+			}
+		}
+		if script.Name.Name != "main" || decl == nil || decl.Type.Params.NumFields() != 1 || decl.Type.Results != nil {
+			t.Errorf("expected a package main script declaring func %s(txn *sql.Tx)", td.Func)
+		}
+	}
+}
+
+func TestDuplicateVersions(t *testing.T) {
+
+	db, fdb := newFakeDB(t)
+	conf := newFakeConf(fakeDialect{})
+	dir := writeMigrations(t, map[string]string{
+		"00041_a.sql":   "-- +goose Up\nCREATE TABLE a (id int);\n-- +goose Down\nDROP TABLE a;\n",
+		"00042_foo.sql": "-- +goose Up\nCREATE TABLE foo (id int);\n-- +goose Down\nDROP TABLE foo;\n",
+		"00042_bar.sql": "-- +goose Up\nCREATE TABLE bar (id int);\n-- +goose Down\nDROP TABLE bar;\n",
+	})
+
+	err := RunMigrationsOnDb(conf, dir, 42, db)
+	if err == nil || !strings.Contains(err.Error(), "00042_foo.sql") || !strings.Contains(err.Error(), "00042_bar.sql") {
+		t.Fatalf("expected an error naming both files, got %v", err)
+	}
+	if got := fdb.statements(); len(got) != 0 {
+		t.Errorf("expected no statements to run, got %q", got)
+	}
+
+	// duplicates are caught even outside of the range being collected,
+	// and whatever the type of migration
+	dir = writeMigrations(t, map[string]string{
+		"00001_a.sql": "-- +goose Up\nCREATE TABLE a (id int);\n",
+		"00002_b.sql": "-- +goose Up\nCREATE TABLE b (id int);\n",
+		"00002_b.go":  "package main\n",
+	})
+	if _, err := CollectMigrations(dir, 0, 1); err == nil || !strings.Contains(err.Error(), "00002_b.go") {
+		t.Errorf("expected an error naming the .go and .sql files, got %v", err)
+	}
+}
+
+// semverVersion maps names starting vMAJOR.MINOR.PATCH_ to versions
+// in that order, e.g. v2.3.1_a.sql to 2003001
+func semverVersion(name string) (int64, error) {
+	var major, minor, patch int64
+	if _, err := fmt.Sscanf(name, "v%d.%d.%d_", &major, &minor, &patch); err != nil {
+		return 0, err
+	}
+	return major*1000000 + minor*1000 + patch, nil
+}
+
+func TestVersionFunc(t *testing.T) {
+
+	db, fdb := newFakeDB(t)
+	conf := newFakeConf(fakeDialect{})
+	conf.Options.VersionFunc = semverVersion
+	dir := writeMigrations(t, map[string]string{
+		"v2.9.0_a.sql":  "-- +goose Up\nCREATE TABLE a (id int);\n-- +goose Down\nDROP TABLE a;\n",
+		"v2.10.0_b.sql": "-- +goose Up\nCREATE TABLE b (id int);\n-- +goose Down\nDROP TABLE b;\n",
+		"v10.0.1_c.sql": "-- +goose Up\nCREATE TABLE c (id int);\n-- +goose Down\nDROP TABLE c;\n",
+		"00001_d.sql":   "-- +goose Up\nCREATE TABLE d (id int);\n-- +goose Down\nDROP TABLE d;\n",
+	})
+
+	// ordered by the versions they map to, not their names
+	if err := RunMigrationsOnDb(conf, dir, 10000001, db); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"CREATE TABLE a (id int);", "CREATE TABLE b (id int);", "CREATE TABLE c (id int);"}
+	if got := fdb.statements(); !reflect.DeepEqual(got, want) {
+		t.Errorf("incorrect statements. got %q, want %q", got, want)
+	}
+	if got, want := fdb.appliedVersions(), []int64{2009000, 2010000, 10000001}; !reflect.DeepEqual(got, want) {
+		t.Errorf("incorrect applied versions. got %v, want %v", got, want)
+	}
+
+	// names mapped to the same version are duplicates
+	dir = writeMigrations(t, map[string]string{
+		"v2.3.1_a.sql":  "-- +goose Up\nCREATE TABLE a (id int);\n",
+		"v2.03.1_b.sql": "-- +goose Up\nCREATE TABLE b (id int);\n",
+	})
+	db, _ = newNamedFakeDB(t, t.Name()+"/duplicates")
+	if err := RunMigrationsOnDb(conf, dir, 2003001, db); err == nil || !strings.Contains(err.Error(), "v2.03.1_b.sql") {
+		t.Errorf("expected an error naming both files, got %v", err)
+	}
+
+	// functions without a DBConf only find numbered files
+	if ms, err := CollectMigrations(dir, 0, 2003001); err != nil || len(ms) != 0 {
+		t.Errorf("expected no numbered migrations, got %v (%v)", ms, err)
+	}
+	if renamed, err := Fix(dir); err != nil || len(renamed) != 0 {
+		t.Errorf("expected Fix to leave the files be, got %v (%v)", renamed, err)
+	}
+}
+
+func TestCancelMidBatch(t *testing.T) {
+
+	db, fdb := newFakeDB(t)
+	conf := newFakeConf(fakeDialect{})
+	dir := writeMigrations(t, map[string]string{
+		"001_a.sql": "-- +goose Up\nCREATE TABLE a (id int);\n-- +goose Down\nDROP TABLE a;\n",
+		"002_b.sql": "-- +goose Up\nCREATE TABLE b (id int);\nSELECT pg_sleep(10);\n-- +goose Down\nDROP TABLE b;\n",
+		"003_c.sql": "-- +goose Up\nCREATE TABLE c (id int);\n-- +goose Down\nDROP TABLE c;\n",
+	})
+	fdb.slowOn = "pg_sleep"
+
+	// cancelled between migrations, the next isn't begun
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	conf.Options.AfterEach = func(m *Migration, err error) {
+		if m.Version == 1 {
+			cancel()
+		}
+	}
+	if err := RunMigrationsOnDbContext(ctx, conf, dir, 3, db); !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+	if got, want := fdb.appliedVersions(), []int64{1}; !reflect.DeepEqual(got, want) {
+		t.Errorf("incorrect applied versions. got %v, want %v", got, want)
+	}
+	if got, want := fdb.statements(), []string{"CREATE TABLE a (id int);"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("incorrect statements. got %q, want %q", got, want)
+	}
+
+	// cancelled during one, it's rolled back and left unrecorded
+	ctx, cancel = context.WithCancel(context.Background())
+	defer cancel()
+	conf.Options.AfterEach = nil
+	conf.Options.BeforeEach = func(m *Migration) {
+		if m.Version == 2 {
+			time.AfterFunc(10*time.Millisecond, cancel)
+		}
+	}
+	if err := RunMigrationsOnDbContext(ctx, conf, dir, 3, db); !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+	if got, want := fdb.appliedVersions(), []int64{1}; !reflect.DeepEqual(got, want) {
+		t.Errorf("incorrect applied versions. got %v, want %v", got, want)
+	}
+	if got, want := fdb.statements(), []string{"CREATE TABLE a (id int);"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("expected 002_b.sql to be rolled back, got statements %q", got)
+	}
+}
+
+func TestTags(t *testing.T) {
+
+	db, fdb := newFakeDB(t)
+	conf := newFakeConf(fakeDialect{})
+	dir := writeMigrations(t, map[string]string{
+		"001_a.sql": "-- +goose TAGS schema, fast\n-- +goose Up\nCREATE TABLE a (id int);\n-- +goose Down\nDROP TABLE a;\n",
+		"002_b.sql": "-- +goose TAGS data\n-- +goose Up\nINSERT INTO a VALUES (1);\n-- +goose Down\nDELETE FROM a;\n",
+		"003_c.sql": "-- +goose Up\nCREATE TABLE c (id int);\n-- +goose Down\nDROP TABLE c;\n",
+		"004_d.sql": "-- +goose TAGS schema\n-- +goose Up\nCREATE TABLE d (id int);\n-- +goose Down\nDROP TABLE d;\n",
+	})
+
+	ms, err := ParseMigrations(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := ms[0].Tags, []string{"schema", "fast"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("incorrect tags. got %q, want %q", got, want)
+	}
+
+	// only the schema migrations
+	conf.Options.IncludeTags = []string{"schema"}
+	if err := RunMigrationsOnDb(conf, dir, 4, db); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := fdb.appliedVersions(), []int64{1, 4}; !reflect.DeepEqual(got, want) {
+		t.Errorf("incorrect applied versions. got %v, want %v", got, want)
+	}
+	if got, want := fdb.statements(), []string{"CREATE TABLE a (id int);", "CREATE TABLE d (id int);"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("incorrect statements. got %q, want %q", got, want)
+	}
+
+	// then everything but the data migrations, including the untagged
+	conf.Options.IncludeTags = nil
+	conf.Options.ExcludeTags = []string{"data"}
+	conf.Options.AllowMissing = true
+	if err := RunMigrationsOnDb(conf, dir, 4, db); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := fdb.appliedVersions(), []int64{1, 4, 3}; !reflect.DeepEqual(got, want) {
+		t.Errorf("incorrect applied versions. got %v, want %v", got, want)
+	}
+
+	// and by default, the rest
+	conf.Options.ExcludeTags = nil
+	if err := RunMigrationsOnDb(conf, dir, 4, db); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := fdb.appliedVersions(), []int64{1, 4, 3, 2}; !reflect.DeepEqual(got, want) {
+		t.Errorf("incorrect applied versions. got %v, want %v", got, want)
+	}
+}
+
+func TestRedo(t *testing.T) {
+
+	db, fdb := newFakeDB(t)
+	conf := newFakeConf(fakeDialect{})
+	dir := writeMigrations(t, map[string]string{
+		"001_a.sql": "-- +goose Up\nCREATE TABLE a (id int);\n-- +goose Down\nDROP TABLE a;\n",
+		"002_b.sql": "-- +goose Up\nCREATE TABLE b (id int);\n-- +goose Down\nDROP TABLE b;\n",
+		"003_c.sql": "-- +goose Up\nCREATE TABLE c (id int);\n-- +goose Down\nDROP TABLE c;\n",
+	})
+	if err := RunMigrationsOnDb(conf, dir, 3, db); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := Redo(conf, db, dir, 2); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"CREATE TABLE a (id int);", "CREATE TABLE b (id int);", "CREATE TABLE c (id int);",
+		"DROP TABLE c;", "DROP TABLE b;",
+		"CREATE TABLE b (id int);", "CREATE TABLE c (id int);",
+	}
+	if got := fdb.statements(); !reflect.DeepEqual(got, want) {
+		t.Errorf("incorrect statements. got %q, want %q", got, want)
+	}
+	if got, err := ListAppliedVersions(db, fakeDialect{}); err != nil || !reflect.DeepEqual(got, []int64{1, 2, 3}) {
+		t.Errorf("incorrect applied versions. got %v (%v), want [1 2 3]", got, err)
+	}
+
+	// asking for more than were applied redoes them all
+	fdb.stmts = nil
+	if err := Redo(conf, db, dir, 10); err != nil {
+		t.Fatal(err)
+	}
+	want = []string{
+		"DROP TABLE c;", "DROP TABLE b;", "DROP TABLE a;",
+		"CREATE TABLE a (id int);", "CREATE TABLE b (id int);", "CREATE TABLE c (id int);",
+	}
+	if got := fdb.statements(); !reflect.DeepEqual(got, want) {
+		t.Errorf("incorrect statements. got %q, want %q", got, want)
+	}
+	if v, err := GetDBVersionOnDb(db, fakeDialect{}); err != nil || v != 3 {
+		t.Errorf("incorrect version. got %v (%v), want 3", v, err)
+	}
+}
+
+func TestPingRetry(t *testing.T) {
+
+	db, fdb := newFakeDB(t)
+	conf := newFakeConf(fakeDialect{})
+	conf.Options.PingAttempts = 3
+	conf.Options.PingBackoff = time.Millisecond
+	dir := writeMigrations(t, map[string]string{
+		"001_a.sql": "-- +goose Up\nCREATE TABLE a (id int);\n-- +goose Down\nDROP TABLE a;\n",
+	})
+
+	// the database comes up on the third attempt
+	fdb.unreachable = 2
+	if err := RunMigrationsOnDb(conf, dir, 1, db); err != nil {
+		t.Fatal(err)
+	}
+	if got := fdb.appliedVersions(); !reflect.DeepEqual(got, []int64{1}) {
+		t.Errorf("incorrect applied versions. got %v, want [1]", got)
+	}
+
+	// but not within the attempts allowed
+	db, fdb = newFakeDB(t)
+	fdb.unreachable = 3
+	err := RunMigrationsOnDb(conf, dir, 1, db)
+	if err == nil || !strings.Contains(err.Error(), errFakeUnreachable.Error()) {
+		t.Errorf("expected the last ping error, got %v", err)
+	}
+	if fdb.versions != nil {
+		t.Error("expected the version table not to be created")
+	}
+}
+
+func TestValidate(t *testing.T) {
+
+	fsys := fstest.MapFS{
+		"migrations/001_a.sql": {Data: []byte("-- +goose Up\nCREATE TABLE a (id int);\n-- +goose Down\nDROP TABLE a;\n")},
+		"migrations/002_b.sql": {Data: []byte("-- +goose Up\nCREATE TABLE b (id int);\n")},
+		"migrations/003_c.sql": {Data: []byte("-- +goose Up\n-- +goose Down\nDROP TABLE c;\n")},
+		"migrations/004_d.sql": {Data: []byte("-- +goose Up\n-- +goose StatementBegin\nCREATE TABLE d (id int);\n")},
+		"migrations/005_e.sql": {Data: []byte("-- +goose Up\nCREATE TABLE e (id int);\n")},
+		"migrations/005_f.sql": {Data: []byte("-- +goose Up\nCREATE TABLE f (id int);\n")},
+	}
+
+	if err := ValidateFS(fsys, "migrations"); err == nil {
+		t.Fatal("expected an error")
+	} else {
+		var verr *ValidationError
+		if !errors.As(err, &verr) || len(verr.Problems) != 3 {
+			t.Fatalf("expected three problems, got %v", err)
+		}
+		for _, name := range []string{"003_c.sql", "004_d.sql", "005_f.sql"} {
+			if !strings.Contains(err.Error(), name) {
+				t.Errorf("expected the error to name %s, got %v", name, err)
+			}
+		}
+		var perr *ParseError
+		if !errors.As(err, &perr) {
+			t.Errorf("expected a *ParseError among the problems, got %v", err)
+		}
+	}
+
+	dir := writeMigrations(t, map[string]string{
+		"001_a.sql": "-- +goose Up\nCREATE TABLE a (id int);\n-- +goose Down\nDROP TABLE a;\n",
+		"002_b.sql": "-- +goose Up\nCREATE TABLE b (id int);\n",
+	})
+	if err := Validate(dir); err != nil {
+		t.Errorf("expected no problems, got %v", err)
+	}
+}
+
+func TestGetPendingMigrations(t *testing.T) {
+
+	db, _ := newFakeDB(t)
+	conf := newFakeConf(fakeDialect{})
+	dir := writeMigrations(t, map[string]string{
+		"001_a.sql": "-- +goose Up\nCREATE TABLE a (id int);\n-- +goose Down\nDROP TABLE a;\n",
+		"002_b.sql": "-- +goose Up\nCREATE TABLE b (id int);\n-- +goose Down\nDROP TABLE b;\n",
+		"003_c.sql": "-- +goose Up\nCREATE TABLE c (id int);\n-- +goose Down\nDROP TABLE c;\n",
+	})
+
+	pendingVersions := func() []int64 {
+		pending, err := GetPendingMigrations(db, fakeDialect{}, dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var vs []int64
+		for _, m := range pending {
+			vs = append(vs, m.Version)
+		}
+		return vs
+	}
+
+	// a missing version table leaves everything pending, and isn't created
+	if got := pendingVersions(); !reflect.DeepEqual(got, []int64{1, 2, 3}) {
+		t.Errorf("incorrect pending versions. got %v, want [1 2 3]", got)
+	}
+	if _, err := GetDBVersionOnDb(db, fakeDialect{}); !errors.Is(err, ErrTableDoesNotExist) {
+		t.Errorf("expected the version table to still be missing, got %v", err)
+	}
+
+	if err := RunMigrationsOnDb(conf, dir, 1, db); err != nil {
+		t.Fatal(err)
+	}
+	if got := pendingVersions(); !reflect.DeepEqual(got, []int64{2, 3}) {
+		t.Errorf("incorrect pending versions. got %v, want [2 3]", got)
+	}
+
+	if err := RunMigrationsOnDb(conf, dir, 3, db); err != nil {
+		t.Fatal(err)
+	}
+	if got := pendingVersions(); len(got) != 0 {
+		t.Errorf("expected nothing pending, got %v", got)
+	}
+}
+
+func TestListMigrations(t *testing.T) {
+
+	db, _ := newFakeDB(t)
+	conf := newFakeConf(fakeDialect{})
+	dir := writeMigrations(t, map[string]string{
+		"001_a.sql": "-- +goose Up\nCREATE TABLE a (id int);\n-- +goose Down\nDROP TABLE a;\n",
+		"002_b.sql": "-- +goose Up\nCREATE TABLE b (id int);\n-- +goose Down\nDROP TABLE b;\n",
+	})
+	if err := RunMigrationsOnDb(conf, dir, 1, db); err != nil {
+		t.Fatal(err)
+	}
+
+	ms, err := ListMigrations(db, fakeDialect{}, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ms) != 2 || ms[0].AppliedAt == nil || ms[0].AppliedAt.IsZero() || ms[1].AppliedAt != nil {
+		t.Fatalf("expected only 001 to be applied, got %+v", ms)
+	}
+
+	b, err := json.Marshal(ms[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := fmt.Sprintf(`{"version":2,"next":-1,"previous":1,"source":%q}`, filepath.Join(dir, "002_b.sql"))
+	if string(b) != want {
+		t.Errorf("incorrect JSON. got %s, want %s", b, want)
+	}
+
+	var m Migration
+	if err := json.Unmarshal(b, &m); err != nil || m.Version != 2 || m.Previous != 1 || m.Source != ms[1].Source {
+		t.Errorf("incorrect round trip. got %+v (%v)", m, err)
+	}
+}
+
+func TestDiffVersions(t *testing.T) {
+
+	onlyA, onlyB := DiffVersions([]int64{5, 1, 3, 3, 4}, []int64{2, 4, 1, 6, 2})
+	if want := []int64{3, 5}; !reflect.DeepEqual(onlyA, want) {
+		t.Errorf("incorrect versions only in a. got %v, want %v", onlyA, want)
+	}
+	if want := []int64{2, 6}; !reflect.DeepEqual(onlyB, want) {
+		t.Errorf("incorrect versions only in b. got %v, want %v", onlyB, want)
+	}
+
+	conf := newFakeConf(fakeDialect{})
+	dir := writeMigrations(t, map[string]string{
+		"001_a.sql": "-- +goose Up\nCREATE TABLE a (id int);\n",
+		"002_b.sql": "-- +goose Up\nCREATE TABLE b (id int);\n",
+		"003_c.sql": "-- +goose Up\nCREATE TABLE c (id int);\n",
+	})
+	staging, _ := newNamedFakeDB(t, t.Name()+"/staging")
+	prod, _ := newNamedFakeDB(t, t.Name()+"/prod")
+
+	// a database without a version table has nothing applied
+	onlyA, onlyB, err := DiffDBVersions(staging, prod, fakeDialect{})
+	if err != nil || len(onlyA) != 0 || len(onlyB) != 0 {
+		t.Errorf("expected no differences, got %v and %v (%v)", onlyA, onlyB, err)
+	}
+
+	if err := RunMigrationsOnDb(conf, dir, 3, staging); err != nil {
+		t.Fatal(err)
+	}
+	if err := RunMigrationsOnDb(conf, dir, 1, prod); err != nil {
+		t.Fatal(err)
+	}
+	onlyA, onlyB, err = DiffDBVersions(staging, prod, fakeDialect{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []int64{2, 3}; !reflect.DeepEqual(onlyA, want) || len(onlyB) != 0 {
+		t.Errorf("expected prod to be behind by %v, got %v and %v", want, onlyA, onlyB)
+	}
+}
+
+func TestParseMigrations(t *testing.T) {
+
+	dir := writeMigrations(t, map[string]string{
+		"001_a.sql": "-- +goose Up\nCREATE TABLE a (id int);\n-- +goose Down\nDROP TABLE a;\n",
+		"002_b.sql": "-- +goose NO TRANSACTION\n-- +goose Up\n-- +goose ENVSUB ON\nCREATE INDEX CONCURRENTLY b ON a (id);\n" +
+			"-- +goose Verify\nSELECT 1;\n-- +goose ENVSUB OFF\n-- +goose ENVSUB ON\n",
+		"003_c.go":  "package main\n\nfunc Up_3(txn *sql.Tx) {\n}\n",
+		"004_d.sql": "-- +goose Down\nDROP TABLE d;\n",
+	})
+
+	ms, err := ParseMigrations(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []MigrationMetadata{
+		{HasUp: true, HasDown: true},
+		{HasUp: true, HasVerify: true, NoTransaction: true, Directives: []string{"NO TRANSACTION", "ENVSUB ON", "ENVSUB OFF"}},
+		{HasUp: true},
+		{HasDown: true},
+	}
+	if len(ms) != len(want) {
+		t.Fatalf("expected %d migrations, got %+v", len(want), ms)
+	}
+	for i, m := range ms {
+		if m.Version != int64(i+1) || !strings.HasPrefix(m.Source, dir) {
+			t.Errorf("incorrect migration %d: %+v", i+1, m)
+		}
+		if m.Metadata == nil || !reflect.DeepEqual(*m.Metadata, want[i]) {
+			t.Errorf("incorrect metadata for %s. got %+v, want %+v", filepath.Base(m.Source), m.Metadata, want[i])
+		}
+	}
+
+	// a script that can't be run as written is reported
+	dir = writeMigrations(t, map[string]string{
+		"001_a.sql": "-- +goose Up\nCREATE TABLE a (id int);\n-- +goose Down\n-- +goose StatementBegin\nDROP TABLE a;\n",
+	})
+	var perr *ParseError
+	if _, err := ParseMigrations(dir); !errors.As(err, &perr) || perr.Line != 4 {
+		t.Errorf("expected a *ParseError at line 4, got %v", err)
+	}
+}
+func TestRunMigrationsDirs(t *testing.T) {
+
+	db, fdb := newFakeDB(t)
+	conf := newFakeConf(fakeDialect{})
+	base := writeMigrations(t, map[string]string{
+		"001_a.sql": "-- +goose Up\nCREATE TABLE a (id int);\n-- +goose Down\nDROP TABLE a;\n",
+		"003_c.sql": "-- +goose Up\nCREATE TABLE c (id int);\n-- +goose Down\nDROP TABLE c;\n",
+	})
+	service := writeMigrations(t, map[string]string{
+		"002_b.sql": "-- +goose Up\nCREATE TABLE b (id int);\n-- +goose Down\nDROP TABLE b;\n",
+	})
+
+	if err := RunMigrationsDirs(conf, []string{base, service}, 3, db); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"CREATE TABLE a (id int);", "CREATE TABLE b (id int);", "CREATE TABLE c (id int);"}
+	if got := fdb.statements(); !reflect.DeepEqual(got, want) {
+		t.Errorf("incorrect statements. got %q, want %q", got, want)
+	}
+
+	fdb.stmts = nil
+	if err := RunMigrationsDirs(conf, []string{base, service}, 1, db); err != nil {
+		t.Fatal(err)
+	}
+	want = []string{"DROP TABLE c;", "DROP TABLE b;"}
+	if got := fdb.statements(); !reflect.DeepEqual(got, want) {
+		t.Errorf("incorrect statements. got %q, want %q", got, want)
+	}
+
+	// a version in two directories is ambiguous
+	clash := writeMigrations(t, map[string]string{
+		"002_other.sql": "-- +goose Up\nCREATE TABLE other (id int);\n-- +goose Down\nDROP TABLE other;\n",
+	})
+	err := RunMigrationsDirs(conf, []string{base, service, clash}, 3, db)
+	if err == nil || !strings.Contains(err.Error(), "002_b.sql") || !strings.Contains(err.Error(), "002_other.sql") {
+		t.Errorf("expected an error naming both files, got %v", err)
+	}
+}
+
+func TestBestEffort(t *testing.T) {
+
+	db, fdb := newFakeDB(t)
+	fdb.failOn = "broken"
+	conf := newFakeConf(fakeDialect{})
+	dir := writeMigrations(t, map[string]string{
+		"001_a.sql": "-- +goose Up\nCREATE TABLE a (id int);\n-- +goose Down\nDROP TABLE a;\n",
+		"002_b.sql": "-- +goose Up\nCREATE TABLE broken_b (id int);\n-- +goose Down\nDROP TABLE broken_b;\n",
+		"003_c.sql": "-- +goose Up\nCREATE TABLE c (id int);\n-- +goose Down\nDROP TABLE c;\n",
+		"004_d.sql": "-- +goose Up\nCREATE TABLE broken_d (id int);\n-- +goose Down\nDROP TABLE broken_d;\n",
+	})
+
+	// by default the run stops at the first failure
+	if err := RunMigrationsOnDb(conf, dir, 4, db); err == nil {
+		t.Fatal("expected migration 2 to fail the run")
+	}
+	if got, want := fdb.appliedVersions(), []int64{1}; !reflect.DeepEqual(got, want) {
+		t.Errorf("incorrect applied versions. got %v, want %v", got, want)
+	}
+
+	conf.Options.BestEffort = true
+	conf.Options.AllowMissing = true
+	err := RunMigrationsOnDb(conf, dir, 4, db)
+	var berr *BestEffortError
+	if !errors.As(err, &berr) {
+		t.Fatalf("expected a *BestEffortError, got %v", err)
+	}
+	var failed []int64
+	for _, f := range berr.Failures {
+		failed = append(failed, f.Migration.Version)
+	}
+	if !reflect.DeepEqual(failed, []int64{2, 4}) {
+		t.Errorf("incorrect failures. got %v, want [2 4]", failed)
+	}
+	if !strings.Contains(err.Error(), "002_b.sql") || !strings.Contains(err.Error(), "004_d.sql") {
+		t.Errorf("expected the error to name both failed migrations, got %v", err)
+	}
+	if got, want := fdb.appliedVersions(), []int64{1, 3}; !reflect.DeepEqual(got, want) {
+		t.Errorf("incorrect applied versions. got %v, want %v", got, want)
+	}
+}
+
+func TestSingleTransaction(t *testing.T) {
+
+	db, fdb := newFakeDB(t)
+	conf := newFakeConf(fakeDialect{})
+	conf.Options.SingleTransaction = true
+	dir := writeMigrations(t, map[string]string{
+		"001_a.sql": "-- +goose Up\nCREATE TABLE a (id int);\n",
+		"002_b.sql": "-- +goose Up\nCREATE TABLE b (id int);\n",
+		"003_c.sql": "-- +goose Up\nCREATE TABLE c (id int);\n",
+	})
+
+	// nothing's reported as having succeeded until the batch commits
+	var after []string
+	var progress [][2]int
+	conf.Options.AfterEach = func(m *Migration, err error) {
+		after = append(after, fmt.Sprintf("%d %v", m.Version, err != nil))
+	}
+	conf.Options.Progress = func(done, total int, m *Migration) {
+		progress = append(progress, [2]int{done, total})
+	}
+
+	// a failure rolls back the migrations that ran before it too
+	fdb.failOn = "CREATE TABLE c"
+	ran, err := Migrate(context.Background(), conf, db, dir, 3)
+	if err == nil || !strings.Contains(err.Error(), "003_c.sql") {
+		t.Fatalf("expected migration 3 to fail, got %v", err)
+	}
+	if len(ran) != 0 {
+		t.Errorf("%d migrations reported as run, all rolled back", len(ran))
+	}
+	if got := fdb.appliedVersions(); len(got) != 0 {
+		t.Errorf("versions %v left applied after the batch failed", got)
+	}
+	if len(fdb.stmts) != 0 {
+		t.Errorf("statements %q left applied after the batch failed", fdb.stmts)
+	}
+	if want := []string{"3 true", "1 true", "2 true"}; !reflect.DeepEqual(after, want) {
+		t.Errorf("AfterEach got %q after the batch failed, want %q", after, want)
+	}
+	if want := [][2]int{{0, 3}, {0, 3}, {0, 3}}; !reflect.DeepEqual(progress, want) {
+		t.Errorf("Progress got %v after the batch failed, want %v", progress, want)
+	}
+
+	// as is a failure to commit
+	after, progress = nil, nil
+	fdb.failOn = ""
+	fdb.lostCommits = 1
+	versions := append([]fakeVersionRow{}, fdb.versions...)
+	if _, err := Migrate(context.Background(), conf, db, dir, 3); err == nil || !strings.Contains(err.Error(), "commit") {
+		t.Fatalf("expected the batch's commit to fail, got %v", err)
+	}
+	if want := []string{"1 true", "2 true", "3 true"}; !reflect.DeepEqual(after, want) {
+		t.Errorf("AfterEach got %q after the commit failed, want %q", after, want)
+	}
+	fdb.versions, fdb.stmts = versions, nil
+
+	after, progress = nil, nil
+	began := len(fdb.txOpts)
+	if ran, err = Migrate(context.Background(), conf, db, dir, 3); err != nil {
+		t.Fatal(err)
+	}
+	if len(ran) != 3 {
+		t.Errorf("%d migrations reported as run, want 3", len(ran))
+	}
+	if got, want := fdb.appliedVersions(), []int64{1, 2, 3}; !reflect.DeepEqual(got, want) {
+		t.Errorf("incorrect applied versions. got %v, want %v", got, want)
+	}
+	if n := len(fdb.txOpts) - began; n != 1 {
+		t.Errorf("the batch ran in %d transactions, want 1", n)
+	}
+	if want := []string{"1 false", "2 false", "3 false"}; !reflect.DeepEqual(after, want) {
+		t.Errorf("AfterEach got %q, want %q", after, want)
+	}
+	if want := [][2]int{{0, 3}, {0, 3}, {0, 3}, {1, 3}, {2, 3}, {3, 3}}; !reflect.DeepEqual(progress, want) {
+		t.Errorf("Progress got %v, want %v", progress, want)
+	}
+	conf.Options.AfterEach, conf.Options.Progress = nil, nil
+
+	// migrations that can't run in the batch's transaction fail the run before any does
+	dir = writeMigrations(t, map[string]string{
+		"004_d.sql": "-- +goose Up\nCREATE TABLE d (id int);\n",
+		"005_e.sql": "-- +goose NO TRANSACTION\n-- +goose Up\nCREATE INDEX CONCURRENTLY e ON d (id);\n",
+	})
+	if err := RunMigrationsOnDb(conf, dir, 5, db); err == nil || !strings.Contains(err.Error(), "005_e.sql is annotated 'NO TRANSACTION'") {
+		t.Errorf("expected the NO TRANSACTION migration to be rejected, got %v", err)
+	}
+	if got, want := fdb.appliedVersions(), []int64{1, 2, 3}; !reflect.DeepEqual(got, want) {
+		t.Errorf("incorrect applied versions. got %v, want %v", got, want)
+	}
+
+	conf.Options.BestEffort = true
+	if err := RunMigrationsOnDb(conf, dir, 4, db); err == nil || !strings.Contains(err.Error(), "BestEffort") {
+		t.Errorf("expected BestEffort to be rejected, got %v", err)
+	}
+}
+
+func TestSentinelErrors(t *testing.T) {
+
+	db, fdb := newFakeDB(t)
+	conf := newFakeConf(fakeDialect{})
+	dir := writeMigrations(t, map[string]string{
+		"001_a.sql": "-- +goose Up\nCREATE TABLE a (id int);\n",
+		"002_b.sql": "-- +goose Up\nCREATE TABLE b (id int);\n-- +goose Down\nDROP TABLE b;\n",
+		"003_c.sql": "-- +goose NO TRANSACTION\n-- +goose Up\nCREATE TABLE c (id int);\nCREATE INDEX broken ON c (id);\n-- +goose Down\nDROP TABLE c;\n",
+	})
+
+	if _, err := GetMostRecentDBVersion(t.TempDir()); !errors.Is(err, ErrNoMigrationFiles) {
+		t.Errorf("expected ErrNoMigrationFiles for an empty directory, got %v", err)
+	}
+
+	// 003 fails after its first statement has run
+	fdb.failOn = "broken"
+	err := RunMigrationsOnDb(conf, dir, 3, db)
+	if !errors.Is(err, ErrDirtyDatabase) {
+		t.Fatalf("expected ErrDirtyDatabase, got %v", err)
+	}
+	var merr *MigrationError
+	if errors.As(err, &merr) {
+		t.Errorf("expected no *MigrationError outside of a best effort run, got %v", merr)
+	}
+	if got, want := fdb.dirtyVersions(), []int64{3}; !reflect.DeepEqual(got, want) {
+		t.Errorf("incorrect dirty versions. got %v, want %v", got, want)
+	}
+	fdb.failOn = ""
+
+	// and, until forced, later runs are refused
+	if err := RunMigrationsOnDb(conf, dir, 3, db); !errors.Is(err, ErrDirtyDatabase) {
+		t.Fatalf("expected a dirty database to be refused, got %v", err)
+	}
+	if err := Force(conf, db, 2); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := fdb.appliedVersions(), []int64{1, 2}; !reflect.DeepEqual(got, want) {
+		t.Errorf("incorrect applied versions. got %v, want %v", got, want)
+	}
+
+	// rolling back 001 needs a down section
+	err = RunMigrationsOnDb(conf, dir, 0, db)
+	if !errors.Is(err, ErrNoDownMigration) {
+		t.Fatalf("expected ErrNoDownMigration, got %v", err)
+	}
+	var perr *ParseError
+	if !errors.As(err, &perr) || filepath.Base(perr.Path) != "001_a.sql" {
+		t.Errorf("expected a *ParseError for 001_a.sql, got %v", err)
+	}
+
+	// rolling back past 002 once its script is gone
+	if err := os.Remove(filepath.Join(dir, "002_b.sql")); err != nil {
+		t.Fatal(err)
+	}
+	err = RunMigrationsOnDb(conf, dir, 1, db)
+	if !errors.Is(err, ErrVersionGap) || !strings.Contains(err.Error(), "version 2") {
+		t.Fatalf("expected ErrVersionGap naming version 2, got %v", err)
+	}
+	if !strings.Contains(err.Error(), "-allowmissing") {
+		t.Errorf("expected the error to point at -allowmissing, got %v", err)
+	}
+	if got, want := fdb.appliedVersions(), []int64{1, 2}; !reflect.DeepEqual(got, want) {
+		t.Errorf("expected nothing rolled back, got applied versions %v", got)
+	}
+
+	// which leaves the version applied
+	conf.Options.AllowMissing = true
+	if err := RunMigrationsOnDb(conf, dir, 1, db); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := fdb.appliedVersions(), []int64{1, 2}; !reflect.DeepEqual(got, want) {
+		t.Errorf("incorrect applied versions. got %v, want %v", got, want)
+	}
+}
+
+func TestForceVersion(t *testing.T) {
+
+	db, fdb := newFakeDB(t)
+	conf := newFakeConf(fakeDialect{})
+	dir := writeMigrations(t, map[string]string{
+		"001_a.sql": "-- +goose Up\nCREATE TABLE a (id int);\n-- +goose Down\nDROP TABLE a;\n",
+		"002_b.sql": "-- +goose Up\nCREATE TABLE b (id int);\n-- +goose Down\nDROP TABLE b;\n",
+		"003_c.sql": "-- +goose NO TRANSACTION\n-- +goose Up\nCREATE TABLE c (id int);\nCREATE INDEX broken ON c (id);\n-- +goose Down\nDROP TABLE c;\n",
+	})
+
+	if err := ForceVersion(db, conf.Driver.Dialect, -1); err == nil {
+		t.Error("expected a negative version to be refused")
+	}
+
+	// a missing version table is created
+	if err := ForceVersion(db, conf.Driver.Dialect, 2); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := fdb.appliedVersions(), []int64{2}; !reflect.DeepEqual(got, want) {
+		t.Errorf("incorrect applied versions. got %v, want %v", got, want)
+	}
+	if current, err := GetDBVersionOnDb(db, conf.Driver.Dialect); err != nil || current != 2 {
+		t.Errorf("expected version 2, got %v (%v)", current, err)
+	}
+	stmts := len(fdb.statements())
+
+	// 003 is left dirty
+	fdb.failOn = "broken"
+	if err := RunMigrationsOnDb(conf, dir, 3, db); !errors.Is(err, ErrDirtyDatabase) {
+		t.Fatalf("expected ErrDirtyDatabase, got %v", err)
+	}
+	fdb.failOn = ""
+
+	// forcing a version clears it, along with anything above the version
+	if err := ForceVersion(db, conf.Driver.Dialect, 1); err != nil {
+		t.Fatal(err)
+	}
+	if got := fdb.dirtyVersions(); len(got) != 0 {
+		t.Errorf("expected no dirty versions, got %v", got)
+	}
+	if got, want := fdb.appliedVersions(), []int64{1}; !reflect.DeepEqual(got, want) {
+		t.Errorf("incorrect applied versions. got %v, want %v", got, want)
+	}
+	if got := fdb.statements(); len(got) != stmts+1 {
+		t.Errorf("expected no migrations to run when forcing, got statements %q", got[stmts:])
+	}
+
+	// forcing the current version again changes nothing
+	if err := ForceVersion(db, conf.Driver.Dialect, 1); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := fdb.appliedVersions(), []int64{1}; !reflect.DeepEqual(got, want) {
+		t.Errorf("incorrect applied versions. got %v, want %v", got, want)
+	}
+}
+
+func TestMarkApplied(t *testing.T) {
+
+	db, fdb := newFakeDB(t)
+	conf := newFakeConf(fakeDialect{})
+	dir := writeMigrations(t, map[string]string{
+		"001_a.sql": "-- +goose Up\nCREATE TABLE a (id int);\n-- +goose Down\nDROP TABLE a;\n",
+		"002_b.sql": "-- +goose Up\nCREATE TABLE b (id int);\n-- +goose Down\nDROP TABLE b;\n",
+		"004_d.sql": "-- +goose Up\nCREATE TABLE d (id int);\n-- +goose Down\nDROP TABLE d;\n",
+	})
+
+	if err := MarkApplied(conf, db, dir, -1); err == nil {
+		t.Error("expected a negative version to be refused")
+	}
+
+	// a missing version table is created, and nothing runs
+	if err := MarkApplied(conf, db, dir, 2); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := fdb.appliedVersions(), []int64{1, 2}; !reflect.DeepEqual(got, want) {
+		t.Errorf("incorrect applied versions. got %v, want %v", got, want)
+	}
+	for _, stmt := range fdb.statements() {
+		if strings.Contains(stmt, "CREATE TABLE b") {
+			t.Errorf("expected no migrations to run when marking them applied, got %q", stmt)
+		}
+	}
+
+	// marking again changes nothing
+	stmts := len(fdb.statements())
+	if err := MarkApplied(conf, db, dir, 2); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := fdb.appliedVersions(), []int64{1, 2}; !reflect.DeepEqual(got, want) {
+		t.Errorf("incorrect applied versions. got %v, want %v", got, want)
+	}
+	if got := fdb.statements(); len(got) != stmts {
+		t.Errorf("expected no statements when marking applied versions, got %q", got[stmts:])
+	}
+
+	// the runner carries on from the marked versions
+	if err := RunMigrationsOnDb(conf, dir, 4, db); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := fdb.appliedVersions(), []int64{1, 2, 4}; !reflect.DeepEqual(got, want) {
+		t.Errorf("incorrect applied versions. got %v, want %v", got, want)
+	}
+
+	// a version below one applied already is missing, so is refused
+	path := filepath.Join(dir, "003_c.sql")
+	if err := ioutil.WriteFile(path, []byte("-- +goose Up\nCREATE TABLE c (id int);\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	err := MarkApplied(conf, db, dir, 4)
+	if err == nil || !strings.Contains(err.Error(), "003_c.sql") {
+		t.Fatalf("expected marking 003_c.sql applied to be refused, got %v", err)
+	}
+	if got, want := fdb.appliedVersions(), []int64{1, 2, 4}; !reflect.DeepEqual(got, want) {
+		t.Errorf("incorrect applied versions. got %v, want %v", got, want)
+	}
+
+	// unless missing migrations are allowed
+	conf.Options.AllowMissing = true
+	if err := MarkApplied(conf, db, dir, 4); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := fdb.appliedVersions(), []int64{1, 2, 4, 3}; !reflect.DeepEqual(got, want) {
+		t.Errorf("incorrect applied versions. got %v, want %v", got, want)
+	}
+
+	// the marked scripts' checksums are recorded, so changes are caught
+	if err := ioutil.WriteFile(filepath.Join(dir, "001_a.sql"), []byte("-- +goose Up\nCREATE TABLE a (id bigint);\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := RunMigrationsOnDb(conf, dir, 5, db); err == nil || !strings.Contains(err.Error(), "has changed since it was applied") {
+		t.Errorf("expected the changed 001_a.sql to be caught, got %v", err)
+	}
+}
+
+func TestReconcile(t *testing.T) {
+
+	db, fdb := newFakeDB(t)
+	conf := newFakeConf(fakeDialect{})
+	dir := writeMigrations(t, map[string]string{
+		"001_a.sql": "-- +goose Up\nCREATE TABLE a (id int);\n-- +goose Down\nDROP TABLE a;\n",
+		"002_b.sql": "-- +goose Up\nCREATE TABLE b (id int);\n-- +goose Down\nDROP TABLE b;\n",
+		"003_c.sql": "-- +goose Up\nCREATE TABLE c (id int);\n-- +goose Down\nDROP TABLE c;\n",
+	})
+
+	// a missing version table is reported, not created
+	anomalies, err := Reconcile(conf, db, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(anomalies) != 1 || !strings.Contains(anomalies[0], "doesn't exist") {
+		t.Errorf("expected the missing version table to be reported, got %q", anomalies)
+	}
+	if fdb.versions != nil {
+		t.Error("expected the version table not to be created")
+	}
+
+	if err := RunMigrationsOnDb(conf, dir, 3, db); err != nil {
+		t.Fatal(err)
+	}
+	if anomalies, err := Reconcile(conf, db, dir); err != nil || len(anomalies) != 0 {
+		t.Fatalf("expected no anomalies in a table goose kept, got %q (%v)", anomalies, err)
+	}
+
+	// edit the table by hand: 1's row is lost, 2's duplicated, 3 is
+	// left dirty, and 9 is recorded with no migration
+	var edited []fakeVersionRow
+	for _, r := range fdb.versions {
+		switch r.args[0] {
+		case int64(1):
+			continue
+		case int64(2):
+			fdb.nextID++
+			dup := fakeVersionRow{fdb.nextID, append([]driver.Value{}, r.args...), time.Now()}
+			edited = append(edited, dup)
+		case int64(3):
+			r.args[3] = true
+		}
+		edited = append(edited, r)
+	}
+	fdb.nextID++
+	fdb.versions = append(edited, fakeVersionRow{fdb.nextID, []driver.Value{int64(9), true, "", false}, time.Now()})
+	rows, stmts := len(fdb.versions), len(fdb.statements())
+
+	anomalies, err = Reconcile(conf, db, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"migration 1 (001_a.sql) isn't applied, but version 9, after it, is",
+		"version 2 is recorded as applied 2 times",
+		"migration 3 is marked dirty, as a run left it partway; Force clears the mark once it's put right",
+		"version 9 is applied, but has no migration in " + dir,
+	}
+	if !reflect.DeepEqual(anomalies, want) {
+		t.Errorf("incorrect anomalies.\ngot  %q\nwant %q", anomalies, want)
+	}
+	if len(fdb.versions) != rows || len(fdb.statements()) != stmts {
+		t.Error("expected Reconcile to change nothing")
+	}
+
+	// with missing migrations allowed, 1 is only missing
+	conf.Options.AllowMissing = true
+	anomalies, err = Reconcile(conf, db, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(anomalies, want[1:]) {
+		t.Errorf("incorrect anomalies.\ngot  %q\nwant %q", anomalies, want[1:])
+	}
+
+	// with a VersionStore, its versions are cross-checked, not the table's
+	conf.Options.AllowMissing = false
+	conf.Options.VersionStore = &memoryVersionStore{applied: map[int64]bool{2: true, 3: true, 9: true}}
+	anomalies, err = Reconcile(conf, db, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = []string{
+		"migration 1 (001_a.sql) isn't applied, but version 9, after it, is",
+		"version 9 is applied, but has no migration in " + dir,
+	}
+	if !reflect.DeepEqual(anomalies, want) {
+		t.Errorf("incorrect anomalies.\ngot  %q\nwant %q", anomalies, want)
+	}
+}
+
+func TestSquash(t *testing.T) {
+
+	t.Setenv("SQUASH_TABLE", "c")
+	files := map[string]string{
+		"001_a.sql": "-- +goose Up\nCREATE TABLE a (id int);\n-- +goose Down\nDROP TABLE a;\n",
+		"002_b.sql": "-- +goose NO TRANSACTION\n-- +goose Up\nCREATE TABLE b (id int);\n" +
+			"-- +goose StatementBegin\nCREATE FUNCTION f() AS $$ SELECT 1; $$;\n-- +goose StatementEnd\n" +
+			"-- +goose Down\nDROP TABLE b;\n",
+		"003_c.sql": "-- +goose Up\n-- +goose ENVSUB ON\nCREATE TABLE ${SQUASH_TABLE} (id int);\n-- +goose Down\nDROP TABLE c;\n",
+		"004_d.sql": "-- +goose Up\nCREATE TABLE ${d} (id int);\n-- +goose Down\nDROP TABLE d;\n",
+	}
+	dir := writeMigrations(t, files)
+
+	// the statements of a script, without the comments around them
+	statements := func(path string) []string {
+		stmts, _, err := newMigration(0, path).parseSQL(true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var stripped []string
+		for _, stmt := range stmts {
+			var lines []string
+			for _, line := range strings.Split(stmt, "\n") {
+				if !strings.HasPrefix(line, "--") && strings.TrimSpace(line) != "" {
+					lines = append(lines, line)
+				}
+			}
+			stripped = append(stripped, strings.Join(lines, "\n"))
+		}
+		return stripped
+	}
+	var want []string
+	for _, name := range []string{"001_a.sql", "002_b.sql", "003_c.sql"} {
+		want = append(want, statements(filepath.Join(dir, name))...)
+	}
+
+	// a database migrated before the squash
+	db, fdb := newFakeDB(t)
+	conf := newFakeConf(fakeDialect{})
+	if err := RunMigrationsOnDb(conf, dir, 3, db); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := Squash(dir, 3, "baseline.sql"); err != nil {
+		t.Fatal(err)
+	}
+
+	squashed := filepath.Join(dir, "003_baseline.sql")
+	for name := range files {
+		_, err := os.Stat(filepath.Join(dir, name))
+		if kept := name == "004_d.sql"; kept != (err == nil) {
+			t.Errorf("%s: expected it kept %v, got %v", name, kept, err)
+		}
+	}
+	if got := statements(squashed); !reflect.DeepEqual(got, want) {
+		t.Errorf("incorrect squashed statements. got %q, want %q", got, want)
+	}
+	m := newMigration(3, squashed)
+	if _, _, err := m.parseSQL(true); err != nil || !m.script.noTx || !m.script.squashed {
+		t.Errorf("expected the squash to run outside a transaction, got %+v (%v)", m.script, err)
+	}
+	if _, _, err := m.parseSQL(false); !errors.Is(err, ErrNoDownMigration) {
+		t.Errorf("expected the squash to have no Down section, got %v", err)
+	}
+
+	// the existing database carries on past it, its checksum aside
+	if err := RunMigrationsOnDb(conf, dir, 4, db); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := fdb.appliedVersions(), []int64{1, 2, 3, 4}; !reflect.DeepEqual(got, want) {
+		t.Errorf("incorrect applied versions. got %v, want %v", got, want)
+	}
+
+	// and a fresh one applies it in their place
+	db, fdb = newNamedFakeDB(t, t.Name()+"/fresh")
+	if err := RunMigrationsOnDb(conf, dir, 4, db); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := fdb.appliedVersions(), []int64{3, 4}; !reflect.DeepEqual(got, want) {
+		t.Errorf("incorrect applied versions. got %v, want %v", got, want)
+	}
+
+	if err := Squash(dir, 0, "again"); !errors.Is(err, ErrNoMigrationFiles) {
+		t.Errorf("expected nothing to squash, got %v", err)
+	}
+	if err := Squash(dir, 4, "../elsewhere"); err == nil {
+		t.Error("expected a name with a path separator to be refused")
+	}
+
+	dir = writeMigrations(t, map[string]string{
+		"001_a.sql": files["001_a.sql"],
+		"002_b.go":  "package main\n",
+	})
+	if err := Squash(dir, 2, "baseline"); err == nil {
+		t.Error("expected a Go migration to be refused")
+	}
+	if _, err := os.Stat(filepath.Join(dir, "001_a.sql")); err != nil {
+		t.Errorf("expected nothing squashed after the error, got %v", err)
+	}
+}
+
+// memoryVersionStore keeps versions in a map, as a VersionStore
+// backed by some other service might.
+type memoryVersionStore struct {
+	applied map[int64]bool
+	inserts int
+}
+
+func (s *memoryVersionStore) GetAppliedVersions(ctx context.Context) ([]int64, error) {
+	var vs []int64
+	for v, applied := range s.applied {
+		if applied {
+			vs = append(vs, v)
+		}
+	}
+	sort.Slice(vs, func(i, j int) bool { return vs[i] < vs[j] })
+	return vs, nil
+}
+
+func (s *memoryVersionStore) Insert(ctx context.Context, version int64, applied bool) error {
+	s.applied[version] = applied
+	s.inserts++
+	return nil
+}
+
+func (s *memoryVersionStore) Delete(ctx context.Context, version int64) error {
+	delete(s.applied, version)
+	return nil
+}
+
+func TestVersionStore(t *testing.T) {
+
+	db, fdb := newFakeDB(t)
+	conf := newFakeConf(fakeDialect{})
+	store := &memoryVersionStore{applied: map[int64]bool{}}
+	conf.Options.VersionStore = store
+	dir := writeMigrations(t, map[string]string{
+		"001_a.sql": "-- +goose Up\nCREATE TABLE a (id int);\n-- +goose Down\nDROP TABLE a;\n",
+		"002_b.sql": "-- +goose NO TRANSACTION\n-- +goose Up\nCREATE TABLE b (id int);\n-- +goose Down\nDROP TABLE b;\n",
+		"003_c.sql": "-- +goose Up\nCREATE TABLE c (id int);\n-- +goose Down\nDROP TABLE c;\n",
+	})
+
+	// the migrations run against the database, but are recorded in the store
+	if err := RunMigrationsOnDb(conf, dir, 3, db); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := store.GetAppliedVersions(context.Background()); !reflect.DeepEqual(got, []int64{1, 2, 3}) {
+		t.Errorf("incorrect stored versions. got %v, want [1 2 3]", got)
+	}
+	if got := fdb.statements(); len(got) != 3 {
+		t.Errorf("expected the migrations to run against the database, got %q", got)
+	}
+	if fdb.versions != nil {
+		t.Error("expected the version table to be left uncreated")
+	}
+
+	// with the store being what decides what's applied
+	if err := RunMigrationsOnDb(conf, dir, 3, db); err != nil || store.inserts != 3 {
+		t.Errorf("expected nothing to run again, got %v inserts (%v)", store.inserts, err)
+	}
+	if err := RunMigrationsOnDb(conf, dir, 1, db); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := store.GetAppliedVersions(context.Background()); !reflect.DeepEqual(got, []int64{1}) {
+		t.Errorf("incorrect stored versions. got %v, want [1]", got)
+	}
+
+	// a failed migration isn't recorded
+	fdb.failOn = "TABLE b"
+	if err := RunMigrationsOnDb(conf, dir, 3, db); err == nil {
+		t.Fatal("expected 002_b.sql to fail")
+	}
+	fdb.failOn = ""
+	if got, _ := store.GetAppliedVersions(context.Background()); !reflect.DeepEqual(got, []int64{1}) {
+		t.Errorf("incorrect stored versions. got %v, want [1]", got)
+	}
+
+	// nor is it marked dirty, as a store has no dirty marks for Force to clear
+	partial := writeMigrations(t, map[string]string{
+		"001_a.sql": "-- +goose Up\nCREATE TABLE a (id int);\n",
+		"002_b.sql": "-- +goose NO TRANSACTION\n-- +goose Up\nCREATE TABLE b (id int);\nCREATE INDEX b_id ON b (id);\n",
+	})
+	fdb.failOn = "INDEX b_id"
+	err := RunMigrationsOnDb(conf, partial, 2, db)
+	if err == nil || errors.Is(err, ErrDirtyDatabase) || !strings.Contains(err.Error(), "after 1 of its 2 statements ran") {
+		t.Errorf("expected the partial run to be reported without ErrDirtyDatabase, got %v", err)
+	}
+	fdb.failOn = ""
+
+	// the default store is the version table
+	conf.Options.VersionStore = NewVersionStore(conf, db)
+	if err := RunMigrationsOnDb(conf, dir, 3, db); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := fdb.appliedVersions(), []int64{1, 2, 3}; !reflect.DeepEqual(got, want) {
+		t.Errorf("incorrect applied versions. got %v, want %v", got, want)
+	}
+}
+
+func TestReadDB(t *testing.T) {
+
+	db, fdb := newNamedFakeDB(t, t.Name()+"/primary")
+	replica, rdb := newNamedFakeDB(t, t.Name()+"/replica")
+	dir := writeMigrations(t, map[string]string{
+		"001_a.sql": "-- +goose Up\nCREATE TABLE a (id int);\n-- +goose Down\nDROP TABLE a;\n",
+		"002_b.sql": "-- +goose Up\nCREATE TABLE b (id int);\n-- +goose Down\nDROP TABLE b;\n",
+		"003_c.sql": "-- +goose Up\nCREATE TABLE c (id int);\n-- +goose Down\nDROP TABLE c;\n",
+	})
+	conf := newFakeConf(fakeDialect{})
+	conf.Options.ReadDB = replica
+
+	// the version table is created on the primary, when the replica has none
+	if err := RunMigrationsOnDb(conf, dir, 1, db); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := fdb.appliedVersions(), []int64{1}; !reflect.DeepEqual(got, want) {
+		t.Errorf("incorrect applied versions. got %v, want %v", got, want)
+	}
+
+	// with one, the run starts from the replica's versions, replicated
+	// here by hand, even where they differ from the primary's
+	if err := RunMigrationsOnDb(newFakeConf(fakeDialect{}), dir, 2, replica); err != nil {
+		t.Fatal(err)
+	}
+	if err := RunMigrationsOnDb(conf, dir, 2, db); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := fdb.appliedVersions(), []int64{1}; !reflect.DeepEqual(got, want) {
+		t.Errorf("expected the run to find the replica at version 2 already. got %v, want %v", got, want)
+	}
+	if err := RunMigrationsOnDb(newFakeConf(fakeDialect{}), dir, 2, db); err != nil {
+		t.Fatal(err)
+	}
+
+	queries := rdb.versionQueries
+	if err := RunMigrationsOnDb(conf, dir, 3, db); err != nil {
+		t.Fatal(err)
+	}
+	if rdb.versionQueries == queries {
+		t.Error("the versions weren't read from the replica")
+	}
+	if got, want := fdb.appliedVersions(), []int64{1, 2, 3}; !reflect.DeepEqual(got, want) {
+		t.Errorf("incorrect applied versions. got %v, want %v", got, want)
+	}
+
+	// Redo reapplies what it rolled back, which the replica, still at 2, doesn't show
+	if err := RunMigrationsOnDb(newFakeConf(fakeDialect{}), dir, 3, replica); err != nil {
+		t.Fatal(err)
+	}
+	if err := Redo(conf, db, dir, 1); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := fdb.appliedVersions(), []int64{1, 2, 3}; !reflect.DeepEqual(got, want) {
+		t.Errorf("incorrect applied versions after Redo. got %v, want %v", got, want)
+	}
+	if got := fdb.statements(); got[len(got)-1] != "CREATE TABLE c (id int);" {
+		t.Errorf("migration 3 wasn't reapplied: %q", got)
+	}
+
+	// a run holding the lock reads the primary
+	locked := newFakeConf(lockingDialect{})
+	locked.Options.ReadDB = replica
+	locked.Options.Lock = true
+	queries = rdb.versionQueries
+	if err := RunMigrationsOnDb(locked, dir, 3, db); err != nil {
+		t.Fatal(err)
+	}
+	if rdb.versionQueries != queries {
+		t.Error("a run holding the lock read the replica")
+	}
+}
+
+// objectCheckingDialect is a fakeDialect that can check whether the
+// tables named by 'CheckExists' annotations exist.
+type objectCheckingDialect struct{ fakeDialect }
+
+func (objectCheckingDialect) namedTableExistsQuery(schema, name string) string {
+	return informationSchemaTableExists("current_schema()", schema, name)
+}
+
+func TestVerify(t *testing.T) {
+
+	db, fdb := newFakeDB(t)
+	conf := newFakeConf(objectCheckingDialect{})
+	dir := writeMigrations(t, map[string]string{
+		"001_a.sql": "-- +goose CheckExists a\n-- +goose Up\nCREATE TABLE a (id int);\n-- +goose Down\nDROP TABLE a;\n",
+		"002_b.sql": "-- +goose Up\n-- +goose CheckExists b\nCREATE TABLE b (id int);\n",
+		"003_c.sql": "-- +goose Up\n-- +goose CheckExists c\nCREATE TABLE c (id int);\n",
+	})
+
+	// nothing's applied before the version table is created
+	if drift, err := Verify(db, conf.Driver.Dialect, dir); err != nil || len(drift) != 0 {
+		t.Fatalf("Verify() = %v, %v, want no drift", drift, err)
+	}
+
+	if err := RunMigrationsOnDb(conf, dir, 2, db); err != nil {
+		t.Fatal(err)
+	}
+	if drift, err := Verify(db, conf.Driver.Dialect, dir); err != nil || len(drift) != 0 {
+		t.Fatalf("Verify() = %v, %v, want no drift", drift, err)
+	}
+
+	// a table dropped by hand, behind goose's back
+	if _, err := db.Exec("DROP TABLE a;"); err != nil {
+		t.Fatal(err)
+	}
+	drift, err := Verify(db, conf.Driver.Dialect, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Drift{{Version: 1, Source: filepath.Join(dir, "001_a.sql"), Table: "a"}}
+	if !reflect.DeepEqual(drift, want) {
+		t.Errorf("incorrect drift. got %+v, want %+v", drift, want)
+	}
+	if got, want := fdb.appliedVersions(), []int64{1, 2}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Verify changed the applied versions. got %v, want %v", got, want)
+	}
+
+	if _, err := Verify(db, fakeDialect{}, dir); err == nil || !strings.Contains(err.Error(), "can't check that tables exist") {
+		t.Errorf("expected a dialect that can't check for tables to fail, got %v", err)
+	}
+
+	bad := writeMigrations(t, map[string]string{
+		"001_a.sql": "-- +goose Up\n-- +goose CheckExists a b\nCREATE TABLE a (id int);\n",
+	})
+	var perr *ParseError
+	if err := Validate(bad); !errors.As(err, &perr) || perr.Line != 2 {
+		t.Errorf("expected an invalid table name to fail to parse at line 2, got %v", err)
+	}
+
+	// a table named by a template is checked for as rendered
+	sharded := writeMigrations(t, map[string]string{
+		"001_a.sql": "-- +goose Up\n-- +goose CheckExists events_{{.Shard}}\nCREATE TABLE events_{{.Shard}} (id int);\n",
+	})
+	db, _ = newNamedFakeDB(t, t.Name()+"/sharded")
+	conf = newFakeConf(objectCheckingDialect{})
+	conf.Options.TemplateData = map[string]interface{}{"Shard": 3}
+	if err := RunMigrationsOnDb(conf, sharded, 1, db); err != nil {
+		t.Fatal(err)
+	}
+	if drift, err := VerifyConf(conf, db, sharded); err != nil || len(drift) != 0 {
+		t.Fatalf("VerifyConf() = %v, %v, want no drift", drift, err)
+	}
+	if _, err := db.Exec("DROP TABLE events_3;"); err != nil {
+		t.Fatal(err)
+	}
+	drift, err = VerifyConf(conf, db, sharded)
+	want = []Drift{{Version: 1, Source: filepath.Join(sharded, "001_a.sql"), Table: "events_3"}}
+	if err != nil || !reflect.DeepEqual(drift, want) {
+		t.Errorf("VerifyConf() = %+v, %v, want %+v", drift, err, want)
+	}
+}
+
+// multiStatementDialect is a fakeDialect whose driver can run several
+// statements in a single Exec.
+type multiStatementDialect struct{ fakeDialect }
+
+func (multiStatementDialect) supportsMultiStatement() bool { return true }
+
+func TestMultiStatement(t *testing.T) {
+
+	db, fdb := newFakeDB(t)
+	conf := newFakeConf(multiStatementDialect{})
+	conf.Options.MultiStatement = true
+	dir := writeMigrations(t, map[string]string{
+		"001_a.sql": "-- +goose Up\nCREATE TABLE a (id int);\nINSERT INTO a VALUES (1);\n" +
+			"-- +goose DELIMITER //\nINSERT INTO a VALUES (2)//\n",
+		"002_b.sql": "-- +goose NO TRANSACTION\n-- +goose Up\nCREATE TABLE b (id int);\nINSERT INTO b VALUES (1);\n",
+	})
+
+	if err := RunMigrationsOnDb(conf, dir, 2, db); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"CREATE TABLE a (id int);\nINSERT INTO a VALUES (1);\nINSERT INTO a VALUES (2);",
+		"CREATE TABLE b (id int);", "INSERT INTO b VALUES (1);",
+	}
+	if got := fdb.statements(); !reflect.DeepEqual(got, want) {
+		t.Errorf("incorrect statements.\ngot  %q\nwant %q", got, want)
+	}
+
+	// dialects without support run a statement at a time regardless
+	db, fdb = newNamedFakeDB(t, t.Name()+"/unsupported")
+	conf = newFakeConf(fakeDialect{})
+	conf.Options.MultiStatement = true
+	if err := RunMigrationsOnDb(conf, dir, 1, db); err != nil {
+		t.Fatal(err)
+	}
+	if got := fdb.statements(); len(got) != 3 {
+		t.Errorf("expected the statements to run one at a time, got %q", got)
+	}
+
+	// StatementTimeout bounds the section sent as one statement
+	db, fdb = newNamedFakeDB(t, t.Name()+"/timeout")
+	fdb.slowOn = "pg_sleep"
+	conf = newFakeConf(multiStatementDialect{})
+	conf.Options.MultiStatement = true
+	conf.Options.StatementTimeout = 20 * time.Millisecond
+	dir = writeMigrations(t, map[string]string{
+		"001_a.sql": "-- +goose Up\nCREATE TABLE a (id int);\nSELECT pg_sleep(3600);\n",
+	})
+	err := RunMigrationsOnDb(conf, dir, 1, db)
+	if want := "001_a.sql: statement 1 timed out after 20ms"; err == nil || !strings.Contains(err.Error(), want) {
+		t.Errorf("expected an error containing %q, got %v", want, err)
+	}
+}
+
+func BenchmarkMultiStatement(b *testing.B) {
+
+	var seed strings.Builder
+	seed.WriteString("-- +goose Up\n")
+	for i := 0; i < 200; i++ {
+		fmt.Fprintf(&seed, "INSERT INTO seed VALUES (%d);\n", i)
+	}
+	seed.WriteString("-- +goose Down\n")
+	for i := 0; i < 200; i++ {
+		fmt.Fprintf(&seed, "DELETE FROM seed WHERE id = %d;\n", i)
+	}
+	dir := writeMigrations(b, map[string]string{"001_seed.sql": seed.String()})
+
+	for _, multi := range []bool{false, true} {
+		name := "per-statement"
+		if multi {
+			name = "multi-statement"
+		}
+		b.Run(name, func(b *testing.B) {
+			db, fdb := newFakeDB(b)
+			fdb.latency = 100 * time.Microsecond
+			conf := newFakeConf(multiStatementDialect{})
+			conf.Options.MultiStatement = multi
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if err := RunMigrationsOnDb(conf, dir, 1, db); err != nil {
+					b.Fatal(err)
+				}
+				if err := RunMigrationsOnDb(conf, dir, 0, db); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestMaxApply(t *testing.T) {
+
+	db, fdb := newFakeDB(t)
+	conf := newFakeConf(fakeDialect{})
+	conf.Options.MaxApply = 2
+	files := map[string]string{}
+	for i := 1; i <= 5; i++ {
+		files[fmt.Sprintf("%03d_m.sql", i)] = fmt.Sprintf("-- +goose Up\nCREATE TABLE t%d (id int);\n-- +goose Down\nDROP TABLE t%d;\n", i, i)
+	}
+	dir := writeMigrations(t, files)
+
+	ran, remaining, err := MigrateBatch(context.Background(), conf, db, dir, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ran) != 2 || remaining != 3 {
+		t.Errorf("expected 2 migrations run and 3 remaining, got %d and %d", len(ran), remaining)
+	}
+	if got, want := fdb.appliedVersions(), []int64{1, 2}; !reflect.DeepEqual(got, want) {
+		t.Errorf("incorrect applied versions. got %v, want %v", got, want)
+	}
+
+	// each run picks up where the last left off
+	for _, want := range []int{1, 0} {
+		if _, remaining, err = MigrateBatch(context.Background(), conf, db, dir, 5); err != nil {
+			t.Fatal(err)
+		}
+		if remaining != want {
+			t.Errorf("incorrect number of migrations remaining. got %d, want %d", remaining, want)
+		}
+	}
+	if got, want := fdb.appliedVersions(), []int64{1, 2, 3, 4, 5}; !reflect.DeepEqual(got, want) {
+		t.Errorf("incorrect applied versions. got %v, want %v", got, want)
+	}
+
+	// rollbacks aren't bounded
+	if err := RunMigrationsOnDb(conf, dir, 0, db); err != nil {
+		t.Fatal(err)
+	}
+	if got := fdb.appliedVersions(); len(got) != 0 {
+		t.Errorf("expected every migration rolled back, got %v", got)
+	}
+}
@@ -0,0 +1,183 @@
+package goose
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"runtime"
+	"sync"
+)
+
+// GoMigrationFunc applies or rolls back a registered Go migration
+// within tx, the transaction that also records it in the version table.
+type GoMigrationFunc func(ctx context.Context, tx *sql.Tx) error
+
+// GoMigrationNoTxFunc applies or rolls back a Go migration registered
+// with RegisterMigrationNoTx, outside of any transaction.
+type GoMigrationNoTxFunc func(ctx context.Context, db *sql.DB) error
+
+type registeredMigration struct {
+	up, down     GoMigrationFunc
+	upDB, downDB GoMigrationNoTxFunc // set instead by RegisterMigrationNoTx
+	source       string              // file the migration was registered from
+}
+
+// Go migrations registered at runtime, keyed by version
+var registeredMigrations = struct {
+	sync.RWMutex
+	m map[int64]registeredMigration
+}{m: map[int64]registeredMigration{}}
+
+// RegisterMigration makes a Go migration available to the runner
+// under the given version, alongside the scripts in the migrations
+// folder. Unlike Go migration scripts, which goose runs with `go run`,
+// registered migrations run inside the program embedding goose.
+//
+// A registered migration replaces a .go script of the same version,
+// which is typically the file registering it. A nil down does nothing
+// when the migration is rolled back, other than record its rollback.
+// Registering a version twice panics.
+func RegisterMigration(version int64, up, down GoMigrationFunc) {
+	if up == nil {
+		panic("goose: RegisterMigration up is nil")
+	}
+
+	_, source, _, _ := runtime.Caller(1)
+	register(version, registeredMigration{up: up, down: down, source: source}, "RegisterMigration")
+}
+
+// RegisterMigrationNoTx is RegisterMigration for a Go migration that
+// can't run in a transaction, e.g. one calling an external service, or
+// running statements the driver can't within one. Its functions are
+// handed db, and run as a SQL migration annotated 'NO TRANSACTION' is:
+// its version is marked dirty before they run, and recorded once they
+// succeed, so a failure leaves the database dirty, for Force to clear
+// once whatever it did has been put right.
+//
+// A version can only be registered once, with one or the other;
+// registering it again panics.
+func RegisterMigrationNoTx(version int64, up, down GoMigrationNoTxFunc) {
+	if up == nil {
+		panic("goose: RegisterMigrationNoTx up is nil")
+	}
+
+	_, source, _, _ := runtime.Caller(1)
+	register(version, registeredMigration{upDB: up, downDB: down, source: source}, "RegisterMigrationNoTx")
+}
+
+// register adds r under version, on behalf of the named function,
+// panicking if the version's registered already.
+func register(version int64, r registeredMigration, by string) {
+	registeredMigrations.Lock()
+	defer registeredMigrations.Unlock()
+	if dup, ok := registeredMigrations.m[version]; ok {
+		if (dup.upDB != nil) != (r.upDB != nil) {
+			panic(fmt.Sprintf("goose: %s called for version %d, which is already registered with the other; a migration runs either in a transaction or outside of one",
+				by, version))
+		}
+		panic(fmt.Sprintf("goose: %s called twice for version %d", by, version))
+	}
+	registeredMigrations.m[version] = r
+}
+
+// registeredMigrationsFor returns the registered migrations
+// with versions accepted by keep.
+func registeredMigrationsFor(keep func(v int64) bool) []*Migration {
+	registeredMigrations.RLock()
+	defer registeredMigrations.RUnlock()
+
+	var ms []*Migration
+	for v, r := range registeredMigrations.m {
+		if keep(v) {
+			m := newMigration(v, r.source)
+			m.up, m.down = r.up, r.down
+			m.upDB, m.downDB = r.upDB, r.downDB
+			ms = append(ms, m)
+		}
+	}
+	return ms
+}
+
+// isRegistered reports whether the migration was registered with
+// RegisterMigration or RegisterMigrationNoTx, rather than found in the
+// migrations folder.
+func (m *Migration) isRegistered() bool {
+	return m.up != nil || m.upDB != nil
+}
+
+// Run a migration registered with RegisterMigration, in the same
+// transaction as the version table update, so that a failing
+// migration leaves no trace.
+func runRegisteredMigration(ctx context.Context, conf *DBConf, db dbConn, m *Migration, direction bool) error {
+
+	fn := m.down
+	if direction {
+		fn = m.up
+	}
+
+	return withRetries(ctx, conf.Driver.Dialect, func() error {
+		txn, err := db.BeginTx(ctx, conf.Options.TxOptions)
+		if err != nil {
+			return err
+		}
+
+		if fn != nil {
+			if err := fn(ctx, txn); err != nil {
+				txn.Rollback()
+				return fmt.Errorf("migration %d: %w", m.Version, err)
+			}
+		}
+
+		return finalizeMigration(ctx, conf, txn, direction, m.Version, "")
+	})
+}
+
+// Run a migration registered with RegisterMigrationNoTx, outside of a
+// transaction. Its version is marked dirty on conn, the run's
+// connection, before its function runs on db, and the mark cleared
+// once it has succeeded; a function that fails may have done part of
+// its work, so leaves the mark.
+func runRegisteredNoTxMigration(ctx context.Context, conf *DBConf, db *sql.DB, conn dbConn, m *Migration, direction bool) error {
+
+	fn := m.downDB
+	if direction {
+		fn = m.upDB
+	}
+
+	d := conf.Driver.Dialect
+	// a VersionStore has no dirty marks, so is only told once the
+	// migration has run
+	store := conf.Options.VersionStore
+	if store == nil {
+		err := withRetries(ctx, d, func() error {
+			return markDirty(ctx, conf, conn, direction, m.Version, "")
+		})
+		if err != nil {
+			return errors.New(fmt.Sprintf("error marking migration %d dirty: %v", m.Version, err))
+		}
+	}
+
+	if fn != nil {
+		if err := fn(ctx, db); err != nil {
+			if store != nil {
+				return fmt.Errorf("migration %d: %w", m.Version, err)
+			}
+			return fmt.Errorf("migration %d: %w: %v", m.Version, ErrDirtyDatabase, err)
+		}
+	}
+
+	if store != nil {
+		if err := recordInStore(ctx, store, direction, m.Version); err != nil {
+			return errors.New(fmt.Sprintf("error recording migration %d in the version store: %v", m.Version, err))
+		}
+		return nil
+	}
+	err := withRetries(ctx, d, func() error {
+		return recordDirtyMigration(ctx, conf, conn, direction, m.Version)
+	})
+	if err != nil {
+		return fmt.Errorf("error recording migration %d: %w: %v", m.Version, ErrDirtyDatabase, err)
+	}
+	return nil
+}
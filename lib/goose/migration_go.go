@@ -2,28 +2,132 @@ package goose
 
 import (
 	"bytes"
+	"context"
+	"database/sql"
 	"encoding/gob"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"log"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"reflect"
 	"text/template"
+	"time"
 )
 
 type templateData struct {
-	Version    int64
-	Import     string
-	Conf       string // gob encoded DBConf
-	Direction  bool
-	Func       string
-	InsertStmt string
+	Version   int64
+	Import    string
+	Conf      string // gob encoded DBConf
+	Direction bool
+	Func      string
 }
 
 func init() {
 	gob.Register(PostgresDialect{})
 	gob.Register(MySqlDialect{})
+	gob.Register(MariaDBDialect{})
+	gob.Register(TiDBDialect{})
+	gob.Register(TrinoDialect{})
+	gob.Register(CockroachDialect{})
+	gob.Register(RedshiftDialect{})
+	gob.Register(SpannerDialect{})
+	gob.Register(VerticaDialect{})
+	gob.Register(OracleDialect{})
+	gob.Register(YugabyteDialect{})
+	gob.Register(DuckDBDialect{})
+	gob.Register(Sqlite3Dialect{})
+	gob.Register(BigQueryDialect{})
+	gob.Register(ClickHouseDialect{})
+}
+
+// gobConf is the form a DBConf is gob encoded in, for the program
+// runGoMigration generates. gob can't encode an *sql.DB, or interface
+// values of types it hasn't been told of, so its options leave out the
+// connections, stores, callbacks and template data the program has no
+// use for.
+type gobConf struct {
+	MigrationsDir string
+	Env           string
+	Driver        DBDriver
+	PgSchema      string
+	DBName        string
+	NoDB          bool
+	Options       gobOptions
+}
+
+// gobOptions holds the Options a generated program is given, copied to
+// and from Options by name.
+type gobOptions struct {
+	Lock              bool
+	LockTimeout       time.Duration
+	PingAttempts      int
+	PingBackoff       time.Duration
+	ProbeDialect      bool
+	DryRun            bool
+	AllowMissing      bool
+	MaxApply          int
+	BestEffort        bool
+	SingleTransaction bool
+	SessionSetup      []string
+	IncludeTags       []string
+	ExcludeTags       []string
+	DisableAutoCreate bool
+	ExtraColumns      []VersionColumn
+	TxOptions         *sql.TxOptions
+	StatementTimeout  time.Duration
+	MultiStatement    bool
+	StrictEnvSub      bool
+	StrictTemplate    bool
+}
+
+// GobEncode encodes the conf as a gobConf.
+func (c DBConf) GobEncode() ([]byte, error) {
+	g := gobConf{
+		MigrationsDir: c.MigrationsDir,
+		Env:           c.Env,
+		Driver:        c.Driver,
+		PgSchema:      c.PgSchema,
+		DBName:        c.DBName,
+		NoDB:          c.NoDB,
+	}
+	copyFields(reflect.ValueOf(&g.Options).Elem(), reflect.ValueOf(c.Options))
+
+	var bb bytes.Buffer
+	if err := gob.NewEncoder(&bb).Encode(g); err != nil {
+		return nil, err
+	}
+	return bb.Bytes(), nil
+}
+
+// GobDecode decodes a conf GobEncode encoded.
+func (c *DBConf) GobDecode(data []byte) error {
+	var g gobConf
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&g); err != nil {
+		return err
+	}
+	*c = DBConf{
+		MigrationsDir: g.MigrationsDir,
+		Env:           g.Env,
+		Driver:        g.Driver,
+		PgSchema:      g.PgSchema,
+		DBName:        g.DBName,
+		NoDB:          g.NoDB,
+	}
+	copyFields(reflect.ValueOf(&c.Options).Elem(), reflect.ValueOf(g.Options))
+	return nil
+}
+
+// copyFields sets each field of the struct dst to the field of the
+// same name in src, where src has one.
+func copyFields(dst, src reflect.Value) {
+	for i := 0; i < dst.NumField(); i++ {
+		if f := src.FieldByName(dst.Type().Field(i).Name); f.IsValid() {
+			dst.Field(i).Set(f)
+		}
+	}
 }
 
 //
@@ -33,7 +137,13 @@ func init() {
 // original .go migration, and execute it via `go run` along
 // with a main() of our own creation.
 //
-func runGoMigration(conf *DBConf, path string, version int64, direction bool) error {
+func runGoMigration(ctx context.Context, conf *DBConf, m *Migration, direction bool) error {
+
+	// the generated program opens its own connection, using conf's driver
+	if conf.Driver.Import == "" {
+		return errors.New(fmt.Sprintf("migration %s is a Go script, which can't run without a configured driver; register it with RegisterMigration instead",
+			filepath.Base(m.Source)))
+	}
 
 	// everything gets written to a temp dir, and zapped afterwards
 	d, e := ioutil.TempDir("", "goose")
@@ -63,28 +173,33 @@ func runGoMigration(conf *DBConf, path string, version int64, direction bool) er
 	sb.WriteString("}")
 
 	td := &templateData{
-		Version:    version,
-		Import:     conf.Driver.Import,
-		Conf:       sb.String(),
-		Direction:  direction,
-		Func:       fmt.Sprintf("%v_%v", directionStr, version),
-		InsertStmt: conf.Driver.Dialect.insertVersionSql(),
+		Version:   m.Version,
+		Import:    conf.Driver.Import,
+		Conf:      sb.String(),
+		Direction: direction,
+		Func:      fmt.Sprintf("%v_%v", directionStr, m.Version),
 	}
 	main, e := writeTemplateToFile(filepath.Join(d, "goose_main.go"), goMigrationDriverTemplate, td)
 	if e != nil {
 		log.Fatal(e)
 	}
 
-	outpath := filepath.Join(d, filepath.Base(path))
-	if _, e = copyFile(outpath, path); e != nil {
+	src, e := m.open()
+	if e != nil {
+		log.Fatal(e)
+	}
+	defer src.Close()
+
+	outpath := filepath.Join(d, filepath.Base(m.Source))
+	if _, e = copyFile(outpath, src); e != nil {
 		log.Fatal(e)
 	}
 
-	cmd := exec.Command("go", "run", main, outpath)
+	cmd := exec.CommandContext(ctx, "go", "run", main, outpath)
 	cmd.Stdout = os.Stdout
 	cmd.Stderr = os.Stderr
 	if e = cmd.Run(); e != nil {
-		log.Fatal("`go run` failed: ", e)
+		return errors.New(fmt.Sprintf("`go run` failed: %v", e))
 	}
 
 	return nil
@@ -99,6 +214,7 @@ var goMigrationDriverTemplate = template.Must(template.New("goose.go-driver").Pa
 package main
 
 import (
+	"context"
 	"log"
 	"bytes"
 	"encoding/gob"
@@ -121,7 +237,7 @@ func main() {
 	}
 	defer db.Close()
 
-	txn, err := db.Begin()
+	txn, err := db.BeginTx(context.Background(), conf.Options.TxOptions)
 	if err != nil {
 		log.Fatal("db.Begin:", err)
 	}
@@ -3,17 +3,71 @@ package goose
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"database/sql"
+	"errors"
+	"fmt"
 	"io"
+	"io/ioutil"
 	"log"
 	"os"
 	"path/filepath"
 	"strings"
+	"text/template"
 )
 
 const sqlCmdPrefix = "-- +goose "
 const bufferSize = 4 * 1024 * 1024
 
+// ParseError reports a SQL migration script that can't be run as
+// written. It's returned before any of a run's migrations execute.
+type ParseError struct {
+	Path   string // the migration script
+	Line   int    // the line the problem was found at, 1 for the script as a whole
+	Reason string
+	Err    error // a sentinel such as ErrNoDownMigration, if one applies
+}
+
+func (e *ParseError) Error() string {
+	return fmt.Sprintf("%s:%d: %s", e.Path, e.Line, e.Reason)
+}
+
+func (e *ParseError) Unwrap() error {
+	return e.Err
+}
+
+// scriptDirectives are the annotations that apply to a whole SQL script.
+type scriptDirectives struct {
+	noTx      bool                // 'NO TRANSACTION': run outside of a transaction
+	isolation *sql.IsolationLevel // 'ISOLATION <level>': override Options.TxOptions' level
+	squashed  bool                // 'SQUASHED': written by Squash, in place of the migrations it replaced
+	tags      []string            // 'TAGS <tag>,...': the tags Options.IncludeTags and ExcludeTags select by
+
+	// 'CheckExists <table>': tables the migration creates, which
+	// Verify checks are still there once it's applied
+	checkExists []string
+
+	// the statements of the 'Verify' section, parsed along with
+	// the Up section, which are checked to return rows once it's run
+	verify []string
+
+	// environment variables referenced between 'ENVSUB ON' and
+	// 'ENVSUB OFF' that weren't set, and so expanded to ""
+	undefinedEnv []string
+}
+
+// parseIsolationLevel parses a level named as in the SQL standard,
+// e.g. SERIALIZABLE or READ COMMITTED, as does ISOLATION.
+func parseIsolationLevel(name string) (sql.IsolationLevel, bool) {
+	name = strings.Join(strings.Fields(strings.ToUpper(name)), " ")
+	for level := sql.LevelDefault; level <= sql.LevelLinearizable; level++ {
+		if strings.ToUpper(level.String()) == name {
+			return level, true
+		}
+	}
+	return 0, false
+}
+
 // Checks the line to see if the line has a statement-ending semicolon
 // or if the line contains a double-dash comment.
 func endsWithSemicolon(line string) bool {
@@ -42,10 +96,42 @@ func endsWithSemicolon(line string) bool {
 // naturally terminate a statement.
 //
 // However, more complex cases like pl/pgsql can have semicolons
-// within a statement. For these cases, we provide the explicit annotations
+// within a statement. Semicolons within dollar-quoted strings and
+// BEGIN ... END blocks are recognised as not ending the statement.
+// For any other cases, we provide the explicit annotations
 // 'StatementBegin' and 'StatementEnd' to allow the script to
 // tell us to ignore semicolons.
-func splitSQLStatements(r io.Reader, direction bool) (stmts []string) {
+//
+// 'DELIMITER <delimiter>' changes what ends a statement to the given
+// delimiter, as in MySQL client scripts, until 'DELIMITER ;' or the
+// end of the section. The delimiter isn't part of the statement.
+//
+// A section annotated with 'NO-OP' is deliberately left without
+// statements, e.g. the Down section of an irreversible migration, which
+// is then rolled back by only recording it. It's an error for the
+// section to have any.
+//
+// Between 'ENVSUB ON' and 'ENVSUB OFF', ${VAR} and $VAR in statements
+// are replaced by the values of the environment variables they name.
+//
+// A 'Verify' section following the Up section holds queries asserting
+// what the Up section should have done, each of which has to return a
+// row once it's been run; they're returned in dirs when parsing the
+// Up section, and ignored otherwise.
+//
+// A script has at most one Up section, one Verify section and one Down
+// section, with any Up section first, and nothing but comments and
+// annotations before them, so that a mistake such as sections swapped
+// by copying and pasting is caught before either is run.
+//
+// Quoted strings and comments are lexed as d, which may be nil for
+// standard SQL, lexes them. A section left within a string, comment or
+// block at its end is an error, rather than a statement that never ends.
+//
+// Annotations applying to the script as a whole are returned in dirs.
+// A script that can't be run in the given direction yields a
+// *ParseError, without a Path, which is left to the caller.
+func splitSQLStatements(d SqlDialect, r io.Reader, direction bool) (stmts []string, dirs scriptDirectives, err error) {
 
 	var buf bytes.Buffer
 	scanner := bufio.NewScanner(r)
@@ -53,36 +139,107 @@ func splitSQLStatements(r io.Reader, direction bool) (stmts []string) {
 	bbuf := make([]byte, bufferSize)
 	scanner.Buffer(bbuf, bufferSize)
 
-	// track the count of each section
-	// so we can diagnose scripts with no annotations
+	// track the count of each section, and where each began,
+	// so we can diagnose scripts with misplaced annotations
 	upSections := 0
 	downSections := 0
+	upLine, downLine, verifyLine := 0, 0, 0
+	verifyActive := false // whether statements go into dirs.verify rather than stmts
 
 	statementEnded := false
 	ignoreSemicolons := false
 	directionIsActive := false
+	lineNum, beginLine := 0, 0
+	noopLine, sectionStart := 0, 0 // the active section's NO-OP annotation, and its first statement
+	envSub := false
+	delimiter := "" // a custom statement delimiter, "" for semicolons
+
+	var blocks sqlBlockTracker
+	_, blocks.mysql = d.(sqlMySQLSyntax)
+	openLine := 0 // where what blocks has left open began
+
+	// a section mustn't end with the statement it's in left open
+	checkClosed := func() error {
+		if what := blocks.unclosed(); directionIsActive && what != "" {
+			return &ParseError{Line: openLine, Reason: fmt.Sprintf("%s begun here is still open at the end of the section", what)}
+		}
+		return nil
+	}
+
+	undefined := make(map[string]bool)
+	lookupEnv := func(name string) string {
+		v, ok := os.LookupEnv(name)
+		if !ok && !undefined[name] {
+			undefined[name] = true
+			dirs.undefinedEnv = append(dirs.undefinedEnv, name)
+		}
+		return v
+	}
 
 	for scanner.Scan() {
 
 		line := scanner.Text()
+		lineNum++
 
 		// handle any goose-specific commands
 		if strings.HasPrefix(line, sqlCmdPrefix) {
 			cmd := strings.TrimSpace(line[len(sqlCmdPrefix):])
+			if cmd == "Up" || cmd == "Down" || cmd == "Verify" {
+				if err := checkNoop(noopLine, stmts[sectionStart:], buf.String()); err != nil {
+					return nil, dirs, err
+				}
+				if err := checkClosed(); err != nil {
+					return nil, dirs, err
+				}
+				noopLine, sectionStart = 0, len(stmts)
+			}
+
 			switch cmd {
 			case "Up":
+				if upLine != 0 {
+					return nil, dirs, &ParseError{Line: lineNum, Reason: fmt.Sprintf("second '-- +goose Up' annotation, after the one at line %d", upLine)}
+				}
+				if downLine != 0 {
+					return nil, dirs, &ParseError{Line: downLine, Reason: fmt.Sprintf("'-- +goose Down' annotation before the '-- +goose Up' one at line %d; are the sections swapped?", lineNum)}
+				}
 				directionIsActive = (direction == true)
+				verifyActive = false
 				upSections++
+				upLine = lineNum
+				delimiter = ""
+				blocks.reset()
 				break
 
 			case "Down":
+				if downLine != 0 {
+					return nil, dirs, &ParseError{Line: lineNum, Reason: fmt.Sprintf("second '-- +goose Down' annotation, after the one at line %d", downLine)}
+				}
 				directionIsActive = (direction == false)
+				verifyActive = false
 				downSections++
+				downLine = lineNum
+				delimiter = ""
+				blocks.reset()
+				break
+
+			case "Verify":
+				if verifyLine != 0 {
+					return nil, dirs, &ParseError{Line: lineNum, Reason: fmt.Sprintf("second '-- +goose Verify' annotation, after the one at line %d", verifyLine)}
+				}
+				if upLine == 0 {
+					return nil, dirs, &ParseError{Line: lineNum, Reason: "'-- +goose Verify' annotation with no '-- +goose Up' section before it to verify"}
+				}
+				directionIsActive = (direction == true)
+				verifyActive = directionIsActive
+				verifyLine = lineNum
+				delimiter = ""
+				blocks.reset()
 				break
 
 			case "StatementBegin":
 				if directionIsActive {
 					ignoreSemicolons = true
+					beginLine = lineNum
 				}
 				break
 
@@ -90,26 +247,113 @@ func splitSQLStatements(r io.Reader, direction bool) (stmts []string) {
 				if directionIsActive {
 					statementEnded = (ignoreSemicolons == true)
 					ignoreSemicolons = false
+					blocks.reset()
 				}
 				break
+
+			case "NO-OP":
+				if directionIsActive {
+					noopLine = lineNum
+				}
+				break
+
+			case "NO TRANSACTION":
+				dirs.noTx = true
+				break
+
+			case "SQUASHED":
+				dirs.squashed = true
+				break
+
+			case "ENVSUB ON":
+				envSub = true
+				break
+
+			case "ENVSUB OFF":
+				envSub = false
+				break
+
+			default:
+				if strings.HasPrefix(cmd, "DELIMITER ") {
+					delimiter = strings.TrimSpace(cmd[len("DELIMITER "):])
+					if delimiter == ";" {
+						delimiter = ""
+					}
+				}
+				if strings.HasPrefix(cmd, "TAGS ") {
+					for _, tag := range strings.Split(cmd[len("TAGS "):], ",") {
+						if tag = strings.TrimSpace(tag); tag != "" {
+							dirs.tags = append(dirs.tags, tag)
+						}
+					}
+				}
+				if strings.HasPrefix(cmd, "CheckExists ") {
+					object := strings.TrimSpace(cmd[len("CheckExists "):])
+					if _, _, ok := splitObjectName(object); !ok {
+						return nil, dirs, &ParseError{Line: lineNum, Reason: fmt.Sprintf("invalid table name in '%s'", line)}
+					}
+					dirs.checkExists = append(dirs.checkExists, object)
+				}
+				if strings.HasPrefix(cmd, "ISOLATION ") {
+					level, ok := parseIsolationLevel(cmd[len("ISOLATION "):])
+					if !ok {
+						return nil, dirs, &ParseError{Line: lineNum, Reason: fmt.Sprintf("unknown isolation level in '%s'", line)}
+					}
+					dirs.isolation = &level
+				}
 			}
 		}
 
+		if upLine == 0 && downLine == 0 && verifyLine == 0 && hasSQL(line) {
+			return nil, dirs, &ParseError{Line: lineNum, Reason: "SQL before the first '-- +goose Up' or '-- +goose Down' annotation, in neither section"}
+		}
+
 		if !directionIsActive {
 			continue
 		}
 
+		if envSub && !strings.HasPrefix(line, sqlCmdPrefix) {
+			line = os.Expand(line, lookupEnv)
+		}
+
+		delimited := false
+		if delimiter != "" && !ignoreSemicolons && !strings.HasPrefix(line, sqlCmdPrefix) {
+			if trimmed := strings.TrimRight(line, " \t\r"); strings.HasSuffix(trimmed, delimiter) {
+				line = strings.TrimSuffix(trimmed, delimiter)
+				delimited = true
+			}
+		}
+
 		if _, err := buf.WriteString(line + "\n"); err != nil {
 			log.Fatalf("io err: %v", err)
 		}
 
-		// Wrap up the two supported cases: 1) basic with semicolon; 2) psql statement
-		// Lines that end with semicolon that are in a statement block
-		// do not conclude statement.
-		if (!ignoreSemicolons && endsWithSemicolon(line)) || statementEnded {
+		code := line // the line without any # comment
+		if delimiter == "" && !ignoreSemicolons && !strings.HasPrefix(line, sqlCmdPrefix) {
+			// a block is begun at BEGIN, whatever follows it settling that
+			// it's one
+			wasOpen := blocks.open() || blocks.pendingBegin
+			blocks.scan(line)
+			if !wasOpen && (blocks.open() || blocks.pendingBegin) {
+				openLine = lineNum
+			}
+			if blocks.hashComment >= 0 {
+				code = line[:blocks.hashComment]
+			}
+		}
+
+		// Wrap up the three supported cases: 1) basic with semicolon; 2) psql statement;
+		// 3) custom delimiter. Lines that end with semicolon that are in a statement
+		// block, or while a custom delimiter is in use, do not conclude statement.
+		if (delimiter == "" && !ignoreSemicolons && !blocks.open() && endsWithSemicolon(code)) || delimited || statementEnded {
 			statementEnded = false
-			stmts = append(stmts, buf.String())
+			if verifyActive {
+				dirs.verify = append(dirs.verify, buf.String())
+			} else {
+				stmts = append(stmts, buf.String())
+			}
 			buf.Reset()
+			blocks.reset()
 		}
 	}
 
@@ -118,20 +362,51 @@ func splitSQLStatements(r io.Reader, direction bool) (stmts []string) {
 	}
 
 	// diagnose likely migration script errors
+	if err := checkNoop(noopLine, stmts[sectionStart:], buf.String()); err != nil {
+		return nil, dirs, err
+	}
 	if ignoreSemicolons {
-		log.Println("WARNING: saw '-- +goose StatementBegin' with no matching '-- +goose StatementEnd'")
+		return nil, dirs, &ParseError{Line: beginLine, Reason: "'-- +goose StatementBegin' with no matching '-- +goose StatementEnd'"}
 	}
-
-	if bufferRemaining := strings.TrimSpace(buf.String()); len(bufferRemaining) > 0 {
-		log.Printf("WARNING: Unexpected unfinished SQL query: %s. Missing a semicolon?\n", bufferRemaining)
+	if err := checkClosed(); err != nil {
+		return nil, dirs, err
 	}
 
 	if upSections == 0 && downSections == 0 {
-		log.Fatalf(`ERROR: no Up/Down annotations found, so no statements were executed.
-			See https://github.com/gojuno/goose/overview for details.`)
+		return nil, dirs, &ParseError{Line: 1, Reason: "no '-- +goose Up' or '-- +goose Down' annotations found"}
+	}
+	if direction && upSections == 0 {
+		return nil, dirs, &ParseError{Line: 1, Reason: "no '-- +goose Up' annotation found, so it can't be applied", Err: ErrNoUpMigration}
+	}
+	if !direction && downSections == 0 {
+		return nil, dirs, &ParseError{Line: 1, Reason: "no '-- +goose Down' annotation found, so it can't be rolled back", Err: ErrNoDownMigration}
+	}
+
+	if bufferRemaining := strings.TrimSpace(buf.String()); hasSQL(bufferRemaining) {
+		logger.Printf("WARNING: Unexpected unfinished SQL query: %s. Missing a semicolon?\n", bufferRemaining)
+	}
+
+	return stmts, dirs, nil
+}
+
+// checkNoop fails a section annotated with 'NO-OP', at noopLine, that
+// has statements, whether complete or still pending. A zero noopLine
+// means the section wasn't annotated.
+func checkNoop(noopLine int, stmts []string, pending string) error {
+	if noopLine == 0 || (len(stmts) == 0 && !hasSQL(pending)) {
+		return nil
 	}
+	return &ParseError{Line: noopLine, Reason: "section annotated '-- +goose NO-OP' has statements"}
+}
 
-	return
+// hasSQL reports whether s has anything but blank lines and comments.
+func hasSQL(s string) bool {
+	for _, line := range strings.Split(s, "\n") {
+		if line = strings.TrimSpace(line); line != "" && !strings.HasPrefix(line, "--") {
+			return true
+		}
+	}
+	return false
 }
 
 // Run a migration specified in raw SQL.
@@ -142,16 +417,87 @@ func splitSQLStatements(r io.Reader, direction bool) (stmts []string) {
 //
 // All statements following an Up or Down directive are grouped together
 // until another direction directive is found.
-func runSQLMigration(conf *DBConf, db *sql.DB, scriptFile string, v int64, direction bool) error {
+//
+// A script annotated with 'NO TRANSACTION' has its statements executed
+// directly against the database, and its version recorded once they've
+// all succeeded. One annotated with 'ISOLATION <level>' runs in a
+// transaction at that isolation level.
+//
+// When applied, the queries of its Verify section are run after its
+// Up section, in the same transaction, and if any fails or returns no
+// rows, the migration fails too.
+func runSQLMigration(ctx context.Context, conf *DBConf, db dbConn, m *Migration, direction bool) error {
+	return runSQLScript(ctx, conf, db, m, direction, true)
+}
 
-	txn, err := db.Begin()
+// runSQLScript is runSQLMigration, leaving the version table alone
+// unless record is set.
+func runSQLScript(ctx context.Context, conf *DBConf, db dbConn, m *Migration, direction, record bool) error {
+
+	stmts, checksum, err := m.statements(conf, direction)
 	if err != nil {
-		log.Fatal("db.Begin:", err)
+		return err
 	}
 
-	f, err := os.Open(scriptFile)
-	if err != nil {
-		log.Fatal(err)
+	if m.noTx(conf) {
+		d := conf.Driver.Dialect
+		// a VersionStore has no dirty marks, so is only told once the
+		// migration has run
+		store := conf.Options.VersionStore
+		markRecord := record && store == nil
+		if markRecord {
+			err = withRetries(ctx, d, func() error {
+				return markDirty(ctx, conf, db, direction, m.Version, checksum)
+			})
+			if err != nil {
+				return errors.New(fmt.Sprintf("error marking migration %s dirty: %v", filepath.Base(m.Source), err))
+			}
+		}
+
+		for i, query := range stmts {
+			if err = execStatement(ctx, conf, db, i, query); err != nil {
+				if i > 0 && markRecord {
+					return fmt.Errorf("%s: %w after %d of its %d statements ran: %v",
+						filepath.Base(m.Source), ErrDirtyDatabase, i, len(stmts), err)
+				}
+				// with no dirty mark to clear, only say how far it got
+				if i > 0 {
+					return errors.New(fmt.Sprintf("%s: failed after %d of its %d statements ran, which aren't undone: %v",
+						filepath.Base(m.Source), i, len(stmts), err))
+				}
+				// nothing ran, so the database isn't dirty after all
+				if markRecord {
+					if uerr := unmarkDirty(ctx, conf, db, direction, m.Version); uerr != nil {
+						logger.Printf("goose: failed to clear the dirty mark of %s: %v\n", filepath.Base(m.Source), uerr)
+					}
+				}
+				return errors.New(fmt.Sprintf("%s: %v", filepath.Base(m.Source), err))
+			}
+		}
+		// without a transaction, there's no taking back what failed verification
+		if err := verifyStatements(ctx, conf, db, m.script.verify); err != nil {
+			if !markRecord {
+				return errors.New(fmt.Sprintf("%s: %v, after its statements ran, which aren't undone", filepath.Base(m.Source), err))
+			}
+			return fmt.Errorf("%s: %w: %v", filepath.Base(m.Source), ErrDirtyDatabase, err)
+		}
+		if !record {
+			return nil
+		}
+		if store != nil {
+			if err := recordInStore(ctx, store, direction, m.Version); err != nil {
+				return errors.New(fmt.Sprintf("error recording migration %s in the version store: %v", filepath.Base(m.Source), err))
+			}
+			return nil
+		}
+
+		err = withRetries(ctx, d, func() error {
+			return recordDirtyMigration(ctx, conf, db, direction, m.Version)
+		})
+		if err != nil {
+			return fmt.Errorf("error recording migration %s: %w: %v", filepath.Base(m.Source), ErrDirtyDatabase, err)
+		}
+		return nil
 	}
 
 	// find each statement, checking annotations for up/down direction
@@ -159,17 +505,250 @@ func runSQLMigration(conf *DBConf, db *sql.DB, scriptFile string, v int64, direc
 	// Commits the transaction if successfully applied each statement and
 	// records the version into the version table or returns an error and
 	// rolls back the transaction.
-	for _, query := range splitSQLStatements(f, direction) {
-		if _, err = txn.Exec(query); err != nil {
+	err = withRetries(ctx, conf.Driver.Dialect, func() error {
+		txn, err := db.BeginTx(ctx, m.txOptions(conf))
+		if err != nil {
+			return errors.New(fmt.Sprintf("db.Begin: %v", err))
+		}
+
+		for i, query := range multiStatements(conf, stmts) {
+			if err := execStatement(ctx, conf, txn, i, query); err != nil {
+				txn.Rollback()
+				return err
+			}
+		}
+		if err := verifyStatements(ctx, conf, txn, m.script.verify); err != nil {
 			txn.Rollback()
-			log.Fatalf("FAIL %s (%v), quitting migration.", filepath.Base(scriptFile), err)
 			return err
 		}
+
+		if !record {
+			return txn.Commit()
+		}
+		return finalizeMigration(ctx, conf, txn, direction, m.Version, checksum)
+	})
+	if err != nil {
+		return errors.New(fmt.Sprintf("%s: %v", filepath.Base(m.Source), err))
+	}
+
+	return nil
+}
+
+// execStatement executes the i'th of a migration's statements, cancelling
+// it if it's still running once Options.StatementTimeout has passed.
+func execStatement(ctx context.Context, conf *DBConf, ex execer, i int, query string) error {
+	timeout := conf.Options.StatementTimeout
+	if timeout <= 0 {
+		_, err := ex.ExecContext(ctx, query)
+		return err
+	}
+
+	sctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	_, err := ex.ExecContext(sctx, query)
+	if err != nil && ctx.Err() == nil && sctx.Err() == context.DeadlineExceeded {
+		return errors.New(fmt.Sprintf("statement %d timed out after %v: %s", i+1, timeout, statementSummary(query)))
 	}
+	return err
+}
 
-	if err = FinalizeMigration(conf, txn, direction, v); err != nil {
-		log.Fatalf("error finalizing migration %s, quitting. (%v)", filepath.Base(scriptFile), err)
+// multiStatements returns a migration's statements as they're executed
+// in a transaction: joined into one, to be sent in a single Exec, if
+// Options.MultiStatement is set and the dialect supports it, and
+// otherwise as they are.
+func multiStatements(conf *DBConf, stmts []string) []string {
+	m, ok := conf.Driver.Dialect.(sqlMultiStatementer)
+	if !conf.Options.MultiStatement || !ok || !m.supportsMultiStatement() || len(stmts) < 2 {
+		return stmts
 	}
 
+	var all strings.Builder
+	for i, stmt := range stmts {
+		if i > 0 {
+			all.WriteString("\n")
+		}
+		stmt = strings.TrimSpace(stmt)
+		all.WriteString(stmt)
+		// a statement ended by a custom DELIMITER has lost it
+		if !strings.HasSuffix(stmt, ";") {
+			all.WriteString(";")
+		}
+	}
+	return []string{all.String()}
+}
+
+// verifyStatements runs the queries of a migration's Verify section,
+// failing at the first that fails, or returns no rows.
+func verifyStatements(ctx context.Context, conf *DBConf, q queryer, queries []string) error {
+	for i, query := range queries {
+		sctx, cancel := ctx, func() {}
+		if timeout := conf.Options.StatementTimeout; timeout > 0 {
+			sctx, cancel = context.WithTimeout(ctx, timeout)
+		}
+		ok, err := returnsRows(sctx, q, query)
+		cancel()
+		if err != nil {
+			return errors.New(fmt.Sprintf("verify query %d failed: %v", i+1, err))
+		}
+		if !ok {
+			return errors.New(fmt.Sprintf("verify query %d returned no rows: %s", i+1, statementSummary(query)))
+		}
+	}
 	return nil
 }
+
+// returnsRows reports whether query returns any rows.
+func returnsRows(ctx context.Context, q queryer, query string) (bool, error) {
+	rows, err := q.QueryContext(ctx, query)
+	if err != nil {
+		return false, err
+	}
+	defer rows.Close()
+
+	if rows.Next() {
+		return true, nil
+	}
+	return false, rows.Err()
+}
+
+// statementSummary shortens a statement to fit in an error message,
+// counting characters rather than bytes, so as not to split one.
+func statementSummary(query string) string {
+	const max = 60
+	s := strings.Join(strings.Fields(query), " ")
+	if r := []rune(s); len(r) > max {
+		s = string(r[:max]) + "..."
+	}
+	return s
+}
+
+// parseSQL reads the migration's script, returning its statements for
+// the given direction and its checksum, and noting on the migration
+// how it's to be run, and its tags.
+func (m *Migration) parseSQL(direction bool) (stmts []string, checksum string, err error) {
+	return m.parseRenderedSQL(nil, direction)
+}
+
+// parseRenderedSQL is parseSQL for a run: with Options.TemplateData
+// set, the script is rendered with it before it's parsed, so that its
+// annotations are read from the rendered script. The checksum is still
+// that of the script as written, which applying it records.
+func (m *Migration) parseRenderedSQL(conf *DBConf, direction bool) (stmts []string, checksum string, err error) {
+	f, err := m.open()
+	if err != nil {
+		return nil, "", err
+	}
+	defer f.Close()
+
+	body, err := ioutil.ReadAll(f)
+	if err != nil {
+		return nil, "", err
+	}
+
+	script := body
+	if conf != nil && conf.Options.TemplateData != nil {
+		if script, err = renderTemplate(conf, m, body); err != nil {
+			return nil, "", err
+		}
+	}
+
+	var d SqlDialect
+	if conf != nil {
+		d = conf.Driver.Dialect
+	}
+	stmts, m.script, err = splitSQLStatements(d, bytes.NewReader(script), direction)
+	if err != nil {
+		err.(*ParseError).Path = m.Source
+		return nil, "", err
+	}
+	m.Tags = m.script.tags
+	return stmts, checksumOf(body), nil
+}
+
+// renderTemplate renders the migration's script with text/template,
+// given Options.TemplateData. A key missing from the data renders as
+// "<no value>", unless Options.StrictTemplate is set, when it's an
+// error.
+func renderTemplate(conf *DBConf, m *Migration, body []byte) ([]byte, error) {
+	missingKey := "missingkey=default"
+	if conf.Options.StrictTemplate {
+		missingKey = "missingkey=error"
+	}
+
+	name := filepath.Base(m.Source)
+	tmpl, err := template.New(name).Option(missingKey).Parse(string(body))
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("migration %s isn't a valid template: %v", name, err))
+	}
+	var rendered bytes.Buffer
+	if err := tmpl.Execute(&rendered, conf.Options.TemplateData); err != nil {
+		return nil, errors.New(fmt.Sprintf("failed to render migration %s: %v", name, err))
+	}
+	return rendered.Bytes(), nil
+}
+
+// checkEnv fails a migration that referenced undefined environment
+// variables, if Options.StrictEnvSub is set.
+func (m *Migration) checkEnv(conf *DBConf) error {
+	if !conf.Options.StrictEnvSub || len(m.script.undefinedEnv) == 0 {
+		return nil
+	}
+	return errors.New(fmt.Sprintf("migration %s references undefined environment variables: %s",
+		filepath.Base(m.Source), strings.Join(m.script.undefinedEnv, ", ")))
+}
+
+// statements returns the migration's statements for the given
+// direction, as they're to be run, and its checksum: parsed, checked
+// for undefined environment variables, and passed through
+// Options.StatementRewriter, if it's set. Every statement is rewritten
+// before any runs, so a rewriter that fails leaves the migration
+// unstarted.
+func (m *Migration) statements(conf *DBConf, direction bool) ([]string, string, error) {
+	stmts, checksum, err := m.parseRenderedSQL(conf, direction)
+	if err != nil {
+		return nil, "", err
+	}
+	if err := m.checkEnv(conf); err != nil {
+		return nil, "", err
+	}
+
+	rewrite := conf.Options.StatementRewriter
+	if rewrite == nil {
+		return stmts, checksum, nil
+	}
+	rewritten := make([]string, 0, len(stmts))
+	for i, stmt := range stmts {
+		stmt, err := rewrite(stmt)
+		if err != nil {
+			return nil, "", fmt.Errorf("%s: failed to rewrite statement %d: %w", filepath.Base(m.Source), i+1, err)
+		}
+		// an empty statement is dropped
+		if strings.TrimSpace(stmt) != "" {
+			rewritten = append(rewritten, stmt)
+		}
+	}
+	return rewritten, checksum, nil
+}
+
+// noTx reports whether the migration's statements are executed directly
+// against the database: if its script is annotated 'NO TRANSACTION',
+// or the dialect can't run DDL within a transaction.
+func (m *Migration) noTx(conf *DBConf) bool {
+	_, ddl := conf.Driver.Dialect.(sqlNoTxDDL)
+	return m.script.noTx || ddl
+}
+
+// txOptions returns the options to begin the migration's transaction
+// with: those configured for the run, with the isolation level
+// overridden by the script's ISOLATION annotation, if it has one.
+func (m *Migration) txOptions(conf *DBConf) *sql.TxOptions {
+	if m.script.isolation == nil {
+		return conf.Options.TxOptions
+	}
+
+	opts := sql.TxOptions{Isolation: *m.script.isolation}
+	if conf.Options.TxOptions != nil {
+		opts.ReadOnly = conf.Options.TxOptions.ReadOnly
+	}
+	return &opts
+}
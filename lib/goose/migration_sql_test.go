@@ -1,6 +1,10 @@
 package goose
 
 import (
+	"database/sql"
+	"os"
+	"path/filepath"
+	"reflect"
 	"strings"
 	"testing"
 )
@@ -66,20 +70,10 @@ func TestSplitStatements(t *testing.T) {
 			direction: false,
 			count:     2,
 		},
-		{
-			sql:       multitxt,
-			direction: true,
-			count:     2,
-		},
-		{
-			sql:       multitxt,
-			direction: false,
-			count:     2,
-		},
 	}
 
 	for _, test := range tests {
-		stmts := splitSQLStatements(strings.NewReader(test.sql), test.direction)
+		stmts, _, _ := splitSQLStatements(nil, strings.NewReader(test.sql), test.direction)
 		if len(stmts) != test.count {
 			t.Errorf("incorrect number of stmts. got %v, want %v", len(stmts), test.count)
 		}
@@ -121,7 +115,7 @@ drop function histories_partition_creation(DATE, DATE);
 drop TABLE histories;
 `
 
-// test multiple up/down transitions in a single script
+// a script can't go back and forth between up and down
 var multitxt = `-- +goose Up
 CREATE TABLE post (
     id int NOT NULL,
@@ -145,3 +139,564 @@ CREATE TABLE fancier_post (
 -- +goose Down
 DROP TABLE fancier_post;
 `
+
+func TestIsolationDirective(t *testing.T) {
+
+	_, dirs, _ := splitSQLStatements(nil, strings.NewReader("-- +goose ISOLATION read committed\n-- +goose Up\nSELECT 1;\n"), true)
+	if dirs.isolation == nil || *dirs.isolation != sql.LevelReadCommitted {
+		t.Errorf("incorrect isolation level. got %v, want %v", dirs.isolation, sql.LevelReadCommitted)
+	}
+
+	_, dirs, _ = splitSQLStatements(nil, strings.NewReader("-- +goose Up\nSELECT 1;\n"), true)
+	if dirs.isolation != nil {
+		t.Errorf("expected no isolation level, got %v", *dirs.isolation)
+	}
+}
+
+func TestEnvSub(t *testing.T) {
+
+	os.Setenv("GOOSE_TEST_TABLESPACE", "fast_ssd")
+	defer os.Unsetenv("GOOSE_TEST_TABLESPACE")
+	os.Unsetenv("GOOSE_TEST_UNSET")
+
+	script := `-- +goose Up
+CREATE TABLE a (price text DEFAULT '$1');
+-- +goose ENVSUB ON
+CREATE TABLE b (id int) TABLESPACE ${GOOSE_TEST_TABLESPACE};
+GRANT SELECT ON b TO $GOOSE_TEST_UNSET;
+-- +goose ENVSUB OFF
+CREATE TABLE c (price text DEFAULT '$GOOSE_TEST_TABLESPACE');
+`
+	stmts, dirs, _ := splitSQLStatements(nil, strings.NewReader(script), true)
+
+	want := []string{
+		"CREATE TABLE a (price text DEFAULT '$1');",
+		"CREATE TABLE b (id int) TABLESPACE fast_ssd;",
+		"GRANT SELECT ON b TO ;",
+		"CREATE TABLE c (price text DEFAULT '$GOOSE_TEST_TABLESPACE');",
+	}
+	for i := range stmts {
+		stmts[i] = stripComments(stmts[i])
+	}
+	if !reflect.DeepEqual(stmts, want) {
+		t.Errorf("incorrect statements. got %q, want %q", stmts, want)
+	}
+	if want := []string{"GOOSE_TEST_UNSET"}; !reflect.DeepEqual(dirs.undefinedEnv, want) {
+		t.Errorf("incorrect undefined variables. got %v, want %v", dirs.undefinedEnv, want)
+	}
+}
+
+func TestStrictEnvSub(t *testing.T) {
+
+	os.Unsetenv("GOOSE_TEST_UNSET")
+
+	db, fdb := newFakeDB(t)
+	conf := newFakeConf(fakeDialect{})
+	conf.Options.StrictEnvSub = true
+	dir := writeMigrations(t, map[string]string{
+		"001_a.sql": "-- +goose Up\n-- +goose ENVSUB ON\nGRANT SELECT ON a TO ${GOOSE_TEST_UNSET};\n-- +goose Down\nREVOKE SELECT ON a FROM ${GOOSE_TEST_UNSET};\n",
+	})
+
+	err := RunMigrationsOnDb(conf, dir, 1, db)
+	if err == nil || !strings.Contains(err.Error(), "GOOSE_TEST_UNSET") {
+		t.Fatalf("expected an error naming the undefined variable, got %v", err)
+	}
+	if got := fdb.statements(); len(got) != 0 {
+		t.Errorf("expected no statements to run, got %q", got)
+	}
+}
+
+func TestTemplateData(t *testing.T) {
+
+	files := map[string]string{
+		"001_events.sql": "-- +goose Up\nCREATE TABLE events_{{.Shard}} (id int);\n-- +goose Down\nDROP TABLE events_{{.Shard}};\n",
+		"002_index.sql": "{{if .Concurrently}}-- +goose NO TRANSACTION\n{{end}}-- +goose Up\n" +
+			"CREATE INDEX{{if .Concurrently}} CONCURRENTLY{{end}} events_{{.Shard}}_id ON events_{{.Shard}} (id);\n" +
+			"-- +goose Down\nDROP INDEX events_{{.Shard}}_id;\n",
+	}
+
+	db, fdb := newFakeDB(t)
+	conf := newFakeConf(fakeDialect{})
+	conf.Options.TemplateData = map[string]interface{}{"Shard": 3, "Concurrently": true}
+	dir := writeMigrations(t, files)
+
+	if err := RunMigrationsOnDb(conf, dir, 2, db); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"CREATE TABLE events_3 (id int);", "CREATE INDEX CONCURRENTLY events_3_id ON events_3 (id);"}
+	if got := fdb.statements(); !reflect.DeepEqual(got, want) {
+		t.Errorf("incorrect statements. got %q, want %q", got, want)
+	}
+	// the annotation rendered into 002 is honoured
+	if untxed := strings.Join(fdb.untxed, "\n"); !strings.Contains(untxed, want[1]) {
+		t.Errorf("migration 2 ran in a transaction: %q", fdb.untxed)
+	}
+
+	// the checksums recorded are of the scripts as written, so a later
+	// run finds them unchanged
+	if err := RunMigrationsOnDb(conf, dir, 2, db); err != nil {
+		t.Errorf("expected the applied migrations to be unchanged, got %v", err)
+	}
+	if err := RunMigrationsOnDb(conf, dir, 0, db); err != nil {
+		t.Fatal(err)
+	}
+	want = append(want, "DROP INDEX events_3_id;", "DROP TABLE events_3;")
+	if got := fdb.statements(); !reflect.DeepEqual(got, want) {
+		t.Errorf("incorrect statements. got %q, want %q", got, want)
+	}
+
+	// with StrictTemplate, a missing key fails the run before anything runs
+	db, fdb = newNamedFakeDB(t, "strict")
+	conf.Options.TemplateData = map[string]interface{}{"Concurrently": false}
+	conf.Options.StrictTemplate = true
+	err := RunMigrationsOnDb(conf, dir, 2, db)
+	if err == nil || !strings.Contains(err.Error(), "001_events.sql") || !strings.Contains(err.Error(), "Shard") {
+		t.Fatalf("expected an error naming the missing key, got %v", err)
+	}
+	if got := fdb.statements(); len(got) != 0 {
+		t.Errorf("expected no statements to run, got %q", got)
+	}
+}
+
+func TestSplitBlocks(t *testing.T) {
+
+	type testData struct {
+		name  string
+		sql   string
+		count int
+	}
+
+	tests := []testData{
+		{
+			name:  "plpgsql function",
+			sql:   plpgsqltxt,
+			count: 3,
+		},
+		{
+			name:  "mysql trigger",
+			sql:   triggertxt,
+			count: 3,
+		},
+		{
+			name:  "nested dollar quotes",
+			sql:   nestedtxt,
+			count: 2,
+		},
+	}
+
+	for _, test := range tests {
+		stmts, _, _ := splitSQLStatements(nil, strings.NewReader(test.sql), true)
+		if len(stmts) != test.count {
+			t.Errorf("%s: incorrect number of stmts. got %v, want %v: %q", test.name, len(stmts), test.count, stmts)
+		}
+	}
+
+	// the splitter must not mistake positional parameters and
+	// transaction statements for the start of a block
+	stmts, _, _ := splitSQLStatements(nil, strings.NewReader(`-- +goose Up
+BEGIN;
+PREPARE q AS SELECT $1::int + $2;
+SELECT CASE WHEN x > 0 THEN 'a;' ELSE 'b' END AS y FROM t;
+COMMIT;
+`), true)
+	if len(stmts) != 4 {
+		t.Errorf("incorrect number of stmts. got %v, want 4: %q", len(stmts), stmts)
+	}
+
+	// nor transactions begun with a mode
+	stmts, _, _ = splitSQLStatements(nil, strings.NewReader(`-- +goose Up
+BEGIN ISOLATION LEVEL SERIALIZABLE;
+UPDATE t SET x = 1;
+COMMIT;
+BEGIN READ WRITE;
+UPDATE t SET x = 2;
+COMMIT;
+BEGIN NOT DEFERRABLE;
+UPDATE t SET x = 3;
+COMMIT;
+BEGIN IMMEDIATE;
+UPDATE t SET x = 4;
+COMMIT;
+`), true)
+	if len(stmts) != 12 {
+		t.Errorf("incorrect number of stmts. got %v, want 12: %q", len(stmts), stmts)
+	}
+
+	// while MariaDB's BEGIN NOT ATOMIC is a block
+	stmts, _, _ = splitSQLStatements(nil, strings.NewReader(`-- +goose Up
+BEGIN NOT ATOMIC
+  UPDATE t SET x = 1;
+  UPDATE t SET y = 1;
+END;
+SELECT 1;
+`), true)
+	if len(stmts) != 2 {
+		t.Errorf("incorrect number of stmts. got %v, want 2: %q", len(stmts), stmts)
+	}
+
+	// backslash escapes and # comments, as the dialect lexes them
+	lexed := []struct {
+		name    string
+		dialect SqlDialect
+		sql     string
+	}{
+		{"escaped quote", MySqlDialect{}, "-- +goose Up\nINSERT INTO t VALUES ('it\\'s', \"a \\\"b\\\"\");\nSELECT 1;\n"},
+		{"hash comment", MySqlDialect{}, "-- +goose Up\nCREATE TABLE t (id int); # don't\nSELECT 1;\n"},
+		{"hash comment on MariaDB", MariaDBDialect{}, "-- +goose Up\n# isn't a quote\nCREATE TABLE t (id int);\nSELECT 1;\n"},
+		{"E string", PostgresDialect{}, "-- +goose Up\nSELECT E'it\\'s';\nSELECT 'C:\\';\n"},
+	}
+	for _, test := range lexed {
+		stmts, _, err := splitSQLStatements(test.dialect, strings.NewReader(test.sql), true)
+		if err != nil || len(stmts) != 2 {
+			t.Errorf("%s: incorrect stmts. got %q (%v), want 2", test.name, stmts, err)
+		}
+	}
+}
+
+// a plpgsql function without StatementBegin/StatementEnd annotations
+var plpgsqltxt = `-- +goose Up
+CREATE TABLE accounts (id bigint PRIMARY KEY, balance numeric NOT NULL);
+
+CREATE OR REPLACE FUNCTION check_balance() RETURNS trigger AS $$
+BEGIN
+  IF NEW.balance < 0 THEN
+    RAISE EXCEPTION 'balance of % can''t be negative; got %', NEW.id, NEW.balance;
+  END IF;
+  RETURN NEW;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER accounts_balance BEFORE INSERT OR UPDATE ON accounts
+  FOR EACH ROW EXECUTE PROCEDURE check_balance();
+
+-- +goose Down
+DROP TABLE accounts;
+`
+
+// a MySQL trigger, with a BEGIN ... END body
+var triggertxt = `-- +goose Up
+CREATE TABLE orders (id int PRIMARY KEY, total int NOT NULL, updated_at datetime);
+
+CREATE TRIGGER orders_touch BEFORE UPDATE ON orders
+FOR EACH ROW
+BEGIN
+  IF NEW.total <> OLD.total THEN
+    SET NEW.updated_at = NOW();
+  END IF;
+  CASE WHEN NEW.total < 0 THEN
+    SET NEW.total = 0;
+  ELSE
+    BEGIN
+      SET @touched = 1;
+    END;
+  END CASE;
+END;
+
+INSERT INTO orders (id, total) VALUES (1, 10);
+
+-- +goose Down
+DROP TABLE orders;
+`
+
+// a function that builds another function, with differently tagged dollar quotes
+var nestedtxt = `-- +goose Up
+CREATE FUNCTION make_counter(name text) RETURNS void AS $outer$
+BEGIN
+  EXECUTE format('CREATE FUNCTION %I() RETURNS int AS $inner$
+    BEGIN
+      RETURN 1;
+    END;
+  $inner$ LANGUAGE plpgsql;', name);
+END;
+$outer$ LANGUAGE plpgsql;
+
+SELECT make_counter('one');
+`
+
+func TestDelimiter(t *testing.T) {
+
+	stmts, _, _ := splitSQLStatements(nil, strings.NewReader(proceduretxt), true)
+
+	want := []string{
+		"CREATE TABLE counters (name varchar(64) PRIMARY KEY, n int NOT NULL);",
+		`CREATE PROCEDURE bump(IN counter varchar(64))
+BEGIN
+INSERT IGNORE INTO counters (name, n) VALUES (counter, 0);
+UPDATE counters SET n = n + 1 WHERE name = counter;
+SELECT n FROM counters WHERE name = counter;
+END`,
+		"CALL bump('a')",
+		"CALL bump('b');",
+	}
+	for i := range stmts {
+		stmts[i] = stripComments(stmts[i])
+	}
+	if !reflect.DeepEqual(stmts, want) {
+		t.Errorf("incorrect statements. got %q, want %q", stmts, want)
+	}
+
+	// the delimiter doesn't carry over to the next section
+	stmts, _, _ = splitSQLStatements(nil, strings.NewReader(proceduretxt), false)
+	if want := []string{"DROP PROCEDURE bump", "DROP TABLE counters;"}; len(stmts) != 2 ||
+		stripComments(stmts[0]) != want[0] || stripComments(stmts[1]) != want[1] {
+		t.Errorf("incorrect statements. got %q, want %q", stmts, want)
+	}
+}
+
+// a MySQL stored procedure, written as for the mysql client
+var proceduretxt = `-- +goose Up
+CREATE TABLE counters (name varchar(64) PRIMARY KEY, n int NOT NULL);
+
+-- +goose DELIMITER //
+CREATE PROCEDURE bump(IN counter varchar(64))
+BEGIN
+  INSERT IGNORE INTO counters (name, n) VALUES (counter, 0);
+  UPDATE counters SET n = n + 1 WHERE name = counter;
+  SELECT n FROM counters WHERE name = counter;
+END //
+
+CALL bump('a')//
+-- +goose DELIMITER ;
+CALL bump('b');
+
+-- +goose Down
+-- +goose DELIMITER $$
+DROP PROCEDURE bump$$
+-- +goose DELIMITER ;
+DROP TABLE counters;
+`
+
+func TestParseErrors(t *testing.T) {
+
+	type testData struct {
+		sql       string
+		direction bool
+		line      int
+		reason    string
+	}
+
+	tests := []testData{
+		{
+			sql:       "-- +goose Down\nDROP TABLE post;\n",
+			direction: true,
+			line:      1,
+			reason:    "can't be applied",
+		},
+		{
+			sql:       "-- +goose Up\nCREATE TABLE post (id int);\n",
+			direction: false,
+			line:      1,
+			reason:    "can't be rolled back",
+		},
+		{
+			sql:       "-- +goose Up\nCREATE TABLE post (id int);\n\n-- +goose StatementBegin\nCREATE FUNCTION f() RETURNS void AS 'SELECT 1;' LANGUAGE sql;\n-- +goose Down\nDROP TABLE post;\n",
+			direction: true,
+			line:      4,
+			reason:    "StatementBegin",
+		},
+		{
+			sql:       "-- +goose Up\n-- +goose ISOLATION sometimes\nSELECT 1;\n",
+			direction: true,
+			line:      2,
+			reason:    "unknown isolation level",
+		},
+		{
+			sql:       "-- +goose Up\nALTER TABLE post DROP COLUMN body;\n\n-- +goose Down\n-- +goose NO-OP\nALTER TABLE post ADD COLUMN body text;\n",
+			direction: false,
+			line:      5,
+			reason:    "NO-OP",
+		},
+		{
+			sql:       multitxt,
+			direction: true,
+			line:      12,
+			reason:    "second '-- +goose Up' annotation, after the one at line 1",
+		},
+		{
+			sql:       "-- +goose Up\nCREATE TABLE post (id int);\n-- +goose Down\nDROP TABLE post;\n-- +goose Down\nDROP TABLE fancier_post;\n",
+			direction: false,
+			line:      5,
+			reason:    "second '-- +goose Down' annotation, after the one at line 3",
+		},
+		{
+			sql:       "-- +goose Down\nCREATE TABLE post (id int);\n-- +goose Up\nDROP TABLE post;\n",
+			direction: true,
+			line:      1,
+			reason:    "'-- +goose Down' annotation before the '-- +goose Up' one at line 3",
+		},
+		{
+			sql:       "-- +goose Verify\nSELECT 1 FROM post;\n-- +goose Up\nCREATE TABLE post (id int);\n",
+			direction: true,
+			line:      1,
+			reason:    "no '-- +goose Up' section before it",
+		},
+		{
+			sql:       "-- +goose Up\nCREATE TABLE post (id int);\n-- +goose Verify\nSELECT 1;\n-- +goose Verify\nSELECT 2;\n",
+			direction: true,
+			line:      5,
+			reason:    "second '-- +goose Verify' annotation, after the one at line 3",
+		},
+		{
+			sql:       "-- +goose Up\nINSERT INTO t VALUES ('it\\'s');\nSELECT 1;\n",
+			direction: true,
+			line:      2,
+			reason:    "a string or identifier quoted with ' begun here is still open at the end of the section",
+		},
+		{
+			sql:       "-- +goose Up\nSELECT 1;\nCREATE FUNCTION f() RETURNS int AS $$\nSELECT 1;\n-- +goose Down\nDROP FUNCTION f;\n",
+			direction: true,
+			line:      3,
+			reason:    "a string quoted with $$",
+		},
+		{
+			sql:       "-- +goose Up\nCREATE TRIGGER t BEFORE INSERT ON t FOR EACH ROW\nBEGIN\n  SET NEW.x = 1;\n",
+			direction: true,
+			line:      3,
+			reason:    "a BEGIN or CASE block",
+		},
+		{
+			sql:       "-- a comment, and an annotation, can come first\n-- +goose NO TRANSACTION\n\nCREATE TABLE post (id int);\n-- +goose Up\nSELECT 1;\n",
+			direction: true,
+			line:      4,
+			reason:    "SQL before the first",
+		},
+	}
+
+	for _, test := range tests {
+		_, _, err := splitSQLStatements(nil, strings.NewReader(test.sql), test.direction)
+		perr, ok := err.(*ParseError)
+		if !ok {
+			t.Errorf("expected a *ParseError for %q, got %v", test.sql, err)
+			continue
+		}
+		if perr.Line != test.line || !strings.Contains(perr.Reason, test.reason) {
+			t.Errorf("incorrect error. got line %v: %v, want line %v: ...%v...", perr.Line, perr.Reason, test.line, test.reason)
+		}
+	}
+}
+
+func TestParseErrorBeforeRun(t *testing.T) {
+
+	db, fdb := newFakeDB(t)
+	conf := newFakeConf(fakeDialect{})
+	dir := writeMigrations(t, map[string]string{
+		"001_a.sql": "-- +goose Up\nCREATE TABLE a (id int);\n-- +goose Down\nDROP TABLE a;\n",
+		"002_b.sql": "-- +goose Up\n-- +goose StatementBegin\nCREATE TABLE b (id int);\n",
+	})
+
+	err := RunMigrationsOnDb(conf, dir, 2, db)
+	perr, ok := err.(*ParseError)
+	if !ok {
+		t.Fatalf("expected a *ParseError, got %v", err)
+	}
+	if filepath.Base(perr.Path) != "002_b.sql" || perr.Line != 2 {
+		t.Errorf("incorrect error location. got %v:%v, want 002_b.sql:2", perr.Path, perr.Line)
+	}
+	if got := fdb.statements(); len(got) != 0 {
+		t.Errorf("expected no statements to run, got %q", got)
+	}
+}
+
+func TestNoopDown(t *testing.T) {
+
+	db, fdb := newFakeDB(t)
+	conf := newFakeConf(fakeDialect{})
+	dir := writeMigrations(t, map[string]string{
+		"001_a.sql": "-- +goose Up\nCREATE TABLE a (id int, body text);\n-- +goose Down\nDROP TABLE a;\n",
+		"002_b.sql": "-- +goose Up\nALTER TABLE a DROP COLUMN body;\n\n-- +goose Down\n-- +goose NO-OP\n",
+		"003_c.sql": "-- +goose Up\nCREATE TABLE c (id int);\n-- +goose Down\n",
+	})
+	if err := RunMigrationsOnDb(conf, dir, 3, db); err != nil {
+		t.Fatal(err)
+	}
+
+	fdb.stmts = nil
+	if err := RunMigrationsOnDb(conf, dir, 1, db); err != nil {
+		t.Fatal(err)
+	}
+	if got := fdb.statements(); len(got) != 0 {
+		t.Errorf("expected no statements to run, got %q", got)
+	}
+	if got, err := ListAppliedVersions(db, fakeDialect{}); err != nil || !reflect.DeepEqual(got, []int64{1}) {
+		t.Errorf("incorrect applied versions. got %v (%v), want [1]", got, err)
+	}
+}
+
+func TestVerifySection(t *testing.T) {
+
+	sql := `-- +goose Up
+CREATE TABLE post (id int);
+INSERT INTO post VALUES (1);
+
+-- +goose Verify
+SELECT id FROM post WHERE id = 1;
+SELECT count(*) FROM post HAVING count(*) = 1;
+
+-- +goose Down
+DROP TABLE post;
+`
+
+	stmts, dirs, err := splitSQLStatements(nil, strings.NewReader(sql), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range stmts {
+		stmts[i] = stripComments(stmts[i])
+	}
+	for i := range dirs.verify {
+		dirs.verify[i] = stripComments(dirs.verify[i])
+	}
+	want := []string{"CREATE TABLE post (id int);", "INSERT INTO post VALUES (1);"}
+	if !reflect.DeepEqual(stmts, want) {
+		t.Errorf("incorrect up statements. got %q, want %q", stmts, want)
+	}
+	want = []string{"SELECT id FROM post WHERE id = 1;", "SELECT count(*) FROM post HAVING count(*) = 1;"}
+	if !reflect.DeepEqual(dirs.verify, want) {
+		t.Errorf("incorrect verify statements. got %q, want %q", dirs.verify, want)
+	}
+
+	// rolling back ignores it
+	stmts, dirs, err = splitSQLStatements(nil, strings.NewReader(sql), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stmts) != 1 || len(dirs.verify) != 0 {
+		t.Errorf("expected only the down statement, got %q and verify %q", stmts, dirs.verify)
+	}
+}
+
+func TestVerifyRollsBack(t *testing.T) {
+
+	db, fdb := newFakeDB(t)
+	conf := newFakeConf(fakeDialect{})
+	dir := writeMigrations(t, map[string]string{
+		"001_a.sql": "-- +goose Up\nCREATE TABLE a (id int);\nINSERT INTO a VALUES (1);\n-- +goose Verify\nSELECT id FROM a;\n-- +goose Down\nDROP TABLE a;\n",
+		"002_b.sql": "-- +goose Up\nCREATE TABLE b (id int);\n-- +goose Verify\nSELECT id FROM b;\n-- +goose Down\nDROP TABLE b;\n",
+	})
+
+	// b is left empty, so its verify query returns no rows
+	err := RunMigrationsOnDb(conf, dir, 2, db)
+	if err == nil || !strings.Contains(err.Error(), "verify query 1 returned no rows") {
+		t.Fatalf("expected 002_b.sql to fail verification, got %v", err)
+	}
+	if got, want := fdb.appliedVersions(), []int64{1}; !reflect.DeepEqual(got, want) {
+		t.Errorf("incorrect applied versions. got %v, want %v", got, want)
+	}
+	for _, stmt := range fdb.statements() {
+		if strings.Contains(stmt, "TABLE b") {
+			t.Errorf("expected 002_b.sql to be rolled back, got %q", stmt)
+		}
+	}
+
+	// as is one whose verify query fails
+	fdb.failOn = "SELECT id FROM b"
+	if err := ApplyOne(conf, db, filepath.Join(dir, "002_b.sql"), Up, true); err == nil || !strings.Contains(err.Error(), "verify query 1 failed") {
+		t.Errorf("expected the failing verify query to fail the migration, got %v", err)
+	}
+	fdb.failOn = ""
+
+	// and rolling back doesn't verify anything
+	if err := RunMigrationsOnDb(conf, dir, 0, db); err != nil {
+		t.Fatal(err)
+	}
+}
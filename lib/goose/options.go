@@ -0,0 +1,223 @@
+package goose
+
+import (
+	"database/sql"
+	"time"
+)
+
+// Options tunes the behaviour of the migration runner.
+// The zero value runs migrations the way goose always has.
+type Options struct {
+	// Lock serializes concurrent migrators by holding a session-level
+	// lock for the duration of a run. Only dialects implementing
+	// sqlLocker support it.
+	Lock bool
+
+	// LockTimeout bounds how long to wait for another migrator to
+	// release the lock. Zero waits indefinitely, or until the run's
+	// context is done.
+	LockTimeout time.Duration
+
+	// PingAttempts, if positive, makes a run first ping the database
+	// until it accepts a connection, up to this many times, such as
+	// when it's started alongside the database. The run fails with
+	// the last ping's error if the database stays unreachable, or
+	// the run's context is done first.
+	PingAttempts int
+
+	// PingBackoff is the delay before the second ping, doubling
+	// with each further attempt. Zero waits half a second.
+	PingBackoff time.Duration
+
+	// ProbeDialect makes a run first check that the database is the
+	// kind the dialect is for, as ProbeDialect does, failing with an
+	// error saying so if it isn't.
+	ProbeDialect bool
+
+	// DryRun prints the statements a run would execute, along with
+	// the version table updates recording each migration, without
+	// executing them. The current version is still read from the
+	// database, so the plan reflects its real state.
+	DryRun bool
+
+	// AllowMissing applies, when migrating up, any migration that
+	// hasn't been applied yet, even if it's older than the current
+	// version, such as one merged in from a long-lived branch.
+	// By default, only migrations newer than the current version run.
+	// When rolling back, it lets a rollback pass applied versions
+	// whose migrations can't be found, leaving them applied.
+	AllowMissing bool
+
+	// MaxApply, if positive, bounds how many migrations a run applies:
+	// once that many have been, it stops, leaving the rest for a later
+	// run, so that each step of a long rollout makes bounded progress.
+	// MigrateBatch reports how many are left. Zero applies them all.
+	// Rollbacks aren't bounded.
+	MaxApply int
+
+	// BestEffort makes a run carry on past a migration that fails,
+	// recording nothing for it, and attempt every remaining migration,
+	// returning a *BestEffortError listing all of those that failed.
+	// This can leave a database in a state no sequence of migrations
+	// would, e.g. with a migration applied after one it depends on
+	// failed, so it's meant for development databases that can be
+	// rebuilt. By default, a run stops at the first failure.
+	BestEffort bool
+
+	// SingleTransaction runs every migration of a run in one
+	// transaction, along with the version table updates recording
+	// them, so that one failing rolls back those run before it too.
+	// It's for databases with transactional DDL, such as Postgres; on
+	// MySQL, DDL commits implicitly, so it isn't all-or-nothing there.
+	// A run with a migration annotated 'NO TRANSACTION', or asking for
+	// an isolation level of its own, fails before any of them runs, as
+	// does one with a Go migration script, with BestEffort or with a
+	// VersionStore. The transaction isn't retried. AfterEach and
+	// Progress hear of each migration's success only once the
+	// transaction has committed, and of the run's error for each
+	// migration rolled back with it.
+	SingleTransaction bool
+
+	// ReadDB, if set, is where a run reads the versions it starts from,
+	// such as a read replica, rather than the database being migrated.
+	// That's still where migrations run and are recorded, where dirty
+	// marks and checksums are checked, and where the version table is
+	// created, should ReadDB not have one yet. A replica lagging behind
+	// has a run start from an older version than the database is at,
+	// so retry migrations that have already been applied; runs holding
+	// the Lock, which is meant to prevent that, read the database being
+	// migrated instead, as does Redo for the migrations it reapplies,
+	// whose rollbacks a replica may not show yet.
+	ReadDB *sql.DB
+
+	// SessionSetup lists statements to run at the start of a run, such
+	// as SET lock_timeout = '5s' on Postgres, to set up the session the
+	// migrations run in: a run issues everything on one connection.
+	// They run once any lock is held, but before the version table is
+	// read, or created if it's missing. Go migration scripts run by
+	// `go run` connect separately, outside the session.
+	SessionSetup []string
+
+	// IncludeTags, if set, limits a run to the migrations tagged with
+	// at least one of them, by a '-- +goose TAGS <tag>,...' annotation,
+	// and ExcludeTags leaves out those tagged with any of them; by
+	// default, every migration runs, tagged or not. Migrations that
+	// are skipped are then older than the current version once later
+	// ones have run, so run them later with AllowMissing.
+	IncludeTags []string
+	ExcludeTags []string
+
+	// DisableAutoCreate stops a run from creating the version table
+	// when it's missing, for databases whose DDL is left to their
+	// administrators; the run fails with an error matching
+	// ErrTableDoesNotExist instead, rather than one from the attempt.
+	DisableAutoCreate bool
+
+	// VersionStore, if set, keeps track of the applied migrations in
+	// place of the version table, which is then neither read, written
+	// nor created, while migrations still run against the database.
+	// Each migration is recorded once its transaction has committed,
+	// so one that fails to be recorded is left applied regardless.
+	// Checksums and dirty marks aren't kept, and Go migration scripts,
+	// which record themselves, can't be run; registered ones can.
+	VersionStore VersionStore
+
+	// ExtraColumns are added to the version table, when it's created,
+	// after goose's own columns, and given their values in each row
+	// recording an applied version. A version table created without
+	// them needs them added by hand, e.g. in a migration of its own.
+	ExtraColumns []VersionColumn
+
+	// TxOptions, if set, are used to begin the transaction each
+	// migration runs in. A SQL migration annotated with
+	// '-- +goose ISOLATION <level>' overrides the isolation level.
+	// Left nil, transactions get the driver's defaults.
+	TxOptions *sql.TxOptions
+
+	// StatementTimeout, if positive, bounds how long each statement of
+	// a SQL migration may run. A statement still running once it has
+	// passed is cancelled, failing the migration, whose transaction is
+	// rolled back. Go migrations are given the run's context, and
+	// are left to set deadlines of their own. With MultiStatement, it
+	// bounds each section sent in a single Exec instead.
+	StatementTimeout time.Duration
+
+	// StatementRewriter, if set, is passed each statement of a SQL
+	// migration before it runs, after any ENVSUB substitution, and the
+	// statement it returns is run in its place, e.g. to strip table
+	// options a managed database rejects. An empty statement is left
+	// out, and an error fails the migration before any of its
+	// statements run. The queries of Verify sections aren't passed to
+	// it, and checksums are of the scripts as written.
+	StatementRewriter func(stmt string) (string, error)
+
+	// MultiStatement sends each section of a SQL migration run in a
+	// transaction to the database in a single Exec, rather than one
+	// statement at a time, saving a round trip per statement, e.g. for
+	// large seed files. Only dialects implementing sqlMultiStatementer
+	// support it, and only if their driver is configured to, e.g. with
+	// multiStatements=true for MySQL; others ignore it. Migrations
+	// annotated 'NO TRANSACTION' still run a statement at a time, so
+	// that a failure can say how many ran. As a section is sent as one
+	// statement, StatementTimeout bounds the whole section rather than
+	// each of its statements, and a timeout is reported as statement 1,
+	// with a summary of the section, whichever of its statements was
+	// running.
+	MultiStatement bool
+
+	// VersionFunc, if set, finds each migration's version from its
+	// file name, in place of the number the name starts with, for names
+	// such as v2.3.1_add_index.sql. It's given the base name of each
+	// .go and .sql file, and a file it returns an error for isn't a
+	// migration. Versions are what the version table records, and
+	// migrations run in their order, so it has to map names to versions
+	// that sort the way the migrations are meant to run, greater than
+	// zero and stable from one release to the next. Files mapped to the
+	// same version are duplicates, as ever. Functions that take no
+	// DBConf, such as CollectMigrations and Fix, always use the number.
+	VersionFunc func(name string) (int64, error)
+
+	// StrictEnvSub fails a SQL migration that uses an undefined
+	// environment variable within an '-- +goose ENVSUB ON' section,
+	// rather than substituting "" for it.
+	StrictEnvSub bool
+
+	// TemplateData, if set, renders each SQL migration with
+	// text/template before it's parsed and run, given the data, e.g.
+	// {"Shard": 3} for a script creating events_{{.Shard}}. Unlike
+	// '-- +goose ENVSUB ON', it applies to the whole script, so that
+	// annotations can be rendered too; checksums are still those of the
+	// scripts as written. Tools that parse migrations without running
+	// them, such as Validate, see the scripts unrendered.
+	TemplateData map[string]interface{}
+
+	// StrictTemplate fails a SQL migration whose template uses a key
+	// missing from TemplateData, rather than rendering "<no value>".
+	StrictTemplate bool
+
+	// BeforeEach, if set, is called before each migration runs,
+	// whether it's being applied or rolled back.
+	BeforeEach func(m *Migration)
+
+	// AfterEach, if set, is called after each migration runs, with
+	// the error it failed with, or nil if it succeeded. With
+	// SingleTransaction, a migration that succeeded is reported once
+	// the transaction commits, or with the run's error if it's rolled
+	// back.
+	AfterEach func(m *Migration, err error)
+
+	// Progress, if set, is called before each migration runs, with the
+	// number of the run's migrations that have succeeded so far and
+	// the total number it will run, and again once the migration has
+	// succeeded, with done counting it. With SingleTransaction, none
+	// has succeeded until the transaction commits, when each is
+	// reported in turn. Like BeforeEach and AfterEach, it's called
+	// synchronously, and so should return promptly.
+	Progress func(done, total int, m *Migration)
+
+	// Metrics, if set, is called once each run that isn't a dry run
+	// ends, however it ends, with how long it and each of its
+	// migrations took, and how many succeeded and failed, e.g. to
+	// record them as spans for a tracer; goose depends on none.
+	Metrics func(m *RunMetrics)
+}
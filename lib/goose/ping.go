@@ -0,0 +1,44 @@
+package goose
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// delay before the second ping, if Options.PingBackoff isn't set
+const defaultPingBackoff = 500 * time.Millisecond
+
+// waitForDB pings db until it accepts a connection, making at most
+// attempts pings, and doubling the delay between them from backoff.
+// It gives up early if ctx is done, in either case reporting the
+// last ping's error.
+//
+// Only reachability is checked: a missing version table is a state
+// of a reachable database, which the runner deals with itself.
+func waitForDB(ctx context.Context, db *sql.DB, attempts int, backoff time.Duration) error {
+	if backoff <= 0 {
+		backoff = defaultPingBackoff
+	}
+
+	var err error
+	for attempt := 1; attempt <= attempts; attempt++ {
+		if err = db.PingContext(ctx); err == nil {
+			return nil
+		}
+		if attempt == attempts {
+			break
+		}
+
+		logger.Printf("goose: database unreachable (%v), retrying in %v\n", err, backoff)
+		select {
+		case <-ctx.Done():
+			return errors.New(fmt.Sprintf("database unreachable after %d attempts: %v", attempt, err))
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+	return errors.New(fmt.Sprintf("database unreachable after %d attempts: %v", attempts, err))
+}
@@ -0,0 +1,38 @@
+package goose
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+)
+
+// ProbeDialect checks that db is the kind of database dialect is for,
+// by asking it what it is, so that a configuration mixing them up, e.g.
+// the postgres dialect with a MySQL DSN, fails clearly rather than at
+// the first statement the database can't make sense of. A dialect
+// whose databases have no way of saying isn't checked.
+//
+// Runs do the same first, if Options.ProbeDialect is set.
+func ProbeDialect(db *sql.DB, dialect SqlDialect) error {
+	return probeDialect(context.Background(), dialect, db)
+}
+
+func probeDialect(ctx context.Context, d SqlDialect, db dbConn) error {
+	p, ok := d.(sqlProber)
+	if !ok {
+		return nil
+	}
+
+	var version string
+	if err := db.QueryRowContext(ctx, p.dialectProbeSql()).Scan(&version); err != nil {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		return errors.New(fmt.Sprintf("database doesn't look like one for dialect %T: %s failed: %v", d, p.dialectProbeSql(), err))
+	}
+	if !p.probeMatches(version) {
+		return errors.New(fmt.Sprintf("database doesn't look like one for dialect %T: it reports being %q", d, version))
+	}
+	return nil
+}
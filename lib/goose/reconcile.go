@@ -0,0 +1,168 @@
+package goose
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"sort"
+)
+
+// Reconcile cross-checks the version table against the migrations in
+// dir, e.g. once it's been edited by hand while recovering from a
+// disaster, returning each anomaly it finds as a sentence, in ascending
+// order of version. It reports versions recorded as applied more than
+// once, applied versions with no migration in dir, migrations left
+// unapplied below a version that's applied, unless Options.AllowMissing
+// is set, and dirty marks left behind.
+//
+// With Options.VersionStore, the versions the store reports applied are
+// cross-checked instead, and db isn't read; a store keeps neither
+// duplicate records nor dirty marks, so only the other anomalies are
+// reported.
+//
+// It only reports: nothing is repaired, and the database isn't
+// modified, not even to add columns a version table created by an
+// earlier release lacks.
+func Reconcile(conf *DBConf, db *sql.DB, dir string) ([]string, error) {
+
+	ctx := context.Background()
+
+	var recs *reconcileRecords
+	if store := conf.Options.VersionStore; store != nil {
+		_, versions, err := storeVersions(ctx, store)
+		if err != nil {
+			return nil, err
+		}
+		recs = newReconcileRecords()
+		for v := range versions {
+			recs.applied[v] = true
+			recs.records[v] = 1
+		}
+	} else {
+		var err error
+		if recs, err = readReconcileRecords(ctx, conf, db); err != nil {
+			if errors.Is(err, ErrTableDoesNotExist) && ctx.Err() == nil {
+				return []string{fmt.Sprintf("the version table %s doesn't exist", qualifiedTableName())}, nil
+			}
+			return nil, err
+		}
+	}
+	applied, records, extra, dirty := recs.applied, recs.records, recs.extra, recs.dirty
+
+	migrations, err := collectMigrations(conf, nil, []string{dir}, 0, (1<<63)-1)
+	if err != nil {
+		return nil, err
+	}
+	sources := make(map[int64]string)
+	for _, m := range migrations {
+		sources[m.Version] = m.Source
+	}
+
+	var current int64
+	var versions []int64
+	for v := range records {
+		if applied[v] && v > current {
+			current = v
+		}
+		versions = append(versions, v)
+	}
+	for v := range sources {
+		if records[v] == 0 {
+			versions = append(versions, v)
+		}
+	}
+	sort.Slice(versions, func(i, j int) bool { return versions[i] < versions[j] })
+
+	var anomalies []string
+	for _, v := range versions {
+		source, ok := sources[v]
+		if n := extra[v]; n > 0 {
+			anomalies = append(anomalies, fmt.Sprintf("version %d is recorded as applied %d times", v, n+1))
+		}
+		if applied[v] && v > 0 && !ok {
+			anomalies = append(anomalies, fmt.Sprintf("version %d is applied, but has no migration in %s", v, dir))
+		}
+		if ok && !applied[v] && v < current && !conf.Options.AllowMissing {
+			anomalies = append(anomalies, fmt.Sprintf("migration %d (%s) isn't applied, but version %d, after it, is",
+				v, filepath.Base(source), current))
+		}
+		if dirty[v] {
+			anomalies = append(anomalies, fmt.Sprintf("migration %d is marked dirty, as a run left it partway; Force clears the mark once it's put right", v))
+		}
+	}
+	return anomalies, nil
+}
+
+// reconcileRecords is what Reconcile reads of the versions recorded: the
+// state of each, how many rows record it, how many of those apply it
+// once too often, and which are marked dirty.
+type reconcileRecords struct {
+	applied map[int64]bool
+	records map[int64]int
+	extra   map[int64]int
+	dirty   map[int64]bool
+}
+
+func newReconcileRecords() *reconcileRecords {
+	return &reconcileRecords{
+		applied: make(map[int64]bool),
+		records: make(map[int64]int),
+		extra:   make(map[int64]int),
+		dirty:   make(map[int64]bool),
+	}
+}
+
+// readReconcileRecords reads the version table on db, row by row, without
+// creating it if it's missing.
+func readReconcileRecords(ctx context.Context, conf *DBConf, db *sql.DB) (*reconcileRecords, error) {
+	d := conf.Driver.Dialect
+
+	rows, err := queryVersionTable(ctx, d, db, d.dbVersionQuery)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	// rows come most recent first, and a version's latest says whether
+	// it's applied; two applying it with no rollback between are one
+	// too many, where a table from an earlier release kept rollbacks
+	recs := newReconcileRecords()
+	newer := make(map[int64]bool) // whether the version's last row read applies it
+	for rows.Next() {
+		var row MigrationRecord
+		if err := rows.Scan(&row.VersionId, &row.IsApplied); err != nil {
+			return nil, errors.New(fmt.Sprintf("error scanning rows: %v", err))
+		}
+		v := row.VersionId
+		if recs.records[v] == 0 {
+			recs.applied[v] = row.IsApplied
+		} else if row.IsApplied && newer[v] {
+			recs.extra[v]++
+		}
+		newer[v] = row.IsApplied
+		recs.records[v]++
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	dirtyRows, err := queryVersionTable(ctx, d, db, d.dirtyQuery)
+	switch {
+	case err == errNoDirtyColumn && ctx.Err() == nil:
+		// a table predating dirty marks has none left over
+	case err != nil:
+		return nil, err
+	default:
+		vs, err := scanDirtyVersions(dirtyRows)
+		dirtyRows.Close()
+		if err != nil {
+			return nil, err
+		}
+		for _, v := range vs {
+			recs.dirty[v] = true
+		}
+	}
+	return recs, nil
+}
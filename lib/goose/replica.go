@@ -0,0 +1,38 @@
+package goose
+
+import "context"
+
+// replicaVersions reads the current version, and the state of every
+// version, from Options.ReadDB, as ensureDBVersion does from the
+// database being migrated. It's reported as ErrTableDoesNotExist if the
+// replica has no version table, as it's only ever created on the
+// primary, and may not have reached the replica yet.
+func replicaVersions(ctx context.Context, conf *DBConf) (int64, versionSet, error) {
+	d := conf.Driver.Dialect
+	rows, err := queryVersionTable(ctx, d, conf.Options.ReadDB, d.dbVersionQuery)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer rows.Close()
+
+	return scanVersions(rows)
+}
+
+// readsReplica reports whether a run reads the versions it starts from
+// from Options.ReadDB. A run holding the lock doesn't, as the replica
+// may not yet show what the run holding it before wrote.
+func readsReplica(conf *DBConf) bool {
+	return conf.Options.ReadDB != nil && !conf.Options.Lock
+}
+
+// onPrimary returns conf, reading only from the database being
+// migrated, for a run following one that wrote to it, whose writes a
+// replica may not show yet.
+func onPrimary(conf *DBConf) *DBConf {
+	if conf.Options.ReadDB == nil {
+		return conf
+	}
+	primary := *conf
+	primary.Options.ReadDB = nil
+	return &primary
+}
@@ -0,0 +1,64 @@
+package goose
+
+import (
+	"context"
+	"database/sql"
+	"time"
+)
+
+// sqlRetrier is implemented by dialects whose databases may abort a
+// transaction with an error that retrying can get past, such as a
+// distributed transaction's serialization failure under contention.
+// Each migration's transaction, along with the version table update
+// it ends with, is then run again, up to retryAttempts times in all.
+type sqlRetrier interface {
+	retryable(err error) bool
+}
+
+// number of times a transaction is attempted by withRetries
+const retryAttempts = 3
+
+// withRetries calls fn, which runs a transaction of its own from start
+// to finish, again after a short pause if it fails with an error the
+// dialect reports as retryable.
+func withRetries(ctx context.Context, d SqlDialect, fn func() error) error {
+	r, ok := d.(sqlRetrier)
+	if !ok {
+		return fn()
+	}
+
+	for attempt := 1; ; attempt++ {
+		err := fn()
+		if err == nil || !r.retryable(err) || attempt == retryAttempts {
+			return err
+		}
+		if err := retryPause(ctx, attempt); err != nil {
+			return err
+		}
+	}
+}
+
+// queryWithRetries issues query, again after a short pause, up to
+// attempts times in all, while it fails with an error retryable accepts.
+func queryWithRetries(ctx context.Context, db dbConn, query string, attempts int, retryable func(error) bool) (*sql.Rows, error) {
+	for attempt := 1; ; attempt++ {
+		rows, err := db.QueryContext(ctx, query)
+		if err == nil || !retryable(err) || attempt >= attempts {
+			return rows, err
+		}
+		if err := retryPause(ctx, attempt); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// retryPause waits a little longer after each failed attempt,
+// unless ctx is done first.
+func retryPause(ctx context.Context, attempt int) error {
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-time.After(time.Duration(attempt) * 50 * time.Millisecond):
+		return nil
+	}
+}
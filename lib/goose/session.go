@@ -0,0 +1,35 @@
+package goose
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+)
+
+// sqlSessionSetup is implemented by dialects with statements of their
+// own to prepare each run's session with, ahead of Options.SessionSetup.
+type sqlSessionSetup interface {
+	sessionSetupSql() []string
+}
+
+// sessionSetup lists the statements a run's session is set up with:
+// the dialect's, followed by those in Options.SessionSetup.
+func sessionSetup(conf *DBConf) []string {
+	var stmts []string
+	if s, ok := conf.Driver.Dialect.(sqlSessionSetup); ok {
+		stmts = append(stmts, s.sessionSetupSql()...)
+	}
+	return append(stmts, conf.Options.SessionSetup...)
+}
+
+// setUpSession runs the statements in setup, in order, on conn, the
+// connection a run issues all of its queries and statements through.
+func setUpSession(ctx context.Context, conn *sql.Conn, setup []string) error {
+	for _, stmt := range setup {
+		if _, err := conn.ExecContext(ctx, stmt); err != nil {
+			return errors.New(fmt.Sprintf("session setup %q failed: %v", stmt, err))
+		}
+	}
+	return nil
+}
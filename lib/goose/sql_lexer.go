@@ -0,0 +1,234 @@
+package goose
+
+import (
+	"fmt"
+	"strings"
+)
+
+// sqlBlockTracker follows a SQL script line by line, to tell whether
+// a semicolon at the end of a line can end a statement, or is part of
+// a statement that has yet to end: inside a dollar-quoted string, as
+// used for Postgres function bodies, or a BEGIN ... END block, as used
+// for MySQL triggers and procedures.
+//
+// Quoted strings and identifiers and comments are skipped, so keywords
+// and dollar signs within them are ignored. Backslashes escape quotes
+// in Postgres E'...' strings, and, for dialects following MySQL's syntax,
+// in every string, where # also begins a comment.
+type sqlBlockTracker struct {
+	mysql bool // the script follows MySQL's syntax; kept across resets
+
+	dollarTag    string // the tag closing the dollar-quoted string we're in, e.g. "$$" or "$body$"
+	quote        byte   // the quote closing the string or identifier we're in, or 0
+	escapes      bool   // backslashes escape characters in the string we're in
+	blockComment bool   // within /* ... */
+	hashComment  int    // where the line last scanned has a # comment, or -1
+
+	depth        int  // number of open BEGIN and CASE blocks
+	pendingBegin bool // saw BEGIN, which may be a transaction statement rather than a block
+	pendingNot   bool // saw BEGIN NOT, which begins a transaction if DEFERRABLE follows, and a block if ATOMIC does
+	pendingEnd   bool // saw END, which closes a block unless followed by IF, LOOP, etc.
+}
+
+// open reports whether the statement being tracked can't end yet.
+func (t *sqlBlockTracker) open() bool {
+	return t.dollarTag != "" || t.quote != 0 || t.blockComment || t.depth > 0 || t.pendingEnd
+}
+
+func (t *sqlBlockTracker) reset() {
+	*t = sqlBlockTracker{mysql: t.mysql}
+}
+
+// unclosed describes what the statement being tracked has left open,
+// for a section that ends with it, or returns "" if nothing is.
+func (t *sqlBlockTracker) unclosed() string {
+	switch {
+	case t.quote != 0:
+		return fmt.Sprintf("a string or identifier quoted with %c", t.quote)
+	case t.dollarTag != "":
+		return fmt.Sprintf("a string quoted with %s", t.dollarTag)
+	case t.blockComment:
+		return "a /* comment"
+	case t.depth > 1 || t.depth == 1 && !t.pendingEnd:
+		return "a BEGIN or CASE block"
+	}
+	return ""
+}
+
+func isWordByte(c byte) bool {
+	return c == '_' || c >= '0' && c <= '9' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z'
+}
+
+// dollarTagAt returns the dollar quote tag, such as $$ or $fn$,
+// starting at line[i], or "" if there isn't one.
+func dollarTagAt(line string, i int) string {
+	if i > 0 && isWordByte(line[i-1]) {
+		return "" // e.g. part of an identifier
+	}
+	j := i + 1
+	for j < len(line) && isWordByte(line[j]) {
+		j++
+	}
+	if j == len(line) || line[j] != '$' {
+		return ""
+	}
+	if j > i+1 && line[i+1] >= '0' && line[i+1] <= '9' {
+		return "" // a positional parameter, e.g. $1
+	}
+	return line[i : j+1]
+}
+
+// isEscapePrefix reports whether the quote at line[i] begins a Postgres
+// E'...' string, in which backslashes escape characters.
+func isEscapePrefix(line string, i int) bool {
+	if line[i] != '\'' || i == 0 || (line[i-1] != 'E' && line[i-1] != 'e') {
+		return false
+	}
+	return i == 1 || !isWordByte(line[i-2])
+}
+
+// scan advances the tracker over a line of the script.
+func (t *sqlBlockTracker) scan(line string) {
+	t.hashComment = -1
+	for i := 0; i < len(line); {
+		switch {
+		case t.dollarTag != "":
+			if j := strings.Index(line[i:], t.dollarTag); j >= 0 {
+				i += j + len(t.dollarTag)
+				t.dollarTag = ""
+			} else {
+				i = len(line)
+			}
+
+		case t.quote != 0:
+			if t.escapes && line[i] == '\\' {
+				i += 2
+				continue
+			}
+			if line[i] == t.quote {
+				// a doubled quote is an escaped one
+				if i+1 < len(line) && line[i+1] == t.quote {
+					i += 2
+					continue
+				}
+				t.quote = 0
+				t.escapes = false
+			}
+			i++
+
+		case t.blockComment:
+			if j := strings.Index(line[i:], "*/"); j >= 0 {
+				i += j + 2
+				t.blockComment = false
+			} else {
+				i = len(line)
+			}
+
+		case strings.HasPrefix(line[i:], "--"):
+			return
+
+		case t.mysql && line[i] == '#':
+			t.hashComment = i
+			return
+
+		case strings.HasPrefix(line[i:], "/*"):
+			t.blockComment = true
+			i += 2
+
+		case line[i] == '\'' || line[i] == '"' || line[i] == '`':
+			t.quote = line[i]
+			t.escapes = line[i] != '`' && (t.mysql || isEscapePrefix(line, i))
+			i++
+
+		case line[i] == '$':
+			if tag := dollarTagAt(line, i); tag != "" {
+				t.dollarTag = tag
+				i += len(tag)
+			} else {
+				i++
+			}
+
+		case isWordByte(line[i]):
+			j := i
+			for j < len(line) && isWordByte(line[j]) {
+				j++
+			}
+			t.word(strings.ToUpper(line[i:j]))
+			i = j
+
+		case line[i] == ' ' || line[i] == '\t' || line[i] == '\r':
+			i++
+
+		default:
+			t.punctuation()
+			i++
+		}
+	}
+}
+
+// word handles a keyword or identifier outside of any string.
+func (t *sqlBlockTracker) word(w string) {
+	if t.pendingBegin {
+		t.pendingBegin = false
+		switch w {
+		case "TRANSACTION", "WORK", "ISOLATION", "READ", "DEFERRABLE", "DEFERRED", "IMMEDIATE", "EXCLUSIVE":
+			// BEGIN followed by a transaction mode, as Postgres and
+			// SQLite accept, starts a transaction
+			return
+		case "NOT":
+			t.pendingNot = true
+			return
+		}
+		t.depth++
+	}
+
+	if t.pendingNot {
+		t.pendingNot = false
+		if w == "DEFERRABLE" {
+			return
+		}
+		t.depth++
+	}
+
+	if t.pendingEnd {
+		t.pendingEnd = false
+		switch w {
+		case "IF", "LOOP", "WHILE", "REPEAT", "FOR":
+			// these close constructs that aren't counted
+			return
+		case "CASE":
+			t.close()
+			return
+		}
+		t.close()
+	}
+
+	switch w {
+	case "BEGIN":
+		t.pendingBegin = true
+	case "CASE":
+		t.depth++
+	case "END":
+		if t.depth > 0 {
+			t.pendingEnd = true
+		}
+	}
+}
+
+// punctuation handles any other character outside of a string,
+// such as a semicolon, which settles a preceding BEGIN or END.
+func (t *sqlBlockTracker) punctuation() {
+	if t.pendingBegin || t.pendingNot {
+		t.pendingBegin, t.pendingNot = false, false // BEGIN; starts a transaction
+	}
+	if t.pendingEnd {
+		t.pendingEnd = false
+		t.close()
+	}
+}
+
+func (t *sqlBlockTracker) close() {
+	if t.depth > 0 {
+		t.depth--
+	}
+}
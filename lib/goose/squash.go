@@ -0,0 +1,217 @@
+package goose
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Squash replaces the SQL migrations in dir with versions up to upto
+// by one, named outName, whose Up section runs each of their Up
+// sections in turn. It takes the version of the newest of them, and is
+// annotated 'SQUASHED', and the migrations it replaces are removed.
+//
+// A fresh database runs the squashed migration in their place, and has
+// its version recorded. A database that had already applied them has
+// that version recorded already, so doesn't run it again. The older
+// versions stay in its version table, with no file to roll them back
+// with; the squashed migration has no Down section, so rollbacks stop
+// at it. Its checksum isn't verified, as those databases recorded the
+// checksum of the migration whose version it took.
+//
+// The migrations are all run in one transaction, unless any of them is
+// annotated 'NO TRANSACTION', in which case none are. Go migrations
+// can't be squashed, and neither can migrations that ask for different
+// isolation levels. Verify sections are left out, as each checked what
+// its own migration had done, and later ones may have changed since.
+func Squash(dir string, upto int64, outName string) error {
+
+	name := strings.TrimSuffix(outName, ".sql")
+	if name == "" || strings.ContainsAny(name, `/\`) {
+		return errors.New(fmt.Sprintf("invalid name %q for the squashed migration", outName))
+	}
+
+	var migrations []*Migration
+	sources := make(map[int64]string)
+	err := walkMigrations(nil, nil, []string{dir}, func(m *Migration) error {
+		if other, dup := sources[m.Version]; dup {
+			return duplicateVersionError(m.Version, other, m.Source)
+		}
+		sources[m.Version] = m.Source
+		if m.Version > 0 && m.Version <= upto {
+			migrations = append(migrations, m)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if len(migrations) == 0 {
+		return fmt.Errorf("nothing to squash in %s up to version %d: %w", dir, upto, ErrNoMigrationFiles)
+	}
+	sort.Sort(migrationSorter(migrations))
+
+	var body bytes.Buffer
+	var noTx bool
+	var isolation *Migration // the first migration asking for an isolation level
+	for _, m := range migrations {
+		if filepath.Ext(m.Source) != ".sql" {
+			return errors.New(fmt.Sprintf("can't squash migration %d (%s): only SQL migrations can be squashed",
+				m.Version, filepath.Base(m.Source)))
+		}
+		if _, _, err := m.parseSQL(true); err != nil {
+			return err
+		}
+
+		noTx = noTx || m.script.noTx
+		if level := m.script.isolation; level != nil {
+			if isolation != nil && *isolation.script.isolation != *level {
+				return errors.New(fmt.Sprintf("can't squash %s and %s, which ask for different isolation levels",
+					filepath.Base(isolation.Source), filepath.Base(m.Source)))
+			}
+			if isolation == nil {
+				isolation = m
+			}
+		}
+
+		up, err := squashedUp(m)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(&body, "\n-- %s\n", filepath.Base(m.Source))
+		body.WriteString(up)
+	}
+
+	last := migrations[len(migrations)-1]
+	base := filepath.Base(last.Source)
+	path := filepath.Join(dir, base[:strings.Index(base, "_")+1]+name+".sql")
+	if _, err := os.Stat(path); err == nil {
+		return errors.New(fmt.Sprintf("can't squash into %s: it already exists", path))
+	}
+
+	var out bytes.Buffer
+	fmt.Fprintf(&out, "-- Squashed from %d migrations, versions %d to %d.\n", len(migrations), migrations[0].Version, last.Version)
+	out.WriteString(sqlCmdPrefix + "SQUASHED\n")
+	if noTx {
+		out.WriteString(sqlCmdPrefix + "NO TRANSACTION\n")
+	}
+	if isolation != nil {
+		out.WriteString(sqlCmdPrefix + "ISOLATION " + strings.ToUpper(isolation.script.isolation.String()) + "\n")
+	}
+	out.WriteString(sqlCmdPrefix + "Up\n")
+	out.Write(body.Bytes())
+
+	if err := ioutil.WriteFile(path, out.Bytes(), 0644); err != nil {
+		return err
+	}
+	if _, _, err := newMigration(last.Version, path).parseSQL(true); err != nil {
+		os.Remove(path)
+		return errors.New(fmt.Sprintf("squashed migration doesn't parse, so nothing was squashed: %v", err))
+	}
+	for _, m := range migrations {
+		if err := os.Remove(m.Source); err != nil {
+			return err
+		}
+	}
+	logger.Printf("goose: squashed %d migrations into %s\n", len(migrations), filepath.Base(path))
+	return nil
+}
+
+// squashedUp returns the lines of the migration's Up section, as
+// written, for Squash to run one after another in a single section.
+// Annotations applying to the whole script are left out, Squash
+// annotating its own, and those that would otherwise carry over into
+// the next migration's lines are undone at the end.
+func squashedUp(m *Migration) (string, error) {
+
+	f, err := m.open()
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	var up strings.Builder
+	inUp := false
+	envSub, envSubUp := false, false // whether it's on in the script, and in what's been returned
+	delimiter := false
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, bufferSize), bufferSize)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.HasPrefix(line, sqlCmdPrefix) {
+			cmd := strings.TrimSpace(line[len(sqlCmdPrefix):])
+			switch {
+			case cmd == "Up" || cmd == "Down" || cmd == "Verify":
+				inUp = cmd == "Up"
+				// each section starts with the default delimiter
+				if delimiter {
+					up.WriteString(sqlCmdPrefix + "DELIMITER ;\n")
+					delimiter = false
+				}
+				// but ENVSUB carries over from the one before
+				if inUp && envSub != envSubUp {
+					if envSub {
+						up.WriteString(sqlCmdPrefix + "ENVSUB ON\n")
+					} else {
+						up.WriteString(sqlCmdPrefix + "ENVSUB OFF\n")
+					}
+					envSubUp = envSub
+				}
+				continue
+			case cmd == "NO TRANSACTION", cmd == "SQUASHED", cmd == "NO-OP",
+				strings.HasPrefix(cmd, "ISOLATION "):
+				continue
+			case cmd == "ENVSUB ON" || cmd == "ENVSUB OFF":
+				envSub = cmd == "ENVSUB ON"
+				if inUp {
+					envSubUp = envSub
+				}
+			case strings.HasPrefix(cmd, "DELIMITER "):
+				delimiter = inUp
+			}
+		}
+		if inUp {
+			up.WriteString(line + "\n")
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return "", err
+	}
+
+	if delimiter {
+		up.WriteString(sqlCmdPrefix + "DELIMITER ;\n")
+	}
+	if envSubUp {
+		up.WriteString(sqlCmdPrefix + "ENVSUB OFF\n")
+	}
+	return up.String(), nil
+}
+
+// isSquashed reports whether the migration's script was written by
+// Squash, which its 'SQUASHED' annotation marks.
+func (m *Migration) isSquashed() (bool, error) {
+	if m.isRegistered() || filepath.Ext(m.Source) != ".sql" {
+		return false, nil
+	}
+
+	f, err := m.open()
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, bufferSize), bufferSize)
+	for scanner.Scan() {
+		if strings.TrimSpace(scanner.Text()) == sqlCmdPrefix+"SQUASHED" {
+			return true, nil
+		}
+	}
+	return false, scanner.Err()
+}
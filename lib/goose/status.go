@@ -0,0 +1,136 @@
+package goose
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+)
+
+// MigrationStatus describes a migration found on disk, in the
+// version table, or both.
+type MigrationStatus struct {
+	Version   int64
+	Source    string    // path to the migration script, "" if it's missing from disk
+	Applied   bool      // whether the migration is currently applied
+	AppliedAt time.Time // when it was applied, the zero Time if it's pending
+}
+
+// Status reports the state of every migration in migrationsDir,
+// along with any applied migration whose script can no longer be
+// found, ordered by version. It doesn't modify the database; a
+// missing version table simply leaves every migration pending.
+func Status(db *sql.DB, dialect SqlDialect, migrationsDir string) ([]MigrationStatus, error) {
+
+	records, err := versionRecords(context.Background(), dialect, db)
+	if err != nil {
+		return nil, err
+	}
+
+	migrations, err := CollectMigrations(migrationsDir, 0, (1<<63)-1)
+	if err != nil {
+		return nil, err
+	}
+
+	statuses := make([]MigrationStatus, 0, len(migrations))
+	onDisk := make(map[int64]bool, len(migrations))
+	for _, m := range migrations {
+		onDisk[m.Version] = true
+		s := MigrationStatus{Version: m.Version, Source: m.Source}
+		if r, ok := records[m.Version]; ok && r.IsApplied {
+			s.Applied, s.AppliedAt = true, r.TStamp
+		}
+		statuses = append(statuses, s)
+	}
+
+	// version 0 marks the creation of the version table, not a migration
+	for v, r := range records {
+		if v > 0 && r.IsApplied && !onDisk[v] {
+			statuses = append(statuses, MigrationStatus{Version: v, Applied: true, AppliedAt: r.TStamp})
+		}
+	}
+
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].Version < statuses[j].Version })
+	return statuses, nil
+}
+
+// versionRecords reads the most recent record for each version
+// from the dialect's statusQuery.
+func versionRecords(ctx context.Context, dialect SqlDialect, db dbConn) (map[int64]MigrationRecord, error) {
+
+	rows, err := queryVersionTable(ctx, dialect, db, dialect.statusQuery)
+	if err != nil {
+		if errors.Is(err, ErrTableDoesNotExist) && ctx.Err() == nil {
+			return map[int64]MigrationRecord{}, nil
+		}
+		return nil, err
+	}
+	defer rows.Close()
+
+	records := make(map[int64]MigrationRecord)
+	for rows.Next() {
+		var row MigrationRecord
+		if err := rows.Scan(&row.VersionId, &row.IsApplied, &row.TStamp); err != nil {
+			return nil, errors.New(fmt.Sprintf("error scanning rows: %v", err))
+		}
+		if _, seen := records[row.VersionId]; !seen {
+			records[row.VersionId] = row
+		}
+	}
+	return records, rows.Err()
+}
+
+// DiffVersions compares two sets of applied versions, such as those
+// ListAppliedVersions reads from two environments, returning the
+// versions only in a, and those only in b, each in ascending order.
+func DiffVersions(a, b []int64) (onlyA, onlyB []int64) {
+	inA := make(map[int64]bool, len(a))
+	for _, v := range a {
+		inA[v] = true
+	}
+	inB := make(map[int64]bool, len(b))
+	for _, v := range b {
+		inB[v] = true
+	}
+
+	only := func(vs []int64, in, other map[int64]bool) []int64 {
+		var diff []int64
+		for _, v := range vs {
+			if in[v] && !other[v] {
+				diff = append(diff, v)
+				in[v] = false // each once, however often it's listed
+			}
+		}
+		sort.Slice(diff, func(i, j int) bool { return diff[i] < diff[j] })
+		return diff
+	}
+	return only(a, inA, inB), only(b, inB, inA)
+}
+
+// DiffDBVersions compares the versions applied to two databases with
+// the same dialect, e.g. staging's and production's, returning those
+// only applied to a, which b is behind by, and those only applied to
+// b, which it's ahead by, as DiffVersions does. A database whose
+// version table is missing has nothing applied.
+func DiffDBVersions(a, b *sql.DB, dialect SqlDialect) (onlyA, onlyB []int64, err error) {
+	applied := func(db *sql.DB) ([]int64, error) {
+		vs, err := ListAppliedVersions(db, dialect)
+		if errors.Is(err, ErrTableDoesNotExist) {
+			return nil, nil
+		}
+		return vs, err
+	}
+
+	va, err := applied(a)
+	if err != nil {
+		return nil, nil, err
+	}
+	vb, err := applied(b)
+	if err != nil {
+		return nil, nil, err
+	}
+	onlyA, onlyB = DiffVersions(va, vb)
+	return onlyA, onlyB, nil
+}
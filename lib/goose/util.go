@@ -23,18 +23,12 @@ func writeTemplateToFile(path string, t *template.Template, data interface{}) (s
 	return f.Name(), nil
 }
 
-func copyFile(dst, src string) (int64, error) {
-	sf, err := os.Open(src)
-	if err != nil {
-		return 0, err
-	}
-	defer sf.Close()
-
+func copyFile(dst string, src io.Reader) (int64, error) {
 	df, err := os.Create(dst)
 	if err != nil {
 		return 0, err
 	}
 	defer df.Close()
 
-	return io.Copy(df, sf)
+	return io.Copy(df, src)
 }
@@ -0,0 +1,112 @@
+package goose
+
+import (
+	"errors"
+	"io/fs"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// ValidationError lists every problem Validate found with a
+// directory's migrations, each naming the file it concerns.
+type ValidationError struct {
+	Problems []error
+}
+
+func (e *ValidationError) Error() string {
+	msgs := make([]string, len(e.Problems))
+	for i, p := range e.Problems {
+		msgs[i] = p.Error()
+	}
+	return strings.Join(msgs, "\n")
+}
+
+// Unwrap returns the problems, so errors.As can find e.g. a
+// *ParseError among them.
+func (e *ValidationError) Unwrap() []error {
+	return e.Problems
+}
+
+// Validate checks that every migration in dir is well-formed, without
+// connecting to a database: that no two migrations share a version,
+// and that each SQL script parses, has an Up section with statements
+// in it, and, if it has a Down section, can be rolled back.
+// It returns a *ValidationError listing all of the problems found,
+// or nil if there are none.
+func Validate(dir string) error {
+	return validate(nil, dir)
+}
+
+// ValidateFS is like Validate, but checks the migrations in dir
+// within fsys.
+func ValidateFS(fsys fs.FS, dir string) error {
+	return validate(fsys, dir)
+}
+
+func validate(fsys fs.FS, dir string) error {
+
+	var problems []error
+	var migrations []*Migration
+	sources := make(map[int64]string)
+	err := walkMigrations(nil, fsys, []string{dir}, func(m *Migration) error {
+		if other, dup := sources[m.Version]; dup {
+			problems = append(problems, duplicateVersionError(m.Version, other, m.Source))
+			return nil
+		}
+		sources[m.Version] = m.Source
+		migrations = append(migrations, m)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, r := range registeredMigrationsFor(func(int64) bool { return true }) {
+		if other, dup := sources[r.Version]; dup && filepath.Ext(other) != ".go" {
+			problems = append(problems, duplicateVersionError(r.Version, other, r.Source))
+		}
+	}
+
+	sort.Sort(migrationSorter(migrations))
+	for _, m := range migrations {
+		if filepath.Ext(m.Source) != ".sql" {
+			continue
+		}
+		if err := validateSQL(m); err != nil {
+			problems = append(problems, err)
+		}
+	}
+
+	if len(problems) > 0 {
+		return &ValidationError{Problems: problems}
+	}
+	return nil
+}
+
+// validateSQL parses a SQL migration in each direction it can be run
+// in; a script may have only a Down section.
+func validateSQL(m *Migration) error {
+
+	stmts, _, err := m.parseSQL(true)
+	switch {
+	case errors.Is(err, ErrNoUpMigration):
+		_, _, err = m.parseSQL(false)
+		return err
+	case err != nil:
+		return err
+	case len(stmts) == 0:
+		return &ParseError{Path: m.Source, Line: 1, Reason: "the '-- +goose Up' section has no statements"}
+	}
+
+	down, err := m.hasDown()
+	if err != nil {
+		return err
+	}
+	if down {
+		if _, _, err := m.parseSQL(false); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,127 @@
+package goose
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"path/filepath"
+)
+
+// VersionStore keeps track of which migrations have been applied. By
+// default, goose keeps it in the version table, in the database being
+// migrated; set Options.VersionStore to keep it elsewhere instead, such
+// as a metadata service, while the migrations still run against the
+// database.
+type VersionStore interface {
+	// GetAppliedVersions returns the version of every migration
+	// applied, in ascending order.
+	GetAppliedVersions(ctx context.Context) ([]int64, error)
+	// Insert records version as applied, or, if applied is false,
+	// as rolled back.
+	Insert(ctx context.Context, version int64, applied bool) error
+	// Delete removes version's records, once it's been rolled back.
+	Delete(ctx context.Context, version int64) error
+}
+
+// NewVersionStore returns the VersionStore goose uses by default,
+// backed by conf's version table in db, which GetAppliedVersions
+// creates if it's missing. It leaves out the checksums and dirty marks
+// goose records alongside versions, so is for wrapping, e.g. to copy
+// versions elsewhere too, as a custom store sees nothing else.
+func NewVersionStore(conf *DBConf, db *sql.DB) VersionStore {
+	return &tableVersionStore{conf, db}
+}
+
+type tableVersionStore struct {
+	conf *DBConf
+	db   *sql.DB
+}
+
+func (s *tableVersionStore) GetAppliedVersions(ctx context.Context) ([]int64, error) {
+	_, versions, err := ensureDBVersion(ctx, s.conf, s.db)
+	if err != nil {
+		return nil, err
+	}
+
+	// version 0 marks the creation of the version table, not a migration
+	var applied []int64
+	for _, v := range versions.applied() {
+		if v > 0 {
+			applied = append(applied, v)
+		}
+	}
+	return applied, nil
+}
+
+func (s *tableVersionStore) Insert(ctx context.Context, version int64, applied bool) error {
+	insert, err := insertVersionSqlFor(s.conf)
+	if err != nil {
+		return err
+	}
+	_, err = s.db.ExecContext(ctx, insert, versionArgs(s.conf, version, applied, "", false)...)
+	return err
+}
+
+func (s *tableVersionStore) Delete(ctx context.Context, version int64) error {
+	_, err := s.db.ExecContext(ctx, s.conf.Driver.Dialect.deleteVersionSql(), version)
+	return err
+}
+
+// storeVersions reads the current version, and the state of every
+// version, from store, as ensureDBVersion does from the version table.
+func storeVersions(ctx context.Context, store VersionStore) (int64, versionSet, error) {
+	applied, err := store.GetAppliedVersions(ctx)
+	if err != nil {
+		return 0, nil, errors.New(fmt.Sprintf("failed to read the applied versions from the version store: %v", err))
+	}
+
+	versions := versionSet{0: true}
+	for _, v := range applied {
+		versions[v] = true
+	}
+	return versions.latest(), versions, nil
+}
+
+// loadVersions reads the current version, and the state of every
+// version, as a run sees them: from Options.VersionStore if it's set,
+// and otherwise from the version table, on Options.ReadDB if it's set
+// and has one, and on db if not, where it's created if it's missing,
+// unless this is a dry run.
+func loadVersions(ctx context.Context, conf *DBConf, db dbConn) (int64, versionSet, error) {
+	if conf.Options.VersionStore == nil && readsReplica(conf) {
+		current, versions, err := replicaVersions(ctx, conf)
+		if !errors.Is(err, ErrTableDoesNotExist) || ctx.Err() != nil {
+			return current, versions, err
+		}
+	}
+
+	switch {
+	case conf.Options.VersionStore != nil:
+		return storeVersions(ctx, conf.Options.VersionStore)
+	case conf.Options.DryRun:
+		return dryRunDBVersion(ctx, conf, db)
+	default:
+		return ensureDBVersion(ctx, conf, db)
+	}
+}
+
+// recordInStore records migration v in Options.VersionStore, once it
+// has run.
+func recordInStore(ctx context.Context, store VersionStore, direction bool, v int64) error {
+	if direction {
+		return store.Insert(ctx, v, true)
+	}
+	return store.Delete(ctx, v)
+}
+
+// checkStoreSupports returns an error for a migration the runner can't
+// record in Options.VersionStore: a Go migration script, which records
+// itself in the version table.
+func checkStoreSupports(conf *DBConf, m *Migration) error {
+	if conf.Options.VersionStore == nil || m.isRegistered() || filepath.Ext(m.Source) != ".go" {
+		return nil
+	}
+	return errors.New(fmt.Sprintf("migration %s is a Go script, which records itself in the version table, so can't be run with a VersionStore; register it with RegisterMigration instead",
+		filepath.Base(m.Source)))
+}